@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	picocache "picocache/src"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const adminTimeout = 5 * time.Minute // verifying reads entries back
+
+// adminCommand declares the flags of an admin subcommand, returning what
+// runs it once parsed.
+type adminCommand func(flags *flag.FlagSet) func(a *adminClient, args []string, stdout io.Writer) error
+
+// adminCommands are the subcommands talking to a running instance.
+var adminCommands = map[string]adminCommand{
+	"stats":   adminStats,
+	"purge":   adminPurge,
+	"verify":  adminVerify,
+	"inspect": adminInspect,
+}
+
+var (
+	// errReported is returned by admin commands whose answer is negative,
+	// e.g. nothing to purge, once they said so.
+	errReported = errors.New("reported")
+	errUsage    = errors.New("usage")
+)
+
+// runAdmin runs the admin subcommand name, returning the exit code:
+//
+//	picocache stats
+//	picocache purge [-prefix] /path
+//	picocache verify [-sample 1000] [-purge]
+//	picocache inspect /path
+//
+// The instance is reached at -admin-addr, the first address of
+// PICOCACHE_LISTENTO by default, with PICOCACHE_ADMIN_TOKEN.
+func runAdmin(name string, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	defaultAddr, _, _ := strings.Cut(os.Getenv(envListenTo), ",")
+	addr := flags.String("admin-addr", strings.TrimSpace(defaultAddr), "address of the instance: host:port, unix:/path or a URL")
+	token := flags.String("token", os.Getenv(envAdminToken), "admin token")
+	run := adminCommands[name](flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	a, err := newAdminClient(*addr, *token)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := run(a, flags.Args(), stdout); err != nil {
+		if !errors.Is(err, errReported) {
+			fmt.Fprintln(stderr, err)
+		}
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// adminClient talks to the admin endpoints of a running instance.
+type adminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newAdminClient(addr, token string) (*adminClient, error) {
+	a := &adminClient{token: token, client: &http.Client{Timeout: adminTimeout}}
+	switch {
+	case addr == "":
+		return nil, errors.New("no address to reach the instance at, set -admin-addr")
+	case strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://"):
+		a.base = strings.TrimSuffix(addr, "/")
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		a.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+		a.base = "http://picocache"
+	default:
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		a.base = "http://" + addr
+	}
+	return a, nil
+}
+
+// do sends a request to path and decodes the JSON answer into v, returning
+// the status code. Answers other than 2xx are errors.
+func (a *adminClient) do(method, path string, query url.Values, v any) (int, error) {
+	u := a.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		msg := strings.TrimSpace(string(b))
+		if msg == "" {
+			msg = http.StatusText(resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			msg += ", check the admin token"
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, msg)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func adminStats(flags *flag.FlagSet) func(a *adminClient, args []string, stdout io.Writer) error {
+	return func(a *adminClient, args []string, stdout io.Writer) error {
+		var s picocache.Stats
+		if _, err := a.do(http.MethodGet, "/__picocache/stats", nil, &s); err != nil {
+			return err
+		}
+
+		hitRate := 0.0
+		if s.Hits+s.Misses > 0 {
+			hitRate = 100 * float64(s.Hits) / float64(s.Hits+s.Misses)
+		}
+		fmt.Fprintf(stdout, "version    %s %s\n", s.Version, s.Commit)
+		fmt.Fprintf(stdout, "entries    %d\n", s.Entries)
+		fmt.Fprintf(stdout, "size       %s of %s\n", units.HumanSize(float64(s.TotalSize)), units.HumanSize(float64(s.MaxSize)))
+		fmt.Fprintf(stdout, "hits       %d (%.1f%%)\n", s.Hits, hitRate)
+		fmt.Fprintf(stdout, "misses     %d\n", s.Misses)
+		fmt.Fprintf(stdout, "read-only  %t\n", s.ReadOnly)
+		return nil
+	}
+}
+
+func adminPurge(flags *flag.FlagSet) func(a *adminClient, args []string, stdout io.Writer) error {
+	prefix := flags.Bool("prefix", false, "purge every entry under the path, needs PICOCACHE_PREFIX_PURGE")
+	return func(a *adminClient, args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%w: picocache purge [-prefix] /path", errUsage)
+		}
+		path := args[0]
+
+		if *prefix {
+			var result struct{ Purged int }
+			if _, err := a.do("PURGE", path, url.Values{"prefix": {"1"}}, &result); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "purged %d entries under %s\n", result.Purged, path)
+			return nil
+		}
+
+		var result struct {
+			Key     string
+			Purged  bool
+			Filling bool
+		}
+		if _, err := a.do(http.MethodPost, "/__picocache/purge", url.Values{"path": {path}}, &result); err != nil {
+			return err
+		}
+		if !result.Purged {
+			fmt.Fprintf(stdout, "%s wasn't cached\n", path)
+			return errReported
+		}
+		if result.Filling {
+			fmt.Fprintf(stdout, "purged %s (%s) while it was being filled\n", path, result.Key)
+			return nil
+		}
+		fmt.Fprintf(stdout, "purged %s (%s)\n", path, result.Key)
+		return nil
+	}
+}
+
+func adminVerify(flags *flag.FlagSet) func(a *adminClient, args []string, stdout io.Writer) error {
+	sample := flags.Int("sample", 1000, "how many random entries to verify")
+	purge := flags.Bool("purge", false, "purge corrupt entries")
+	return func(a *adminClient, args []string, stdout io.Writer) error {
+		query := url.Values{"sample": {fmt.Sprint(*sample)}}
+		if *purge {
+			query.Set("purge", "1")
+		}
+
+		var report picocache.VerifyReport
+		if _, err := a.do(http.MethodPost, "/__picocache/verify", query, &report); err != nil {
+			return err
+		}
+		for _, corrupt := range report.Corrupt {
+			name := corrupt.Key
+			if corrupt.Path != "" {
+				name = corrupt.Path + " (" + corrupt.Key + ")"
+			}
+			purged := ""
+			if corrupt.Purged {
+				purged = ", purged"
+			}
+			fmt.Fprintf(stdout, "%s: %s%s\n", name, corrupt.Problem, purged)
+		}
+		fmt.Fprintf(stdout, "checked %d entries, %d against their hash, %d corrupt\n",
+			report.Checked, report.Checksummed, len(report.Corrupt))
+		if len(report.Corrupt) > 0 {
+			return errReported
+		}
+		return nil
+	}
+}
+
+func adminInspect(flags *flag.FlagSet) func(a *adminClient, args []string, stdout io.Writer) error {
+	return func(a *adminClient, args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%w: picocache inspect /path", errUsage)
+		}
+		path := args[0]
+
+		var e picocache.EntryDetails
+		status, err := a.do(http.MethodGet, "/__picocache/inspect", url.Values{"path": {path}}, &e)
+		if status == http.StatusNotFound {
+			fmt.Fprintf(stdout, "%s isn't cached\n", path)
+			return errReported
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "key        %s\n", e.Key)
+		if e.Location != "" {
+			fmt.Fprintf(stdout, "status     %d to %s\n", e.Status, e.Location)
+		} else {
+			fmt.Fprintf(stdout, "status     %d\n", e.Status)
+		}
+		fmt.Fprintf(stdout, "size       %s (%d bytes, %s on disk)\n", units.HumanSize(float64(e.Size)), e.Size, units.HumanSize(float64(e.DiskSize)))
+		if e.Encoding != "" {
+			fmt.Fprintf(stdout, "encoding   %s, %d bytes decoded\n", e.Encoding, e.DecodedSize)
+		}
+		fmt.Fprintf(stdout, "filled     %s\n", e.Filled.Format(time.RFC3339))
+		fmt.Fprintf(stdout, "last used  %s\n", e.LastUsed.Format(time.RFC3339))
+		if e.Expires != nil {
+			fmt.Fprintf(stdout, "expires    %s\n", e.Expires.Format(time.RFC3339))
+		}
+		fmt.Fprintf(stdout, "hits       %d\n", e.Hits)
+		fmt.Fprintf(stdout, "readers    %d\n", e.Readers)
+		if e.Hash != "" {
+			fmt.Fprintf(stdout, "sha256     %s\n", e.Hash)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+)
+
+func TestAdminCommands(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer source.Close()
+
+	dir := t.TempDir()
+	cache, err := picocache.NewCache(slog.Default(), source.URL, dir, 1<<20,
+		picocache.WithAdminToken("s3cret"), picocache.WithPrefixPurge(), picocache.WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+	for _, path := range []string{"/a", "/b", "/gallery/c", "/gallery/d"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	run := func(name string, args ...string) (int, string) {
+		t.Helper()
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		args = append([]string{"-admin-addr", server.URL, "-token", "s3cret"}, args...)
+		code := runAdmin(name, args, stdout, stderr)
+		return code, stdout.String() + stderr.String()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		code     int
+		expected string
+	}{
+		{"stats", nil, 0, "entries    4\n"},
+		{"inspect", []string{"/a"}, 0, "key        " + picocache.KeyForPath("/a")},
+		{"inspect", []string{"/missing"}, 1, "/missing isn't cached"},
+		{"inspect", nil, 2, "usage: picocache inspect /path"},
+		{"inspect", []string{"-token", "nope", "/a"}, 1, "check the admin token"},
+		{"purge", []string{"/a"}, 0, "purged /a (" + picocache.KeyForPath("/a") + ")"},
+		{"purge", []string{"/a"}, 1, "/a wasn't cached"},
+		{"purge", []string{"-prefix", "/gallery/"}, 0, "purged 2 entries under /gallery/"},
+		{"verify", []string{"-sample", "10"}, 0, "checked 1 entries, 1 against their hash, 0 corrupt"},
+		{"stats", []string{"-token", "nope"}, 0, "entries    1\n"},
+		{"purge", []string{"-token", "nope", "/b"}, 1, "check the admin token"},
+	} {
+		code, out := run(tc.name, tc.args...)
+		if code != tc.code || !strings.Contains(out, tc.expected) {
+			t.Errorf("%s %v: expected %d with %q, got %d with %q", tc.name, tc.args, tc.code, tc.expected, code, out)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, picocache.KeyForPath("/b")), []byte("Nay"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, out := run("verify", "-purge")
+	if code != 1 || !strings.Contains(out, "/b ("+picocache.KeyForPath("/b")+"): body doesn't match its hash, purged") {
+		t.Errorf("expected /b reported corrupt, got %d with %q", code, out)
+	}
+}
+
+func TestNewAdminClient(t *testing.T) {
+	for _, tc := range []struct{ addr, base string }{
+		{":8080", "http://localhost:8080"},
+		{"10.0.0.1:8080", "http://10.0.0.1:8080"},
+		{"https://cache.example.com/", "https://cache.example.com"},
+		{"unix:/run/picocache.sock", "http://picocache"},
+	} {
+		a, err := newAdminClient(tc.addr, "")
+		if err != nil || a.base != tc.base {
+			t.Errorf("%s: expected %s, got %+v (%v)", tc.addr, tc.base, a, err)
+		}
+	}
+	if _, err := newAdminClient("", ""); err == nil {
+		t.Error("expected an error without an address")
+	}
+}
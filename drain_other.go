@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals is empty, SIGUSR1 being left out on this platform: drains
+// go through the admin API only.
+var drainSignals = []os.Signal{}
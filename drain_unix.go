@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start draining the cache, see drainOnSignal.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
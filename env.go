@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	picocache "picocache/src"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config reads the configuration from env variables, keeping the first
+// error met so that the whole of it can be read before checking.
+type config struct {
+	getenv func(string) string
+	err    error
+}
+
+// configError is a misconfiguration, as opposed to a failure while running.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+func (c *config) get(key string) string {
+	return c.getenv(key)
+}
+
+// fail records err, unless an earlier error was.
+func (c *config) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// required returns the env variable key, failing if it isn't set.
+func (c *config) required(key string) string {
+	value := c.get(key)
+	if value == "" {
+		c.fail(fmt.Errorf("%s is required", key))
+	}
+	return value
+}
+
+// optionalEnv appends to opts the option built from the env variable key,
+// when it is set. It records an error in cfg if the value can't be parsed.
+func optionalEnv[T any](cfg *config, opts *[]picocache.Option, key string, parse func(string) (T, error), option func(T) picocache.Option) {
+	value := cfg.get(key)
+	if value == "" {
+		return
+	}
+
+	v, err := parse(value)
+	if err != nil {
+		cfg.fail(fmt.Errorf("can't parse %s: %w", key, err))
+		return
+	}
+	*opts = append(*opts, option(v))
+}
+
+// envOr parses the env variable key with parse, or returns def when it isn't
+// set. It records an error in cfg and returns def if the value can't be
+// parsed.
+func envOr[T any](cfg *config, key string, parse func(string) (T, error), def T) T {
+	value := cfg.get(key)
+	if value == "" {
+		return def
+	}
+
+	v, err := parse(value)
+	if err != nil {
+		cfg.fail(fmt.Errorf("can't parse %s: %w", key, err))
+		return def
+	}
+	return v
+}
+
+// parseInterval parses a duration that has to be positive, such as the
+// period of a ticker.
+func parseInterval(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		return 0, fmt.Errorf("expected a positive duration, got %s", s)
+	}
+	return d, err
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseString(s string) (string, error) {
+	return s, nil
+}
+
+// parseList splits a comma-separated list, dropping empty items.
+func parseList(s string) ([]string, error) {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
@@ -1,5 +1,5 @@
 module picocache
 
-go 1.23.2
+go 1.24
 
 require github.com/docker/go-units v0.5.0
@@ -0,0 +1,215 @@
+// Package proxyproto implements the receiving side of the HAProxy PROXY
+// protocol, versions 1 and 2, as a net.Listener wrapper.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const headerTimeout = 5 * time.Second
+
+// v1 headers are at most 107 bytes long, CRLF included.
+const v1MaxLength = 107
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener wraps a net.Listener whose connections all start with a PROXY
+// protocol header. Headers are parsed on the connection's first use, so a
+// slow client can't hold up Accept.
+type Listener struct {
+	net.Listener
+	from []netip.Prefix
+}
+
+// NewListener only accepts connections from the proxies in the given
+// networks, which would otherwise be able to claim any address. Peers
+// connecting over unix sockets, which have no address, are up to the
+// permissions of the socket.
+func NewListener(l net.Listener, from ...netip.Prefix) *Listener {
+	return &Listener{l, from}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(c.RemoteAddr()) {
+			return NewConn(c), nil
+		}
+		c.Close()
+	}
+}
+
+// allowed reports whether a PROXY header may be taken from peer.
+func (l *Listener) allowed(peer net.Addr) bool {
+	tcp, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.from {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose RemoteAddr is the client address advertised by
+// its PROXY protocol header. Connections with a malformed header get closed.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.remote, c.err = readHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address from the PROXY header, or the peer address
+// for LOCAL or UNKNOWN headers.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader consumes a v1 or v2 header from r, returning the source address
+// it carries, if any.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readV1(r)
+	}
+	return nil, ErrInvalidHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+	}
+
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 header not CRLF terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidHeader, header)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: invalid v1 source address %q", ErrInvalidHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid v1 source port %q", ErrInvalidHeader, fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, header[12]>>4)
+	}
+	command := header[12] & 0xF
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL: health checks from the proxy itself, keep the peer address
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// UNSPEC or unix sockets carry no usable address
+		return nil, nil
+	}
+}
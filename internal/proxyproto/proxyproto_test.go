@@ -0,0 +1,180 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// roundTrip sends header then a GET over a pipe to an HTTP server behind a
+// PROXY protocol Conn, returning the RemoteAddr the handler saw.
+func roundTrip(t *testing.T, header []byte) (string, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	remote := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote <- r.RemoteAddr
+	})}
+	l := &pipeListener{conns: make(chan net.Conn, 1)}
+	l.conns <- server
+	go srv.Serve(NewListener(l))
+	defer srv.Close()
+
+	go func() {
+		client.Write(header)
+		io.WriteString(client, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return <-remote, nil
+}
+
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *pipeListener) Close() error {
+	defer func() { recover() }()
+	close(l.conns)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func v2Header(command byte, family byte, addrs []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|command, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestV1(t *testing.T) {
+	for header, expected := range map[string]string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n":  "192.0.2.1:56324",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n": "[2001:db8::1]:56324",
+	} {
+		remote, err := roundTrip(t, []byte(header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote != expected {
+			t.Fatalf("%q: expected %s, got %s", header, expected, remote)
+		}
+	}
+}
+
+func TestV1Unknown(t *testing.T) {
+	remote, err := roundTrip(t, []byte("PROXY UNKNOWN\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "pipe" {
+		t.Fatalf("expected the peer address, got %s", remote)
+	}
+}
+
+func TestV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB}
+	remote, err := roundTrip(t, v2Header(0x1, 0x11, ipv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "192.0.2.1:56324" {
+		t.Fatalf("expected 192.0.2.1:56324, got %s", remote)
+	}
+
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x01, 0xBB)
+	remote, err = roundTrip(t, v2Header(0x1, 0x21, ipv6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "[2001:db8::1]:56324" {
+		t.Fatalf("expected [2001:db8::1]:56324, got %s", remote)
+	}
+
+	// LOCAL connections keep the peer address
+	remote, err = roundTrip(t, v2Header(0x0, 0x00, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "pipe" {
+		t.Fatalf("expected the peer address, got %s", remote)
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY " + strings.Repeat("X", 200) + "\r\n",
+		string(v2Header(0x1, 0x11, []byte{192, 0, 2})),
+		string(v2Header(0x7, 0x11, make([]byte, 12))),
+	} {
+		if _, err := roundTrip(t, []byte(header)); err == nil {
+			t.Fatalf("%q: connection wasn't rejected", header)
+		}
+	}
+}
+
+func TestHeadersFromAllowedPeersOnly(t *testing.T) {
+	for _, tc := range []struct {
+		from     string
+		accepted bool
+	}{
+		{"127.0.0.0/8", true},
+		{"192.0.2.0/24", false},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := make(chan string, 1)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remote <- r.RemoteAddr
+		})}
+		go srv.Serve(NewListener(l, netip.MustParsePrefix(tc.from)))
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(client, "PROXY TCP4 10.0.0.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if tc.accepted {
+			if err != nil {
+				t.Fatalf("%s: %v", tc.from, err)
+			}
+			resp.Body.Close()
+			if addr := <-remote; addr != "10.0.0.1:56324" {
+				t.Fatalf("%s: expected the address of the header, got %s", tc.from, addr)
+			}
+		} else if err == nil {
+			t.Fatalf("%s: expected the forged header of a peer not allowed rejected, got %s", tc.from, resp.Status)
+		}
+		client.Close()
+		srv.Close()
+	}
+}
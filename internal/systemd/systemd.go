@@ -0,0 +1,87 @@
+// Package systemd implements the small subset of the systemd protocols picocache
+// needs: socket activation (sd_listen_fds) and readiness notification (sd_notify).
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// Listeners returns the listeners inherited from systemd through socket
+// activation, or nil when the process wasn't socket activated. The
+// LISTEN_* variables are unset so they don't leak into child processes.
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	return listeners(os.Getenv, os.Getpid(), listenFdsStart)
+}
+
+func listeners(getenv func(string) string, pid int, start int) ([]net.Listener, error) {
+	listenPid := getenv("LISTEN_PID")
+	if listenPid == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); err != nil || p != pid {
+		// Meant for another process
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		// FileListener dups the descriptor, the original isn't needed anymore
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d isn't a listening socket: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// Notify sends state (e.g. "READY=1") to the service manager. It returns
+// false without error when NOTIFY_SOCKET isn't set.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading "@" denotes an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := notify(conn, state); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func notify(conn net.Conn, state string) error {
+	_, err := conn.Write([]byte(state))
+	return err
+}
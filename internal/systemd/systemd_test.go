@@ -0,0 +1,153 @@
+//go:build unix
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func socketpair(t *testing.T, typ int) (*os.File, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := os.NewFile(uintptr(fds[0]), "a"), os.NewFile(uintptr(fds[1]), "b")
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+// dup returns a copy of f's descriptor for listeners to take ownership of.
+func dup(t *testing.T, f *os.File) int {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	ls, err := listeners(env(nil), os.Getpid(), listenFdsStart)
+	if err != nil || ls != nil {
+		t.Fatalf("expected no listeners, got %v, %v", ls, err)
+	}
+
+	ls, err = listeners(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid() + 1),
+		"LISTEN_FDS": "1",
+	}), os.Getpid(), listenFdsStart)
+	if err != nil || ls != nil {
+		t.Fatalf("expected no listeners for another pid, got %v, %v", ls, err)
+	}
+}
+
+func TestListenersFromFds(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ls, err := listeners(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "1",
+	}), os.Getpid(), dup(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("expected 1 listener, got %d", len(ls))
+	}
+	defer ls[0].Close()
+
+	if ls[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("inherited listener on %s, expected %s", ls[0].Addr(), l.Addr())
+	}
+}
+
+func TestListenersFromSocketpair(t *testing.T) {
+	a, _ := socketpair(t, syscall.SOCK_STREAM)
+
+	ls, err := listeners(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "1",
+	}), os.Getpid(), dup(t, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls[0].Close()
+
+	if ls[0].Addr().Network() != "unix" {
+		t.Fatalf("expected a unix listener, got %s", ls[0].Addr().Network())
+	}
+}
+
+func TestListenersRejectsNonSocketFd(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "notasocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = listeners(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "1",
+	}), os.Getpid(), dup(t, f))
+	if err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+}
+
+func TestListenersInvalidCount(t *testing.T) {
+	_, err := listeners(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "zero",
+	}), os.Getpid(), listenFdsStart)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	a, b := socketpair(t, syscall.SOCK_DGRAM)
+
+	conn, err := net.FileConn(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := notify(conn, "READY=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Fatalf("unexpected state %q", buf[:n])
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify("READY=1")
+	if sent || err != nil {
+		t.Fatalf("expected a no-op, got %v, %v", sent, err)
+	}
+}
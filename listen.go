@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const shutdownTimeout = 30 * time.Second
+
+// serverTimeouts bound how long clients may hold connections without
+// making progress, on top of the cache's own write stall timeout.
+type serverTimeouts struct {
+	readHeader time.Duration // to send the request headers
+	idle       time.Duration // between keep-alive requests
+}
+
+// listenAll opens one listener per comma-separated address of addrs.
+// Addresses prefixed with "unix:" are bound as unix sockets.
+func listenAll(addrs string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network = "unix"
+			addr = path
+		}
+
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("can't listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen to")
+	}
+
+	return listeners, nil
+}
+
+// openListeners returns the listeners inherited through socket activation,
+// see systemd.Listeners, or those of listenTo, which is required without
+// them.
+func openListeners(activated func() ([]net.Listener, error), listenTo string, log *slog.Logger) ([]net.Listener, error) {
+	listeners, err := activated()
+	if err != nil {
+		return nil, fmt.Errorf("can't use systemd sockets: %w", err)
+	}
+	if listeners != nil {
+		log.Info("Using systemd socket activation", slog.Int("listeners", len(listeners)))
+		return listeners, nil
+	}
+	if listenTo == "" {
+		return nil, &configError{fmt.Errorf("%s is required", envListenTo)}
+	}
+	listeners, err = listenAll(listenTo)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Listening", slog.String("addrs", listenTo))
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// serveAll serves handler on every listener, each with its own http.Server,
+// until ctx is done or one of them fails. All servers are then shut down
+// gracefully together.
+func serveAll(ctx context.Context, listeners []net.Listener, handler http.Handler, timeouts serverTimeouts) error {
+	servers := make([]*http.Server, len(listeners))
+	errs := make(chan error, len(listeners))
+
+	for i, l := range listeners {
+		srv := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: timeouts.readHeader,
+			IdleTimeout:       timeouts.idle,
+		}
+		servers[i] = srv
+		go func() {
+			if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("serving on %s: %w", l.Addr(), err)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	shutdownErrs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrs[i] = srv.Shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(append(shutdownErrs, err)...)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeAllMultipleListeners(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer source.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), source.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := listenAll("127.0.0.1:0, 127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serveAll(ctx, listeners, cache, serverTimeouts{}) }()
+
+	for _, l := range listeners {
+		resp, err := http.Get("http://" + l.Addr().String() + "/hi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "Yay" {
+			t.Fatalf("unexpected body from %s: %q", l.Addr(), b)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers did not shut down")
+	}
+
+	for _, l := range listeners {
+		if _, err := http.Get("http://" + l.Addr().String() + "/hi"); err == nil {
+			t.Fatalf("%s still serving after shutdown", l.Addr())
+		}
+	}
+}
+
+func TestListenAllFailsOnBadAddress(t *testing.T) {
+	_, err := listenAll("127.0.0.1:0,256.0.0.1:80")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "256.0.0.1:80") {
+		t.Fatalf("error doesn't name the offending address: %v", err)
+	}
+}
+
+func TestListenAllEmpty(t *testing.T) {
+	if _, err := listenAll(" , "); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	activated := func() ([]net.Listener, error) { return []net.Listener{inherited}, nil }
+	notActivated := func() ([]net.Listener, error) { return nil, nil }
+
+	// Socket activated, no address is needed
+	listeners, err := openListeners(activated, "", slog.Default())
+	if err != nil || len(listeners) != 1 || listeners[0] != inherited {
+		t.Fatalf("expected the inherited listener, got %v %v", listeners, err)
+	}
+
+	listeners, err = openListeners(notActivated, "127.0.0.1:0", slog.Default())
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("expected a listener of the address, got %v %v", listeners, err)
+	}
+	closeAll(listeners)
+
+	var cfgErr *configError
+	if _, err := openListeners(notActivated, "", slog.Default()); !errors.As(err, &cfgErr) || !strings.Contains(err.Error(), envListenTo+" is required") {
+		t.Fatalf("expected a configuration error about %s, got %v", envListenTo, err)
+	}
+}
+
+func TestServeAllReapsSlowHeaders(t *testing.T) {
+	cache, err := picocache.NewCache(slog.Default(), "http://127.0.0.1:1", t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listenAll("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveAll(ctx, listeners, cache, serverTimeouts{readHeader: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /hi HTTP/1.1\r\nHost: x\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connection with unfinished headers kept for %s", elapsed)
+	}
+}
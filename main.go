@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
-	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"picocache/internal/proxyproto"
+	"picocache/internal/systemd"
 	picocache "picocache/src"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-units"
 )
@@ -13,39 +24,508 @@ const envSource = "PICOCACHE_SRC"
 const envCachedir = "PICOCACHE_DIR"
 const envMaxSize = "PICOCACHE_MAXSIZE"
 const envListenTo = "PICOCACHE_LISTENTO"
+const envOriginMaxIdleConns = "PICOCACHE_ORIGIN_MAX_IDLE_CONNS"
+const envOriginIdleTimeout = "PICOCACHE_ORIGIN_IDLE_TIMEOUT"
+const envOriginMaxConnsPerHost = "PICOCACHE_ORIGIN_MAX_CONNS_PER_HOST"
+const envAdmitAfter = "PICOCACHE_ADMIT_AFTER"
+const envAdmitWindow = "PICOCACHE_ADMIT_WINDOW"
+const envKeyFloodPerClient = "PICOCACHE_KEY_FLOOD_PER_CLIENT"
+const envKeyFloodGlobal = "PICOCACHE_KEY_FLOOD_GLOBAL"
+const envKeyFloodWindow = "PICOCACHE_KEY_FLOOD_WINDOW"
+const envKeyFloodMode = "PICOCACHE_KEY_FLOOD_MODE"
+const envAdmitEnforcement = "PICOCACHE_ADMIT_ENFORCEMENT"
+const envKeyFloodEnforcement = "PICOCACHE_KEY_FLOOD_ENFORCEMENT"
+const envValidateContentTypeEnforcement = "PICOCACHE_VALIDATE_CONTENT_TYPE_ENFORCEMENT"
+const envRejectBodyEnforcement = "PICOCACHE_REJECT_BODY_ENFORCEMENT"
+const envStrictOriginEnforcement = "PICOCACHE_STRICT_ORIGIN_ENFORCEMENT"
+const envBlockSize = "PICOCACHE_BLOCK_SIZE"
+const envCompress = "PICOCACHE_COMPRESS"
+const envOriginCompression = "PICOCACHE_ORIGIN_COMPRESSION"
+const envProtectedShare = "PICOCACHE_PROTECTED_SHARE"
+const envProxyProtocol = "PICOCACHE_PROXY_PROTOCOL"
+const envProxyProtocolFrom = "PICOCACHE_PROXY_PROTOCOL_FROM"
+const envOriginProbeInterval = "PICOCACHE_ORIGIN_PROBE_INTERVAL"
+const envOriginProbePath = "PICOCACHE_ORIGIN_PROBE_PATH"
+const envOriginProbeMethod = "PICOCACHE_ORIGIN_PROBE_METHOD"
+const envAccessLogSample = "PICOCACHE_ACCESS_LOG_SAMPLE"
+const envSlowRequestThreshold = "PICOCACHE_SLOW_REQUEST_THRESHOLD"
+const envNormalizePaths = "PICOCACHE_NORMALIZE_PATHS"
+const envNormalizeLowercase = "PICOCACHE_NORMALIZE_LOWERCASE"
+const envStripQueryParams = "PICOCACHE_STRIP_QUERY_PARAMS"
+const envKeepQueryParams = "PICOCACHE_KEEP_QUERY_PARAMS"
+const envRules = "PICOCACHE_RULES"
+const envLanguages = "PICOCACHE_LANGUAGES"
+const envPassthroughHeaders = "PICOCACHE_PASSTHROUGH_HEADERS"
+const envHosts = "PICOCACHE_HOSTS"
+const envAbandonedFill = "PICOCACHE_ABANDONED_FILL"
+const envResumableFills = "PICOCACHE_RESUMABLE_FILLS"
+const envResumeTTL = "PICOCACHE_RESUME_TTL"
+const envExpiryJitter = "PICOCACHE_EXPIRY_JITTER"
+const envMaxRevalidations = "PICOCACHE_MAX_REVALIDATIONS"
+const envStaleGrace = "PICOCACHE_STALE_GRACE"
+const envOriginFirstByteTimeout = "PICOCACHE_ORIGIN_FIRST_BYTE_TIMEOUT"
+const envValidateContentType = "PICOCACHE_VALIDATE_CONTENT_TYPE"
+const envRejectBodyPrefixes = "PICOCACHE_REJECT_BODY_PREFIXES"
+const envRejectWith502 = "PICOCACHE_REJECT_WITH_502"
+const envOriginHTTP = "PICOCACHE_ORIGIN_HTTP"
+const envOriginUserAgent = "PICOCACHE_ORIGIN_USER_AGENT"
+const envServedBy = "PICOCACHE_SERVED_BY"
+const envOriginMaxHeaderBytes = "PICOCACHE_ORIGIN_MAX_HEADER_BYTES"
+const envMaxContentLength = "PICOCACHE_MAX_CONTENT_LENGTH"
+const envLargeObjectMode = "PICOCACHE_LARGE_OBJECT_MODE"
+const envRedirectLocation = "PICOCACHE_REDIRECT_LOCATION"
+const envSizeProbeTTL = "PICOCACHE_SIZE_PROBE_TTL"
+const envHeadMetadataTTL = "PICOCACHE_HEAD_METADATA_TTL"
+const envMaxAuxEntries = "PICOCACHE_MAX_AUX_ENTRIES"
+const envProxyPaths = "PICOCACHE_PROXY_PATHS"
+const envWarmFrom = "PICOCACHE_WARM_FROM"
+const envWarmEvery = "PICOCACHE_WARM_EVERY"
+const envWarmConcurrency = "PICOCACHE_WARM_CONCURRENCY"
+const envLegacyUpgradeRate = "PICOCACHE_LEGACY_UPGRADE_RATE"
+const envLegacyUpgradeValidate = "PICOCACHE_LEGACY_UPGRADE_VALIDATE"
+const envDedup = "PICOCACHE_DEDUP"
+const envIntegrityTrailer = "PICOCACHE_INTEGRITY_TRAILER"
+const envPrefixPurge = "PICOCACHE_PREFIX_PURGE"
+const envGhosts = "PICOCACHE_GHOSTS"
+const envFsync = "PICOCACHE_FSYNC"
+const envMaxSizeFile = "PICOCACHE_MAXSIZE_FILE"
+const envDrainGrace = "PICOCACHE_DRAIN_GRACE"
+const envShrinkRate = "PICOCACHE_SHRINK_RATE"
+const envMIMETypes = "PICOCACHE_MIME_TYPES"
+const envSourceContentType = "PICOCACHE_SOURCE_CONTENT_TYPE"
+const envMetadataRefreshRate = "PICOCACHE_METADATA_REFRESH_RATE"
+const envEvictionPolicy = "PICOCACHE_EVICTION_POLICY"
+const envKeyMigration = "PICOCACHE_KEY_MIGRATION"
+const envCacheableStatus = "PICOCACHE_CACHEABLE_STATUS"
+const envReadOnly = "PICOCACHE_READONLY"
+const envOffline = "PICOCACHE_OFFLINE"
+const envOfflineMissStatus = "PICOCACHE_OFFLINE_MISS_STATUS"
+const envReadOnlyMisses = "PICOCACHE_READONLY_MISSES"
+const envUncachedPreconditions = "PICOCACHE_UNCACHED_PRECONDITIONS"
+const envStreamFills = "PICOCACHE_STREAM_FILLS"
+const envIgnoreLock = "PICOCACHE_IGNORE_LOCK"
+const envPeers = "PICOCACHE_PEERS"
+const envPeerHopLimit = "PICOCACHE_PEER_HOP_LIMIT"
+const envPurgeDropDir = "PICOCACHE_PURGE_DROP_DIR"
+const envPurgeDropQuiescence = "PICOCACHE_PURGE_DROP_QUIESCENCE"
+const envManifestFile = "PICOCACHE_MANIFEST_FILE"
+const envLogSuppressWindow = "PICOCACHE_LOG_SUPPRESS_WINDOW"
+const envMaintenanceWindows = "PICOCACHE_MAINTENANCE_WINDOWS"
+const envMaintenanceTZ = "PICOCACHE_MAINTENANCE_TZ"
+const envScrubSample = "PICOCACHE_SCRUB_SAMPLE"
+const envScrubInterval = "PICOCACHE_SCRUB_INTERVAL"
+const envQuarantineFailures = "PICOCACHE_QUARANTINE_FAILURES"
+const envQuarantineFor = "PICOCACHE_QUARANTINE_FOR"
+const envOriginByteBudget = "PICOCACHE_ORIGIN_BYTE_BUDGET"
+const envFillBytesBudget = "PICOCACHE_FILL_BYTES_BUDGET"
+const envOriginRateLimit = "PICOCACHE_ORIGIN_RATE_LIMIT"
+const envOriginRateWait = "PICOCACHE_ORIGIN_RATE_WAIT"
+const envStrictOrigin = "PICOCACHE_STRICT_ORIGIN"
+const envStaleIfError = "PICOCACHE_STALE_IF_ERROR"
+const envRevalidateOnStart = "PICOCACHE_REVALIDATE_ON_START"
+const envAdaptiveTTL = "PICOCACHE_ADAPTIVE_TTL"
+const envTraceFile = "PICOCACHE_TRACE_FILE"
+const envTraceFileSize = "PICOCACHE_TRACE_FILE_SIZE"
+const envMaxReadersPerEntry = "PICOCACHE_MAX_READERS_PER_ENTRY"
+const envReaderQueue = "PICOCACHE_READER_QUEUE"
+const envMaxRequests = "PICOCACHE_MAX_REQUESTS"
+const envHitShare = "PICOCACHE_HIT_SHARE"
+const envRequestQueue = "PICOCACHE_REQUEST_QUEUE"
+const envReadHeaderTimeout = "PICOCACHE_READ_HEADER_TIMEOUT"
+const envIdleTimeout = "PICOCACHE_IDLE_TIMEOUT"
+const envWriteStallTimeout = "PICOCACHE_WRITE_STALL_TIMEOUT"
+const envFsyncInterval = "PICOCACHE_FSYNC_INTERVAL"
+const envAdminToken = "PICOCACHE_ADMIN_TOKEN"
+const envTrustedProxies = "PICOCACHE_TRUSTED_PROXIES"
+const envSelfTestPath = "PICOCACHE_SELFTEST_PATH"
+const envSelfTestRequired = "PICOCACHE_SELFTEST_REQUIRED"
 
 func main() {
-	source := os.Getenv(envSource)
-	if source == "" {
-		panic(envSource + " is empty")
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulate(os.Args[2:])
+		return
 	}
-	cacheDir := os.Getenv(envCachedir)
-	if cacheDir == "" {
-		panic(envCachedir + " is empty")
+	if len(os.Args) > 1 && adminCommands[os.Args[1]] != nil {
+		os.Exit(runAdmin(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
 	}
-	maxSize := os.Getenv(envMaxSize)
-	if maxSize == "" {
-		panic(envMaxSize + " is empty")
+
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *version {
+		fmt.Println(picocache.Product(), picocache.Commit)
+		return
 	}
-	listenTo := os.Getenv(envListenTo)
-	if maxSize == "" {
-		panic(envListenTo + " is empty")
+	if err := run(os.Getenv); err != nil {
+		fmt.Fprintln(os.Stderr, "picocache:", err)
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			os.Exit(2)
+		}
+		os.Exit(1)
 	}
+}
 
-	size, err := units.FromHumanSize(maxSize)
-	if err != nil {
-		panic("can't parse PICOCACHE_MAXSIZE: " + err.Error())
+// run starts the cache configured by the env variables getenv returns,
+// serving it until interrupted. Misconfigurations are *configError.
+func run(getenv func(string) string) error {
+	cfg := &config{getenv: getenv}
+	offline := envOr(cfg, envOffline, strconv.ParseBool, false)
+	source := cfg.get(envSource)
+	if !offline {
+		source = cfg.required(envSource)
+	}
+	cacheDir := cfg.required(envCachedir)
+	cfg.required(envMaxSize)
+	listenTo := cfg.get(envListenTo) // not needed with socket activation
+	size := envOr(cfg, envMaxSize, units.FromHumanSize, 0)
+
+	opts := []picocache.Option{}
+	if dirs := envOr(cfg, envCachedir, picocache.ParseCacheDirs, nil); len(dirs) > 0 {
+		// The first one holds the manifest and lock
+		cacheDir = dirs[0].Path
+		opts = append(opts, picocache.WithCacheDirs(dirs...))
+	}
+	optionalEnv(cfg, &opts, envOriginMaxIdleConns, strconv.Atoi, picocache.WithOriginMaxIdleConns)
+	optionalEnv(cfg, &opts, envOriginIdleTimeout, time.ParseDuration, picocache.WithOriginIdleTimeout)
+	optionalEnv(cfg, &opts, envOriginMaxConnsPerHost, strconv.Atoi, picocache.WithOriginMaxConnsPerHost)
+	optionalEnv(cfg, &opts, envOriginHTTP, picocache.ParseOriginProtocol, picocache.WithOriginProtocol)
+	optionalEnv(cfg, &opts, envOriginUserAgent, parseString, picocache.WithOriginUserAgent)
+	optionalEnv(cfg, &opts, envOriginFirstByteTimeout, time.ParseDuration, picocache.WithOriginFirstByteTimeout)
+	optionalEnv(cfg, &opts, envStaleIfError, time.ParseDuration, picocache.WithStaleIfError)
+	if envOr(cfg, envValidateContentType, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithContentTypeValidation())
+	}
+	optionalEnv(cfg, &opts, envRejectBodyPrefixes, parseList, func(prefixes []string) picocache.Option {
+		return picocache.WithBodyBlocklist(prefixes...)
+	})
+	optionalEnv(cfg, &opts, envProxyPaths, parseList, func(prefixes []string) picocache.Option {
+		return picocache.WithProxyPaths(prefixes...)
+	})
+	optionalEnv(cfg, &opts, envWarmFrom, parseString, func(listing string) picocache.Option {
+		return picocache.WithWarmFrom(listing, envOr(cfg, envWarmEvery, time.ParseDuration, 0), envOr(cfg, envWarmConcurrency, strconv.Atoi, 0))
+	})
+	if envOr(cfg, envRejectWith502, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithRejectedAsBadGateway())
+	}
+	optionalEnv(cfg, &opts, envOriginMaxHeaderBytes, units.RAMInBytes, picocache.WithOriginMaxHeaderBytes)
+	optionalEnv(cfg, &opts, envMaxContentLength, units.FromHumanSize, picocache.WithMaxContentLength)
+	switch mode := envOr(cfg, envLargeObjectMode, parseString, "proxy"); mode {
+	case "proxy":
+	case "redirect":
+		opts = append(opts, picocache.WithLargeObjectRedirect(cfg.get(envRedirectLocation), envOr(cfg, envSizeProbeTTL, time.ParseDuration, time.Minute)))
+	default:
+		cfg.fail(fmt.Errorf("can't parse %s: expected proxy or redirect, got %s", envLargeObjectMode, mode))
+	}
+	optionalEnv(cfg, &opts, envHeadMetadataTTL, time.ParseDuration, picocache.WithHeadMetadata)
+	optionalEnv(cfg, &opts, envMaxAuxEntries, strconv.Atoi, picocache.WithMaxAuxEntries)
+	optionalEnv(cfg, &opts, envLegacyUpgradeRate, parseFloat, func(perSecond float64) picocache.Option {
+		return picocache.WithLegacyUpgrades(perSecond, envOr(cfg, envLegacyUpgradeValidate, strconv.ParseBool, false))
+	})
+	optionalEnv(cfg, &opts, envOriginByteBudget, picocache.ParseByteBudget, picocache.WithOriginByteBudget)
+	optionalEnv(cfg, &opts, envFillBytesBudget, picocache.ParseByteBudget, picocache.WithFillByteBudget)
+	optionalEnv(cfg, &opts, envOriginRateLimit, picocache.ParseRequestRate, func(rate picocache.RequestRate) picocache.Option {
+		return picocache.WithOriginRateLimit(rate, envOr(cfg, envOriginRateWait, time.ParseDuration, 0))
+	})
+	if envOr(cfg, envRevalidateOnStart, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithStartupRevalidation())
+	}
+	if envOr(cfg, envStrictOrigin, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithStrictOrigin())
+	}
+	optionalEnv(cfg, &opts, envAdaptiveTTL, picocache.ParseAdaptiveTTL, picocache.WithAdaptiveTTL)
+	optionalEnv(cfg, &opts, envBlockSize, units.RAMInBytes, picocache.WithBlockSize)
+	optionalEnv(cfg, &opts, envCompress, strconv.ParseBool, picocache.WithCompression)
+	optionalEnv(cfg, &opts, envDrainGrace, time.ParseDuration, picocache.WithDrainGrace)
+	optionalEnv(cfg, &opts, envOriginCompression, picocache.ParseEncodingFallback, picocache.WithOriginCompression)
+	optionalEnv(cfg, &opts, envProtectedShare, parseFloat, picocache.WithProtectedShare)
+	optionalEnv(cfg, &opts, envOriginProbeInterval, parseInterval, func(interval time.Duration) picocache.Option {
+		return picocache.WithOriginProbe(interval, cfg.get(envOriginProbeMethod), envOr(cfg, envOriginProbePath, parseString, "/"))
+	})
+	optionalEnv(cfg, &opts, envAccessLogSample, parseFloat, picocache.WithAccessLog)
+	optionalEnv(cfg, &opts, envSlowRequestThreshold, time.ParseDuration, picocache.WithSlowRequestThreshold)
+	optionalEnv(cfg, &opts, envGhosts, strconv.Atoi, picocache.WithGhosts)
+	optionalEnv(cfg, &opts, envShrinkRate, units.FromHumanSize, picocache.WithShrinkRate)
+	optionalEnv(cfg, &opts, envMIMETypes, picocache.ParseMIMETypes, picocache.WithMIMETypes)
+	if envOr(cfg, envSourceContentType, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithSourceContentType())
+	}
+	optionalEnv(cfg, &opts, envMetadataRefreshRate, parseFloat, picocache.WithMetadataRefreshRate)
+	optionalEnv(cfg, &opts, envEvictionPolicy, picocache.ParseEvictionPolicy, picocache.WithEvictionPolicy)
+	optionalEnv(cfg, &opts, envKeyMigration, picocache.ParseKeyMigration, picocache.WithKeyMigration)
+	optionalEnv(cfg, &opts, envCacheableStatus, picocache.ParseStatusCodes, picocache.WithCacheableStatus)
+	optionalEnv(cfg, &opts, envWriteStallTimeout, time.ParseDuration, picocache.WithWriteStallTimeout)
+	optionalEnv(cfg, &opts, envReadOnlyMisses, picocache.ParseFrozenMisses, picocache.WithFrozenMisses)
+	optionalEnv(cfg, &opts, envUncachedPreconditions, picocache.ParseUncachedPreconditions, picocache.WithUncachedPreconditions)
+	traceFileSize := envOr(cfg, envTraceFileSize, units.FromHumanSize, 100_000_000)
+	optionalEnv(cfg, &opts, envTraceFile, parseString, func(path string) picocache.Option {
+		return picocache.WithTraceFile(path, traceFileSize)
+	})
+	optionalEnv(cfg, &opts, envFsync, picocache.ParseFsyncPolicy, func(policy picocache.FsyncPolicy) picocache.Option {
+		return picocache.WithFsync(policy, envOr(cfg, envFsyncInterval, time.ParseDuration, 0))
+	})
+	if envOr(cfg, envIntegrityTrailer, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithIntegrityTrailer())
+	}
+	if envOr(cfg, envServedBy, strconv.ParseBool, false) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("can't get the hostname: %w", err)
+		}
+		opts = append(opts, picocache.WithServedBy(hostname))
+	}
+	if envOr(cfg, envPrefixPurge, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithPrefixPurge())
+	}
+	if envOr(cfg, envReadOnly, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithFrozen())
 	}
+	if offline {
+		opts = append(opts, picocache.WithOffline())
+	}
+	optionalEnv(cfg, &opts, envOfflineMissStatus, picocache.ParseOfflineMissStatus, picocache.WithOfflineMissStatus)
+	if envOr(cfg, envIgnoreLock, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithIgnoreLock())
+	}
+	if envOr(cfg, envStreamFills, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithStreamingFills())
+	}
+	if envOr(cfg, envDedup, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithDedup())
+	}
+	if envOr(cfg, envNormalizePaths, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithPathNormalization(envOr(cfg, envNormalizeLowercase, strconv.ParseBool, false)))
+	}
+	if cfg.get(envStripQueryParams) != "" && cfg.get(envKeepQueryParams) != "" {
+		cfg.fail(fmt.Errorf("%s and %s can't be both set", envStripQueryParams, envKeepQueryParams))
+	}
+	optionalEnv(cfg, &opts, envStripQueryParams, parseList, func(names []string) picocache.Option {
+		return picocache.WithStrippedQueryParams(names...)
+	})
+	optionalEnv(cfg, &opts, envKeepQueryParams, parseList, func(names []string) picocache.Option {
+		return picocache.WithKeptQueryParams(names...)
+	})
+	optionalEnv(cfg, &opts, envLanguages, parseList, func(languages []string) picocache.Option {
+		return picocache.WithLanguages(languages...)
+	})
+	optionalEnv(cfg, &opts, envPassthroughHeaders, parseList, func(names []string) picocache.Option {
+		return picocache.WithPassthroughHeaders(names...)
+	})
+	optionalEnv(cfg, &opts, envHosts, parseList, func(hosts []string) picocache.Option {
+		return picocache.WithHosts(hosts...)
+	})
+	optionalEnv(cfg, &opts, envRules, picocache.ParseRules, func(rules []picocache.Rule) picocache.Option {
+		return picocache.WithRules(rules...)
+	})
+	optionalEnv(cfg, &opts, envExpiryJitter, parseFloat, picocache.WithExpiryJitter)
+	staleGrace := envOr(cfg, envStaleGrace, time.ParseDuration, 30*time.Second)
+	optionalEnv(cfg, &opts, envMaxRevalidations, parseFloat, func(perSecond float64) picocache.Option {
+		return picocache.WithMaxRevalidations(perSecond, staleGrace)
+	})
+	if window := envOr(cfg, envLogSuppressWindow, time.ParseDuration, time.Minute); window > 0 {
+		opts = append(opts, picocache.WithLogSuppression(window))
+	}
+	maintenanceTZ := envOr(cfg, envMaintenanceTZ, time.LoadLocation, time.Local)
+	optionalEnv(cfg, &opts, envMaintenanceWindows, picocache.ParseWindows, func(windows []picocache.Window) picocache.Option {
+		return picocache.WithMaintenanceWindows(maintenanceTZ, windows...)
+	})
+	scrubInterval := envOr(cfg, envScrubInterval, time.ParseDuration, 24*time.Hour)
+	optionalEnv(cfg, &opts, envScrubSample, strconv.Atoi, func(sample int) picocache.Option {
+		return picocache.WithScrub(sample, scrubInterval)
+	})
+	opts = append(opts, picocache.WithQuarantine(envOr(cfg, envQuarantineFailures, strconv.Atoi, 3), envOr(cfg, envQuarantineFor, time.ParseDuration, 10*time.Minute)))
+	optionalEnv(cfg, &opts, envAdminToken, parseString, picocache.WithAdminToken)
+	optionalEnv(cfg, &opts, envPeers, parseList, func(peers []string) picocache.Option {
+		return picocache.WithPeers(peers...)
+	})
+	optionalEnv(cfg, &opts, envPeerHopLimit, strconv.Atoi, picocache.WithPeerHopLimit)
+	optionalEnv(cfg, &opts, envPurgeDropDir, parseString, func(dir string) picocache.Option {
+		return picocache.WithPurgeDrop(dir, envOr(cfg, envPurgeDropQuiescence, time.ParseDuration, 0))
+	})
+	optionalEnv(cfg, &opts, envManifestFile, parseString, picocache.WithReleaseManifest)
+	optionalEnv(cfg, &opts, envTrustedProxies, picocache.ParsePrefixes, func(prefixes []netip.Prefix) picocache.Option {
+		return picocache.WithTrustedProxies(prefixes...)
+	})
+	optionalEnv(cfg, &opts, envSelfTestPath, parseString, picocache.WithSelfTest)
+	optionalEnv(cfg, &opts, envAbandonedFill, picocache.ParseAbandonedFill, picocache.WithAbandonedFill)
+	if envOr(cfg, envResumableFills, strconv.ParseBool, false) {
+		opts = append(opts, picocache.WithResumableFills(envOr(cfg, envResumeTTL, time.ParseDuration, 0)))
+	}
+	readerQueue := envOr(cfg, envReaderQueue, time.ParseDuration, 0)
+	optionalEnv(cfg, &opts, envMaxReadersPerEntry, strconv.Atoi, func(n int) picocache.Option {
+		return picocache.WithMaxReadersPerEntry(n, readerQueue)
+	})
+	hitShare := envOr(cfg, envHitShare, parseFloat, 0.2)
+	requestQueue := envOr(cfg, envRequestQueue, time.ParseDuration, 0)
+	optionalEnv(cfg, &opts, envMaxRequests, strconv.Atoi, func(n int) picocache.Option {
+		return picocache.WithMaxRequests(n, hitShare, requestQueue)
+	})
+	admitWindow := envOr(cfg, envAdmitWindow, time.ParseDuration, 0)
+	optionalEnv(cfg, &opts, envAdmitAfter, strconv.Atoi, func(n int) picocache.Option {
+		return picocache.WithAdmitAfter(n, admitWindow)
+	})
+	floodPerClient := envOr(cfg, envKeyFloodPerClient, strconv.Atoi, 0)
+	floodGlobal := envOr(cfg, envKeyFloodGlobal, strconv.Atoi, 0)
+	if floodPerClient > 0 || floodGlobal > 0 {
+		opts = append(opts, picocache.WithKeyFloodGuard(floodPerClient, floodGlobal, envOr(cfg, envKeyFloodWindow, time.ParseDuration, 0)))
+	}
+	optionalEnv(cfg, &opts, envKeyFloodMode, picocache.ParseKeyFloodMode, picocache.WithKeyFloodMode)
+	for _, p := range []struct {
+		env    string
+		policy picocache.Policy
+	}{
+		{envAdmitEnforcement, picocache.PolicyAdmission},
+		{envKeyFloodEnforcement, picocache.PolicyKeyFlood},
+		{envValidateContentTypeEnforcement, picocache.PolicyContentType},
+		{envRejectBodyEnforcement, picocache.PolicyBodyBlocklist},
+		{envStrictOriginEnforcement, picocache.PolicyStrictOrigin},
+	} {
+		optionalEnv(cfg, &opts, p.env, picocache.ParsePolicyMode, func(mode picocache.PolicyMode) picocache.Option {
+			return picocache.WithPolicyMode(p.policy, mode)
+		})
+	}
+	proxyProtocol := envOr(cfg, envProxyProtocol, strconv.ParseBool, false)
+	var proxyProtocolFrom []netip.Prefix
+	if proxyProtocol {
+		cfg.required(envProxyProtocolFrom)
+		proxyProtocolFrom = envOr(cfg, envProxyProtocolFrom, picocache.ParsePrefixes, nil)
+	}
+	selfTestRequired := envOr(cfg, envSelfTestRequired, strconv.ParseBool, false)
+	timeouts := serverTimeouts{
+		readHeader: envOr(cfg, envReadHeaderTimeout, time.ParseDuration, 10*time.Second),
+		idle:       envOr(cfg, envIdleTimeout, time.ParseDuration, 2*time.Minute),
+	}
+	if cfg.err != nil {
+		return &configError{cfg.err}
+	}
+
+	log := slog.Default().With(slog.String("ident", "main"))
 
 	pcache, err := picocache.NewCache(
-		slog.Default().With(slog.String("ident", "main")),
+		log,
 		source,
 		cacheDir,
 		size,
+		opts...,
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("can't open the cache: %w", err)
 	}
+	defer pcache.Close()
 
-	http.ListenAndServe(listenTo, pcache)
+	listeners, err := openListeners(systemd.Listeners, listenTo, log)
+	if err != nil {
+		return err
+	}
+
+	if proxyProtocol {
+		for i, l := range listeners {
+			listeners[i] = proxyproto.NewListener(l, proxyProtocolFrom...)
+		}
+		log.Info("Expecting PROXY protocol headers", slog.String("from", cfg.get(envProxyProtocolFrom)))
+	}
+
+	if path := cfg.get(envSelfTestPath); path != "" {
+		if err := pcache.SelfTest(context.Background(), path); err != nil {
+			if selfTestRequired {
+				closeAll(listeners)
+				return fmt.Errorf("self-test failed: %w", err)
+			}
+			log.Warn("Self-test failed", slog.String("err", err.Error()))
+		}
+	}
+
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		log.Warn("Failed to notify systemd", slog.String("err", err.Error()))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go drainOnSignal(ctx, pcache, stop)
+	if path := cfg.get(envMaxSizeFile); path != "" {
+		go resizeOnHangup(ctx, pcache, path, log)
+	}
+	if cfg.get(envManifestFile) != "" {
+		go reloadManifestOnHangup(ctx, pcache, log)
+	}
+
+	err = serveAll(ctx, listeners, pcache, timeouts)
+	systemd.Notify("STOPPING=1")
+	if err != nil {
+		log.Error("Server stopped", slog.String("err", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// drainOnSignal drains the cache on drainSignals, and calls stop for the
+// server to shut down once drained, however the drain got started.
+func drainOnSignal(ctx context.Context, pcache *picocache.PicoCache, stop func()) {
+	signals := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(signals, drainSignals...)
+		defer signal.Stop(signals)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			pcache.Drain(0)
+		case <-pcache.Drained():
+			stop()
+			return
+		}
+	}
+}
+
+// resizeOnHangup resizes the cache to the size written in path on SIGHUP.
+func resizeOnHangup(ctx context.Context, pcache *picocache.PicoCache, path string, log *slog.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Error("Can't read the cache size", slog.String("err", err.Error()))
+			continue
+		}
+		size, err := units.FromHumanSize(strings.TrimSpace(string(b)))
+		if err == nil {
+			err = pcache.Resize(size)
+		}
+		if err != nil {
+			log.Error("Can't resize the cache", slog.String("err", err.Error()))
+		}
+	}
+}
+
+// reloadManifestOnHangup reads the release manifest again on SIGHUP.
+func reloadManifestOnHangup(ctx context.Context, pcache *picocache.PicoCache, log *slog.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		n, err := pcache.ReloadReleaseManifest()
+		if err != nil {
+			log.Error("Can't reload the release manifest", slog.String("err", err.Error()))
+			continue
+		}
+		log.Info("Reloaded the release manifest", slog.Int("paths", n))
+	}
 }
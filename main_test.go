@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunMisconfigured(t *testing.T) {
+	valid := map[string]string{
+		envSource:   "http://127.0.0.1:1",
+		envCachedir: t.TempDir(),
+		envMaxSize:  "1MB",
+		envListenTo: "127.0.0.1:0",
+	}
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		message string
+	}{
+		{"no source", map[string]string{envSource: ""}, envSource + " is required"},
+		{"no cache dir", map[string]string{envCachedir: ""}, envCachedir + " is required"},
+		{"no max size", map[string]string{envMaxSize: ""}, envMaxSize + " is required"},
+		{"no listen address", map[string]string{envListenTo: ""}, envListenTo + " is required"},
+		{"bad max size", map[string]string{envMaxSize: "lots"}, "can't parse " + envMaxSize},
+		{"bad option", map[string]string{envCompress: "maybe"}, "can't parse " + envCompress},
+		{"zero probe interval", map[string]string{envOriginProbeInterval: "0s"}, "can't parse " + envOriginProbeInterval},
+		{"negative probe interval", map[string]string{envOriginProbeInterval: "-1m"}, "can't parse " + envOriginProbeInterval},
+		{"proxy protocol from anyone", map[string]string{envProxyProtocol: "1"}, envProxyProtocolFrom + " is required"},
+		{"bad proxy protocol peers", map[string]string{envProxyProtocol: "1", envProxyProtocolFrom: "10.0.0.0/33"}, "can't parse " + envProxyProtocolFrom},
+		{"bad rate limit", map[string]string{envOriginRateLimit: "fast"}, "can't parse " + envOriginRateLimit},
+		{"conflicting options", map[string]string{envStripQueryParams: "utm", envKeepQueryParams: "v"}, "can't be both set"},
+		// Offline, the source isn't required
+		{"bad offline status", map[string]string{envOffline: "1", envSource: "", envOfflineMissStatus: "200"}, "can't parse " + envOfflineMissStatus},
+		{"bad dir weight", map[string]string{envCachedir: "/tmp/a,/tmp/b=heavy"}, "can't parse " + envCachedir},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := run(func(key string) string {
+				if v, ok := tc.env[key]; ok {
+					return v
+				}
+				return valid[key]
+			})
+			var cfgErr *configError
+			if !errors.As(err, &cfgErr) || !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("expected a configuration error about %q, got %v", tc.message, err)
+			}
+		})
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	for _, tc := range []struct {
+		name     string
+		cacheDir string
+		listenTo string
+		message  string
+	}{
+		{"cache init", filepath.Join(file, "cache"), "127.0.0.1:0", "can't open the cache"},
+		{"listener bind", t.TempDir(), taken.Addr().String(), "can't listen on " + taken.Addr().String()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := map[string]string{
+				envSource:   "http://127.0.0.1:1",
+				envCachedir: tc.cacheDir,
+				envMaxSize:  "1MB",
+				envListenTo: tc.listenTo,
+			}
+			err := run(func(key string) string { return env[key] })
+			var cfgErr *configError
+			if err == nil || errors.As(err, &cfgErr) || !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("expected a runtime error about %q, got %v", tc.message, err)
+			}
+		})
+	}
+}
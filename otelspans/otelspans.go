@@ -0,0 +1,85 @@
+// Package otelspans traces picocache requests with OpenTelemetry, see
+// picocache.WithTracer. It's a module of its own, so that the cache doesn't
+// depend on OpenTelemetry.
+package otelspans
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	picocache "picocache/src"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a picocache.Tracer starting spans with tracer, propagated by
+// propagator, the W3C trace context if nil.
+func New(tracer trace.Tracer, propagator propagation.TextMapPropagator) picocache.Tracer {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &otelTracer{tracer: tracer, propagator: propagator}
+}
+
+type otelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t *otelTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+func (t *otelTracer) StartSpan(ctx context.Context, name string) (context.Context, picocache.Span) {
+	kind := trace.SpanKindInternal
+	switch name {
+	case picocache.SpanRequest:
+		kind = trace.SpanKindServer
+	case picocache.SpanOriginFetch:
+		kind = trace.SpanKindClient
+	}
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, otelSpan{span}
+}
+
+func (t *otelTracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error, attrs ...slog.Attr) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = append(kvs, keyValue(a))
+	}
+	s.span.SetAttributes(kvs...)
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// keyValue converts a, durations to seconds.
+func keyValue(a slog.Attr) attribute.KeyValue {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindBool:
+		return attribute.Bool(a.Key, v.Bool())
+	case slog.KindInt64:
+		return attribute.Int64(a.Key, v.Int64())
+	case slog.KindUint64:
+		return attribute.Int64(a.Key, int64(v.Uint64()))
+	case slog.KindFloat64:
+		return attribute.Float64(a.Key, v.Float64())
+	case slog.KindDuration:
+		return attribute.Float64(a.Key, v.Duration().Seconds())
+	}
+	return attribute.String(a.Key, v.String())
+}
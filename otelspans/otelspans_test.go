@@ -0,0 +1,53 @@
+package otelspans_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"picocache/otelspans"
+	picocache "picocache/src"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := otelspans.New(provider.Tracer("picocache"), nil)
+
+	incoming := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	ctx, request := tracer.StartSpan(tracer.Extract(context.Background(), incoming), picocache.SpanRequest)
+	fetchCtx, fetch := tracer.StartSpan(ctx, picocache.SpanOriginFetch)
+	outgoing := http.Header{}
+	tracer.Inject(fetchCtx, outgoing)
+	fetch.End(errors.New("source down"), slog.String("picocache.fetch", "fill"), slog.Int64("picocache.bytes", 0))
+	request.End(nil, slog.Int("http.response.status_code", http.StatusOK))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	f, r := spans[0], spans[1]
+	if r.Parent().SpanID().String() != "00f067aa0ba902b7" || r.SpanKind() != trace.SpanKindServer || !r.Parent().IsRemote() {
+		t.Fatalf("expected the request span to be a server child of the incoming one, got %v %v", r.Parent(), r.SpanKind())
+	}
+	if f.Parent().SpanID() != r.SpanContext().SpanID() || f.SpanKind() != trace.SpanKindClient || f.Status().Code != codes.Error {
+		t.Fatalf("expected the fetch span to be a failed client child of the request one, got %v %v %v", f.Parent(), f.SpanKind(), f.Status())
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + f.SpanContext().SpanID().String() + "-01"; outgoing.Get("Traceparent") != want {
+		t.Fatalf("expected traceparent %s, got %s", want, outgoing.Get("Traceparent"))
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range f.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["picocache.fetch"].AsString() != "fill" || attrs["picocache.bytes"].Type() != attribute.INT64 {
+		t.Fatalf("unexpected attributes %v", f.Attributes())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	picocache "picocache/src"
+
+	"github.com/docker/go-units"
+)
+
+// simulate replays trace files through an hypothetical cache, reporting its
+// hit rate:
+//
+//	picocache simulate -trace trace.1,trace -size 50GB -policy lfu
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	traces := flags.String("trace", "", "comma-separated trace files, oldest first")
+	size := flags.String("size", "", "cache size, e.g. 50GB")
+	policy := flags.String("policy", "slru", "eviction policy: slru, lru or lfu")
+	protectedShare := flags.Float64("protected-share", 0.8, "share of the cache protected with slru")
+	flags.Parse(args)
+
+	files, _ := parseList(*traces)
+	if len(files) == 0 || *size == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	maxSize, err := units.FromHumanSize(*size)
+	if err != nil {
+		panic("can't parse -size: " + err.Error())
+	}
+	p, err := picocache.ParseEvictionPolicy(*policy)
+	if err != nil {
+		panic(err)
+	}
+
+	readers := []io.Reader{}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	result, err := picocache.Simulate(io.MultiReader(readers...), maxSize, p, *protectedShare)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("requests %d, hits %d, hit rate %.2f%%, evictions %d\n",
+		result.Requests, result.Hits, 100*result.HitRate, result.Evictions)
+}
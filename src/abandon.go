@@ -0,0 +1,137 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errAbandoned = errors.New("fill abandoned by its clients")
+
+// fill is a download in progress, shared by the clients waiting on it.
+type fill struct {
+	key     string    // cache key of the entry
+	path    string    // requested
+	started time.Time // see FillProgress
+	waiters atomic.Int64
+	cancel  context.CancelFunc
+	written atomic.Int64 // body bytes written, see fillWriter
+	length  atomic.Int64 // expected body size, -1 when unknown
+
+	sampledAt    atomic.Int64 // UnixNano, see sample
+	sampledBytes atomic.Int64
+	rate         atomic.Int64 // bytes per second
+
+	timedOut atomic.Bool // the source body never started
+	partial  atomic.Bool // the source sent partial content, see errPartialContent
+	over     atomic.Bool // the body didn't fit in the origin byte budget
+	unbudget atomic.Bool // the body didn't fit in the fill byte budget
+	limited  atomic.Bool // the source couldn't be asked within the origin request rate limit
+	rejected atomic.Bool // the source sent an error page, see errRejected
+	differed atomic.Bool // the body differed from the release manifest
+	failed   atomic.Bool // the source failed, see errSourceFailed
+
+	growing atomic.Pointer[growingFile] // of the current attempt, see WithStreamingFills
+
+	condemned atomic.Bool                // purged while in progress, see PurgedFilling
+	result    atomic.Pointer[cacheEntry] // once condemned and complete, not cached
+
+	mu      sync.Mutex
+	holders int    // clients yet to open result, or done with f
+	orphan  string // the file of result, removed once they all opened it
+}
+
+// hold counts a client which may open the result of f, reporting false if
+// it's too late for that.
+func (f *fill) hold() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.holders == 0 {
+		return false
+	}
+	f.holders++
+	return true
+}
+
+// release uncounts a client, done with f or having opened its result.
+func (f *fill) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.holders--
+	if f.holders == 0 && f.orphan != "" {
+		os.Remove(f.orphan)
+	}
+}
+
+// fillReader counts the body bytes a fill received.
+// WithAbandonedFill sets what happens to a fill once every client waiting
+// on it gave up: it is completed only if more than completeOver of its body
+// already arrived, and aborted otherwise. Zero, the default, always
+// completes them; anything over 1 always aborts them.
+func WithAbandonedFill(completeOver float64) Option {
+	return func(c *PicoCache) {
+		c.abandonedCompleteOver = completeOver
+	}
+}
+
+// ParseAbandonedFill parses an abandoned fill policy for WithAbandonedFill:
+// complete, abort or complete-if-over=<percentage>%.
+func ParseAbandonedFill(s string) (float64, error) {
+	switch s {
+	case "complete":
+		return 0, nil
+	case "abort":
+		return math.Inf(1), nil
+	}
+
+	percent, ok := strings.CutPrefix(s, "complete-if-over=")
+	if !ok {
+		return 0, fmt.Errorf("unknown policy %q", s)
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", percent)
+	}
+	return p / 100, nil
+}
+
+// attach counts a client waiting on f until its ctx is done, applying the
+// abandoned fill policy once the last one gave up. The returned func
+// detaches a client which didn't.
+func (c *PicoCache) attach(ctx context.Context, f *fill) func() {
+	f.waiters.Add(1)
+	stop := context.AfterFunc(ctx, func() {
+		if f.waiters.Add(-1) == 0 {
+			c.abandon(f)
+		}
+	})
+	return func() {
+		if stop() {
+			f.waiters.Add(-1)
+		}
+	}
+}
+
+func (c *PicoCache) abandon(f *fill) {
+	if c.abandonedCompleteOver == 0 {
+		c.stats.abandonedCompleted.Add(1)
+		return
+	}
+
+	length := f.length.Load()
+	if length > 0 && float64(f.written.Load()) >= c.abandonedCompleteOver*float64(length) {
+		c.stats.abandonedCompleted.Add(1)
+		return
+	}
+	c.stats.abandonedAborted.Add(1)
+	f.cancel()
+}
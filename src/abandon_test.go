@@ -0,0 +1,135 @@
+package picocache
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAbandonedFill(t *testing.T) {
+	for s, expected := range map[string]float64{
+		"complete":              0,
+		"abort":                 math.Inf(1),
+		"complete-if-over=50%":  0.5,
+		"complete-if-over=12.5": 0.125,
+	} {
+		if got, err := ParseAbandonedFill(s); err != nil || got != expected {
+			t.Errorf("%s: expected %v, got %v, %v", s, expected, got, err)
+		}
+	}
+	for _, s := range []string{"", "finish", "complete-if-over=", "complete-if-over=150%", "complete-if-over=x%"} {
+		if _, err := ParseAbandonedFill(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+// abandonFill starts clients fills of a slow source which sends half of
+// its body then stalls, cancels them all, lets the source finish and
+// returns the cache once the fill settled.
+func abandonFill(t *testing.T, clients int, opts ...Option) *PicoCache {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(strings.Repeat("x", 50)))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			w.Write([]byte(strings.Repeat("x", 50)))
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancels := []context.CancelFunc{}
+	done := make(chan struct{}, clients)
+	for range clients {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		go func() {
+			req := httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx)
+			cache.ServeHTTP(httptest.NewRecorder(), req)
+			done <- struct{}{}
+		}()
+	}
+
+	cacheFile := cache.getCacheFilename("/slow")
+	waitFor(t, func() bool {
+		f, ok := cache.downloading.Load(cacheFile)
+		return ok && f.(*fill).written.Load() == 50 && f.(*fill).waiters.Load() == int64(clients)
+	})
+
+	for i, cancel := range cancels {
+		cancel()
+		if i < clients-1 {
+			if s := cache.Stats(); s.AbandonedFillsCompleted+s.AbandonedFillsAborted != 0 {
+				t.Fatal("fill abandoned while clients are still waiting")
+			}
+		}
+	}
+	close(release)
+	for range clients {
+		<-done
+	}
+	waitFor(t, func() bool {
+		_, ok := cache.downloading.Load(cacheFile)
+		return !ok
+	})
+	return cache
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAbandonedFill(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		clients   int
+		opts      []Option
+		completed bool
+	}{
+		{"complete", 1, nil, true},
+		{"abort", 1, []Option{WithAbandonedFill(math.Inf(1))}, false},
+		{"abort with several clients", 3, []Option{WithAbandonedFill(math.Inf(1))}, false},
+		{"complete over 40%", 1, []Option{WithAbandonedFill(0.4)}, true},
+		{"complete over 60%", 1, []Option{WithAbandonedFill(0.6)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := abandonFill(t, tc.clients, tc.opts...)
+
+			s := cache.Stats()
+			_, cached := cache.entries.Load(cache.getCacheFilename("/slow"))
+			if tc.completed {
+				if !cached || s.AbandonedFillsCompleted != 1 || s.AbandonedFillsAborted != 0 {
+					t.Fatalf("expected a completed fill, got cached=%v and %+v", cached, s)
+				}
+				return
+			}
+
+			if cached || s.AbandonedFillsAborted != 1 || s.AbandonedFillsCompleted != 0 {
+				t.Fatalf("expected an aborted fill, got cached=%v and %+v", cached, s)
+			}
+			leftovers := entryFiles(t, cache.cacheDir)
+			if len(leftovers) != 0 {
+				t.Fatalf("aborted fill left files behind: %v", leftovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package picocache
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// WithAccessLog logs served requests. Only a sample share of successful hits
+// get logged, misses and errors always are.
+func WithAccessLog(sample float64) Option {
+	return func(c *PicoCache) {
+		c.accessLog = true
+		c.accessLogSample = sample
+	}
+}
+
+// WithSlowRequestThreshold logs, with a breakdown of where the time went,
+// any request taking longer than threshold.
+func WithSlowRequestThreshold(threshold time.Duration) Option {
+	return func(c *PicoCache) {
+		c.slowRequestThreshold = threshold
+	}
+}
+
+// WithEvents calls fn after each request got served.
+func WithEvents(fn func(RequestEvent)) Option {
+	return func(c *PicoCache) {
+		c.onRequest = fn
+	}
+}
+
+// RequestEvent describes a served request.
+type RequestEvent struct {
+	Method string
+	Path   string
+	Status int
+	Cache  Outcome
+	Bytes  int64 // body bytes sent to the client
+
+	Duration        time.Duration
+	FirstByte       time.Duration // until the first byte sent to the client
+	OriginFirstByte time.Duration // until the source response headers
+	LockWait        time.Duration // blocked on a concurrent fill, the entry lock or a queue
+	Copy            time.Duration // sending the body to the client
+
+	Fill *FillProgress // final figures of the fill the request made, if any
+}
+
+// timings collects where a request spends its time.
+type timings struct {
+	start           time.Time
+	originFirstByte time.Duration
+	lockWait        time.Duration // see waitTracker
+	copy            time.Duration
+
+	traced bool     // see trace
+	steps  []string // decisions made, when traced
+
+	cacheFile string // of the entry requested, see traceRequest
+	language  string // the entry varies by, see WithLanguages
+	size      int64  // of the entry served
+	changed   bool   // the source changed since the entry held, see WithAdaptiveTTL
+
+	staleIfError time.Duration // the client accepts, see WithStaleIfError
+	failedOver   bool          // served stale as the source failed
+
+	tracer  Tracer          // nil unless traced, see WithTracer
+	spanCtx context.Context // carrying span
+	span    Span            // of the request
+
+	tail func(g *growingFile) // streams a miss as it fills, see WithStreamingFills
+	fill *FillProgress        // made for the request, once complete
+
+	outcome Outcome       // sent as X-Cache, see stampOutcome
+	age     time.Duration // of the entry served, if aged
+	aged    bool
+	stamped bool
+}
+
+// recorder captures what gets sent to the client.
+type recorder struct {
+	http.ResponseWriter
+	t         *timings
+	now       func() time.Time
+	status    int
+	bytes     int64
+	headerAt  time.Time
+	firstByte time.Time
+}
+
+func (r *recorder) WriteHeader(status int) {
+	// Informational responses, such as the 100 Continue of a proxied
+	// request, come before the final one
+	if r.status == 0 && status >= http.StatusOK {
+		r.sendingHeader(status)
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.sendingHeader(http.StatusOK)
+	}
+	if r.firstByte.IsZero() && len(p) > 0 {
+		r.firstByte = r.now()
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *recorder) sendingHeader(status int) {
+	r.status = status
+	r.headerAt = r.now()
+	if r.t != nil {
+		r.t.stampOutcome(r.Header())
+	}
+	if r.t != nil && r.t.traced {
+		r.Header().Set(traceHeader, r.t.traceString())
+	}
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (c *PicoCache) observe(r *http.Request, rec *recorder, t *timings) {
+	ev := RequestEvent{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Status: rec.status,
+		Cache:  t.outcome,
+		Bytes:  rec.bytes,
+
+		Duration:        c.now().Sub(t.start),
+		OriginFirstByte: t.originFirstByte,
+		LockWait:        t.lockWait,
+		Copy:            t.copy,
+		Fill:            t.fill,
+	}
+	if ev.Status == 0 {
+		ev.Status = http.StatusOK
+	}
+
+	// Responses without a body count until their headers
+	firstByte := rec.firstByte
+	if firstByte.IsZero() {
+		firstByte = rec.headerAt
+	}
+	if !firstByte.IsZero() {
+		ev.FirstByte = firstByte.Sub(t.start)
+		if i := ev.Cache.ttfb(); i >= 0 {
+			c.ttfb[i].observe(ev.FirstByte)
+		}
+	}
+	if i := ev.Cache.ttfb(); i >= 0 {
+		c.lockWait[i].observe(ev.LockWait)
+	}
+
+	c.outcomes[ev.Cache].Add(1)
+	t.endRequestSpan(ev)
+	if c.onRequest != nil {
+		c.onRequest(ev)
+	}
+
+	attrs := []any{
+		slog.String("method", ev.Method),
+		slog.String("url", ev.Path),
+		slog.Int("status", ev.Status),
+		slog.String("cache", ev.Cache.String()),
+		slog.Int64("bytes", ev.Bytes),
+		slog.Duration("duration", ev.Duration),
+	}
+	if ev.LockWait > 0 {
+		attrs = append(attrs, slog.Duration("lock_wait", ev.LockWait))
+	}
+
+	if c.slowRequestThreshold > 0 && ev.Duration >= c.slowRequestThreshold {
+		c.log.Warn("Slow request", append(attrs,
+			slog.Duration("origin_first_byte", ev.OriginFirstByte),
+			slog.Duration("copy", ev.Copy),
+		)...)
+	}
+
+	if c.traceFile != nil {
+		c.traceRequest(t, ev.Cache)
+	}
+
+	if t.traced {
+		c.log.Debug("Request trace", append(attrs, slog.String("trace", t.traceString()))...)
+	}
+
+	if c.accessLog && (ev.Status >= 400 || ev.Cache != OutcomeHit && ev.Cache != OutcomeHitOffline || rand.Float64() < c.accessLogSample) {
+		c.log.Info("Request", attrs...)
+	}
+}
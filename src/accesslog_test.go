@@ -0,0 +1,126 @@
+package picocache_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHandler keeps the messages logged through it.
+type recordHandler struct {
+	mu       sync.Mutex
+	messages map[string]int
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.messages == nil {
+		h.messages = map[string]int{}
+	}
+	h.messages[r.Message]++
+	return nil
+}
+
+func (h *recordHandler) count(message string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.messages[message]
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	h := &recordHandler{}
+	var events []picocache.RequestEvent
+	cache, err := picocache.NewCache(slog.New(h), origin.URL, t.TempDir(), 1<<20,
+		picocache.WithAccessLog(0.1),
+		picocache.WithEvents(func(ev picocache.RequestEvent) { events = append(events, ev) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// The miss is always logged, and about 10% of the hits
+	const hits = 5000
+	for range hits + 1 {
+		get("/file")
+	}
+	if logged := h.count("Request") - 1; logged < hits*0.07 || logged > hits*0.13 {
+		t.Fatalf("expected about %d sampled hits, got %d", hits/10, logged)
+	}
+
+	// Errors are never sampled out
+	before := h.count("Request")
+	for range 100 {
+		get("/missing")
+	}
+	if logged := h.count("Request") - before; logged != 100 {
+		t.Fatalf("expected all 100 errors to be logged, got %d", logged)
+	}
+
+	if len(events) != hits+101 {
+		t.Fatalf("expected an event per request, got %d", len(events))
+	}
+	if ev := events[0]; ev.Cache != picocache.OutcomeMiss || ev.Status != http.StatusOK || ev.Bytes != 3 || ev.OriginFirstByte == 0 {
+		t.Fatalf("unexpected miss event: %+v", ev)
+	}
+	if ev := events[len(events)-1]; ev.Status != http.StatusInternalServerError {
+		t.Fatalf("unexpected error event: %+v", ev)
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	h := &recordHandler{}
+	var last picocache.RequestEvent
+	cache, err := picocache.NewCache(slog.New(h), origin.URL, t.TempDir(), 1<<20,
+		picocache.WithSlowRequestThreshold(40*time.Millisecond),
+		picocache.WithEvents(func(ev picocache.RequestEvent) { last = ev }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if h.count("Slow request") != 0 {
+		t.Fatal("fast request logged as slow")
+	}
+
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if h.count("Slow request") != 1 {
+		t.Fatal("slow request not logged")
+	}
+	if last.OriginFirstByte < 50*time.Millisecond {
+		t.Fatalf("slowness not attributed to the source: %+v", last)
+	}
+	// Without an access log, nothing else gets logged per request
+	if h.count("Request") != 0 {
+		t.Fatal("access log enabled by default")
+	}
+}
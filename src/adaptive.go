@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdaptiveTTL bounds how the TTL of entries adapts to how often they
+// change at the source, see WithAdaptiveTTL.
+type AdaptiveTTL struct {
+	Floor  time.Duration // TTL of entries found changed
+	Cap    time.Duration
+	Growth float64 // the TTL gets multiplied by each time an entry is found unchanged
+}
+
+// ParseAdaptiveTTL parses the floor, cap and growth factor of an adaptive
+// TTL, such as 5m,24h,2.
+func ParseAdaptiveTTL(s string) (AdaptiveTTL, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return AdaptiveTTL{}, fmt.Errorf("expected floor,cap,growth such as 5m,24h,2, got %q", s)
+	}
+	floor, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return AdaptiveTTL{}, err
+	}
+	ceiling, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return AdaptiveTTL{}, err
+	}
+	growth, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+	if err != nil {
+		return AdaptiveTTL{}, err
+	}
+	if floor <= 0 || ceiling < floor || growth < 1 {
+		return AdaptiveTTL{}, fmt.Errorf("expected 0 < floor <= cap and a growth of at least 1, got %q", s)
+	}
+	return AdaptiveTTL{Floor: floor, Cap: ceiling, Growth: growth}, nil
+}
+
+// WithAdaptiveTTL adapts the TTL of entries under rules setting one to how
+// often they change at the source, like feed readers adapt their polling.
+// Entries start with the TTL of their rule, kept between the floor and the
+// cap. Expired ones with validators get revalidated: each time they're
+// found unchanged their TTL gets multiplied by the growth factor, up to the
+// cap, and once found changed it gets back to the floor. The TTL and the
+// history of each entry persist in its metadata.
+func WithAdaptiveTTL(a AdaptiveTTL) Option {
+	return func(c *PicoCache) {
+		c.adaptiveTTL = &a
+	}
+}
+
+// adaptiveState is the revalidation history of an entry, see
+// WithAdaptiveTTL.
+type adaptiveState struct {
+	ttl       time.Duration // zero unless adapted
+	unchanged int           // revalidations in a row finding it unchanged
+	changed   time.Time     // wall clock time it last was found changed, if ever
+}
+
+func (a *AdaptiveTTL) clamp(ttl time.Duration) time.Duration {
+	return min(max(ttl, a.Floor), a.Cap)
+}
+
+// filled returns the state of an entry of rule just filled, found changed
+// at the source at now or filled for the first time.
+func (a *AdaptiveTTL) filled(rule *Rule, changed bool, now time.Time) adaptiveState {
+	if changed {
+		return adaptiveState{ttl: a.Floor, changed: now}
+	}
+	return adaptiveState{ttl: a.clamp(rule.TTL)}
+}
+
+// unchanged returns the state of an entry of rule in state s, just found
+// unchanged at the source.
+func (a *AdaptiveTTL) unchanged(rule *Rule, s adaptiveState) adaptiveState {
+	ttl := s.ttl
+	if ttl == 0 {
+		ttl = a.clamp(rule.TTL)
+	}
+	return adaptiveState{
+		ttl:       a.clamp(time.Duration(float64(ttl) * a.Growth)),
+		unchanged: s.unchanged + 1,
+		changed:   s.changed,
+	}
+}
+
+// store records s in the metadata of its entry.
+func (s adaptiveState) store(meta *entryMeta) {
+	meta.AdaptiveTTL, meta.Unchanged, meta.Changed = int64(s.ttl/time.Second), s.unchanged, 0
+	if !s.changed.IsZero() {
+		meta.Changed = s.changed.Unix()
+	}
+}
+
+// loadAdaptiveState returns the state recorded in the metadata of an entry.
+func loadAdaptiveState(meta *entryMeta) adaptiveState {
+	s := adaptiveState{ttl: time.Duration(meta.AdaptiveTTL) * time.Second, unchanged: meta.Unchanged}
+	if meta.Changed != 0 {
+		s.changed = time.Unix(meta.Changed, 0)
+	}
+	return s
+}
@@ -0,0 +1,120 @@
+package picocache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseAdaptiveTTL(t *testing.T) {
+	if a, err := ParseAdaptiveTTL("5m, 24h, 1.5"); err != nil || a != (AdaptiveTTL{5 * time.Minute, 24 * time.Hour, 1.5}) {
+		t.Errorf("unexpected %+v, %v", a, err)
+	}
+	for _, s := range []string{"", "5m,24h", "1h,5m,2", "5m,24h,0.5", "0s,1h,2", "5m,1d,2"} {
+		if _, err := ParseAdaptiveTTL(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	var version atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"stable"`
+		if r.URL.Path == "/churn.txt" {
+			etag = `"` + strconv.FormatInt(version.Add(1), 10) + `"`
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(r.URL.Path)))
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	rules, _ := ParseRules(".txt ttl=10m")
+	dir := t.TempDir()
+	open := func() *PicoCache {
+		cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithRules(rules...),
+			WithAdaptiveTTL(AdaptiveTTL{Floor: time.Minute, Cap: time.Hour, Growth: 2}), WithAdminToken("s3cret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		return cache
+	}
+	cache := open()
+	ttl := func(path string) time.Duration {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/__picocache/inspect?path="+path, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		cache.ServeHTTP(w, r)
+		var d EntryDetails
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatalf("%s: unexpected response %d %s", path, w.Code, w.Body.String())
+		}
+		return time.Duration(d.TTL) * time.Second
+	}
+	// get requests path once it expired, checking how it got served and
+	// the TTL it got
+	get := func(path, cacheStatus string, expected time.Duration) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Cache"); got != cacheStatus || w.Body.String() != path {
+			t.Fatalf("%s: expected %s, got %s %q", path, cacheStatus, got, w.Body.String())
+		}
+		if got := ttl(path); got != expected {
+			t.Fatalf("%s: expected a TTL of %s, got %s", path, expected, got)
+		}
+		mu.Lock()
+		now = now.Add(expected + time.Second)
+		mu.Unlock()
+	}
+
+	// Stable objects get revalidated less and less often
+	get("/stable.txt", "MISS", 10*time.Minute)
+	get("/stable.txt", "REVALIDATED", 20*time.Minute)
+	get("/stable.txt", "REVALIDATED", 40*time.Minute)
+	get("/stable.txt", "REVALIDATED", time.Hour)
+	get("/stable.txt", "REVALIDATED", time.Hour)
+
+	// Churning ones drop to the floor
+	get("/churn.txt", "MISS", 10*time.Minute)
+	get("/churn.txt", "MISS", time.Minute)
+	get("/churn.txt", "MISS", time.Minute)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/__picocache/inspect?path=/stable.txt", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	cache.ServeHTTP(w, r)
+	var d EntryDetails
+	json.Unmarshal(w.Body.Bytes(), &d)
+	if d.Unchanged != 4 || d.Changed != nil {
+		t.Errorf("expected 4 revalidations in a row and no change, got %d and %v", d.Unchanged, d.Changed)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// The history survives restarts
+	cache = open()
+	defer cache.Close()
+	if got := ttl("/stable.txt"); got != time.Hour {
+		t.Errorf("expected the stable TTL kept, got %s", got)
+	}
+	if got := ttl("/churn.txt"); got != time.Minute {
+		t.Errorf("expected the churning TTL kept, got %s", got)
+	}
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,79 @@
+package picocache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const adminPrefix = "/__picocache/"
+
+// serveAdmin handles the internal endpoints living under adminPrefix.
+func (c *PicoCache) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case adminPrefix + "health":
+		c.serveHealth(w)
+	case adminPrefix + "stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Stats())
+	case adminPrefix + "purge":
+		c.servePurge(w, r)
+	case adminPrefix + "resize":
+		c.serveResize(w, r)
+	case adminPrefix + "selftest":
+		c.serveSelfTest(w, r)
+	case adminPrefix + "top":
+		c.serveTop(w, r)
+	case adminPrefix + "exists":
+		c.serveExists(w, r)
+	case adminPrefix + "inspect":
+		c.serveInspect(w, r)
+	case adminPrefix + "verify":
+		c.serveVerify(w, r)
+	case adminPrefix + "reload-manifest":
+		c.serveReloadManifest(w, r)
+	case adminPrefix + "refresh":
+		c.serveRefresh(w, r)
+	case adminPrefix + "refresh-metadata":
+		c.serveRefreshMetadata(w, r)
+	case adminPrefix + "readonly":
+		c.serveFreeze(w, r)
+	case adminPrefix + "drain":
+		c.serveDrain(w, r)
+	case adminPrefix + "metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.WritePrometheus(w)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type health struct {
+	Status      string        `json:"status"`
+	ReadOnly    bool          `json:"read_only"`
+	Frozen      bool          `json:"frozen"`
+	OfflineDirs []string      `json:"offline_dirs,omitempty"` // see WithCacheDirs
+	Origin      *OriginHealth `json:"origin,omitempty"`
+}
+
+func (c *PicoCache) serveHealth(w http.ResponseWriter) {
+	h := health{Status: "ok", ReadOnly: c.readOnly.Load(), Frozen: c.frozen.Load(), OfflineDirs: c.offlineDirs()}
+	if c.probe != nil {
+		h.Origin = c.probe.health()
+	}
+	status := http.StatusOK
+	switch {
+	case c.draining():
+		// Load balancers stop sending traffic
+		h.Status, status = c.DrainState(), http.StatusServiceUnavailable
+	case h.ReadOnly, len(h.OfflineDirs) > 0:
+		h.Status = "degraded"
+	case h.Frozen:
+		h.Status = "frozen"
+	case h.Origin != nil && !h.Origin.Up:
+		h.Status = "origin-down"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
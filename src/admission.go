@@ -0,0 +1,82 @@
+package picocache
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const defaultAdmissionWindow = time.Hour
+const defaultAdmissionCapacity = 100_000
+
+// admission tracks how often uncached keys get requested, so only keys seen
+// admitAfter times within a window get written to the cache. Counts live in
+// two generations rotated every window (or as soon as the current one is
+// full), which bounds memory and makes old sightings decay.
+type admission struct {
+	admitAfter int
+	window     time.Duration
+	capacity   int
+
+	mu       sync.Mutex
+	seed     maphash.Seed
+	current  map[uint64]uint8
+	previous map[uint64]uint8
+	rotated  time.Time
+}
+
+func newAdmission(admitAfter int, window time.Duration, capacity int) *admission {
+	return &admission{
+		admitAfter: admitAfter,
+		window:     window,
+		capacity:   capacity,
+		seed:       maphash.MakeSeed(),
+		current:    map[uint64]uint8{},
+		previous:   map[uint64]uint8{},
+	}
+}
+
+// admit records a request for key and reports whether it should be cached.
+func (a *admission) admit(key string, now time.Time) bool {
+	h := maphash.String(a.seed, key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.rotated) >= a.window || len(a.current) >= a.capacity {
+		a.previous = a.current
+		a.current = make(map[uint64]uint8, len(a.previous))
+		a.rotated = now
+	}
+
+	count := a.current[h]
+	if count < 255 {
+		count++
+		a.current[h] = count
+	}
+
+	if int(count)+int(a.previous[h]) < a.admitAfter {
+		return false
+	}
+
+	// Admitted keys get cached, no need to keep tracking them
+	delete(a.current, h)
+	delete(a.previous, h)
+	return true
+}
+
+// WithAdmitAfter only caches a path once it was requested n times within
+// window, earlier requests being streamed from the source uncached. A zero
+// window defaults to an hour.
+func WithAdmitAfter(n int, window time.Duration) Option {
+	return func(c *PicoCache) {
+		if n <= 1 {
+			c.admission = nil
+			return
+		}
+		if window <= 0 {
+			window = defaultAdmissionWindow
+		}
+		c.admission = newAdmission(n, window, defaultAdmissionCapacity)
+	}
+}
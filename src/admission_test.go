@@ -0,0 +1,83 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionDecay(t *testing.T) {
+	a := newAdmission(2, time.Minute, defaultAdmissionCapacity)
+	now := time.Now()
+
+	if a.admit("/a", now) {
+		t.Fatal("first request admitted")
+	}
+	// Still counted from the previous generation
+	if !a.admit("/a", now.Add(90*time.Second)) {
+		t.Fatal("second request within the window not admitted")
+	}
+
+	a = newAdmission(2, time.Minute, defaultAdmissionCapacity)
+	if a.admit("/b", now) {
+		t.Fatal("first request admitted")
+	}
+	// Two rotations later the first sighting is forgotten
+	a.admit("/c", now.Add(time.Minute))
+	if a.admit("/b", now.Add(2*time.Minute)) {
+		t.Fatal("sighting didn't decay")
+	}
+}
+
+func TestAdmissionBounded(t *testing.T) {
+	a := newAdmission(2, time.Hour, 10)
+	now := time.Now()
+
+	for i := range 1000 {
+		a.admit(string(rune(i)), now)
+		if len(a.current) > 10 || len(a.previous) > 10 {
+			t.Fatalf("tracker grew past its capacity: %d+%d", len(a.current), len(a.previous))
+		}
+	}
+}
+
+func TestAdmitAfter(t *testing.T) {
+	var fetches int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithAdmitAfter(3, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"BYPASS-ADMISSION", "BYPASS-ADMISSION", "MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hot", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+			t.Fatalf("request %d: unexpected response %d %q", i, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("request %d: expected %s, got %s", i, expected, got)
+		}
+
+		files := entryFiles(t, dir)
+		if cached := len(files) > 0; cached != (i >= 2) {
+			t.Fatalf("request %d: cached=%v", i, cached)
+		}
+	}
+
+	if fetches != 3 {
+		t.Fatalf("expected 3 fetches, got %d", fetches)
+	}
+	if s := cache.Stats(); s.AdmissionRejections != 2 {
+		t.Fatalf("expected 2 admission rejections, got %d", s.AdmissionRejections)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
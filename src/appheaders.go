@@ -0,0 +1,58 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// maxAppHeaderValue caps the values of application headers stored along
+// with entries, see WithPassthroughHeaders.
+const maxAppHeaderValue = 1 << 10
+
+// WithPassthroughHeaders stores the headers named of source responses along
+// with their entries, replaying them verbatim on hits, HEAD requests and
+// 304s, e.g. versions or checksums the application sets. Revalidations and
+// metadata refreshes update those the source sends again. Values over 1KB
+// are truncated.
+func WithPassthroughHeaders(names ...string) Option {
+	return func(c *PicoCache) {
+		c.appHeaders = nil
+		for _, name := range names {
+			c.appHeaders = append(c.appHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// storeAppHeaders returns stored with the application headers header has
+// replacing theirs, nil if there are none.
+func (c *PicoCache) storeAppHeaders(stored, header http.Header) http.Header {
+	var headers http.Header
+	for _, name := range c.appHeaders {
+		values := header.Values(name)
+		if len(values) == 0 {
+			values = stored.Values(name)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if headers == nil {
+			headers = http.Header{}
+		}
+		for _, v := range values {
+			if len(v) > maxAppHeaderValue {
+				c.log.Warn("Truncating an application header", slog.String("header", name), slog.Int("bytes", len(v)))
+				v = v[:maxAppHeaderValue]
+			}
+			headers.Add(name, v)
+		}
+	}
+	return headers
+}
+
+// sendAppHeaders sets the application headers stored with entry on header.
+func sendAppHeaders(header http.Header, entry *cacheEntry) {
+	for name, values := range entry.headers {
+		header[name] = slices.Clone(values)
+	}
+}
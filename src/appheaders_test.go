@@ -0,0 +1,54 @@
+package picocache_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+)
+
+func TestPassthroughHeaders(t *testing.T) {
+	origin := NewFakeOrigin(t)
+	checksum := strings.Repeat("c", 2000)
+	origin.Handle("/a", OriginResponse{Body: "a", Header: http.Header{
+		"X-Render-Version": {"7"},
+		"X-Asset-Checksum": {checksum},
+		"X-Other":          {"not kept"},
+	}})
+	cache := NewTestCache(t, origin, 1<<20, picocache.WithPassthroughHeaders("x-render-version", "X-Asset-Checksum"))
+	expect := func(method string, header http.Header, code int) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "/a", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		if w.Code != code || w.Header().Get("X-Render-Version") != "7" || w.Header().Get("X-Asset-Checksum") != checksum[:1024] || w.Header().Get("X-Other") != "" {
+			t.Fatalf("%s: expected %d with the application headers, got %d %v", method, code, w.Code, w.Header())
+		}
+		return w
+	}
+
+	etag := expect(http.MethodGet, nil, http.StatusOK).Header().Get("ETag")
+	expect(http.MethodGet, nil, http.StatusOK)
+	expect(http.MethodHead, nil, http.StatusOK)
+	expect(http.MethodGet, http.Header{"If-None-Match": {etag}}, http.StatusNotModified)
+
+	// They're kept along with the entry
+	cache.Reopen()
+	if w := expect(http.MethodGet, nil, http.StatusOK); w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected a hit after restarting, got %s", w.Header().Get("X-Cache"))
+	}
+	expect(http.MethodGet, http.Header{"If-None-Match": {etag}}, http.StatusNotModified)
+	cache.Range(func(d picocache.EntryDetails) bool {
+		if d.Headers.Get("X-Render-Version") != "7" || len(d.Headers.Get("X-Asset-Checksum")) != 1024 || len(d.Headers) != 2 {
+			t.Fatalf("unexpected headers inspected %v", d.Headers)
+		}
+		return true
+	})
+	if n := origin.Requests("/a"); n != 1 {
+		t.Fatalf("expected a single fill, got %d requests", n)
+	}
+}
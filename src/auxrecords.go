@@ -0,0 +1,175 @@
+package picocache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMaxAuxEntries = 4096
+
+// auxSweepEvery is how often expired auxiliary records get swept.
+const auxSweepEvery = time.Minute
+
+// WithMaxAuxEntries caps the auxiliary records, held apart from body
+// entries, at n of each kind: negative entries, of source responses with an
+// error status such as cached 404s and 410s, and what HEAD requests to the
+// source learned, see WithHeadMetadata. Past n, the least recently used go
+// first. Negative entries don't count towards the max cache size, so that a
+// flood of probes for missing objects can't evict real content, nor does
+// evicting bodies ever pick them. Expired ones get swept every minute, within
+// maintenance windows. It defaults to 4096.
+func WithMaxAuxEntries(n int) Option {
+	return func(c *PicoCache) {
+		c.aux.max = n
+	}
+}
+
+// negative tells whether entry holds an error response of the source,
+// an auxiliary record.
+func (e *cacheEntry) negative() bool {
+	return e.status >= 400
+}
+
+// auxEntries are the negative entries held, by recency.
+type auxEntries struct {
+	max int
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	elems   map[*cacheEntry]*list.Element
+	evicted atomic.Int64 // over max
+	expired atomic.Int64 // swept
+}
+
+func (a *auxEntries) add(entry *cacheEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.elems[entry] = a.order.PushFront(entry)
+}
+
+func (a *auxEntries) remove(entry *cacheEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.elems[entry]; ok {
+		a.order.Remove(e)
+		delete(a.elems, entry)
+	}
+}
+
+// touch records entry being served.
+func (a *auxEntries) touch(entry *cacheEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.elems[entry]; ok {
+		a.order.MoveToFront(e)
+	}
+}
+
+func (a *auxEntries) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.elems)
+}
+
+// over returns the least recently used entries past max.
+func (a *auxEntries) over() []*cacheEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var victims []*cacheEntry
+	for e := a.order.Back(); e != nil && len(a.elems)-len(victims) > a.max; e = e.Prev() {
+		victims = append(victims, e.Value.(*cacheEntry))
+	}
+	return victims
+}
+
+// expiredBy returns the entries expired by now.
+func (a *auxEntries) expiredBy(now time.Time) []*cacheEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var expired []*cacheEntry
+	for entry := range a.elems {
+		if entry.expired(now) {
+			expired = append(expired, entry)
+		}
+	}
+	return expired
+}
+
+// dropAux removes the negative entry, unless it got replaced meanwhile,
+// reporting whether it did.
+func (c *PicoCache) dropAux(entry *cacheEntry) bool {
+	unlock := c.lockFile(entry.filename)
+	if !c.entries.CompareAndDelete(entry.filename, entry) {
+		unlock()
+		return false
+	}
+	entry.sealed.Store(false)
+	removeFiles(entry)
+	unlock()
+	c.unaccount(entry)
+	return true
+}
+
+// trimAux evicts negative entries down to the cap, least recently used
+// first.
+func (c *PicoCache) trimAux() {
+	if c.frozen.Load() {
+		return
+	}
+	for _, entry := range c.aux.over() {
+		if c.dropAux(entry) {
+			c.aux.evicted.Add(1)
+		}
+	}
+}
+
+// sweepAux drops the expired auxiliary records, returning how many.
+func (c *PicoCache) sweepAux() int {
+	if c.frozen.Load() {
+		return 0
+	}
+	swept := 0
+	for _, entry := range c.aux.expiredBy(c.steadyNow()) {
+		if c.dropAux(entry) {
+			c.aux.expired.Add(1)
+			swept++
+		}
+	}
+	if c.heads != nil {
+		swept += c.heads.sweep(c.now())
+	}
+	return swept
+}
+
+// AuxStats counts the auxiliary records, held apart from body entries, see
+// WithMaxAuxEntries.
+type AuxStats struct {
+	Max             int   `json:"max"`              // of each kind
+	Negative        int   `json:"negative"`         // entries of error responses held, left out of entries and sizes
+	NegativeEvicted int64 `json:"negative_evicted"` // over the cap
+	NegativeExpired int64 `json:"negative_expired"` // swept once expired
+	Head            int   `json:"head"`             // what HEAD requests learned, see WithHeadMetadata
+	HeadEvicted     int64 `json:"head_evicted"`
+	HeadExpired     int64 `json:"head_expired"`
+}
+
+func (c *PicoCache) auxStats() AuxStats {
+	s := AuxStats{
+		Max:             c.aux.max,
+		Negative:        c.aux.len(),
+		NegativeEvicted: c.aux.evicted.Load(),
+		NegativeExpired: c.aux.expired.Load(),
+	}
+	if c.heads != nil {
+		s.Head, s.HeadEvicted, s.HeadExpired = c.heads.counts()
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuxEntries(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/body") {
+			w.Write([]byte("0123456789"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}))
+	defer origin.Close()
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 30, WithBlockSize(1),
+		WithCacheableStatus([]int{http.StatusNotFound}), WithMaxAuxEntries(3), WithHeadMetadata(time.Minute),
+		WithRules(Rule{Prefix: "/gone", TTL: time.Minute}), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/body/a", "/body/b"} {
+		if w := serve(http.MethodGet, path); w.Code != http.StatusOK {
+			t.Fatalf("expected %s filled, got %d", path, w.Code)
+		}
+	}
+	cache.cleanupOldEntries()
+
+	// A flood of probes for missing objects, one of which keeps being hit
+	for i := range 20 {
+		if w := serve(http.MethodGet, fmt.Sprintf("/missing/%d", i)); w.Code != http.StatusNotFound {
+			t.Fatalf("expected a 404, got %d", w.Code)
+		}
+		if w := serve(http.MethodGet, "/missing/0"); w.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("expected the hot 404 held, got %s", w.Header().Get("X-Cache"))
+		}
+	}
+	cache.cleanupOldEntries()
+
+	s := cache.Stats()
+	if s.Aux.Negative != 3 || s.Aux.NegativeEvicted != 17 || s.Entries != 2 || s.TotalSize != 20 {
+		t.Fatalf("expected 3 negative entries past 17 evicted, along with the 2 bodies, got %+v, %d entries of %d bytes", s.Aux, s.Entries, s.TotalSize)
+	}
+	for _, path := range []string{"/body/a", "/body/b", "/missing/0", "/missing/19"} {
+		if w := serve(http.MethodGet, path); w.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("expected %s held, got %s", path, w.Header().Get("X-Cache"))
+		}
+	}
+
+	// Body pressure doesn't evict negative entries
+	serve(http.MethodGet, "/body/c")
+	serve(http.MethodGet, "/body/d")
+	cache.cleanupOldEntries()
+	cache.evictTask.mu.Lock()
+	cache.evictTask.mu.Unlock()
+	if s := cache.Stats(); s.Aux.Negative != 3 || s.TotalSize > 30 {
+		t.Fatalf("expected eviction to leave negative entries alone, got %+v, %d bytes", s.Aux, s.TotalSize)
+	}
+
+	// Expired ones get swept
+	serve(http.MethodGet, "/gone")
+	serve(http.MethodHead, "/head")
+	now = now.Add(2 * time.Minute)
+	cache.maintain()
+	s = cache.Stats()
+	if s.Aux.Negative != 2 || s.Aux.NegativeExpired != 1 || s.Aux.Head != 0 || s.Aux.HeadExpired != 1 {
+		t.Fatalf("expected the expired records swept, got %+v", s.Aux)
+	}
+	if _, ok := cache.entries.Load(cache.getCacheFilename("/gone")); ok {
+		t.Fatal("expected the expired negative entry out of the index")
+	}
+
+	// The cap holds over restarts
+	cache.Close()
+	reopened, err := NewCache(slog.Default(), origin.URL, cache.cacheDir, 30, WithBlockSize(1),
+		WithCacheableStatus([]int{http.StatusNotFound}), WithMaxAuxEntries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if s := reopened.Stats(); s.Aux.Negative != 1 || s.Entries != 2 {
+		t.Fatalf("expected the rebuilt negative entries capped, got %+v, %d entries", s.Aux, s.Entries)
+	}
+}
@@ -0,0 +1,62 @@
+package picocache
+
+// WithBlockSize overrides the filesystem block size entries are rounded up
+// to when accounting for the disk space they use. One disables the rounding.
+func WithBlockSize(size int64) Option {
+	return func(c *PicoCache) {
+		c.blockSize = size
+	}
+}
+
+// roundToBlock returns the disk space used by a file of the given size.
+func (c *PicoCache) roundToBlock(size int64) int64 {
+	if c.blockSize <= 1 {
+		return size
+	}
+	return (size + c.blockSize - 1) / c.blockSize * c.blockSize
+}
+
+// account adds entry to the cache size totals, returning the new physical
+// size. Bodies shared by several entries only take space once, negative
+// entries none, see WithMaxAuxEntries.
+func (c *PicoCache) account(entry *cacheEntry) int64 {
+	if c.paths != nil {
+		c.paths.add(entry)
+	}
+	if entry.negative() {
+		c.aux.add(entry)
+		return c.totalSize.Load()
+	}
+	c.stats.sizes[sizeBucket(entry.size)].Add(1)
+	c.logicalSize.Add(entry.size)
+	if entry.hash != "" && !c.ref(entry) {
+		return c.totalSize.Load()
+	}
+	if d := c.dirOf(entry.filename); d != nil {
+		d.size.Add(entry.diskSize)
+	}
+	return c.totalSize.Add(entry.diskSize)
+}
+
+// unaccount removes entry from the cache size totals, returning the disk
+// space it freed.
+func (c *PicoCache) unaccount(entry *cacheEntry) int64 {
+	if c.paths != nil {
+		c.paths.remove(entry)
+	}
+	c.served(entry) // its failures don't matter anymore
+	if entry.negative() {
+		c.aux.remove(entry)
+		return 0
+	}
+	c.stats.sizes[sizeBucket(entry.size)].Add(-1)
+	c.logicalSize.Add(-entry.size)
+	if entry.hash != "" && !c.unref(entry) {
+		return 0
+	}
+	if d := c.dirOf(entry.filename); d != nil {
+		d.size.Add(-entry.diskSize)
+	}
+	c.totalSize.Add(-entry.diskSize)
+	return entry.diskSize
+}
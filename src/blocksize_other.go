@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package picocache
+
+// fsBlockSize returns 1, the block size can't be determined on this platform.
+func fsBlockSize(dir string) int64 {
+	return 1
+}
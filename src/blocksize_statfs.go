@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package picocache
+
+import "syscall"
+
+// fsBlockSize returns the block size of the filesystem holding dir, or 1
+// when it can't be determined.
+func fsBlockSize(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil || st.Bsize <= 0 {
+		return 1
+	}
+	return int64(st.Bsize)
+}
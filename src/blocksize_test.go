@@ -0,0 +1,67 @@
+package picocache_test
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	picocache "picocache/src"
+	"testing"
+	"time"
+)
+
+func TestBlockSizeAccounting(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	// Ten 10 bytes files would fit 100 times in the logical budget, but each
+	// takes a whole 4KB block
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, dir, 4*4096, picocache.WithBlockSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 10 {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tiny/%d", i), nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" {
+			t.Fatalf("unexpected response %d, length %s", w.Code, w.Header().Get("Content-Length"))
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Stats().TotalSize > 4*4096 {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache never shrunk to its physical budget: %+v", cache.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s := cache.Stats()
+	if s.Entries >= 10 || s.TotalSize != s.Entries*4096 || s.LogicalSize != s.Entries*10 {
+		t.Fatalf("inconsistent accounting: %+v", s)
+	}
+}
+
+func TestBlockSizeRebuild(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 3 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte("tiny"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := picocache.NewCache(slog.Default(), "http://unused", dir, 1<<20, picocache.WithBlockSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := cache.Stats(); s.TotalSize != 3*4096 || s.LogicalSize != 3*4 {
+		t.Fatalf("rebuild didn't round to the block size: %+v", s)
+	}
+}
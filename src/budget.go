@@ -0,0 +1,204 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// ByteBudget is how many body bytes may be pulled from the source per
+// period, see WithOriginByteBudget.
+type ByteBudget struct {
+	Bytes int64
+	Per   time.Duration
+}
+
+// ParseByteBudget parses a size per period such as 10GB/hour, the period
+// being a second, minute, hour, day or a Go duration.
+func ParseByteBudget(s string) (ByteBudget, error) {
+	size, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return ByteBudget{}, fmt.Errorf("invalid budget %q, expected a size per period such as 10GB/hour", s)
+	}
+	bytes, err := units.FromHumanSize(strings.TrimSpace(size))
+	if err != nil || bytes <= 0 {
+		return ByteBudget{}, fmt.Errorf("invalid budget size %q", size)
+	}
+	per, err := parsePeriod(period)
+	if err != nil {
+		return ByteBudget{}, fmt.Errorf("invalid budget period %q", period)
+	}
+	return ByteBudget{Bytes: bytes, Per: per}, nil
+}
+
+// parsePeriod parses a second, minute, hour, day or a Go duration.
+func parsePeriod(s string) (time.Duration, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "second", "s":
+		return time.Second, nil
+	case "minute", "min", "m":
+		return time.Minute, nil
+	case "hour", "h":
+		return time.Hour, nil
+	case "day", "d":
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("not positive")
+	}
+	return d, err
+}
+
+// WithOriginByteBudget caps the body bytes fills and pass-throughs pull from
+// the source, as a bucket of budget.Bytes refilling over budget.Per. Misses
+// are answered 503 once it's empty, expired entries served stale rather
+// than fetched again, while revalidations, costing no body, go on. Bodies
+// of unknown length may overdraw it.
+func WithOriginByteBudget(budget ByteBudget) Option {
+	return func(c *PicoCache) {
+		c.budget = &byteBudget{ByteBudget: budget, tokens: float64(budget.Bytes)}
+	}
+}
+
+var errBudgetExhausted = errors.New("origin byte budget exhausted")
+
+// byteBudget is a token bucket in bytes.
+type byteBudget struct {
+	ByteBudget
+
+	mu      sync.Mutex
+	tokens  float64 // may go negative
+	last    time.Time
+	refused int64
+}
+
+// refill adds the tokens earned since the last call, holding mu.
+func (b *byteBudget) refill(now time.Time) {
+	if !b.last.IsZero() {
+		earned := now.Sub(b.last).Seconds() * float64(b.Bytes) / b.Per.Seconds()
+		b.tokens = min(b.tokens+max(earned, 0), float64(b.Bytes))
+	}
+	b.last = now
+}
+
+// allows tells whether n more bytes, or any when n is unknown, fit in the
+// budget, counting a refusal otherwise.
+func (b *byteBudget) allows(n int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens > 0 && (n < 0 || float64(n) <= b.tokens) {
+		return true
+	}
+	b.refused++
+	return false
+}
+
+func (b *byteBudget) spend(n int64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// draw spends n bytes unless the budget is empty, reporting whether it did.
+func (b *byteBudget) draw(n int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// wait returns how long until the budget isn't empty anymore.
+func (b *byteBudget) wait(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.until(1)
+}
+
+// until returns how long until the budget holds tokens, holding mu.
+func (b *byteBudget) until(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.tokens) / float64(b.Bytes) * float64(b.Per))
+}
+
+// OriginBudgetStats is the state of the origin byte budget, or of the fill
+// byte budget.
+type OriginBudgetStats struct {
+	Bytes     int64         `json:"bytes"` // per period
+	Per       time.Duration `json:"per"`
+	Available int64         `json:"available"` // negative when overdrawn
+	Exhausted bool          `json:"exhausted"`
+	RefillIn  time.Duration `json:"refill_in"` // until full again
+	Refused   int64         `json:"refused"`   // misses turned away or served stale, or not cached for the fill byte budget
+}
+
+func (b *byteBudget) stats(now time.Time) *OriginBudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return &OriginBudgetStats{
+		Bytes:     b.Bytes,
+		Per:       b.Per,
+		Available: int64(b.tokens),
+		Exhausted: b.tokens <= 0,
+		RefillIn:  b.until(float64(b.Bytes)),
+		Refused:   b.refused,
+	}
+}
+
+// budgetReader spends the budget on the bytes read through it, as they
+// stream.
+type budgetReader struct {
+	io.Reader
+	c *PicoCache
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.c.budget.spend(int64(n), r.c.steadyNow())
+	}
+	return n, err
+}
+
+// budgeted returns body, spending the origin byte budget if any.
+func (c *PicoCache) budgeted(body io.Reader) io.Reader {
+	if c.budget == nil {
+		return body
+	}
+	return &budgetReader{Reader: body, c: c}
+}
+
+// overBudget tells whether a body of length bytes, -1 when unknown, can't
+// be pulled from the source within the budget.
+func (c *PicoCache) overBudget(length int64) bool {
+	return c.budget != nil && !c.budget.allows(length, c.steadyNow())
+}
+
+// refuseOverBudget answers a miss with a 503 until the budget refills.
+func (c *PicoCache) refuseOverBudget(w http.ResponseWriter, t *timings) {
+	t.outcome = OutcomeBudget
+	w.Header().Set("Retry-After", strconv.Itoa(int(c.budget.wait(c.steadyNow()).Seconds())+1))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
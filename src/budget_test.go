@@ -0,0 +1,124 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOriginByteBudget(t *testing.T) {
+	var mu sync.Mutex
+	gets := 0
+	bodies := map[string]string{"/a.txt": "aaaaaaaaaa", "/b.txt": "bbbbbbbbbbbbbbb", "/c": "cc", "/e": "e1"}
+	etags := map[string]string{"/a.txt": `"a"`, "/e": `"e1"`}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		body, etag := bodies[r.URL.Path], etags[r.URL.Path]
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		mu.Unlock()
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if r.URL.Path == "/b.txt" {
+			// Chunked, overdrawing the budget
+			w.Write([]byte(body[:1]))
+			w.(http.Flusher).Flush()
+			body = body[1:]
+		}
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+	fetched := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets
+	}
+
+	budget, err := ParseByteBudget("20B/hour")
+	if err != nil || budget != (ByteBudget{Bytes: 20, Per: time.Hour}) {
+		t.Fatalf("unexpected budget %+v %v", budget, err)
+	}
+	if _, err := ParseByteBudget("20B"); err == nil {
+		t.Fatal("expected a budget without period refused")
+	}
+	rules, err := ParseRules(".txt ttl=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithRules(rules...), WithOriginByteBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	get := func(cache *PicoCache, path string, code int, cacheStatus, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || w.Header().Get("X-Cache") != cacheStatus || !strings.HasPrefix(w.Body.String(), body) {
+			t.Fatalf("%s: expected %d %s %q, got %d %s %q", path, code, cacheStatus, body, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+		return w
+	}
+
+	get(cache, "/a.txt", http.StatusOK, "MISS", "aaaaaaaaaa")
+	get(cache, "/b.txt", http.StatusOK, "MISS", "bbbbbbbbbbbbbbb")
+	w := get(cache, "/c", http.StatusServiceUnavailable, "BUDGET", "")
+	if w.Header().Get("Retry-After") != "1081" {
+		t.Errorf("expected the time until a byte is earned back, got %s", w.Header().Get("Retry-After"))
+	}
+	s := cache.Stats().OriginBudget
+	if s == nil || !s.Exhausted || s.Available != -5 || s.Refused != 1 || s.RefillIn.Round(time.Second) != 75*time.Minute {
+		t.Fatalf("unexpected budget stats %+v", s)
+	}
+
+	// Expired entries are revalidated when they can be, served stale otherwise
+	now = now.Add(2 * time.Second)
+	before := fetched()
+	get(cache, "/a.txt", http.StatusOK, "REVALIDATED", "aaaaaaaaaa")
+	get(cache, "/a.txt", http.StatusOK, "HIT", "aaaaaaaaaa")
+	get(cache, "/b.txt", http.StatusOK, "STALE", "bbbbbbbbbbbbbbb")
+	if n := fetched() - before; n != 0 {
+		t.Errorf("expected no body pulled from the source, got %d", n)
+	}
+	if s := cache.Stats(); s.Revalidated != 1 || s.OriginBudget.Refused != 2 {
+		t.Errorf("unexpected stats %+v %+v", s, s.OriginBudget)
+	}
+
+	now = now.Add(time.Hour)
+	get(cache, "/c", http.StatusOK, "MISS", "cc")
+	get(cache, "/e", http.StatusOK, "MISS", "e1")
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// Entries found on startup are revalidated once
+	mu.Lock()
+	bodies["/e"], etags["/e"] = "e2", `"e2"`
+	mu.Unlock()
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithStartupRevalidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	before = fetched()
+	get(cache, "/a.txt", http.StatusOK, "REVALIDATED", "aaaaaaaaaa")
+	get(cache, "/a.txt", http.StatusOK, "HIT", "aaaaaaaaaa")
+	get(cache, "/c", http.StatusOK, "HIT", "cc")
+	if n := fetched() - before; n != 0 {
+		t.Errorf("expected unchanged entries kept, got %d fetches", n)
+	}
+	get(cache, "/e", http.StatusOK, "MISS", "e2")
+	get(cache, "/e", http.StatusOK, "HIT", "e2")
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,70 @@
+package picocache
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// clockStepThreshold is how far back the wall clock has to step, e.g. on an
+// NTP correction, to get logged.
+const clockStepThreshold = time.Second
+
+// steadyClock turns wall clock readings into a timeline which never goes
+// backwards, which recency and expiry are tracked on. Readings carrying a
+// monotonic clock reading, like those of time.Now, advance it by the
+// monotonic time elapsed, others by the wall time, clamped at zero: steps of
+// the wall clock are taken out. Times get back to the wall clock, to be
+// persisted, by the steps taken out so far.
+type steadyClock struct {
+	mu   sync.Mutex
+	last time.Time     // wall clock reading, zero before the first one
+	now  time.Time     // on the timeline
+	skew time.Duration // wall clock ahead of the timeline by
+}
+
+// steadyNow returns the current time on the timeline entries are tracked
+// on, see steadyClock.
+func (c *PicoCache) steadyNow() time.Time {
+	c.clock.mu.Lock()
+	defer c.clock.mu.Unlock()
+
+	wall := c.now()
+	if c.clock.last.IsZero() {
+		c.clock.last, c.clock.now = wall, wall.Round(0)
+		return c.clock.now
+	}
+	elapsed := max(wall.Sub(c.clock.last), 0)
+	if stepped := wall.Round(0).Sub(c.clock.last.Round(0)) - elapsed; stepped < -clockStepThreshold {
+		c.stats.clockSteps.Add(1)
+		c.log.Warn("Wall clock stepped backwards", slog.Duration("step", -stepped))
+	}
+	c.clock.last = wall
+	c.clock.now = c.clock.now.Add(elapsed)
+	c.clock.skew = wall.Round(0).Sub(c.clock.now)
+	return c.clock.now
+}
+
+// toWall returns the wall clock time of t, on the timeline.
+func (c *PicoCache) toWall(t time.Time) time.Time {
+	c.clock.mu.Lock()
+	defer c.clock.mu.Unlock()
+	return t.Add(c.clock.skew)
+}
+
+// fromWall returns the time on the timeline of the wall clock time t,
+// re-anchoring persisted times on load.
+func (c *PicoCache) fromWall(t time.Time) time.Time {
+	c.clock.mu.Lock()
+	defer c.clock.mu.Unlock()
+	return t.Add(-c.clock.skew)
+}
+
+// WithClock replaces the wall clock, time.Now by default, which expiry,
+// recency and request timings are read from. Tests use it to move time
+// along at will.
+func WithClock(now func() time.Time) Option {
+	return func(c *PicoCache) {
+		c.now = now
+	}
+}
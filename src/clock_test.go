@@ -0,0 +1,89 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClockSteps(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	rules, err := ParseRules(".txt ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &recordingHandler{}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	open := func() *PicoCache {
+		cache, err := NewCache(slog.New(h), origin.URL, dir, 1<<20, WithBlockSize(1), WithRules(rules...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.now = func() time.Time { return now }
+		return cache
+	}
+	get := func(cache *PicoCache, path, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+
+	cache := open()
+	get(cache, "/a", "MISS")
+	now = now.Add(time.Second)
+	get(cache, "/b", "MISS")
+	now = now.Add(time.Second)
+	get(cache, "/expiring.txt", "MISS")
+	now = now.Add(2 * time.Hour)
+	get(cache, "/a", "HIT")
+
+	// Stepping back to before the expiry doesn't bring the entry back
+	now = now.Add(-3 * time.Hour)
+	get(cache, "/expiring.txt", "MISS")
+	logged := 0
+	for _, r := range h.records {
+		if r.Message == "Wall clock stepped backwards" && attr(r, "step").Duration() == 3*time.Hour {
+			logged++
+		}
+	}
+	if s := cache.Stats(); s.ClockSteps != 1 || logged != 1 {
+		t.Fatalf("expected the step logged, got %d steps and %d lines", s.ClockSteps, logged)
+	}
+
+	// Nor makes entries used since look older than the ones used before
+	now = now.Add(time.Second)
+	get(cache, "/c", "MISS")
+	cache.maxCacheSize.Store(9)
+	cache.cleanupOldEntries()
+	cache.evictTask.mu.Lock()
+	cache.evictTask.mu.Unlock()
+	for path, held := range map[string]bool{"/a": true, "/b": false, "/expiring.txt": true, "/c": true} {
+		if _, ok := cache.entries.Load(cache.getCacheFilename(path)); ok != held {
+			t.Errorf("%s: expected held %v, got %v", path, held, ok)
+		}
+	}
+	e, _ := cache.entries.Load(cache.getCacheFilename("/c"))
+	if used := cache.details(e.(*cacheEntry)).LastUsed; !used.Equal(now) {
+		t.Errorf("expected the wall clock time reported, got %s rather than %s", used, now)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// The expiry got persisted on the wall clock
+	cache = open()
+	defer cache.Close()
+	get(cache, "/expiring.txt", "HIT")
+	now = now.Add(time.Hour)
+	get(cache, "/expiring.txt", "MISS")
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,53 @@
+package picocache
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// WithCompression stores bodies with compressible content types gzipped on
+// disk. They are served as-is to clients accepting gzip, and decompressed
+// on the fly for the others.
+func WithCompression(enabled bool) Option {
+	return func(c *PicoCache) {
+		c.compress = enabled
+	}
+}
+
+// compressible reports whether bodies of contentType are worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-ndjson", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the client accepts bodies with coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), coding) {
+				continue
+			}
+
+			q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			return !found || strings.Trim(q, "0.") != ""
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package picocache_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strconv"
+	"testing"
+)
+
+func TestCompressionAtRest(t *testing.T) {
+	text := bytes.Repeat([]byte(`{"hello": "world"}`), 1000)
+	binary := []byte("\x89PNG not really compressible")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.Write(text)
+		case "/img.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(binary)
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, dir, 1<<20, picocache.WithCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cache *picocache.PicoCache, path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+			t.Fatalf("%s: Content-Length %s for a %d bytes body", path, w.Header().Get("Content-Length"), w.Body.Len())
+		}
+		return w
+	}
+	gzipClient := http.Header{"Accept-Encoding": {"gzip, deflate"}}
+
+	check := func(cache *picocache.PicoCache) {
+		// Plain client gets it decompressed
+		w := get(cache, "/data.json", nil)
+		if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), text) {
+			t.Fatalf("plain client got an unexpected body (encoding %q)", w.Header().Get("Content-Encoding"))
+		}
+
+		// Gzip client gets what's on disk
+		w = get(cache, "/data.json", gzipClient)
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Body.Len() >= len(text) {
+			t.Fatalf("gzip client got an unexpected body (encoding %q, %d bytes)", w.Header().Get("Content-Encoding"), w.Body.Len())
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(gz); !bytes.Equal(b, text) {
+			t.Fatal("gzip body doesn't round-trip")
+		}
+
+		// Incompressible types are stored, and ranged, as usual
+		w = get(cache, "/img.png", gzipClient)
+		if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), binary) {
+			t.Fatal("binary entry was compressed")
+		}
+		r := httptest.NewRequest(http.MethodGet, "/img.png", nil)
+		r.Header.Set("Range", "bytes=0-3")
+		rw := httptest.NewRecorder()
+		cache.ServeHTTP(rw, r)
+		if rw.Code != http.StatusPartialContent || rw.Body.String() != "\x89PNG" {
+			t.Fatalf("unexpected range response %d %q", rw.Code, rw.Body.String())
+		}
+
+		// Ranges on compressed entries get the whole body
+		r = httptest.NewRequest(http.MethodGet, "/data.json", nil)
+		r.Header.Set("Range", "bytes=0-3")
+		rw = httptest.NewRecorder()
+		cache.ServeHTTP(rw, r)
+		if rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), text) {
+			t.Fatalf("unexpected range response on a compressed entry: %d", rw.Code)
+		}
+
+		if s := cache.Stats(); s.LogicalSize >= int64(len(text)) {
+			t.Fatalf("size accounting doesn't use the compressed size: %+v", s)
+		}
+	}
+
+	check(cache)
+
+	// Metadata survives a restart
+	origin.Close()
+	cache.Close()
+	cache, err = picocache.NewCache(slog.Default(), origin.URL, dir, 1<<20, picocache.WithCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cache.Stats(); s.Entries != 2 {
+		t.Fatalf("expected 2 entries after rebuild, got %+v", s)
+	}
+	check(cache)
+}
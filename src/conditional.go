@@ -0,0 +1,112 @@
+package picocache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UncachedPreconditions is how If-Match and If-Unmodified-Since are handled
+// for objects the cache doesn't hold, there being nothing to evaluate them
+// against.
+type UncachedPreconditions int
+
+const (
+	PreconditionsSkip    UncachedPreconditions = iota // the object gets filled and served as if they weren't there
+	PreconditionsForward                              // streamed from the source along with them, uncached
+)
+
+// ParseUncachedPreconditions parses skip or forward.
+func ParseUncachedPreconditions(s string) (UncachedPreconditions, error) {
+	switch s {
+	case "skip":
+		return PreconditionsSkip, nil
+	case "forward":
+		return PreconditionsForward, nil
+	}
+	return PreconditionsSkip, fmt.Errorf("invalid uncached preconditions %q, expected skip or forward", s)
+}
+
+// WithUncachedPreconditions sets how preconditions of requests for objects
+// not held are handled.
+func WithUncachedPreconditions(p UncachedPreconditions) Option {
+	return func(c *PicoCache) {
+		c.uncachedPreconditions = p
+	}
+}
+
+// entityTag is an element of an If-Match or If-None-Match list.
+type entityTag struct {
+	weak   bool
+	opaque string // without its quotes
+}
+
+// parseEntityTags parses the list of an If-Match or If-None-Match header,
+// wildcard telling it was *. Tags are usually quoted, bare ones as the ETag
+// sent for entries are taken as they are.
+func parseEntityTags(header string) (tags []entityTag, wildcard bool) {
+	for field := range strings.SplitSeq(header, ",") {
+		field = strings.TrimSpace(field)
+		if field == "*" {
+			return nil, true
+		}
+		var tag entityTag
+		if rest, ok := strings.CutPrefix(field, "W/"); ok {
+			tag.weak, field = true, rest
+		}
+		if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+			field = field[1 : len(field)-1]
+		}
+		if field != "" {
+			tag.opaque = field
+			tags = append(tags, tag)
+		}
+	}
+	return tags, false
+}
+
+// matchesETag reports whether the list of header holds etag, the strong ETag
+// sent for an entry. The strong comparison of If-Match never matches weak
+// tags, the weak one of If-None-Match ignores the W/. Keys being Crockford
+// base32, opaque tags are compared case insensitively.
+func matchesETag(header, etag string, strong bool) bool {
+	tags, wildcard := parseEntityTags(header)
+	if wildcard {
+		return true
+	}
+	for _, tag := range tags {
+		if (!strong || !tag.weak) && strings.EqualFold(tag.opaque, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPreconditions reports whether r sends preconditions the cache
+// evaluates against the entry, the ones answered with a 412.
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != ""
+}
+
+// evaluatePreconditions returns the status r gets for an entry served with
+// etag, 0 to serve it, in the order of RFC 9110 section 13.2.2: If-Match,
+// If-Unmodified-Since only without it, then If-None-Match. The date of
+// If-Unmodified-Since is compared with the Last-Modified of the source,
+// ignored along with it when the source sent none or it doesn't parse.
+func evaluatePreconditions(r *http.Request, entry *cacheEntry, etag string) int {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !matchesETag(match, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since := r.Header.Get("If-Unmodified-Since"); since != "" && entry.lastModified != "" {
+		limit, err := http.ParseTime(since)
+		modified, err2 := http.ParseTime(entry.lastModified)
+		if err == nil && err2 == nil && modified.After(limit) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && matchesETag(match, etag, false) {
+		return http.StatusNotModified
+	}
+	return 0
+}
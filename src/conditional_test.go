@@ -0,0 +1,150 @@
+package picocache_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	fetches := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/hi", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, req)
+		return w
+	}
+
+	// Not cached yet, a matching ETag still gets the full response
+	etag := picocache.KeyForPath("/hi")
+	if w := get(etag); w.Code != http.StatusOK || w.Body.String() != "Yay" || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected a full miss, got %d %q %s", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+
+	if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected a 304 hit, got %d %q %s", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if w := get("other"); w.Code != http.StatusOK || w.Body.String() != "Yay" {
+		t.Fatalf("expected a full hit, got %d %q", w.Code, w.Body.String())
+	}
+
+	if s := cache.Stats(); s.Hits != 2 || s.Misses != 1 || fetches != 1 {
+		t.Fatalf("unexpected counters %+v after %d fetches", s, fetches)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	origin := NewFakeOrigin(t)
+	cache := NewTestCache(t, origin, 1<<20)
+	modified := "Sat, 01 Jun 2024 10:00:00 GMT"
+	origin.Handle("/hi", OriginResponse{Body: "Yay", Header: http.Header{"Last-Modified": {modified}}})
+	cache.Expect("/hi", "MISS", "Yay")
+	etag := picocache.KeyForPath("/hi")
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"matching If-Match", http.Header{"If-Match": {etag}}, http.StatusOK},
+		{"quoted in a list", http.Header{"If-Match": {`"other", "` + etag + `"`}}, http.StatusOK},
+		{"any", http.Header{"If-Match": {"*"}}, http.StatusOK},
+		{"lower case", http.Header{"If-Match": {strings.ToLower(etag)}}, http.StatusOK},
+		{"mismatching If-Match", http.Header{"If-Match": {`"other"`}}, http.StatusPreconditionFailed},
+		{"weak If-Match", http.Header{"If-Match": {`W/"` + etag + `"`}}, http.StatusPreconditionFailed},
+		{"weak If-None-Match", http.Header{"If-None-Match": {`W/"` + etag + `"`}}, http.StatusNotModified},
+		{"If-None-Match any", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"unmodified since", http.Header{"If-Unmodified-Since": {modified}}, http.StatusOK},
+		{"modified since", http.Header{"If-Unmodified-Since": {"Sat, 01 Jun 2024 09:00:00 GMT"}}, http.StatusPreconditionFailed},
+		{"invalid date ignored", http.Header{"If-Unmodified-Since": {"yesterday"}}, http.StatusOK},
+		// If-Unmodified-Since is ignored along with If-Match
+		{"If-Match first", http.Header{"If-Match": {etag}, "If-Unmodified-Since": {"Sat, 01 Jun 2024 09:00:00 GMT"}}, http.StatusOK},
+		// If-Match comes before If-None-Match
+		{"412 over 304", http.Header{"If-Match": {`"other"`}, "If-None-Match": {etag}}, http.StatusPreconditionFailed},
+		{"then 304", http.Header{"If-Match": {etag}, "If-None-Match": {etag}}, http.StatusNotModified},
+		// A 412 also comes before ranges
+		{"412 over a range", http.Header{"If-Match": {`"other"`}, "Range": {"bytes=0-0"}}, http.StatusPreconditionFailed},
+		{"then the range", http.Header{"If-Match": {etag}, "Range": {"bytes=0-0"}}, http.StatusPartialContent},
+	} {
+		w := cache.Get("/hi", tc.header)
+		if w.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if w.Code != http.StatusOK && w.Code != http.StatusPartialContent && w.Body.Len() != 0 {
+			t.Fatalf("%s: expected no body, got %q", tc.name, w.Body.String())
+		}
+	}
+
+	// Objects not held skip them by default
+	cache.Expect("/new", "MISS", "/new")
+	if w := cache.Get("/other", http.Header{"If-Match": {`"other"`}}); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected the preconditions skipped, got %d %s", w.Code, w.Header().Get("X-Cache"))
+	}
+	if n := origin.Requests("/hi"); n != 1 {
+		t.Fatalf("expected the source asked once, got %d requests", n)
+	}
+}
+
+func TestForwardedPreconditions(t *testing.T) {
+	var forwarded []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("If-Match"))
+		if match := r.Header.Get("If-Match"); match != "" && match != `"v1"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, picocache.WithUncachedPreconditions(picocache.PreconditionsForward))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	get := func(match string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/hi", nil)
+		if match != "" {
+			req.Header.Set("If-Match", match)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(`"v2"`); w.Code != http.StatusPreconditionFailed || w.Header().Get("X-Cache") != "BYPASS-PRECONDITION" || w.Body.Len() != 0 {
+		t.Fatalf("expected the 412 of the source relayed, got %d %s %q", w.Code, w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w := get(`"v1"`); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS-PRECONDITION" || w.Body.String() != "Yay" {
+		t.Fatalf("expected the object streamed, got %d %s %q", w.Code, w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("expected nothing cached, got %d entries", n)
+	}
+
+	// Once held, they're evaluated by the cache
+	if w := get(""); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected a miss, got %s", w.Header().Get("X-Cache"))
+	}
+	if w := get(`"v1"`); w.Code != http.StatusPreconditionFailed || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the entry ETag compared, got %d %s", w.Code, w.Header().Get("X-Cache"))
+	}
+	if len(forwarded) != 3 || forwarded[0] != `"v2"` || forwarded[1] != `"v1"` || forwarded[2] != "" {
+		t.Fatalf("unexpected preconditions forwarded %q", forwarded)
+	}
+}
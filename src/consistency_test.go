@@ -0,0 +1,135 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyConsistency checks that the index, the size totals and the files in
+// dir agree, once background fills and cleanups settled down.
+func verifyConsistency(t *testing.T, cache *PicoCache, dir string) {
+	t.Helper()
+	var problems []string
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		cache.evictTask.mu.Lock()
+		problems = inconsistencies(cache, dir)
+		cache.evictTask.mu.Unlock()
+		if len(problems) == 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+func inconsistencies(cache *PicoCache, dir string) []string {
+	problems := []string{}
+	indexed := map[string]bool{}
+	totalSize, logicalSize := int64(0), int64(0)
+	bodies := []os.FileInfo{} // distinct files of shared bodies
+	cache.entries.Range(func(key, value any) bool {
+		entry := value.(*cacheEntry)
+		indexed[entry.filename] = true
+		if key != entry.filename {
+			problems = append(problems, fmt.Sprintf("entry of %s indexed under %s", entry.filename, key))
+		}
+		if !entry.sealed.Load() {
+			problems = append(problems, fmt.Sprintf("unsealed entry %s", entry.filename))
+		}
+		info, err := os.Stat(entry.filename)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry without a file: %v", err))
+		} else if info.Size() != entry.size {
+			problems = append(problems, fmt.Sprintf("entry of %s is %d bytes, its file %d", entry.filename, entry.size, info.Size()))
+		}
+		logicalSize += entry.size
+		if info == nil || entry.hash == "" || !slices.ContainsFunc(bodies, func(body os.FileInfo) bool { return os.SameFile(body, info) }) {
+			totalSize += entry.diskSize
+			if info != nil && entry.hash != "" {
+				bodies = append(bodies, info)
+			}
+		}
+		return true
+	})
+	if n := cache.totalSize.Load(); n != totalSize {
+		problems = append(problems, fmt.Sprintf("total size of %d, %d indexed", n, totalSize))
+	}
+	if n := cache.logicalSize.Load(); n != logicalSize {
+		problems = append(problems, fmt.Sprintf("logical size of %d, %d indexed", n, logicalSize))
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case d.IsDir() && (d.Name() == quarantineDir || d.Name() == resumeDir):
+			return filepath.SkipDir
+		case d.IsDir() || isControlFile(d.Name()):
+		case strings.HasSuffix(path, tempSuffix):
+			problems = append(problems, fmt.Sprintf("leftover temporary file %s", path))
+		case strings.HasSuffix(path, metaSuffix):
+			if _, err := os.Stat(strings.TrimSuffix(path, metaSuffix)); errors.Is(err, fs.ErrNotExist) {
+				problems = append(problems, fmt.Sprintf("metadata without a file: %s", path))
+			}
+		case !indexed[path]:
+			problems = append(problems, fmt.Sprintf("file not indexed: %s", path))
+		}
+		return nil
+	})
+	return problems
+}
+
+func TestConsistencyAfterFailures(t *testing.T) {
+	fail := true
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/short" && fail:
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("Yay"))
+		default:
+			w.Write([]byte("Yay"))
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	get("/missing")
+	get("/short")
+	get("/a")
+	verifyConsistency(t, cache, dir)
+
+	// A file removed behind the cache's back is filled again
+	os.Remove(cache.getCacheFilename("/a"))
+	if code := get("/a"); code != http.StatusOK {
+		t.Fatalf("expected the entry filled again, got %d", code)
+	}
+	verifyConsistency(t, cache, dir)
+
+	fail = false
+	get("/short")
+	cache.Purge(KeyForPath("/short"))
+	verifyConsistency(t, cache, dir)
+}
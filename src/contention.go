@@ -0,0 +1,101 @@
+package picocache
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLongestWaits is how many of the current waits Stats lists.
+const maxLongestWaits = 10
+
+// What requests can be blocked on
+const (
+	waitFill      = "fill"      // a concurrent fill of their entry
+	waitLock      = "lock"      // the file lock of their entry, held by eviction, a purge or a fill publishing
+	waitReaders   = "readers"   // a reader slot, see WithMaxReadersPerEntry
+	waitAdmission = "admission" // a request slot, see WithMaxRequests
+)
+
+// BlockedWait is a wait in progress, see Stats.LongestWaits.
+type BlockedWait struct {
+	Key  string  `json:"key"`  // cache key of the entry waited on
+	For  string  `json:"for"`  // fill, lock, readers or admission
+	Wait float64 `json:"wait"` // seconds so far
+}
+
+// blockedWait is a request blocked right now.
+type blockedWait struct {
+	key   string
+	kind  string
+	since time.Time
+}
+
+// waitTracker follows the requests blocked right now, only those getting
+// blocked paying for it.
+type waitTracker struct {
+	blocked atomic.Int64
+	mu      sync.Mutex
+	waits   map[*blockedWait]struct{}
+}
+
+// begin records a wait for kind on the entry of cacheFile, until the
+// returned func, telling how long it lasted, is called. t, if set, gets it
+// added to its lock wait.
+func (w *waitTracker) begin(cacheFile, kind string, t *timings) (end func() time.Duration) {
+	b := &blockedWait{key: filepath.Base(cacheFile), kind: kind, since: time.Now()}
+	w.blocked.Add(1)
+	w.mu.Lock()
+	if w.waits == nil {
+		w.waits = make(map[*blockedWait]struct{})
+	}
+	w.waits[b] = struct{}{}
+	w.mu.Unlock()
+	_, span := t.startSpan(SpanLockWait)
+
+	return func() time.Duration {
+		w.mu.Lock()
+		delete(w.waits, b)
+		w.mu.Unlock()
+		w.blocked.Add(-1)
+		waited := time.Since(b.since)
+		span.end(nil, slog.String("picocache.wait", kind))
+		if t != nil {
+			t.lockWait += waited
+		}
+		return waited
+	}
+}
+
+// longest returns the n longest waits in progress, longest first.
+func (w *waitTracker) longest(n int) []BlockedWait {
+	w.mu.Lock()
+	waits := make([]*blockedWait, 0, len(w.waits))
+	for b := range w.waits {
+		waits = append(waits, b)
+	}
+	w.mu.Unlock()
+
+	slices.SortFunc(waits, func(a, b *blockedWait) int { return a.since.Compare(b.since) })
+	longest := []BlockedWait{}
+	for _, b := range waits[:min(n, len(waits))] {
+		longest = append(longest, BlockedWait{Key: b.key, For: b.kind, Wait: time.Since(b.since).Seconds()})
+	}
+	return longest
+}
+
+// lockFileTimed is lockFile, counting the time waited for a lock held by
+// another as blocked, added to the lock wait of t if set. Uncontended
+// locks are taken without further ado.
+func (c *PicoCache) lockFileTimed(cacheFile string, t *timings) (unlock func()) {
+	i := c.fileLock(cacheFile)
+	if !c.fileLocks[i].TryLock() {
+		end := c.waits.begin(cacheFile, waitLock, t)
+		c.fileLocks[i].Lock()
+		end()
+	}
+	return c.fileUnlocks[i]
+}
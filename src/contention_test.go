@@ -0,0 +1,121 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockWait(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("body"))
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	waits := map[string][]time.Duration{}
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithEvents(func(ev RequestEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		waits[ev.Path] = append(waits[ev.Path], ev.LockWait)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	get := func(path string) {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+	get("/fast")
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get("/slow")
+		}()
+	}
+	waitFor(t, func() bool { return cache.Stats().Blocked == 2 })
+	s := cache.Stats()
+	key := filepath.Base(cache.getCacheFilename("/slow"))
+	if len(s.LongestWaits) != 2 || s.LongestWaits[0].Key != key || s.LongestWaits[0].For != waitFill {
+		t.Fatalf("expected the waits on the fill listed, got %+v", s.LongestWaits)
+	}
+
+	// Hits of other entries aren't held up
+	get("/fast")
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	if fast := waits["/fast"]; len(fast) != 2 || fast[0] != 0 || fast[1] != 0 {
+		t.Fatalf("expected no wait on /fast, got %v", fast)
+	}
+	var blocked int
+	for _, wait := range waits["/slow"] {
+		if wait >= 100*time.Millisecond {
+			blocked++
+		}
+	}
+	if blocked != 2 {
+		t.Fatalf("expected the 2 requests waiting on the fill to account for it, got %v", waits["/slow"])
+	}
+	mu.Unlock()
+
+	// A fill publishing waits for the entry lock
+	unlock := cache.lockFile(cache.getCacheFilename("/locked"))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		get("/locked")
+	}()
+	waitFor(t, func() bool { return cache.Stats().Blocked == 1 })
+	if s := cache.Stats(); s.LongestWaits[0].For != waitLock {
+		t.Fatalf("expected the wait on the lock listed, got %+v", s.LongestWaits)
+	}
+	time.Sleep(50 * time.Millisecond)
+	unlock()
+	wg.Wait()
+	mu.Lock()
+	if locked := waits["/locked"]; len(locked) != 1 || locked[0] < 50*time.Millisecond {
+		t.Fatalf("expected the wait on the lock accounted for, got %v", locked)
+	}
+	mu.Unlock()
+
+	s = cache.Stats()
+	if s.Blocked != 0 || len(s.LongestWaits) != 0 || s.LockWait["miss"].Count != 5 || s.LockWait["hit"].Count != 1 {
+		t.Fatalf("unexpected stats %+v %+v", s.LockWait, s.LongestWaits)
+	}
+	if s.LockWait["miss"].Buckets[0] != 2 {
+		t.Fatalf("expected 3 misses waiting over a millisecond, got %v", s.LockWait["miss"].Buckets)
+	}
+	var metrics strings.Builder
+	cache.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `picocache_lock_wait_seconds_count{outcome="miss"} 5`) {
+		t.Fatal("expected the lock wait histogram exported")
+	}
+
+	fast := cache.getCacheFilename("/fast")
+	if allocs := testing.AllocsPerRun(100, func() { cache.lockFile(fast)() }); allocs != 0 {
+		t.Fatalf("expected uncontended locks not to allocate, got %v allocations", allocs)
+	}
+
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,128 @@
+package picocache
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// WithDedup stores byte-identical bodies once: a fill whose content hash
+// matches a cached body hard-links it rather than writing a copy. Entries
+// keep their own metadata, and the body is reclaimed along with the last
+// entry using it. Where the body can't be linked, e.g. on filesystems
+// without hard links, the fill keeps its own copy, taking its own space.
+func WithDedup() Option {
+	return func(c *PicoCache) {
+		c.dedup = true
+	}
+}
+
+// sharedBody is a cached body on disk and the entries linking it.
+type sharedBody struct {
+	files    map[string]*cacheEntry
+	info     os.FileInfo // of the body, telling its links from copies
+	size     int64
+	diskSize int64
+}
+
+// ref adds entry to the users of its body, reporting whether it's the first
+// one so the body has to be accounted for. Copies with the same hash that
+// aren't links of the body are bodies of their own.
+func (c *PicoCache) ref(entry *cacheEntry) bool {
+	info, err := os.Stat(entry.filename)
+	if err != nil {
+		info = nil // never the same file as another body
+	}
+
+	c.bodiesMutex.Lock()
+	defer c.bodiesMutex.Unlock()
+
+	key := c.bodyKey(entry.hash, entry.filename)
+	for _, body := range c.bodies[key] {
+		if info != nil && os.SameFile(body.info, info) {
+			body.files[entry.filename] = entry
+			return false
+		}
+	}
+	body := &sharedBody{files: map[string]*cacheEntry{entry.filename: entry}, info: info, size: entry.size, diskSize: entry.diskSize}
+	c.bodies[key] = append(c.bodies[key], body)
+	return true
+}
+
+// unref removes entry from the users of its body, reporting whether it was
+// the last one so the body got reclaimed.
+func (c *PicoCache) unref(entry *cacheEntry) bool {
+	c.bodiesMutex.Lock()
+	defer c.bodiesMutex.Unlock()
+
+	key := c.bodyKey(entry.hash, entry.filename)
+	bodies := c.bodies[key]
+	replaced := false
+	for i, body := range bodies {
+		switch body.files[entry.filename] {
+		case entry:
+			delete(body.files, entry.filename)
+			if len(body.files) > 0 {
+				return false
+			}
+			if bodies = slices.Delete(bodies, i, i+1); len(bodies) == 0 {
+				delete(c.bodies, key)
+			} else {
+				c.bodies[key] = bodies
+			}
+			return true
+		case nil:
+		default:
+			// Replaced by an entry of the same file, see revalidate
+			replaced = true
+		}
+	}
+	return !replaced
+}
+
+// linkBody hard-links a cached body with the given hash to name, reporting
+// whether it could. Only sealed entries other than cacheFile, which is
+// about to be replaced, are linked from.
+func (c *PicoCache) linkBody(hash, cacheFile, name string) bool {
+	c.bodiesMutex.Lock()
+	defer c.bodiesMutex.Unlock()
+
+	for _, body := range c.bodies[c.bodyKey(hash, cacheFile)] {
+		for file, entry := range body.files {
+			if file == cacheFile || !entry.sealed.Load() {
+				continue
+			}
+			err := c.link(file, name)
+			if err == nil {
+				return true
+			}
+			c.log.Debug("Can't hard-link cached body, storing a copy", slog.String("file", file), slog.String("err", err.Error()))
+			return false
+		}
+	}
+	return false
+}
+
+// bodyKey returns the key of the body with the given hash of cacheFile in
+// bodies. Hard links don't cross filesystems, so bodies are shared within a
+// directory only, see WithCacheDirs.
+func (c *PicoCache) bodyKey(hash, cacheFile string) string {
+	if len(c.dirs) <= 1 {
+		return hash
+	}
+	return c.fileDir(cacheFile) + "\x00" + hash
+}
+
+// dedupSavedBytes returns how many bytes are saved by sharing bodies.
+func (c *PicoCache) dedupSavedBytes() int64 {
+	c.bodiesMutex.Lock()
+	defer c.bodiesMutex.Unlock()
+
+	saved := int64(0)
+	for _, bodies := range c.bodies {
+		for _, body := range bodies {
+			saved += int64(len(body.files)-1) * body.diskSize
+		}
+	}
+	return saved
+}
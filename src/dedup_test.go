@@ -0,0 +1,137 @@
+package picocache
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func dedupOrigin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/logo.png") {
+			w.Write(bytes.Repeat([]byte("L"), 100))
+			return
+		}
+		w.Write(bytes.Repeat([]byte(r.URL.Path[1:2]), 100))
+	}))
+}
+
+func TestDedupSharesBodies(t *testing.T) {
+	origin := dedupOrigin()
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/en/logo.png", "/fr/logo.png", "/de/logo.png", "/other"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.Len() != 100 {
+			t.Fatalf("%s: unexpected response %d with %d bytes", path, w.Code, w.Body.Len())
+		}
+	}
+
+	en, _ := os.Stat(cache.getCacheFilename("/en/logo.png"))
+	fr, _ := os.Stat(cache.getCacheFilename("/fr/logo.png"))
+	if !os.SameFile(en, fr) {
+		t.Fatal("identical bodies aren't shared")
+	}
+
+	check := func(cache *PicoCache) {
+		t.Helper()
+		if s := cache.Stats(); s.TotalSize != 200 || s.LogicalSize != 400 || s.DedupSaved != 200 {
+			t.Fatalf("unexpected sizes %+v", s)
+		}
+	}
+	check(cache)
+
+	// Shared bodies are reference counted again on restart
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restarted)
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
+
+func TestDedupEviction(t *testing.T) {
+	origin := dedupOrigin()
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 250, WithBlockSize(1), WithProtectedShare(0), WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/en/logo.png", "/fr/logo.png", "/other", "/new"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		cache.cleanupOldEntries()
+	}
+
+	// Evicting /en/logo.png alone frees nothing, /fr/logo.png has to go too
+	for path, cached := range map[string]bool{"/en/logo.png": false, "/fr/logo.png": false, "/other": true, "/new": true} {
+		if _, ok := cache.entries.Load(cache.getCacheFilename(path)); ok != cached {
+			t.Errorf("%s: expected cached=%v", path, cached)
+		}
+	}
+	if s := cache.Stats(); s.TotalSize != 200 || s.LogicalSize != 200 || s.DedupSaved != 0 {
+		t.Fatalf("unexpected sizes %+v", s)
+	}
+	if len(cache.bodies) != 2 {
+		t.Fatalf("expected 2 bodies left, got %d", len(cache.bodies))
+	}
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != strings.Repeat("o", 100) {
+		t.Fatalf("unexpected /other response %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestDedupWithoutLinks(t *testing.T) {
+	origin := dedupOrigin()
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+	for _, path := range []string{"/en/logo.png", "/fr/logo.png", "/de/logo.png"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Each copy takes its own space
+	check := func(cache *PicoCache, copies int64) {
+		t.Helper()
+		if s := cache.Stats(); s.TotalSize != copies*100 || s.LogicalSize != copies*100 || s.DedupSaved != 0 {
+			t.Fatalf("expected %d copies accounted for, got %+v", copies, s)
+		}
+		verifyConsistency(t, cache, cache.cacheDir)
+	}
+	check(cache, 3)
+	if cache.PurgePath("/en/logo.png") != Purged {
+		t.Fatal("expected /en/logo.png purged")
+	}
+	check(cache, 2)
+
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restarted, 2)
+}
@@ -0,0 +1,313 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CacheDir is one of the directories entries get spread over, see
+// WithCacheDirs.
+type CacheDir struct {
+	Path   string
+	Weight float64 // share of the entries and of the max size, relative to the other directories
+}
+
+// ParseCacheDirs parses a comma separated list of directories, each one
+// optionally followed by =weight, e.g. /mnt/a=2,/mnt/b. Weights default to 1.
+func ParseCacheDirs(s string) ([]CacheDir, error) {
+	var dirs []CacheDir
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		dir := CacheDir{Path: part, Weight: 1}
+		if i := strings.LastIndex(part, "="); i >= 0 {
+			weight, err := strconv.ParseFloat(part[i+1:], 64)
+			if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+				return nil, fmt.Errorf("invalid weight %q of cache directory %s", part[i+1:], part[:i])
+			}
+			dir = CacheDir{Path: part[:i], Weight: weight}
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no cache directory")
+	}
+	return dirs, nil
+}
+
+// WithCacheDirs spreads entries over several directories, typically on
+// different disks, along with the one given to NewCache which also holds
+// the manifest and lock. Each entry goes to a directory
+// picked by hashing its key, so a given directory holds about its weight's
+// share of the entries and of the max size, and evicts on its own once over
+// that share. The directory given to NewCache weighs 1 unless listed too.
+//
+// A directory failing to be read or written is taken offline: its entries
+// are misses and fills go to the next directory for their key, until a
+// probe write succeeds again. Entries moved that way are left to eviction
+// once their directory is back.
+func WithCacheDirs(dirs ...CacheDir) Option {
+	return func(c *PicoCache) {
+		c.extraDirs = dirs
+	}
+}
+
+// dirState is a directory of the cache and how it's doing.
+type dirState struct {
+	CacheDir
+	size     atomic.Int64 // disk space of its entries
+	offline  atomic.Bool
+	failures atomic.Int64 // times taken offline
+}
+
+// openDirs sets up the directories of the cache, that of NewCache first.
+// Other directories aren't created: one missing starts offline, as its disk
+// may not be mounted yet.
+func (c *PicoCache) openDirs() {
+	primary := &dirState{CacheDir: CacheDir{Path: filepath.Clean(c.cacheDir), Weight: 1}}
+	c.dirs = []*dirState{primary}
+	for _, dir := range c.extraDirs {
+		dir.Path = filepath.Clean(dir.Path)
+		if dir.Path == primary.Path {
+			primary.Weight = dir.Weight
+			continue
+		}
+		if slices.ContainsFunc(c.dirs, func(d *dirState) bool { return d.Path == dir.Path }) {
+			continue
+		}
+		c.dirs = append(c.dirs, &dirState{CacheDir: dir})
+	}
+	if len(c.dirs) == 1 {
+		return
+	}
+	for _, d := range c.dirs[1:] {
+		if err := c.probeDir(d); err != nil {
+			c.takeOffline(d, err)
+		}
+	}
+	c.log.Info("Spreading entries over several directories", slog.Int("dirs", len(c.dirs)))
+}
+
+// score ranks d for key, the highest scoring online directory holding it.
+// This is weighted rendezvous hashing: adding or removing a directory only
+// moves the entries going to or coming from it.
+func (d *dirState) score(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(d.Path))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -d.Weight / math.Log(u)
+}
+
+// keyFile returns the cache file of the given cache key.
+func (c *PicoCache) keyFile(key string) string {
+	if len(c.dirs) <= 1 {
+		return filepath.Join(c.cacheDir, key)
+	}
+	var best, fallback *dirState
+	bestScore, fallbackScore := 0.0, 0.0
+	for _, d := range c.dirs {
+		score := d.score(key)
+		if fallback == nil || score > fallbackScore {
+			fallback, fallbackScore = d, score
+		}
+		if !d.offline.Load() && (best == nil || score > bestScore) {
+			best, bestScore = d, score
+		}
+	}
+	if best == nil {
+		// All offline, which the fill will find out
+		best = fallback
+	}
+	return filepath.Join(best.Path, key)
+}
+
+// keyFiles returns the cache files the given cache key may have, one for
+// each directory.
+func (c *PicoCache) keyFiles(key string) []string {
+	if len(c.dirs) <= 1 {
+		return []string{c.keyFile(key)}
+	}
+	files := make([]string, 0, len(c.dirs))
+	for _, d := range c.dirs {
+		files = append(files, filepath.Join(d.Path, key))
+	}
+	return files
+}
+
+// dirOf returns the directory file is in, nil if none. Partial and
+// quarantined files are in a subdirectory of theirs.
+func (c *PicoCache) dirOf(file string) *dirState {
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		for _, d := range c.dirs {
+			if d.Path == dir {
+				return d
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
+
+// fileDir returns the directory of the cache file is in, that of NewCache if
+// none.
+func (c *PicoCache) fileDir(file string) string {
+	if d := c.dirOf(file); d != nil {
+		return d.Path
+	}
+	return c.cacheDir
+}
+
+// dirFailed tells whether err, got reading or writing file, took its
+// directory offline. Files missing from directories that are fine don't.
+// With a single directory, the cache goes read-only instead, see degrade.
+func (c *PicoCache) dirFailed(file string, err error) bool {
+	if len(c.dirs) <= 1 {
+		return false
+	}
+	d := c.dirOf(file)
+	if d == nil {
+		return false
+	}
+	if d.offline.Load() {
+		return true
+	}
+	if probeErr := c.probeDir(d); probeErr != nil {
+		c.takeOffline(d, errors.Join(err, probeErr))
+		return true
+	}
+	return false
+}
+
+// probeDir writes and removes a probe file in d.
+func (c *PicoCache) probeDir(d *dirState) error {
+	if info, err := os.Stat(d.Path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return &fs.PathError{Op: "probe", Path: d.Path, Err: errors.New("not a directory")}
+	}
+	probe := filepath.Join(d.Path, "probe"+tempSuffix)
+	file, err := c.create(probe)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(probe)
+}
+
+// takeOffline takes d offline, probing it until it can be written again.
+func (c *PicoCache) takeOffline(d *dirState, err error) {
+	if !d.offline.CompareAndSwap(false, true) {
+		return
+	}
+	d.failures.Add(1)
+	c.log.Error("Cache directory failing, taking it offline", slog.String("dir", d.Path), slog.String("err", err.Error()))
+	go c.probeOffline(d)
+}
+
+// probeOffline brings d back online once a probe write succeeds, indexing
+// the entries found in it that aren't already.
+func (c *PicoCache) probeOffline(d *dirState) {
+	ticker := time.NewTicker(c.writableProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		if c.probeDir(d) != nil {
+			continue
+		}
+		if _, err := c.indexDir(d.Path, false); err != nil {
+			c.log.Warn("Failed to index cache directory back online", slog.String("dir", d.Path), slog.String("err", err.Error()))
+		}
+		d.offline.Store(false)
+		c.log.Info("Cache directory is back, bringing it online", slog.String("dir", d.Path))
+		go c.cleanupOldEntries()
+		return
+	}
+}
+
+// dirLimit returns the share of the eviction limit d gets.
+func (c *PicoCache) dirLimit(d *dirState, limit int64) int64 {
+	total := 0.0
+	for _, d := range c.dirs {
+		total += d.Weight
+	}
+	return int64(float64(limit) * d.Weight / total)
+}
+
+// overLimit reports whether any directory is over its share of the eviction
+// limit.
+func (c *PicoCache) overLimit() bool {
+	limit := c.evictionLimit()
+	if len(c.dirs) <= 1 {
+		return c.totalSize.Load() > limit
+	}
+	for _, d := range c.dirs {
+		if !d.offline.Load() && d.size.Load() > c.dirLimit(d, limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// offlineDirs returns the directories offline, if any.
+func (c *PicoCache) offlineDirs() []string {
+	var offline []string
+	for _, d := range c.dirs {
+		if d.offline.Load() {
+			offline = append(offline, d.Path)
+		}
+	}
+	return offline
+}
+
+// labelValue escapes s as a Prometheus label value.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// DirStats is how a directory of the cache is doing, see WithCacheDirs.
+type DirStats struct {
+	Path     string  `json:"path"`
+	Weight   float64 `json:"weight"`
+	Size     int64   `json:"size"`     // physical size of its entries
+	MaxSize  int64   `json:"max_size"` // its share of the max size
+	Offline  bool    `json:"offline"`
+	Failures int64   `json:"failures"` // times taken offline
+}
+
+func (c *PicoCache) dirStats() []DirStats {
+	if len(c.dirs) <= 1 {
+		return nil
+	}
+	s := make([]DirStats, 0, len(c.dirs))
+	for _, d := range c.dirs {
+		s = append(s, DirStats{
+			Path:     d.Path,
+			Weight:   d.Weight,
+			Size:     d.size.Load(),
+			MaxSize:  c.dirLimit(d, c.maxCacheSize.Load()),
+			Offline:  d.offline.Load(),
+			Failures: d.failures.Load(),
+		})
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheDirsSpread(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer origin.Close()
+
+	primary, a, b := t.TempDir(), t.TempDir(), t.TempDir()
+	dirs := []CacheDir{{a, 2}, {b, 1}}
+	open := func(size int64) *PicoCache {
+		cache, err := NewCache(slog.Default(), origin.URL, primary, size, WithBlockSize(1), WithCacheDirs(dirs...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	cache := open(1 << 20)
+	for i := range 200 {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d.txt", i), nil))
+	}
+	counts := map[string]int{}
+	for entry := range cache.allEntries {
+		counts[filepath.Dir(entry.filename)]++
+	}
+	// Weights 1, 2 and 1
+	if counts[primary] < 25 || counts[a] < 75 || counts[b] < 25 || counts[primary]+counts[a]+counts[b] != 200 {
+		t.Fatalf("expected entries spread by weight, got %v", counts)
+	}
+	for i := range 200 {
+		path := fmt.Sprintf("/%d.txt", i)
+		if _, err := os.Stat(cache.getCacheFilename(path)); err != nil {
+			t.Fatalf("expected %s where its key goes, got %v", path, err)
+		}
+	}
+	cache.Close()
+
+	// Rebuilt from every directory, each one evicting down to its share
+	cache = open(8000)
+	defer cache.Close()
+	if s := cache.Stats(); len(s.Dirs) != 3 || s.Dirs[1].Path != a || s.Dirs[1].MaxSize != 4000 {
+		t.Fatalf("expected the directories and their share reported, got %+v", s.Dirs)
+	}
+	waitFor(t, func() bool {
+		for _, d := range cache.Stats().Dirs {
+			if d.Size > d.MaxSize {
+				return false
+			}
+		}
+		return true
+	})
+	for _, d := range cache.Stats().Dirs {
+		if d.Size < d.MaxSize-200 {
+			t.Fatalf("expected %s evicted down to its share only, got %+v", d.Path, d)
+		}
+	}
+}
+
+func TestCacheDirOffline(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	primary, other := t.TempDir(), t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, primary, 1<<20, WithCacheDirs(CacheDir{other, 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.writableProbeInterval = 10 * time.Millisecond
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	var moved, stayed string
+	for i := 0; moved == "" || stayed == ""; i++ {
+		path := fmt.Sprintf("/%d.txt", i)
+		get(path)
+		if filepath.Dir(cache.getCacheFilename(path)) == other {
+			moved = path
+		} else {
+			stayed = path
+		}
+	}
+
+	// The disk goes away
+	if err := os.RemoveAll(other); err != nil {
+		t.Fatal(err)
+	}
+	// Answered from the source by the request finding out
+	w := get(moved)
+	if w.Code != http.StatusOK || w.Body.String() != "body of "+moved || w.Header().Get("X-Cache") != "BYPASS-READONLY" {
+		t.Fatalf("expected the entry of the offline directory passed through, got %d %q %s", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if filepath.Dir(cache.getCacheFilename(moved)) != primary {
+		t.Fatalf("expected fills moved to the directory left, got %s", cache.getCacheFilename(moved))
+	}
+	if w := get(moved); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected a miss for the entry of the offline directory, got %s", w.Header().Get("X-Cache"))
+	}
+	if w := get(moved); w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the entry filled again elsewhere, got %s", w.Header().Get("X-Cache"))
+	}
+	if w := get(stayed); w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the other directory still served, got %s", w.Header().Get("X-Cache"))
+	}
+	w = get(adminPrefix + "health")
+	if !strings.Contains(w.Body.String(), `"status":"degraded"`) || !strings.Contains(w.Body.String(), other) {
+		t.Fatalf("expected health degraded by the offline directory, got %s", w.Body.String())
+	}
+
+	// And comes back
+	if err := os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !cache.Stats().Dirs[1].Offline })
+	if d := cache.Stats().Dirs[1]; d.Failures != 1 {
+		t.Fatalf("expected one failure recorded, got %+v", d)
+	}
+	if filepath.Dir(cache.getCacheFilename(moved)) != other {
+		t.Fatalf("expected fills back to the directory, got %s", cache.getCacheFilename(moved))
+	}
+	if w := get(moved); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected the entry lost with the disk filled again, got %s", w.Header().Get("X-Cache"))
+	}
+	w = get(adminPrefix + "health")
+	if !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Fatalf("expected health back to ok, got %s", w.Body.String())
+	}
+}
+
+func TestCacheDirMissingOnStartup(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "not-mounted")
+	cache, err := NewCache(slog.Default(), "http://localhost", t.TempDir(), 1<<20, WithCacheDirs(CacheDir{missing, 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if s := cache.Stats(); !s.Dirs[1].Offline {
+		t.Fatalf("expected the missing directory offline, got %+v", s.Dirs)
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Fatal("expected the missing directory left alone")
+	}
+	if dir := filepath.Dir(cache.getCacheFilename("/a.txt")); dir == missing {
+		t.Fatalf("expected no fill going to the missing directory, got %s", dir)
+	}
+}
+
+func TestParseCacheDirs(t *testing.T) {
+	dirs, err := ParseCacheDirs("/mnt/a, /mnt/b=2,/mnt/c=0.5")
+	if err != nil || len(dirs) != 3 || dirs[0] != (CacheDir{"/mnt/a", 1}) || dirs[1] != (CacheDir{"/mnt/b", 2}) || dirs[2].Weight != 0.5 {
+		t.Fatalf("expected 3 weighted directories, got %v %v", dirs, err)
+	}
+	for _, s := range []string{"", "/mnt/a=0", "/mnt/a=heavy", "/mnt/a,/mnt/b=-1"} {
+		if _, err := ParseCacheDirs(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
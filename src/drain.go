@@ -0,0 +1,137 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultDrainGrace = 30 * time.Second
+
+// States of the cache on its way out of a pool, see Drain
+const (
+	drainServing int32 = iota
+	drainDraining
+	drainStopped
+)
+
+var drainStates = [...]string{"serving", "draining", "stopped"}
+
+var errDraining = errors.New("cache is draining")
+
+// WithDrainGrace sets how long Drain waits at most for the requests and
+// fills in progress, 30s by default.
+func WithDrainGrace(grace time.Duration) Option {
+	return func(c *PicoCache) {
+		c.drainGrace = grace
+	}
+}
+
+// draining reports whether Drain got called.
+func (c *PicoCache) draining() bool {
+	return c.drainState.Load() != drainServing
+}
+
+// DrainState returns serving, draining or stopped, see Drain.
+func (c *PicoCache) DrainState() string {
+	return drainStates[c.drainState.Load()]
+}
+
+// Drain takes the cache out of its pool: the health endpoint answers 503
+// draining so that load balancers stop sending traffic, while requests
+// still get served, misses then streamed from the source uncached.
+// Background maintenance stops. Once the requests and fills in progress are
+// over, or grace (see WithDrainGrace, when 0) elapsed, pending syncs get
+// flushed and Drained closes for the server to exit. It reports false if
+// the cache was already draining.
+func (c *PicoCache) Drain(grace time.Duration) bool {
+	if !c.drainState.CompareAndSwap(drainServing, drainDraining) {
+		return false
+	}
+	if grace <= 0 {
+		grace = c.drainGrace
+	}
+	c.log.Warn("Draining", slog.Duration("grace", grace), slog.Int64("in_flight", c.inFlight.Load()))
+	go c.drain(grace)
+	return true
+}
+
+// Drained is closed once the cache stopped draining, see Drain.
+func (c *PicoCache) Drained() <-chan struct{} {
+	return c.drained
+}
+
+// drain waits for the requests and fills in progress, see waitIdle, then
+// stops the cache.
+func (c *PicoCache) drain(grace time.Duration) {
+	c.waitIdle(grace)
+	c.syncPending()
+	c.drainState.Store(drainStopped)
+	c.log.Info("Drained")
+	close(c.drained)
+}
+
+// waitIdle waits up to grace for the requests and fills in progress to be
+// over, or the cache to be closed.
+func (c *PicoCache) waitIdle(grace time.Duration) {
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.inFlight.Load() > 0 || c.fillsInProgress() > 0 {
+		select {
+		case <-c.closed:
+			return
+		case <-deadline.C:
+			c.log.Warn("Drain grace period over", slog.Int64("in_flight", c.inFlight.Load()), slog.Int("filling", c.fillsInProgress()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fillsInProgress returns how many fills are running.
+func (c *PicoCache) fillsInProgress() int {
+	n := 0
+	c.downloading.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// serveDrain starts draining for trusted POST requests, waiting for up to
+// grace, a duration, if set. On a cache already draining, it answers 409.
+func (c *PicoCache) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	grace := time.Duration(0)
+	if s := r.URL.Query().Get("grace"); s != "" {
+		var err error
+		if grace, err = time.ParseDuration(s); err != nil || grace <= 0 {
+			http.Error(w, "invalid grace "+strconv.Quote(s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	status := http.StatusAccepted
+	if !c.Drain(grace) {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		State    string `json:"state"`
+		InFlight int64  `json:"in_flight"`
+	}{c.DrainState(), c.inFlight.Load()})
+}
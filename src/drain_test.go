@@ -0,0 +1,125 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	gate := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-gate
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	get := func(path, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" || w.Header().Get("X-Cache") != expected {
+			t.Fatalf("%s: expected %s, got %d %s %q", path, expected, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	drain := func(query string) int {
+		r := httptest.NewRequest(http.MethodPost, "/__picocache/drain"+query, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w.Code
+	}
+	healthStatus := func() (int, string) {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/__picocache/health", nil))
+		var h health
+		if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, h.Status
+	}
+
+	get("/hot", "MISS")
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		get("/slow", "MISS")
+	}()
+	waitFor(t, func() bool { return cache.inFlight.Load() == 1 })
+
+	if code := drain("?grace=soon"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid grace refused, got %d", code)
+	}
+	if code := drain("?grace=5s"); code != http.StatusAccepted {
+		t.Fatalf("expected the drain accepted, got %d", code)
+	}
+	if code := drain(""); code != http.StatusConflict {
+		t.Fatalf("expected a second drain refused, got %d", code)
+	}
+	if code, status := healthStatus(); code != http.StatusServiceUnavailable || status != "draining" {
+		t.Fatalf("expected health draining, got %d %s", code, status)
+	}
+
+	// Hits are still served, misses no longer cached
+	get("/hot", "HIT")
+	get("/new", "BYPASS-DRAINING")
+	get("/new", "BYPASS-DRAINING")
+	select {
+	case <-cache.Drained():
+		t.Fatal("drained with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gate)
+	<-slow
+	select {
+	case <-cache.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("never drained")
+	}
+	if code, status := healthStatus(); code != http.StatusServiceUnavailable || status != "stopped" {
+		t.Fatalf("expected health stopped, got %d %s", code, status)
+	}
+	if s := cache.Stats(); s.Drain != "stopped" || s.InFlight != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if n := cache.Len(); n != 2 {
+		t.Fatalf("expected /hot and /slow cached, got %d entries", n)
+	}
+	verifyConsistency(t, cache, dir)
+
+	// Requests still running after the grace period don't hold the drain
+	stuck := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer blocked.Close()
+	defer close(stuck)
+	other, err := NewCache(slog.Default(), blocked.URL, t.TempDir(), 1<<20, WithDrainGrace(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	go other.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stuck", nil))
+	waitFor(t, func() bool { return other.inFlight.Load() == 1 })
+	if !other.Drain(0) {
+		t.Fatal("expected the drain started")
+	}
+	select {
+	case <-other.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("never drained past the grace period")
+	}
+}
@@ -0,0 +1,155 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// emptyOrigin serves empty bodies, except for /full ones.
+func emptyOrigin(fetches *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.URL.Path == "/full" || r.URL.Path == "/full2" {
+			w.Write([]byte("Yay"))
+			return
+		}
+		w.Header().Set("Content-Length", "0")
+	}))
+}
+
+func TestEmptyBodies(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := emptyOrigin(&fetches)
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithCompression(true), WithDedup(), WithIntegrityTrailer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var etag string
+	for i, cacheStatus := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/lock.json", nil)
+		r.Header.Set("TE", "trailers")
+		cache.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("X-Cache") != cacheStatus {
+			t.Fatalf("%d: unexpected response %d %q %v", i, w.Code, w.Body.String(), w.Header())
+		}
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%d: empty bodies shouldn't get compressed", i)
+		}
+		if sum := w.Result().Trailer.Get(integrityTrailer); sum != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+			t.Fatalf("%d: unexpected digest %q", i, sum)
+		}
+		etag = w.Header().Get("ETag")
+	}
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/lock.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "0" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("unexpected HEAD response %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/lock.json", nil)
+	r.Header.Set("If-None-Match", etag)
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected a 304, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/lock.json", nil)
+	r.Header.Set("Range", "bytes=0-")
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected a 416, got %d", w.Code)
+	}
+
+	// Empty bodies get deduplicated like others
+	w = httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other.lock", nil))
+	if w.Code != http.StatusOK || cache.Stats().Entries != 2 {
+		t.Fatalf("unexpected response %d %+v", w.Code, cache.Stats())
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected 2 fetches, got %d", n)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestEmptyBodiesRebuild(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := emptyOrigin(&fetches)
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithFsync(FsyncData, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/empty", "/grown"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+	if err := os.WriteFile(cache.getCacheFilename("/grown"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithFsync(FsyncData, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.entries.Load(restarted.getCacheFilename("/grown")); ok {
+		t.Fatal("an empty entry found with a body should be dropped")
+	}
+	w := httptest.NewRecorder()
+	restarted.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/empty", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Length") != "0" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
+
+func TestEmptyBodiesEviction(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := emptyOrigin(&fetches)
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 5, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/empty1", "/empty2", "/full"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		time.Sleep(10 * time.Millisecond) // distinct last uses
+	}
+	if s := cache.Stats(); s.Entries != 3 || s.TotalSize != 3 {
+		t.Fatalf("empty entries should count without taking space, got %+v", s)
+	}
+
+	// Evicting the empty entries frees nothing, so eviction goes on
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/full2", nil))
+	for deadline := time.Now().Add(time.Second); cache.Stats().TotalSize > 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache still over its size, %+v", cache.Stats())
+		}
+	}
+	if s := cache.Stats(); s.Entries != 1 || s.TotalSize != 3 {
+		t.Fatalf("expected only the last entry left, got %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
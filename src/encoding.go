@@ -0,0 +1,95 @@
+package picocache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// EncodingFallback is how clients not accepting the content coding the
+// source sent an entry with get it, see WithOriginCompression.
+type EncodingFallback int
+
+const (
+	EncodingDecompress EncodingFallback = iota // decompressed on the fly
+	EncodingRefetch                            // streamed from the source uncompressed, uncached
+)
+
+// ParseEncodingFallback parses decompress or refetch.
+func ParseEncodingFallback(s string) (EncodingFallback, error) {
+	switch s {
+	case "decompress":
+		return EncodingDecompress, nil
+	case "refetch":
+		return EncodingRefetch, nil
+	}
+	return EncodingDecompress, fmt.Errorf("invalid encoding fallback %q, expected decompress or refetch", s)
+}
+
+// WithOriginCompression asks the source for gzipped bodies when filling.
+// Whatever content coding the source sends, asked or not, is stored as is
+// and sent back with its Content-Encoding to clients accepting it. The
+// others get gzipped entries as fallback tells, and entries of any other
+// coding streamed from the source uncompressed.
+func WithOriginCompression(fallback EncodingFallback) Option {
+	return func(c *PicoCache) {
+		c.originCompression = true
+		c.encodingFallback = fallback
+	}
+}
+
+// sourceEncoding returns the content coding of resp, empty for none.
+func sourceEncoding(resp *http.Response) string {
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if coding == "identity" {
+		return ""
+	}
+	return coding
+}
+
+// refetched reports whether the client of r gets entry, which it may not
+// accept the coding of, streamed from the source instead.
+func (c *PicoCache) refetched(r *http.Request, entry *cacheEntry) bool {
+	if acceptsEncoding(r, entry.encoding) {
+		return false
+	}
+	return entry.encoding != "gzip" || entry.sourceEncoded && c.encodingFallback == EncodingRefetch && !c.offline
+}
+
+// decodedCounter counts how many bytes the gzip stream written to it
+// decodes to, failing writes once it turns out malformed.
+type decodedCounter struct {
+	w    *io.PipeWriter
+	done chan struct{}
+	n    int64
+	err  error
+}
+
+func newDecodedCounter() *decodedCounter {
+	r, w := io.Pipe()
+	d := &decodedCounter{w: w, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		zr, err := gzip.NewReader(r)
+		if err == nil {
+			d.n, err = io.Copy(io.Discard, zr)
+		}
+		d.err = err
+		r.CloseWithError(err)
+	}()
+	return d
+}
+
+func (d *decodedCounter) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+// close ends the stream, cut short by err if set, returning its decoded
+// size once whole.
+func (d *decodedCounter) close(err error) (int64, error) {
+	d.w.CloseWithError(err)
+	<-d.done
+	return d.n, d.err
+}
@@ -0,0 +1,136 @@
+package picocache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestOriginCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("hello world "), 1000)
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(text)
+	zw.Close()
+
+	var mu sync.Mutex
+	var asked []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		asked = append(asked, r.URL.Path+" "+r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/br":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("not really brotli"))
+		case r.Header.Get("Accept-Encoding") == "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(zipped.Len()))
+			w.Write(zipped.Bytes())
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.Write(text)
+		}
+	}))
+	defer origin.Close()
+
+	get := func(cache *PicoCache, path string, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+			t.Fatalf("%s: Content-Length %s for a %d bytes body", path, w.Header().Get("Content-Length"), w.Body.Len())
+		}
+		return w
+	}
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		was := asked
+		asked = nil
+		return was
+	}
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithOriginCompression(EncodingDecompress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	// Stored as sent, counting the bytes received
+	w := get(cache, "/a.txt", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(w.Body.Bytes(), zipped.Bytes()) {
+		t.Fatalf("expected the gzipped body replayed, got %q", w.Header().Get("Content-Encoding"))
+	}
+	if s := cache.Stats(); s.LogicalSize != int64(zipped.Len()) || s.TotalSize != int64(zipped.Len()) {
+		t.Fatalf("expected %d bytes accounted for, got %d", zipped.Len(), s.LogicalSize)
+	}
+	if was := reset(); len(was) != 1 || was[0] != "/a.txt gzip" {
+		t.Fatalf("expected gzip asked for, got %q", was)
+	}
+
+	// Decompressed for clients not accepting it
+	w = get(cache, "/a.txt", "")
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), text) || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the decompressed body hit, got %s %q", w.Header().Get("X-Cache"), w.Header().Get("Content-Encoding"))
+	}
+	w = get(cache, "/a.txt", "gzip;q=0")
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), text) {
+		t.Fatal("expected the decompressed body for clients refusing gzip")
+	}
+
+	// Codings which can't be decoded are sent from the source
+	get(cache, "/br", "br")
+	w = get(cache, "/br", "br")
+	if w.Header().Get("Content-Encoding") != "br" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the br body hit, got %s %q", w.Header().Get("X-Cache"), w.Header().Get("Content-Encoding"))
+	}
+	reset()
+	w = get(cache, "/br", "gzip")
+	if w.Header().Get("X-Cache") != "BYPASS-ENCODING" {
+		t.Fatalf("expected the br entry bypassed, got %s", w.Header().Get("X-Cache"))
+	}
+	if was := reset(); len(was) != 1 || was[0] != "/br identity" {
+		t.Fatalf("expected an identity body asked for, got %q", was)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// Survives restarts
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithOriginCompression(EncodingRefetch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	w = get(cache, "/a.txt", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the gzipped entry kept, got %s %q", w.Header().Get("X-Cache"), w.Header().Get("Content-Encoding"))
+	}
+
+	// Refetched uncompressed for clients not accepting it
+	reset()
+	w = get(cache, "/a.txt", "")
+	if w.Header().Get("X-Cache") != "BYPASS-ENCODING" || !bytes.Equal(w.Body.Bytes(), text) {
+		t.Fatalf("expected the body refetched, got %s", w.Header().Get("X-Cache"))
+	}
+	if was := reset(); len(was) != 1 || was[0] != "/a.txt identity" {
+		t.Fatalf("expected an identity body asked for, got %q", was)
+	}
+	if s := cache.Stats(); s.Outcomes["bypass-encoding"] != 1 {
+		t.Fatalf("expected the bypass counted, got %v", s.Outcomes)
+	}
+	verifyConsistency(t, cache, dir)
+}
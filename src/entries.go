@@ -0,0 +1,74 @@
+package picocache
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Range calls fn with every cached entry until it returns false. Entries
+// are described by copies taken when reached: the view is weakly
+// consistent, entries filled or evicted meanwhile may or may not be seen,
+// but none is seen twice or half described.
+func (c *PicoCache) Range(fn func(EntryDetails) bool) {
+	c.entries.Range(func(key, value any) bool {
+		entry := value.(*cacheEntry)
+		if !entry.sealed.Load() {
+			return true
+		}
+		return fn(c.details(entry))
+	})
+}
+
+// Len returns how many entries are cached.
+func (c *PicoCache) Len() int {
+	n := int64(0)
+	for i := range c.stats.sizes {
+		n += c.stats.sizes[i].Load()
+	}
+	return int(n)
+}
+
+// TotalSize returns the disk space used by cached entries, see
+// Stats.TotalSize.
+func (c *PicoCache) TotalSize() int64 {
+	return c.totalSize.Load()
+}
+
+// details describes entry as of now.
+func (c *PicoCache) details(entry *cacheEntry) EntryDetails {
+	_, pinned := c.pinned.Load(entry.filename)
+	d := EntryDetails{
+		Key:         filepath.Base(entry.filename),
+		Path:        entry.path,
+		Size:        entry.size,
+		DiskSize:    entry.diskSize,
+		Encoding:    entry.encoding,
+		DecodedSize: entry.decodedSize,
+		Status:      entry.statusCode(),
+		Location:    entry.location,
+		Origin:      entry.origin,
+		Headers:     entry.headers,
+		Filled:      c.toWall(entry.filled).UTC(),
+		LastUsed:    c.toWall(time.Unix(0, entry.lastUsed.Load())).UTC(),
+		Hits:        entry.hits.Load(),
+		Protected:   entry.protected.Load(),
+		Pinned:      pinned,
+		Readers:     entry.readers.Load(),
+		Hash:        entry.hash,
+	}
+	if entry.path != "" {
+		path, _, _ := strings.Cut(entry.path, "?")
+		d.ContentType = c.entryContentType(entry, path)
+	}
+	if !entry.expires.IsZero() {
+		expires := c.toWall(entry.expires).UTC()
+		d.Expires = &expires
+	}
+	d.TTL, d.Unchanged = int64(entry.adaptive.ttl/time.Second), entry.adaptive.unchanged
+	if !entry.adaptive.changed.IsZero() {
+		changed := entry.adaptive.changed.UTC()
+		d.Changed = &changed
+	}
+	return d
+}
@@ -0,0 +1,67 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRange(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	defer origin.Close()
+
+	// Small enough for fills to keep evicting
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 2000, WithBlockSize(1), WithPrefixPurge())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := atomic.Bool{}
+	wg := sync.WaitGroup{}
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; !stop.Load(); j++ {
+				path := fmt.Sprintf("/%d/%d.txt", i, j%200)
+				cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+		}()
+	}
+
+	for cache.stats.misses.Load() < 300 {
+		seen := map[string]bool{}
+		cache.Range(func(e EntryDetails) bool {
+			if seen[e.Key] {
+				t.Errorf("%s seen twice", e.Key)
+			}
+			seen[e.Key] = true
+			if e.Key != KeyForPath(e.Path) || e.Size != int64(len(e.Path)) || e.ContentType != "text/plain; charset=utf-8" {
+				t.Errorf("inconsistent entry %+v", e)
+			}
+			return true
+		})
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	n := 0
+	cache.Range(func(EntryDetails) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("expected Range to stop after 3 entries, got %d", n)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+	if s := cache.Stats(); cache.Len() != int(s.Entries) || cache.TotalSize() != s.TotalSize {
+		t.Errorf("expected %d entries of %d bytes, got %d of %d", s.Entries, s.TotalSize, cache.Len(), cache.TotalSize())
+	}
+}
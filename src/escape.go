@@ -0,0 +1,110 @@
+package picocache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// canonicalPath returns the escaped form of a request path, as sent by the
+// client, which keys and source URLs derive from. Clients escape paths in
+// many equivalent ways, so escapes are canonicalized:
+//
+//   - escapes of characters which don't need one are decoded, e.g. %7E is ~
+//     and %41 is A;
+//   - escapes of reserved characters stay, uppercased: %2f is %2F and
+//     differs from /, %2B differs from +;
+//   - characters which need an escape get one, e.g. a space is %20 and é
+//     is %C3%A9.
+//
+// Lowercasing applies to what isn't an escaped reserved character.
+func canonicalPath(escaped string, lowercase bool) string {
+	var b, plain strings.Builder
+	flush := func() {
+		s := plain.String()
+		if lowercase {
+			s = strings.ToLower(s)
+		}
+		for i := 0; i < len(s); i++ {
+			if ch := s[i]; literal(ch) {
+				b.WriteByte(ch)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", ch)
+			}
+		}
+		plain.Reset()
+	}
+
+	for i := 0; i < len(escaped); i++ {
+		ch := escaped[i]
+		if ch == '%' && i+2 < len(escaped) && ishex(escaped[i+1]) && ishex(escaped[i+2]) {
+			ch = unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+			i += 2
+			if reserved(ch) {
+				flush()
+				fmt.Fprintf(&b, "%%%02X", ch)
+				continue
+			}
+		}
+		plain.WriteByte(ch)
+	}
+	flush()
+	return b.String()
+}
+
+// keyPath returns the path part of the key of u, see canonicalPath and
+// WithPathNormalization.
+func keyPath(u *url.URL, normalize, lowercase bool) string {
+	path := canonicalPath(u.EscapedPath(), normalize && lowercase)
+	if normalize {
+		path = normalized(path, false)
+	}
+	return path
+}
+
+// requestKey returns the normalized path of u, which rules and content
+// types match on, and its request key.
+func (c *PicoCache) requestKey(u *url.URL) (path, key string) {
+	path = c.normalizePath(u.Path)
+	return path, keyPath(u, c.normalizePaths, c.lowercasePaths) + c.queryString(u)
+}
+
+// pathKey returns the cache key of a request path given by an admin, which
+// may carry a query string.
+func (c *PicoCache) pathKey(path string) (string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	_, key := c.requestKey(u)
+	return KeyForPath(key), nil
+}
+
+// reserved reports whether ch is a delimiter of RFC 3986, whose escaped
+// form means something else than the character itself.
+func reserved(ch byte) bool {
+	return strings.IndexByte(":/?#[]@!$&'()*+,;=", ch) >= 0
+}
+
+// literal reports whether ch goes unescaped in canonical paths.
+func literal(ch byte) bool {
+	switch {
+	case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~:/@!$&'()*+,;=", ch) >= 0
+}
+
+func ishex(ch byte) bool {
+	return '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func unhex(ch byte) byte {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return ch - '0'
+	case 'a' <= ch && ch <= 'f':
+		return ch - 'a' + 10
+	}
+	return ch - 'A' + 10
+}
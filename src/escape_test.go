@@ -0,0 +1,138 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	for _, tc := range []struct {
+		escaped   string
+		lowercase bool
+		expected  string
+	}{
+		{"/img/logo.png", false, "/img/logo.png"},
+		{"/a%20b", false, "/a%20b"},
+		{"/a b", false, "/a%20b"},
+		{"/%7euser/%41", false, "/~user/A"},
+		{"/a%2fb", false, "/a%2Fb"},
+		{"/a%2Fb", false, "/a%2Fb"},
+		{"/a+b", false, "/a+b"},
+		{"/a%2bb", false, "/a%2Bb"},
+		{"/caf%c3%a9", false, "/caf%C3%A9"},
+		{"/café", false, "/caf%C3%A9"},
+		{"/100%25", false, "/100%25"},
+		{"/100%", false, "/100%25"},
+		{"/%5B1%5D", false, "/%5B1%5D"},
+		{"/Img%2FB", true, "/img%2Fb"},
+		{"/CAF%C3%89", true, "/caf%C3%A9"},
+	} {
+		if got := canonicalPath(tc.escaped, tc.lowercase); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.escaped, tc.expected, got)
+		}
+	}
+}
+
+func TestTrickyPaths(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.RequestURI)
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL+"/base", t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) (string, string) {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		return w.Header().Get("X-Cache"), w.Header().Get("X-Cache-Key")
+	}
+
+	for _, tc := range []struct {
+		path     string
+		spelled  []string // other spellings of the same entry
+		target   string
+		distinct string // a path which mustn't share its entry
+	}{
+		{"/a%20b.jpg", nil, "/base/a%20b.jpg", ""},
+		{"/a+b.jpg", nil, "/base/a+b.jpg", "/a%20b.jpg"},
+		{"/a%2bb.jpg", []string{"/a%2Bb.jpg"}, "/base/a%2Bb.jpg", "/a+b.jpg"},
+		{"/dir%2Ffile", []string{"/dir%2ffile"}, "/base/dir%2Ffile", "/dir/file"},
+		{"/caf%C3%A9.png", []string{"/caf%c3%a9.png"}, "/base/caf%C3%A9.png", ""},
+		{"/%7Euser", []string{"/~user"}, "/base/~user", ""},
+		{"/100%25", nil, "/base/100%25", ""},
+	} {
+		fetched = fetched[:0]
+		cacheStatus, key := get(tc.path)
+		if cacheStatus != "MISS" {
+			t.Errorf("%s: expected a MISS, got %s", tc.path, cacheStatus)
+		}
+		if len(fetched) != 1 || fetched[0] != tc.target {
+			t.Errorf("%s: expected %s fetched, got %v", tc.path, tc.target, fetched)
+		}
+		for _, path := range tc.spelled {
+			if cacheStatus, other := get(path); cacheStatus != "HIT" || other != key {
+				t.Errorf("%s: expected a HIT on %s, got %s on %s", path, key, cacheStatus, other)
+			}
+		}
+		if tc.distinct != "" {
+			if _, other := get(tc.distinct); other == key {
+				t.Errorf("%s: shares its entry with %s", tc.distinct, tc.path)
+			}
+		}
+	}
+
+	for _, path := range []string{"/caf%c3%a9.png", "/dir%2ffile"} {
+		if cache.PurgePath(path) != Purged {
+			t.Errorf("%s: expected its entry purged", path)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestKeyVersionUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	// Filled by a version keying on decoded paths
+	dir := t.TempDir()
+	if err := writeManifest(filepath.Join(dir, manifestFile), &manifest{Scheme: keyScheme{Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/plain.jpg", "/a b.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, KeyForPath(path)), []byte("Yay"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+		if err != nil {
+			t.Fatalf("expected the upgrade to be migrated, got %v", err)
+		}
+		if cache.previousScheme == nil {
+			t.Fatal("expected entries looked up under their previous key")
+		}
+		for _, path := range []string{"/plain.jpg", "/a%20b.jpg"} {
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if got := w.Header().Get("X-Cache"); got != "HIT" {
+				t.Errorf("%s: expected a HIT, got %s", path, got)
+			}
+		}
+		verifyConsistency(t, cache, cache.cacheDir)
+		cache.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package picocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	maxExistsBatch = 10000
+	maxExistsBody  = 4 << 20
+)
+
+// ExistsResult tells whether a request path is cached, see Exists.
+type ExistsResult struct {
+	Path    string
+	Cached  bool          // a fresh entry is held
+	Expired bool          // an entry is held, past its TTL
+	Filling bool          // a fill is in progress
+	Size    int64         // of the entry held, if any
+	Age     time.Duration // of the entry held, since filled or last used before a restart
+}
+
+// Exists tells for each request path, escaped and possibly with a query
+// string as for ServeHTTP, whether it is cached, of the default language
+// for those varying by it. Only the index is looked at, nothing gets read
+// from the disk or fetched.
+func (c *PicoCache) Exists(paths []string) []ExistsResult {
+	results := make([]ExistsResult, len(paths))
+	for i, path := range paths {
+		results[i] = c.exists(path)
+	}
+	return results
+}
+
+func (c *PicoCache) exists(path string) ExistsResult {
+	result := ExistsResult{Path: path}
+	u, err := url.Parse(path)
+	if err != nil || climbs(u.Path) {
+		return result
+	}
+	path, key := c.requestKey(u)
+	if language := c.language("", c.matchRule(path)); language != "" {
+		key = languageKey(key, language)
+	}
+	cacheFile := c.getCacheFilename(key)
+
+	_, result.Filling = c.downloading.Load(cacheFile)
+	if e, ok := c.entries.Load(cacheFile); ok && e.(*cacheEntry).sealed.Load() {
+		entry := e.(*cacheEntry)
+		result.Expired = entry.expired(c.steadyNow())
+		result.Cached = !result.Expired
+		result.Size, result.Age = entry.size, c.entryAge(entry)
+	}
+	return result
+}
+
+type existsResult struct {
+	Path    string `json:"path"`
+	Cached  bool   `json:"cached"`
+	Expired bool   `json:"expired,omitempty"`
+	Filling bool   `json:"filling,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Age     int64  `json:"age,omitempty"` // seconds
+}
+
+func newExistsResult(r ExistsResult) existsResult {
+	return existsResult{Path: r.Path, Cached: r.Cached, Expired: r.Expired, Filling: r.Filling, Size: r.Size, Age: int64(r.Age.Seconds())}
+}
+
+// serveExists tells trusted clients whether the path query parameter is
+// cached on GET, or each of the JSON array of paths POSTed, streaming the
+// results of the latter as a JSON array.
+func (c *PicoCache) serveExists(w http.ResponseWriter, r *http.Request) {
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newExistsResult(c.exists(path)))
+	case http.MethodPost:
+		var paths []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExistsBody)).Decode(&paths); err != nil {
+			http.Error(w, "expected a JSON array of paths", http.StatusBadRequest)
+			return
+		}
+		if len(paths) > maxExistsBatch {
+			http.Error(w, "at most "+strconv.Itoa(maxExistsBatch)+" paths at once", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+		for i, path := range paths {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			b, _ := json.Marshal(newExistsResult(c.exists(path)))
+			w.Write(b)
+		}
+		w.Write([]byte("]\n"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
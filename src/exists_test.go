@@ -0,0 +1,101 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExists(t *testing.T) {
+	release := make(chan struct{})
+	var fetches atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	rules, _ := ParseRules(".txt ttl=1h")
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithRules(rules...), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for _, path := range []string{"/hit", "/old.txt"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	e, _ := cache.entries.Load(cache.getCacheFilename("/old.txt"))
+	e.(*cacheEntry).expires = cache.steadyNow().Add(-time.Second)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	waitFor(t, func() bool {
+		_, ok := cache.downloading.Load(cache.getCacheFilename("/slow"))
+		return ok
+	})
+	defer wg.Wait()
+	defer close(release)
+
+	fetch := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+	if w := fetch(http.MethodPost, "/__picocache/exists", "", `["/hit"]`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted clients refused, got %d", w.Code)
+	}
+
+	w := fetch(http.MethodPost, "/__picocache/exists", "s3cret", `["/hit", "/missing", "/old.txt", "/slow", "/../up"]`)
+	var results []existsResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	expected := []existsResult{
+		{Path: "/hit", Cached: true, Size: 3},
+		{Path: "/missing"},
+		{Path: "/old.txt", Expired: true, Size: 3},
+		{Path: "/slow", Filling: true},
+		{Path: "/../up"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %s", len(expected), w.Body.String())
+	}
+	for i, r := range results {
+		if r != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], r)
+		}
+	}
+	if got := cache.Exists([]string{"/hit"}); !got[0].Cached || got[0].Age < 0 || got[0].Age > time.Minute {
+		t.Errorf("unexpected result %+v", got[0])
+	}
+
+	w = fetch(http.MethodGet, "/__picocache/exists?path=/hit", "s3cret", "")
+	var single existsResult
+	if err := json.Unmarshal(w.Body.Bytes(), &single); err != nil || single != expected[0] {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if w := fetch(http.MethodPost, "/__picocache/exists", "s3cret", "["+strings.Repeat(`"/a",`, maxExistsBatch)+`"/a"]`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected batches over the cap refused, got %d", w.Code)
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Errorf("expected no fetch, got %d source requests", n)
+	}
+}
@@ -0,0 +1,70 @@
+package picocache
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// WithExpiryJitter spreads the TTL of each entry by up to ±fraction of it,
+// so that entries filled together don't all expire together.
+func WithExpiryJitter(fraction float64) Option {
+	return func(c *PicoCache) {
+		c.expiryJitter = fraction
+	}
+}
+
+// WithMaxRevalidations bounds how many expired entries get fetched again
+// per second. The ones over budget keep being served, as STALE, until they
+// expired for longer than grace.
+func WithMaxRevalidations(perSecond float64, grace time.Duration) Option {
+	return func(c *PicoCache) {
+		c.revalidations = newTokenBucket(perSecond)
+		c.staleGrace = grace
+	}
+}
+
+// ttl returns the TTL to give an entry of rule, jittered.
+func (c *PicoCache) ttl(rule *Rule) time.Duration {
+	if c.expiryJitter == 0 {
+		return rule.TTL
+	}
+	spread := (rand.Float64()*2 - 1) * c.expiryJitter
+	return time.Duration(float64(rule.TTL) * (1 + spread))
+}
+
+// serveStale reports whether the expired entry should rather be served
+// stale than fetched again, the revalidation budget being spent.
+func (c *PicoCache) serveStale(entry *cacheEntry, now time.Time) bool {
+	if c.revalidations == nil || now.Sub(entry.expires) >= c.staleGrace {
+		return false
+	}
+	return !c.revalidations.take(now)
+}
+
+// tokenBucket allows rate events per second, in bursts of as many.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: max(rate, 1)}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = min(max(b.rate, 1), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,99 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiryJitter(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	rules, _ := ParseRules(".txt ttl=1h")
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithRules(rules...), WithExpiryJitter(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	earliest, latest := time.Duration(2*time.Hour), time.Duration(0)
+	for i := range 100 {
+		path := fmt.Sprintf("/%d.txt", i)
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		e, _ := cache.entries.Load(cache.getCacheFilename(path))
+		ttl := e.(*cacheEntry).expires.Sub(start)
+		earliest, latest = min(earliest, ttl), max(latest, ttl)
+	}
+
+	if earliest < 54*time.Minute || latest > 66*time.Minute+time.Second {
+		t.Fatalf("TTLs out of bounds: %s to %s", earliest, latest)
+	}
+	if latest-earliest < 6*time.Minute {
+		t.Fatalf("TTLs not spread: %s to %s", earliest, latest)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestMaxRevalidations(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	rules, _ := ParseRules(".txt ttl=1m")
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithRules(rules...), WithMaxRevalidations(5, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for i := range 20 {
+		paths = append(paths, fmt.Sprintf("/%d.txt", i))
+	}
+	getAll := func() (outcomes map[string]int) {
+		outcomes = map[string]int{}
+		for _, path := range paths {
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			outcomes[w.Header().Get("X-Cache")]++
+		}
+		return outcomes
+	}
+	getAll()
+	fetches.Store(0)
+
+	// All of them expire at once
+	now := time.Now().Add(90 * time.Second)
+	cache.now = func() time.Time { return now }
+	if outcomes := getAll(); outcomes["MISS"] != 5 || outcomes["STALE"] != 15 {
+		t.Fatalf("expected 5 revalidations, got %v", outcomes)
+	}
+
+	// The budget refills over time
+	now = now.Add(time.Second)
+	if outcomes := getAll(); outcomes["MISS"] != 5 || outcomes["STALE"] != 10 || outcomes["HIT"] != 5 {
+		t.Fatalf("expected 5 more revalidations, got %v", outcomes)
+	}
+	if n := fetches.Load(); n != 10 {
+		t.Fatalf("expected 10 fetches, got %d", n)
+	}
+
+	// Entries expired for longer than the grace period are fetched anyway
+	now = now.Add(2 * time.Minute)
+	if outcomes := getAll(); outcomes["STALE"] != 0 {
+		t.Fatalf("expected no stale entries past the grace period, got %v", outcomes)
+	}
+	if s := cache.Stats(); s.Stale != 25 {
+		t.Fatalf("expected 25 stale responses, got %d", s.Stale)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,56 @@
+package picocache
+
+import (
+	"errors"
+	"io"
+)
+
+// WithFillByteBudget caps the bytes written to cache files, as a bucket of
+// budget.Bytes refilling over budget.Per, sparing the disk the write bursts
+// of a crawl through a cold cache. Once it's empty misses are streamed from
+// the source without being cached, as BYPASS-BUDGET, while hits and
+// revalidations go on. Fills of a known length only start when they fit,
+// the others are abandoned midway when it runs dry, and aren't streamed to
+// their client while in progress.
+func WithFillByteBudget(budget ByteBudget) Option {
+	return func(c *PicoCache) {
+		c.fillBudget = &byteBudget{ByteBudget: budget, tokens: float64(budget.Bytes)}
+	}
+}
+
+var errFillBudget = errors.New("fill byte budget exhausted")
+
+// fillBudgetWriter spends the fill byte budget on the bytes written
+// through it. Unless the body length got checked against it up front,
+// writes fail once it's empty.
+type fillBudgetWriter struct {
+	io.Writer
+	c     *PicoCache
+	known bool
+}
+
+func (w *fillBudgetWriter) Write(p []byte) (int, error) {
+	if !w.known && !w.c.fillBudget.draw(int64(len(p)), w.c.steadyNow()) {
+		return 0, errFillBudget
+	}
+	n, err := w.Writer.Write(p)
+	if w.known {
+		w.c.fillBudget.spend(int64(n), w.c.steadyNow())
+	}
+	return n, err
+}
+
+// fillBudgeted returns file, spending the fill byte budget if any on a body
+// of length bytes, -1 when unknown.
+func (c *PicoCache) fillBudgeted(file io.Writer, length int64) io.Writer {
+	if c.fillBudget == nil {
+		return file
+	}
+	return &fillBudgetWriter{Writer: file, c: c, known: length >= 0}
+}
+
+// overFillBudget tells whether a body of length bytes, -1 when unknown,
+// can't be written to the cache within the fill byte budget.
+func (c *PicoCache) overFillBudget(length int64) bool {
+	return c.fillBudget != nil && !c.fillBudget.allows(length, c.steadyNow())
+}
@@ -0,0 +1,75 @@
+package picocache_test
+
+import (
+	"net/http"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFillByteBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []picocache.Option
+	}{
+		{"plain", nil},
+		{"dedup", []picocache.Option{picocache.WithDedup()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := picocache.ParseRules(".txt ttl=1m")
+			if err != nil {
+				t.Fatal(err)
+			}
+			budget, err := picocache.ParseByteBudget("20B/hour")
+			if err != nil {
+				t.Fatal(err)
+			}
+			origin := NewFakeOrigin(t)
+			origin.Handle("/a.txt", OriginResponse{Body: strings.Repeat("a", 15), Header: http.Header{"Etag": {`"a"`}}})
+			origin.Handle("/large", OriginResponse{Body: strings.Repeat("l", 30)})
+			origin.Handle("/chunked", OriginResponse{Chunks: []string{strings.Repeat("c", 10), strings.Repeat("c", 10)}})
+			cache := NewTestCache(t, origin, 1<<20, append(tc.opts, picocache.WithRules(rules...), picocache.WithFillByteBudget(budget))...)
+
+			cache.Expect("/a.txt", "MISS", strings.Repeat("a", 15))
+
+			// Known lengths are checked before filling
+			cache.Expect("/large", "BYPASS-BUDGET", strings.Repeat("l", 30))
+			if s := cache.Stats().FillBudget; s == nil || s.Available != 5 || s.Refused != 1 {
+				t.Fatalf("expected the budget untouched by the large body, got %+v", s)
+			}
+
+			// Unknown ones are abandoned once it runs dry, and streamed instead
+			cache.Expect("/chunked", "BYPASS-BUDGET", strings.Repeat("c", 20))
+			if n := origin.Requests("/chunked"); n != 2 {
+				t.Fatalf("expected the fill abandoned then passed through, got %d requests", n)
+			}
+			s := cache.Stats()
+			if s.FillsOverBudget != 1 || !s.FillBudget.Exhausted || s.Outcomes["bypass-budget"] != 2 {
+				t.Fatalf("unexpected stats %+v %+v", s, s.FillBudget)
+			}
+			if n := cache.Len(); n != 1 {
+				t.Fatalf("expected only /a.txt cached, got %d entries", n)
+			}
+
+			// Once empty, misses aren't filled, while hits and revalidations go on
+			cache.Expect("/b", "BYPASS-BUDGET", "/b")
+			cache.Expect("/a.txt", "HIT", strings.Repeat("a", 15))
+			cache.Clock.Advance(2 * time.Minute)
+			origin.Handle("/a.txt", OriginResponse{Status: http.StatusNotModified})
+			cache.Expect("/a.txt", "REVALIDATED", strings.Repeat("a", 15))
+			if s := cache.Stats().FillBudget; s.Refused != 2 || !s.Exhausted {
+				t.Fatalf("unexpected budget stats %+v", s)
+			}
+
+			// It refills over its period
+			cache.Clock.Advance(time.Hour)
+			cache.Expect("/b", "MISS", "/b")
+			cache.Expect("/chunked", "MISS", strings.Repeat("c", 20))
+			cache.Expect("/chunked", "HIT", strings.Repeat("c", 20))
+			if s := cache.Stats(); s.FillsOverBudget != 1 || s.FillBudget.Available >= 0 {
+				t.Fatalf("unexpected stats %+v %+v", s, s.FillBudget)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// FrozenMisses is how requests missing the cache are answered while it's
+// frozen, see Freeze.
+type FrozenMisses int
+
+const (
+	FrozenReject      FrozenMisses = iota // 503
+	FrozenPassThrough                     // streamed from the source, uncached
+)
+
+// ParseFrozenMisses parses reject or pass-through.
+func ParseFrozenMisses(s string) (FrozenMisses, error) {
+	switch s {
+	case "reject":
+		return FrozenReject, nil
+	case "pass-through":
+		return FrozenPassThrough, nil
+	}
+	return FrozenReject, fmt.Errorf("invalid frozen misses %q, expected reject or pass-through", s)
+}
+
+// WithFrozen starts the cache frozen, see Freeze.
+func WithFrozen() Option {
+	return func(c *PicoCache) {
+		c.frozen.Store(true)
+	}
+}
+
+// WithFrozenMisses sets how misses are answered while frozen.
+func WithFrozenMisses(m FrozenMisses) Option {
+	return func(c *PicoCache) {
+		c.frozenMisses = m
+	}
+}
+
+var errFrozen = errors.New("cache is frozen")
+
+// Freeze switches the read-only serving mode, for snapshots and debugging:
+// while frozen, nothing in the cache directory gets written or removed.
+// Hits are served without recording their use, misses are rejected or
+// passed through, see WithFrozenMisses, and purges and evictions are
+// refused. Fills already running when freezing still complete. Eviction
+// catches up once thawed.
+func (c *PicoCache) Freeze(frozen bool) {
+	if c.frozen.Swap(frozen) == frozen {
+		return
+	}
+	if frozen {
+		c.log.Warn("Cache frozen, serving what's on disk only")
+		return
+	}
+	c.log.Info("Cache thawed")
+	go c.cleanupOldEntries()
+}
+
+// Frozen reports whether the cache is frozen, see Freeze.
+func (c *PicoCache) Frozen() bool {
+	return c.frozen.Load()
+}
+
+// serveFreeze switches the read-only mode for trusted POST requests, with
+// enabled=true or false.
+func (c *PicoCache) serveFreeze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	c.Freeze(enabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+	}{enabled})
+}
@@ -0,0 +1,170 @@
+package picocache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshot returns the modification time and content hash of every file
+// in dir but its lock, taken even when frozen.
+func snapshot(t *testing.T, dir string) map[string]string {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := map[string]string{}
+	for _, f := range files {
+		if f.Name() == dirLockFile {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s[f.Name()] = fmt.Sprintf("%d %x", info.ModTime().UnixNano(), sha256.Sum256(b))
+	}
+	return s
+}
+
+func TestFrozen(t *testing.T) {
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	rules, err := ParseRules(".txt ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithBlockSize(1), WithAdminToken("s3cret"), WithPrefixPurge(), WithRules(rules...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	serve := func(method, path string, trusted bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if trusted {
+			r.Header.Set("Authorization", "Bearer s3cret")
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	cached := []string{"/a", "/b", "/dir/c", "/expiring.txt"}
+	for _, path := range cached {
+		serve(http.MethodGet, path, false)
+	}
+	if w := serve(http.MethodPost, "/__picocache/readonly?enabled=true", false); w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted freezing to be forbidden, got %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/__picocache/readonly?enabled=true", true); w.Code != http.StatusOK || !cache.Frozen() {
+		t.Fatalf("expected the cache frozen, got %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/__picocache/health", false); !strings.Contains(w.Body.String(), `"status":"frozen"`) {
+		t.Fatalf("health doesn't report the cache frozen: %s", w.Body.String())
+	}
+	now = now.Add(2 * time.Hour)
+	before := snapshot(t, cache.cacheDir)
+	fetched = 0
+
+	// Mixed workload while frozen
+	wg := sync.WaitGroup{}
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				path := cached[(i+j)%len(cached)]
+				if w := serve(http.MethodGet, path, false); w.Code != http.StatusOK || w.Body.String() != "Yay" {
+					t.Errorf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+				}
+				if w := serve(http.MethodGet, fmt.Sprintf("/new/%d", j), false); w.Code != http.StatusServiceUnavailable {
+					t.Errorf("expected a miss rejected while frozen, got %d", w.Code)
+				}
+			}
+		}()
+	}
+	if w := serve(http.MethodPost, "/__picocache/purge?path=/a", true); w.Code != http.StatusConflict {
+		t.Errorf("expected a purge refused while frozen, got %d", w.Code)
+	}
+	if w := serve("PURGE", "/dir/?prefix=1", true); w.Code != http.StatusConflict {
+		t.Errorf("expected a prefix purge refused while frozen, got %d", w.Code)
+	}
+	if cache.PurgePath("/b") != NotPurged {
+		t.Error("expected PurgePath refused while frozen")
+	}
+	if err := cache.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	cache.cleanupOldEntries()
+	cache.Verify(100, true)
+	wg.Wait()
+
+	if after := snapshot(t, cache.cacheDir); !maps.Equal(before, after) {
+		t.Errorf("cache directory changed while frozen:\n%v\n%v", before, after)
+	}
+	if fetched != 0 {
+		t.Errorf("expected the source left alone, got %d fetches", fetched)
+	}
+	if s := cache.Stats(); !s.Frozen || s.Entries != int64(len(cached)) {
+		t.Errorf("unexpected stats while frozen %+v", s)
+	}
+
+	cache.frozenMisses = FrozenPassThrough
+	if w := serve(http.MethodGet, "/new/0", false); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS-FROZEN" {
+		t.Errorf("expected a miss passed through, got %d %s", w.Code, w.Header().Get("X-Cache"))
+	}
+
+	cache.Freeze(false)
+	if err := cache.Resize(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(http.MethodGet, "/new/0", false); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected a fill once thawed, got %s", w.Header().Get("X-Cache"))
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestFrozenAtStartup(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "leftover"+tempSuffix), []byte("Y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot(t, dir)
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithFrozen(), WithFrozenMisses(FrozenPassThrough))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS-FROZEN" {
+		t.Errorf("expected a miss passed through, got %d %s", w.Code, w.Header().Get("X-Cache"))
+	}
+	if after := snapshot(t, dir); !maps.Equal(before, after) {
+		t.Errorf("cache directory changed while frozen:\n%v\n%v", before, after)
+	}
+}
@@ -0,0 +1,125 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy is how durable cache writes are made, see WithFsync.
+type FsyncPolicy int
+
+const (
+	FsyncNone FsyncPolicy = iota // leave it to the OS
+	FsyncData                    // sync files before renaming them in place
+	FsyncFull                    // also sync their directory after the rename
+)
+
+// ParseFsyncPolicy parses none, data or full.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "none":
+		return FsyncNone, nil
+	case "data":
+		return FsyncData, nil
+	case "full":
+		return FsyncFull, nil
+	}
+	return FsyncNone, fmt.Errorf("invalid fsync policy %q, expected none, data or full", s)
+}
+
+// WithFsync makes cache files and their metadata survive host crashes as
+// told by policy. With a non-zero interval the writes get synced every
+// interval rather than one by one, a crash losing at most that much.
+func WithFsync(policy FsyncPolicy, interval time.Duration) Option {
+	return func(c *PicoCache) {
+		c.fsync = policy
+		c.fsyncInterval = interval
+	}
+}
+
+// syncBatch keeps the files written since the last periodic sync.
+type syncBatch struct {
+	mu    sync.Mutex
+	files map[string]struct{}
+}
+
+// syncFile syncs a file about to be renamed in place, unless batched.
+func (c *PicoCache) syncFile(file *os.File) error {
+	if c.fsync == FsyncNone || c.fsyncInterval > 0 {
+		return nil
+	}
+	return file.Sync()
+}
+
+// renamed makes the rename of a file into path durable, or queues it for
+// the next periodic sync.
+func (c *PicoCache) renamed(path string) error {
+	if c.fsync == FsyncNone {
+		return nil
+	}
+	if c.fsyncInterval > 0 {
+		c.pendingSync.mu.Lock()
+		c.pendingSync.files[path] = struct{}{}
+		c.pendingSync.mu.Unlock()
+		return nil
+	}
+	if c.fsync == FsyncFull {
+		return syncPath(filepath.Dir(path))
+	}
+	return nil
+}
+
+func (c *PicoCache) syncPeriodically() {
+	ticker := time.NewTicker(c.fsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			c.syncPending()
+			return
+		case <-ticker.C:
+			c.syncPending()
+		}
+	}
+}
+
+func (c *PicoCache) syncPending() {
+	c.pendingSync.mu.Lock()
+	files := c.pendingSync.files
+	c.pendingSync.files = map[string]struct{}{}
+	c.pendingSync.mu.Unlock()
+	if len(files) == 0 {
+		return
+	}
+
+	dirs := map[string]struct{}{}
+	for file := range files {
+		// Evicted since is fine
+		if err := syncPath(file); err != nil && !os.IsNotExist(err) {
+			c.log.Warn("Failed to sync cache file", slog.String("file", file), slog.String("err", err.Error()))
+		}
+		dirs[filepath.Dir(file)] = struct{}{}
+	}
+	if c.fsync != FsyncFull {
+		return
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil && !os.IsNotExist(err) {
+			c.log.Warn("Failed to sync cache directory", slog.String("dir", dir), slog.String("err", err.Error()))
+		}
+	}
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,143 @@
+package picocache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for s, expected := range map[string]FsyncPolicy{"none": FsyncNone, "data": FsyncData, "full": FsyncFull} {
+		if policy, err := ParseFsyncPolicy(s); err != nil || policy != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", s, expected, policy, err)
+		}
+	}
+	if _, err := ParseFsyncPolicy("always"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// Crashes are simulated by tearing cache files behind the cache's back, as
+// if their data never made it to disk.
+func TestTornWritesDetectedOnRebuild(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("A"), 100))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithFsync(FsyncFull, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/torn", "/intact"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+
+	torn := cache.getCacheFilename("/torn")
+	if err := os.Truncate(torn, 10); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := cache.getCacheFilename("/interrupted") + tempSuffix
+	if err := os.WriteFile(interrupted, []byte("AAA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithFsync(FsyncFull, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.entries.Load(torn); ok {
+		t.Fatal("torn entry was kept")
+	}
+	if _, ok := restarted.entries.Load(restarted.getCacheFilename("/intact")); !ok {
+		t.Fatal("intact entry was dropped")
+	}
+	for _, file := range []string{torn, torn + metaSuffix, interrupted} {
+		if _, err := os.Stat(file); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s wasn't removed: %v", file, err)
+		}
+	}
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
+
+func TestBatchedFsync(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithFsync(FsyncFull, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/yay", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		cache.pendingSync.mu.Lock()
+		pending := len(cache.pendingSync.files)
+		cache.pendingSync.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files still pending sync", pending)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func BenchmarkFsyncFill(b *testing.B) {
+	body := bytes.Repeat([]byte("A"), 64<<10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	for _, mode := range []struct {
+		name     string
+		policy   FsyncPolicy
+		interval time.Duration
+	}{
+		{"none", FsyncNone, 0},
+		{"data", FsyncData, 0},
+		{"full", FsyncFull, 0},
+		{"full-batched", FsyncFull, time.Second},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			cache, err := NewCache(slog.Default(), origin.URL, b.TempDir(), 1<<40, WithFsync(mode.policy, mode.interval))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cache.Close()
+
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	errOriginDown     = errors.New("source is down")
+	errNotAdmitted    = errors.New("not admitted in the cache yet")
+	errTooManyReaders = errors.New("too many clients reading the entry")
+)
+
+// ErrNotCached is returned by Get for objects ServeHTTP would stream from
+// the source without caching them, or refuse to fill for now, e.g. over the
+// origin byte budget or with the source down.
+var ErrNotCached = errors.New("not served from the cache")
+
+// notCached reports whether err keeps an object from being filled while
+// the cache works as configured, ServeHTTP answering with serveUncached.
+func notCached(err error) bool {
+	for _, reason := range []error{
+		errBudgetExhausted, errRateLimited, errOriginDown, errNotAdmitted, errReadOnly, errFrozen, errDraining,
+		errOffline, errTooLarge, errPartialContent, errQuarantined, errRejected, errFillBudget,
+	} {
+		if errors.Is(err, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve finds the entry of cacheFile, filling it from the source on a
+// miss, and opens it. It returns the outcome along with it. Both
+// ServeHTTP and Get go through it, so they can't diverge. An entry missing
+// but held under previous, its file under the previous key scheme, is moved
+// over first.
+func (c *PicoCache) resolve(ctx context.Context, key, cacheFile, previous string, rule *Rule, t *timings) (*cacheEntry, *os.File, Outcome, error) {
+	_, span := t.startSpan(SpanLookup)
+	entry, file, err := c.lookup(cacheFile)
+	span.end(err, slog.Bool("picocache.held", entry != nil))
+	if err != nil {
+		return nil, nil, OutcomeNone, err
+	}
+	frozen := c.frozen.Load()
+	if entry == nil && previous != "" && !frozen && c.rehome(previous, cacheFile, key) {
+		t.trace("entry moved from %s, its previous key", filepath.Base(previous))
+		if entry, file, err = c.lookup(cacheFile); err != nil {
+			return nil, nil, OutcomeNone, err
+		}
+	}
+	if c.offline {
+		// Without a source to revalidate or refill it, what's held is
+		// served however old it is
+		if entry == nil {
+			t.trace("no entry, offline")
+			c.stats.offlineMisses.Add(1)
+			return nil, nil, OutcomeNone, errOffline
+		}
+		t.trace("entry held, offline")
+		c.stats.hits.Add(1)
+		c.policy.hit(entry)
+		return entry, file, OutcomeHitOffline, nil
+	}
+	if entry != nil && c.strictOrigin && c.foreign(entry) &&
+		c.enforced(PolicyStrictOrigin, t, "filled from another source", slog.String("file", cacheFile), slog.String("origin", entry.origin)) {
+		t.trace("filled from %s, another source", entry.origin)
+		c.stats.foreignRefills.Add(1)
+		if !frozen {
+			renewed, changed := c.revalidate(ctx, key, entry, rule, t)
+			if renewed != nil {
+				c.stats.hits.Add(1)
+				c.policy.hit(renewed)
+				return renewed, file, OutcomeRevalidated, nil
+			}
+			t.changed = changed
+		}
+		file.Close()
+		entry = nil
+	}
+	var stale *cacheEntry
+	var staleFile *os.File
+	if now := c.steadyNow(); entry != nil && entry.expired(now) {
+		if frozen {
+			t.trace("expired %s ago, served stale while frozen", now.Sub(entry.expires).Round(time.Millisecond))
+			c.stats.stale.Add(1)
+			return entry, file, OutcomeStale, nil
+		}
+		if c.serveStale(entry, now) {
+			t.trace("expired %s ago, served stale over the revalidation budget", now.Sub(entry.expires).Round(time.Millisecond))
+			c.stats.stale.Add(1)
+			return entry, file, OutcomeStale, nil
+		}
+		if c.overRate() {
+			t.trace("expired %s ago, served stale over the origin request rate limit", now.Sub(entry.expires).Round(time.Millisecond))
+			c.stats.stale.Add(1)
+			return entry, file, OutcomeStale, nil
+		}
+		t.trace("expired %s ago", now.Sub(entry.expires).Round(time.Millisecond))
+		if c.budget != nil || c.fillBudget != nil || c.adaptiveTTL != nil {
+			// Revalidating costs no body, refilling would
+			renewed, changed := c.revalidate(ctx, key, entry, rule, t)
+			if renewed != nil {
+				c.stats.hits.Add(1)
+				c.policy.hit(renewed)
+				return renewed, file, OutcomeRevalidated, nil
+			}
+			t.changed = changed
+			if c.overBudget(-1) {
+				t.trace("served stale over the origin byte budget")
+				c.stats.stale.Add(1)
+				return entry, file, OutcomeStale, nil
+			}
+		}
+		// Kept at hand, should the source fail to fill it again
+		stale, staleFile = entry, file
+		entry = nil
+		c.stats.expirations.Add(1)
+	}
+	if entry != nil && !frozen && c.startupEntry(entry) {
+		t.trace("found on disk on startup")
+		renewed, changed := c.revalidate(ctx, key, entry, rule, t)
+		switch {
+		case renewed != nil:
+			c.stats.hits.Add(1)
+			c.policy.hit(renewed)
+			return renewed, file, OutcomeRevalidated, nil
+		case changed && c.overBudget(-1):
+			t.trace("served stale over the origin byte budget")
+			c.stats.stale.Add(1)
+			return entry, file, OutcomeStale, nil
+		case changed:
+			t.changed = true
+			file.Close()
+			entry = nil
+		}
+	}
+	if entry != nil {
+		if entry.expires.IsZero() {
+			t.trace("entry held")
+		} else {
+			t.trace("entry held, expiring in %s", entry.expires.Sub(c.steadyNow()).Round(time.Millisecond))
+		}
+		c.stats.hits.Add(1)
+		c.policy.hit(entry)
+		return entry, file, OutcomeHit, nil
+	}
+
+	entry, file, outcome, err := c.fillMiss(ctx, key, cacheFile, rule, t)
+	if stale != nil {
+		if err != nil && c.failOver(stale, err, t) {
+			return stale, staleFile, OutcomeStale, nil
+		}
+		staleFile.Close()
+	}
+	return entry, file, outcome, err
+}
+
+// fillMiss fills the entry of cacheFile from the source, unless something
+// keeps it from being, and opens it.
+func (c *PicoCache) fillMiss(ctx context.Context, key, cacheFile string, rule *Rule, t *timings) (*cacheEntry, *os.File, Outcome, error) {
+	if c.draining() {
+		t.trace("no entry, draining")
+		return nil, nil, OutcomeNone, errDraining
+	}
+	if c.frozen.Load() {
+		t.trace("no entry, frozen")
+		return nil, nil, OutcomeNone, errFrozen
+	}
+	if c.originDown() {
+		t.trace("no entry, source down")
+		return nil, nil, OutcomeNone, errOriginDown
+	}
+	if c.admission != nil && !c.admission.admit(cacheFile, time.Now()) &&
+		c.enforced(PolicyAdmission, t, "not admitted yet", slog.String("file", cacheFile)) {
+		t.trace("no entry, not admitted yet")
+		c.stats.admissionRejections.Add(1)
+		return nil, nil, OutcomeNone, errNotAdmitted
+	}
+
+	if size, ok := c.knownSize(cacheFile); ok && size > c.sizeCap(rule) {
+		t.trace("no entry, %d bytes as a HEAD request told, over the size cap", size)
+		return nil, nil, OutcomeNone, errTooLarge
+	}
+	if c.avoid.avoided(cacheFile, c.steadyNow()) {
+		t.trace("no entry, quarantined")
+		return nil, nil, OutcomeNone, errQuarantined
+	}
+	if c.redirect != nil && c.oversized(ctx, key, cacheFile, rule, t) {
+		t.trace("no entry, over the size cap")
+		return nil, nil, OutcomeNone, errTooLarge
+	}
+
+	if c.overBudget(-1) {
+		t.trace("no entry, over the origin byte budget")
+		return nil, nil, OutcomeNone, errBudgetExhausted
+	}
+	if c.overRate() {
+		t.trace("no entry, over the origin request rate limit")
+		return nil, nil, OutcomeNone, errRateLimited
+	}
+	if c.overFillBudget(-1) {
+		t.trace("no entry, over the fill byte budget")
+		return nil, nil, OutcomeNone, errFillBudget
+	}
+	t.trace("no entry, filling")
+	c.stats.misses.Add(1)
+	entry, err := c.downloadFile(ctx, c.originURL(key), cacheFile, key, rule, t)
+	if errors.Is(err, errTooLarge) && c.redirect != nil {
+		c.redirect.learn(cacheFile, true, c.now())
+	}
+	if err != nil {
+		return nil, nil, OutcomeNone, err
+	}
+	file, err := c.open(entry.filename)
+	if entry.condemned != nil {
+		entry.condemned.release()
+	}
+	if err != nil {
+		return nil, nil, OutcomeNone, err
+	}
+	return entry, file, OutcomeMiss, nil
+}
+
+// EntryInfo describes an entry returned by Get.
+type EntryInfo struct {
+	Key         string
+	Size        int64  // of the reader
+	Encoding    string // content coding of the reader, if any
+	DecodedSize int64  // once decoded, when Encoding is set
+	ContentType string
+	Age         time.Duration // since filled, or last used before a restart
+	Cache       Outcome
+	Status      int    // of the source response, see WithCacheableStatus
+	Location    string // Location header of the source response, if any
+}
+
+// entryReader keeps its entry from being evicted until closed.
+type entryReader struct {
+	*os.File
+	release func()
+	once    sync.Once
+}
+
+func (r *entryReader) Close() error {
+	r.once.Do(r.release)
+	return r.File.Close()
+}
+
+// Get pulls the object at path, which may carry a query string, through
+// the cache like ServeHTTP would, returning the cached file as is. Entries
+// stored compressed are returned compressed, see EntryInfo.Encoding. The
+// entry isn't evicted until the reader is closed.
+func (c *PicoCache) Get(ctx context.Context, path string) (io.ReadSeekCloser, *EntryInfo, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if climbs(u.Path) {
+		return nil, nil, fmt.Errorf("path %q goes above the root", u.Path)
+	}
+	path, key := c.requestKey(u)
+	if _, ok := c.released(key); !ok {
+		c.stats.releaseDenied.Add(1)
+		return nil, nil, errNotReleased
+	}
+	cacheFile := c.getCacheFilename(key)
+	previous := c.previousFile(u, cacheFile)
+	rule := c.matchRule(path)
+
+	t := &timings{start: c.now()}
+	if t.language = c.language("", rule); t.language != "" {
+		// Not asking for any, the default one
+		cacheFile, previous = c.getCacheFilename(languageKey(key, t.language)), ""
+	}
+	entry, file, outcome, err := c.resolve(ctx, key, cacheFile, previous, rule, t)
+	if notCached(err) {
+		return nil, nil, errors.Join(ErrNotCached, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release, ok := c.acquireReader(ctx, entry, t)
+	if !ok {
+		file.Close()
+		return nil, nil, errTooManyReaders
+	}
+
+	return &entryReader{File: file, release: release}, c.entryInfo(entry, cacheFile, path, outcome), nil
+}
+
+// entryInfo describes entry, held in cacheFile for the request path.
+func (c *PicoCache) entryInfo(entry *cacheEntry, cacheFile, path string, outcome Outcome) *EntryInfo {
+	return &EntryInfo{
+		Key:         filepath.Base(cacheFile),
+		Size:        entry.size,
+		Encoding:    entry.encoding,
+		DecodedSize: entry.decodedSize,
+		ContentType: c.entryContentType(entry, path),
+		Age:         c.entryAge(entry),
+		Cache:       outcome,
+		Status:      entry.statusCode(),
+		Location:    entry.location,
+	}
+}
@@ -0,0 +1,145 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetAndServeHTTPShareFills(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for range 5 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r, info, err := cache.Get(context.Background(), "/cold.png")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer r.Close()
+			if b, _ := io.ReadAll(r); string(b) != "Yay" || info.Size != 3 || info.ContentType != "image/png" {
+				t.Errorf("unexpected entry %q %+v", b, info)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cold.png", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+				t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected a single fetch, got %d", n)
+	}
+	if s := cache.Stats(); s.Hits+s.Misses != 10 {
+		t.Fatalf("expected 10 lookups, got %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestGetProtectsFromEviction(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 5, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := cache.getCacheFilename("/held")
+	waitEvicted := func(path string) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			cache.cleanupOldEntries()
+			if _, ok := cache.entries.Load(cache.getCacheFilename(path)); !ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s didn't get evicted", path)
+			}
+		}
+	}
+
+	r, info, err := cache.Get(context.Background(), "/held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Cache != OutcomeMiss {
+		t.Fatalf("expected a miss, got %s", info.Cache)
+	}
+	if _, err := r.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overflowing the cache evicts the newer entry rather than the one read
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other", nil))
+	waitEvicted("/other")
+	if _, ok := cache.entries.Load(held); !ok {
+		t.Fatal("entry being read got evicted")
+	}
+	if b, _ := io.ReadAll(r); string(b) != "ay" {
+		t.Fatalf("unexpected body %q", b)
+	}
+
+	r.Close()
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other", nil))
+	waitEvicted("/held")
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestGetNotCached(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithAdmitAfter(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.Get(context.Background(), "/once"); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("expected ErrNotCached, got %v", err)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+
+	// Refused fills too, as ServeHTTP would refuse them
+	cache, err = NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithOriginByteBudget(ByteBudget{Bytes: 3, Per: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := cache.Get(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, _, err := cache.Get(context.Background(), "/b"); !errors.Is(err, ErrNotCached) || !errors.Is(err, errBudgetExhausted) {
+		t.Fatalf("expected ErrNotCached over budget, got %v", err)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
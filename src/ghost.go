@@ -0,0 +1,120 @@
+package picocache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Why a ghost lost its body.
+const (
+	lostEvicted = iota
+	lostRestart
+)
+
+var ghostReasons = [...]string{"evicted", "restart"}
+
+// WithGhosts remembers up to n entries lost to eviction or restarts, to
+// count the misses which would have been hits had they been kept.
+func WithGhosts(n int) Option {
+	return func(c *PicoCache) {
+		if n > 0 {
+			c.ghosts = newGhostIndex(n)
+		}
+	}
+}
+
+type ghost struct {
+	size   int64
+	lostAt time.Time
+	reason int
+	slot   int // in the ring
+}
+
+// ghostIndex is a bounded set of lost entries, by key. Once full, recording
+// a ghost overwrites the oldest one.
+type ghostIndex struct {
+	mutex  sync.Mutex
+	ghosts map[string]ghost
+	ring   []string
+	next   int
+
+	hits  [len(ghostReasons)]atomic.Int64
+	bytes [len(ghostReasons)]atomic.Int64
+}
+
+func newGhostIndex(n int) *ghostIndex {
+	return &ghostIndex{ghosts: map[string]ghost{}, ring: make([]string, n)}
+}
+
+// lost records that the entry of cacheFile lost its body.
+func (g *ghostIndex) lost(cacheFile string, size int64, reason int, now time.Time) {
+	key := filepath.Base(cacheFile)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if old, ok := g.ghosts[g.ring[g.next]]; ok && old.slot == g.next {
+		delete(g.ghosts, g.ring[g.next])
+	}
+	g.ring[g.next] = key
+	g.ghosts[key] = ghost{size: size, lostAt: now, reason: reason, slot: g.next}
+	g.next = (g.next + 1) % len(g.ring)
+}
+
+// refetched counts a would-have-hit if cacheFile, just fetched again with
+// size bytes, was a ghost.
+func (g *ghostIndex) refetched(cacheFile string, size int64) {
+	key := filepath.Base(cacheFile)
+
+	g.mutex.Lock()
+	ghost, ok := g.ghosts[key]
+	if ok {
+		delete(g.ghosts, key)
+	}
+	g.mutex.Unlock()
+
+	if ok {
+		g.hits[ghost.reason].Add(1)
+		g.bytes[ghost.reason].Add(size)
+	}
+}
+
+// removeLeftover removes a temporary file left by a fill interrupted by a
+// restart, or metadata whose body was lost meanwhile, remembering it as a
+// ghost. Bodies get walked before their metadata, so they are already known.
+func (c *PicoCache) removeLeftover(path string) {
+	if strings.HasSuffix(path, tempSuffix) {
+		os.Remove(path)
+		return
+	}
+	cacheFile, ok := strings.CutSuffix(path, metaSuffix)
+	if !ok {
+		return
+	}
+	if _, ok := c.entries.Load(cacheFile); ok {
+		return
+	}
+
+	os.Remove(path)
+	if c.ghosts != nil {
+		c.ghosts.lost(cacheFile, 0, lostRestart, c.now())
+	}
+}
+
+// WouldHaveHits counts misses on entries lost for a given reason.
+type WouldHaveHits struct {
+	Hits  int64 `json:"hits"`
+	Bytes int64 `json:"bytes"` // fetched again
+}
+
+func (g *ghostIndex) summary() map[string]WouldHaveHits {
+	s := map[string]WouldHaveHits{}
+	for i, reason := range ghostReasons {
+		s[reason] = WouldHaveHits{g.hits[i].Load(), g.bytes[i].Load()}
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGhostsCountWouldHaveHits(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("A"), 100))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	rules, err := ParseRules(".txt ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithBlockSize(1), WithGhosts(10), WithRules(rules...)}
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 250, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cache *PicoCache, path, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+
+	for _, path := range []string{"/first", "/second", "/third"} {
+		get(cache, path, "MISS")
+		time.Sleep(time.Millisecond)
+	}
+	cache.cleanupOldEntries()
+	if _, ok := cache.entries.Load(cache.getCacheFilename("/first")); ok {
+		t.Fatal("expected the oldest entry to be evicted")
+	}
+
+	get(cache, "/first", "MISS")
+	if s := cache.Stats(); s.WouldHaveHits["evicted"] != (WouldHaveHits{1, 100}) {
+		t.Fatalf("unexpected would-have-hits %+v", s.WouldHaveHits)
+	}
+
+	// Bodies lost while down are known from the metadata they left
+	get(cache, "/lost.txt", "MISS")
+	// Evicting for it mustn't race with the restart
+	for deadline := time.Now().Add(time.Second); cache.totalSize.Load() > 250; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected an entry evicted for /lost.txt")
+		}
+	}
+	lost := cache.getCacheFilename("/lost.txt")
+	if err := os.Remove(lost); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lost + metaSuffix); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("orphaned metadata wasn't removed: %v", err)
+	}
+
+	get(restarted, "/lost.txt", "MISS")
+	get(restarted, "/lost.txt", "HIT")
+	if s := restarted.Stats(); s.WouldHaveHits["restart"] != (WouldHaveHits{1, 100}) {
+		t.Fatalf("unexpected would-have-hits %+v", s.WouldHaveHits)
+	}
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
+
+func TestGhostsAreBounded(t *testing.T) {
+	g := newGhostIndex(2)
+	for _, file := range []string{"a", "b", "c"} {
+		g.lost(file, 1, lostEvicted, time.Now())
+	}
+	if len(g.ghosts) != 2 {
+		t.Fatalf("expected 2 ghosts, got %d", len(g.ghosts))
+	}
+
+	g.refetched("a", 1)
+	g.refetched("c", 1)
+	g.refetched("c", 1)
+	if hits := g.hits[lostEvicted].Load(); hits != 1 {
+		t.Fatalf("expected 1 would-have-hit, got %d", hits)
+	}
+
+	// A ghost recorded again must survive its older slot being overwritten
+	g.lost("b", 1, lostEvicted, time.Now())
+	g.lost("d", 1, lostEvicted, time.Now())
+	if _, ok := g.ghosts["b"]; !ok {
+		t.Fatal("recorded ghost got overwritten")
+	}
+}
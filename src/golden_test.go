@@ -0,0 +1,181 @@
+package picocache_test
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	picocache "picocache/src"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// exchange is a request of a golden transcript, along with what to do
+// before sending it.
+type exchange struct {
+	method string
+	path   string
+	header http.Header
+	before func(c *TestCache)
+}
+
+// TestServeGolden replays full exchanges against a cache, comparing
+// everything sent back, status, headers, body and trailers, with
+// testdata/serve.golden. Run with -update to record it again, after a
+// change of behaviour that's meant.
+func TestServeGolden(t *testing.T) {
+	rules, err := picocache.ParseRules(".txt ttl=1h, /docs/ lang, /short/ nocache-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := NewFakeOrigin(t)
+	origin.Handle("/hi", OriginResponse{Body: "Yay", Header: http.Header{"Content-Type": {"text/plain"}, "Last-Modified": {"Sat, 01 Jun 2024 10:00:00 GMT"}}})
+	origin.Handle("/missing", OriginResponse{Status: http.StatusNotFound, Body: "nope"})
+	origin.Handle("/short/gone", OriginResponse{Status: http.StatusMovedPermanently, Header: http.Header{"Location": {"https://example.com/new"}}})
+	origin.Handle("/large", OriginResponse{Body: strings.Repeat("x", 2000)})
+	origin.Handle("/page.html", OriginResponse{Body: strings.Repeat("<p>compressible</p>", 20), Header: http.Header{"Content-Type": {"text/html"}}})
+	origin.Handle("/docs/intro", OriginResponse{Body: "intro", Header: http.Header{"Content-Language": {"fr"}}})
+
+	caches := map[string]*TestCache{
+		"default": NewTestCache(t, origin, 1000,
+			picocache.WithRules(rules...),
+			picocache.WithAdminToken("s3cret"),
+			picocache.WithLanguages("en", "fr"),
+			picocache.WithCacheableStatus([]int{http.StatusMovedPermanently}),
+			picocache.WithUncachedPreconditions(picocache.PreconditionsForward)),
+		"compressed": NewTestCache(t, origin, 1000, picocache.WithCompression(true), picocache.WithIntegrityTrailer()),
+		"streaming":  NewTestCache(t, origin, 1000, picocache.WithStreamingFills()),
+		"offline":    NewTestCache(t, origin, 1000, picocache.WithOffline()),
+	}
+	trusted := http.Header{"Authorization": {"Bearer s3cret"}}
+
+	transcripts := []struct {
+		cache     string
+		exchanges []exchange
+	}{
+		{"default", []exchange{
+			{method: "POST", path: "/hi"},
+			{path: "/a/../../etc/passwd"},
+			{path: "/"},
+			{path: "/favicon.ico"},
+			{path: "/hi"},
+			{path: "/hi"},
+			{method: "HEAD", path: "/hi"},
+			{path: "/hi", header: http.Header{"Range": {"bytes=1-"}}},
+			{path: "/hi", header: http.Header{"Range": {"bytes=7-9"}}},
+			{path: "/hi", header: http.Header{"If-None-Match": {picocache.KeyForPath("/hi")}}},
+			{path: "/hi", header: http.Header{"If-Match": {`"other"`}}},
+			{path: "/hi", header: http.Header{"If-Unmodified-Since": {"Sat, 01 Jun 2024 09:00:00 GMT"}}},
+			{path: "/cold", header: http.Header{"If-Match": {"*"}}},
+			{path: "/a.txt"},
+			{path: "/a.txt", before: func(c *TestCache) { c.Clock.Advance(30 * time.Minute) }},
+			{path: "/a.txt", before: func(c *TestCache) { c.Clock.Advance(31 * time.Minute) }},
+			{path: "/missing"},
+			{path: "/large"},
+			{path: "/short/gone"},
+			{path: "/short/gone"},
+			{path: "/docs/intro", header: http.Header{"Accept-Language": {"fr-FR,fr;q=0.9"}}},
+			{path: "/docs/intro", header: http.Header{"Accept-Language": {"fr"}}},
+			{path: "/keyed", header: http.Header{"X-Picocache-Key": {"0123456789ABCDEFGHJKMNPQRS"}}},
+			{path: "/keyed", header: merge(trusted, http.Header{"X-Picocache-Key": {"not a key"}})},
+			{path: "/keyed", header: merge(trusted, http.Header{"X-Picocache-Key": {"0123456789abcdefghjkmnpqrs"}})},
+			{path: "/down", before: func(c *TestCache) { c.Origin.SetDown(true) }},
+			{path: "/hi", before: func(c *TestCache) { c.Origin.SetDown(false) }},
+			{path: "/frozen", before: func(c *TestCache) { c.Freeze(true) }},
+			{path: "/hi"},
+		}},
+		{"compressed", []exchange{
+			{path: "/page.html"},
+			{path: "/page.html", header: http.Header{"Accept-Encoding": {"gzip"}}},
+			{path: "/page.html", header: http.Header{"TE": {"trailers"}}},
+			{path: "/page.html", header: http.Header{"Range": {"bytes=0-4"}}},
+			{path: "/hi", header: http.Header{"TE": {"trailers"}}},
+		}},
+		{"streaming", []exchange{
+			{path: "/hi"},
+			{path: "/hi"},
+			{path: "/missing"},
+		}},
+		{"offline", []exchange{
+			{path: "/hi"},
+		}},
+	}
+
+	var b strings.Builder
+	for _, transcript := range transcripts {
+		c := caches[transcript.cache]
+		for _, ex := range transcript.exchanges {
+			if ex.before != nil {
+				ex.before(c)
+			}
+			method := ex.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, ex.path, nil)
+			for k, v := range ex.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+
+			fmt.Fprintf(&b, "### %s: %s %s\n", transcript.cache, method, ex.path)
+			writeHeader(&b, r.Header)
+			resp := w.Result()
+			fmt.Fprintf(&b, "%d\n", resp.StatusCode)
+			writeHeader(&b, resp.Header)
+			fmt.Fprintf(&b, "%q\n", w.Body.String())
+			writeHeader(&b, resp.Trailer)
+			b.WriteString("\n")
+		}
+	}
+
+	golden := filepath.Join("testdata", "serve.golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != string(want) {
+		gotLines, wantLines := strings.Split(got, "\n"), strings.Split(string(want), "\n")
+		for i := range min(len(gotLines), len(wantLines)) {
+			if gotLines[i] != wantLines[i] {
+				t.Fatalf("%s differs at line %d:\nwant %s\ngot  %s", golden, i+1, wantLines[i], gotLines[i])
+			}
+		}
+		t.Fatalf("%s differs: %d lines, got %d", golden, len(wantLines), len(gotLines))
+	}
+}
+
+// writeHeader writes h sorted, one field per line, as they went.
+func writeHeader(b *strings.Builder, h http.Header) {
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[k] {
+			fmt.Fprintf(b, "%s: %s\n", k, v)
+		}
+	}
+}
+
+func merge(headers ...http.Header) http.Header {
+	merged := http.Header{}
+	for _, h := range headers {
+		for k, v := range h {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,81 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const defaultOriginMaxHeaderBytes = 1 << 20
+
+// WithOriginMaxHeaderBytes bounds the size of the response headers accepted
+// from the source.
+func WithOriginMaxHeaderBytes(n int64) Option {
+	return func(c *PicoCache) {
+		c.transport.MaxResponseHeaderBytes = n
+	}
+}
+
+// WithMaxContentLength sets the largest Content-Length trusted from the
+// source, defaulting to the cache size. Larger ones are handled as if the
+// length were unknown, and fills stop once they go over it.
+func WithMaxContentLength(n int64) Option {
+	return func(c *PicoCache) {
+		c.maxContentLength = n
+	}
+}
+
+var errOriginViolation = errors.New("malformed source response")
+
+// isOriginViolation reports whether err comes from the source sending a
+// malformed response, which retrying won't fix. Go's client refuses
+// conflicting Content-Length headers, among others.
+func isOriginViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "response headers exceeded") || strings.Contains(msg, "Content-Length")
+}
+
+// originViolation logs and counts a source misbehaving fetching url.
+func (c *PicoCache) originViolation(url string, reason string) {
+	c.stats.originViolations.Add(1)
+	c.log.Warn("Source sent a malformed response", slog.String("url", url), slog.String("reason", reason))
+}
+
+// bodyLength returns the body length announced by a source response for
+// url, or -1 if it is unknown or can't be trusted. A Content-Length sent
+// along with a chunked Transfer-Encoding is ignored, as Go's client drops
+// it. Only lengths checked by checkBody end up advertised for hits, which
+// use the size of their file.
+func (c *PicoCache) bodyLength(url string, resp *http.Response) int64 {
+	if resp.ContentLength > c.maxContentLength {
+		c.originViolation(url, "implausible Content-Length")
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// checkBody checks the n bytes copied from the body of a source response
+// for url until err, against the length it announced, see bodyLength.
+// Bodies of unknown length end whenever the source closes the connection.
+func (c *PicoCache) checkBody(url string, length, n int64, err error) error {
+	switch {
+	case length < 0 && errors.Is(err, io.ErrUnexpectedEOF):
+		// Short of an untrusted Content-Length, the body ends once the
+		// source closes just like without one
+		return nil
+	case length >= 0 && errors.Is(err, io.ErrUnexpectedEOF):
+		c.log.Warn("Source body shorter than its Content-Length", slog.String("url", url),
+			slog.Int64("bytes", n), slog.Int64("expected", length))
+		return err
+	case err != nil:
+		return err
+	case n > c.maxContentLength:
+		return errTooLarge
+	case length >= 0 && n != length:
+		return fmt.Errorf("body of %d bytes, not %d", n, length)
+	}
+	return nil
+}
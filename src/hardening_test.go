@@ -0,0 +1,143 @@
+package picocache
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rawOrigin answers each request with the raw response of its path, then
+// closes the connection.
+func rawOrigin(t *testing.T, responses map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(responses[req.URL.Path]))
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestAbusiveOrigin(t *testing.T) {
+	origin := rawOrigin(t, map[string]string{
+		"/huge-headers": "HTTP/1.1 200 OK\r\nX-Junk: " + strings.Repeat("x", 128<<10) + "\r\nContent-Length: 3\r\n\r\nYay",
+		"/huge-length":  "HTTP/1.1 200 OK\r\nContent-Length: 1152921504606846976\r\n\r\nYay",
+		"/negative":     "HTTP/1.1 200 OK\r\nContent-Length: -5\r\n\r\nYay",
+		"/not-a-number": "HTTP/1.1 200 OK\r\nContent-Length: abc\r\n\r\nYay",
+		"/conflicting":  "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nYay",
+		"/unknown":      "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nYay",
+		"/over-ceiling": "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + strings.Repeat("x", 2000),
+	})
+
+	cache, err := NewCache(slog.Default(), origin, t.TempDir(), 1<<20, WithBlockSize(1),
+		WithOriginMaxHeaderBytes(64<<10), WithMaxContentLength(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/huge-headers", "/negative", "/not-a-number", "/conflicting"} {
+		if w := get(path); w.Code != http.StatusBadGateway {
+			t.Errorf("%s: expected a bad gateway, got %d", path, w.Code)
+		}
+	}
+	if n := cache.Stats().OriginViolations; n != 4 {
+		t.Fatalf("expected 4 violations, got %d", n)
+	}
+
+	for _, path := range []string{"/huge-length", "/unknown"} {
+		w := get(path)
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" || w.Header().Get("Content-Length") != "3" {
+			t.Fatalf("%s: unexpected response %d %q, Content-Length %s", path, w.Code, w.Body.String(), w.Header().Get("Content-Length"))
+		}
+	}
+	if n := cache.Stats().OriginViolations; n != 5 {
+		t.Fatalf("expected the implausible length to be counted, got %d violations", n)
+	}
+
+	if w := get("/over-ceiling"); w.Header().Get("X-Cache") != "BYPASS-SIZE" || w.Body.Len() != 2000 {
+		t.Fatalf("expected the oversized body to be streamed uncached, got %s with %d bytes", w.Header().Get("X-Cache"), w.Body.Len())
+	}
+
+	if s := cache.Stats(); s.Entries != 2 || s.TotalSize != 6 || s.LogicalSize != 6 {
+		t.Fatalf("accounting got corrupted: %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestBodyLength(t *testing.T) {
+	origin := rawOrigin(t, map[string]string{
+		"/chunked":     "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nYay\r\n0\r\n\r\n",
+		"/duplicate":   "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nYay",
+		"/conflicting": "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 10\r\n\r\nYay",
+		"/listed":      "HTTP/1.1 200 OK\r\nContent-Length: 3, 3\r\n\r\nYay",
+		"/short":       "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: close\r\n\r\nYay",
+	})
+
+	cache, err := NewCache(slog.Default(), origin, t.TempDir(), 1<<20, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for _, tc := range []struct {
+		path   string
+		code   int
+		cached bool
+	}{
+		{"/chunked", http.StatusOK, true},
+		{"/duplicate", http.StatusOK, true},
+		{"/conflicting", http.StatusBadGateway, false},
+		{"/listed", http.StatusBadGateway, false},
+		{"/short", http.StatusInternalServerError, false},
+	} {
+		w := get(tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.code, w.Code)
+			continue
+		}
+		if tc.code == http.StatusOK && (w.Body.String() != "Yay" || w.Header().Get("Content-Length") != "3") {
+			t.Errorf("%s: unexpected response %q, Content-Length %s", tc.path, w.Body.String(), w.Header().Get("Content-Length"))
+		}
+		w = get(tc.path)
+		if hit := w.Header().Get("X-Cache") == "HIT"; hit != tc.cached {
+			t.Errorf("%s: expected cached %v, got %s", tc.path, tc.cached, w.Header().Get("X-Cache"))
+		}
+		if tc.cached && w.Header().Get("Content-Length") != "3" {
+			t.Errorf("%s: hit advertises Content-Length %s", tc.path, w.Header().Get("Content-Length"))
+		}
+	}
+	if s := cache.Stats(); s.Entries != 2 || s.TotalSize != 6 {
+		t.Fatalf("accounting got corrupted: %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,208 @@
+package picocache_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The end-to-end harness: a programmable source, and caches over a
+// temporary directory on a clock only moving when told to. Tests of the
+// package as embedders see it build on these.
+
+// OriginResponse is what a FakeOrigin answers for a path.
+type OriginResponse struct {
+	Status int // 200 if unset
+	Header http.Header
+	Body   string
+	Delay  time.Duration // before answering
+	Drop   bool          // close the connection rather than answer
+	Chunks []string      // sent in turn without a Content-Length, in place of Body
+}
+
+// FakeOrigin is a source answering what it's programmed to per path, and
+// by default the path itself, counting the requests it gets.
+type FakeOrigin struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]OriginResponse
+	requests  map[string]int
+	arrivals  []time.Time
+	down      bool
+}
+
+// NewFakeOrigin starts a FakeOrigin, stopped once t is over.
+func NewFakeOrigin(t testing.TB) *FakeOrigin {
+	o := &FakeOrigin{responses: map[string]OriginResponse{}, requests: map[string]int{}}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.serve))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *FakeOrigin) serve(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.requests[r.URL.Path]++
+	o.arrivals = append(o.arrivals, time.Now())
+	resp, ok := o.responses[r.URL.Path]
+	if !ok {
+		resp.Body = r.URL.Path
+	}
+	resp.Drop = resp.Drop || o.down
+	o.mu.Unlock()
+
+	time.Sleep(resp.Delay)
+	if resp.Drop {
+		panic(http.ErrAbortHandler)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if resp.Chunks != nil {
+		w.WriteHeader(max(resp.Status, http.StatusOK))
+		for _, chunk := range resp.Chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(max(resp.Status, http.StatusOK))
+	w.Write([]byte(resp.Body))
+}
+
+// Handle programs the response to requests for path.
+func (o *FakeOrigin) Handle(path string, resp OriginResponse) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.responses[path] = resp
+}
+
+// SetDown makes the origin drop every connection, or stop doing so.
+func (o *FakeOrigin) SetDown(down bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.down = down
+}
+
+// Requests returns how many requests for path the origin got.
+func (o *FakeOrigin) Requests(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests[path]
+}
+
+// Arrivals returns when the origin got each of its requests, in order.
+func (o *FakeOrigin) Arrivals() []time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.arrivals)
+}
+
+// FakeClock is a wall clock only moving when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestCache is a cache over a temporary directory, filled from a FakeOrigin
+// on a FakeClock.
+type TestCache struct {
+	*picocache.PicoCache
+	T      testing.TB
+	Origin *FakeOrigin
+	Clock  *FakeClock
+	Dir    string
+
+	maxSize int64
+	opts    []picocache.Option
+}
+
+// NewTestCache opens a cache of maxSize bytes over a new temporary
+// directory, accounting for entries to the byte unless opts say otherwise.
+// It gets closed once t is over.
+func NewTestCache(t testing.TB, origin *FakeOrigin, maxSize int64, opts ...picocache.Option) *TestCache {
+	c := &TestCache{T: t, Origin: origin, Clock: NewFakeClock(), Dir: t.TempDir(), maxSize: maxSize}
+	c.opts = append([]picocache.Option{picocache.WithBlockSize(1), picocache.WithClock(c.Clock.Now)}, opts...)
+	c.open()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (c *TestCache) open() {
+	c.T.Helper()
+	cache, err := picocache.NewCache(slog.Default(), c.Origin.URL, c.Dir, c.maxSize, c.opts...)
+	if err != nil {
+		c.T.Fatal(err)
+	}
+	c.PicoCache = cache
+}
+
+// Reopen closes the cache and opens it again over the same directory with
+// the same options, as a restart would.
+func (c *TestCache) Reopen() {
+	c.T.Helper()
+	c.Close()
+	c.open()
+}
+
+// Get serves a GET request for path, along with header, checking that the
+// Content-Length sent matches the body.
+func (c *TestCache) Get(path string, header http.Header) *httptest.ResponseRecorder {
+	c.T.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	if length := w.Header().Get("Content-Length"); length != "" && length != strconv.Itoa(w.Body.Len()) {
+		c.T.Fatalf("%s: Content-Length %s for a %d bytes body", path, length, w.Body.Len())
+	}
+	return w
+}
+
+// Expect gets path, failing unless it's a 200 with body and the X-Cache
+// outcome given.
+func (c *TestCache) Expect(path, outcome, body string) {
+	c.T.Helper()
+	w := c.Get(path, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != outcome || w.Body.String() != body {
+		c.T.Fatalf("%s: expected %s %q, got %d %s %q", path, outcome, body, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
+
+// Eventually waits up to 5 seconds for cond to hold.
+func Eventually(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
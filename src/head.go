@@ -0,0 +1,251 @@
+package picocache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithHeadMetadata answers HEAD requests for objects without an entry with
+// a HEAD request to the source rather than filling the entry. What it tells
+// of the object is remembered for ttl, answering further HEAD requests and
+// letting a GET skip filling objects known to be over the size cap. It is
+// never mistaken for an entry: a GET still fills from the source. The
+// records are capped as WithMaxAuxEntries says.
+func WithHeadMetadata(ttl time.Duration) Option {
+	return func(c *PicoCache) {
+		c.heads = &headMetadata{ttl: ttl, known: map[string]*list.Element{}, order: list.New()}
+	}
+}
+
+type headMetadata struct {
+	ttl time.Duration
+	max int // records, see WithMaxAuxEntries
+
+	mu      sync.Mutex
+	known   map[string]*list.Element // of *headRecord, by cache file
+	order   *list.List               // most recently used first
+	evicted int64                    // over max
+	expired int64                    // swept
+}
+
+type headRecord struct {
+	cacheFile string
+	meta      headMeta
+}
+
+// headMeta is what a HEAD request to the source learned of an object.
+type headMeta struct {
+	key          string // request key, for prefix purges
+	status       int
+	size         int64 // -1 when not given
+	contentType  string
+	lastModified string
+	location     string
+	learned      time.Time
+	expires      time.Time
+}
+
+// learn records meta for cacheFile, letting the least recently used record
+// go once over max.
+func (h *headMetadata) learn(cacheFile string, meta headMeta, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	meta.learned, meta.expires = now, now.Add(h.ttl)
+	if e, ok := h.known[cacheFile]; ok {
+		e.Value.(*headRecord).meta = meta
+		h.order.MoveToFront(e)
+		return
+	}
+	h.known[cacheFile] = h.order.PushFront(&headRecord{cacheFile: cacheFile, meta: meta})
+	for len(h.known) > h.max {
+		h.drop(h.order.Back())
+		h.evicted++
+	}
+}
+
+func (h *headMetadata) lookup(cacheFile string, now time.Time) (headMeta, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.known[cacheFile]
+	if !ok || !now.Before(e.Value.(*headRecord).meta.expires) {
+		return headMeta{}, false
+	}
+	h.order.MoveToFront(e)
+	return e.Value.(*headRecord).meta, true
+}
+
+// drop removes the record of e, holding mu.
+func (h *headMetadata) drop(e *list.Element) {
+	delete(h.known, e.Value.(*headRecord).cacheFile)
+	h.order.Remove(e)
+}
+
+// forget drops what was learned of cacheFile, once filled or purged.
+func (h *headMetadata) forget(cacheFile string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e, ok := h.known[cacheFile]; ok {
+		h.drop(e)
+	}
+}
+
+// forgetPrefix drops what was learned of the objects whose request key
+// starts with prefix.
+func (h *headMetadata) forgetPrefix(prefix string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range h.known {
+		if strings.HasPrefix(e.Value.(*headRecord).meta.key, prefix) {
+			h.drop(e)
+		}
+	}
+}
+
+// sweep drops the records expired by now, returning how many.
+func (h *headMetadata) sweep(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	swept := 0
+	for _, e := range h.known {
+		if !now.Before(e.Value.(*headRecord).meta.expires) {
+			h.drop(e)
+			swept++
+		}
+	}
+	h.expired += int64(swept)
+	return swept
+}
+
+// counts returns how many records are held, got evicted and swept.
+func (h *headMetadata) counts() (held int, evicted, expired int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.known), h.evicted, h.expired
+}
+
+// knownSize returns the size a HEAD request learned of cacheFile, if any.
+func (c *PicoCache) knownSize(cacheFile string) (int64, bool) {
+	if c.heads == nil {
+		return 0, false
+	}
+	meta, ok := c.heads.lookup(cacheFile, c.now())
+	if !ok || meta.size < 0 {
+		return 0, false
+	}
+	return meta.size, true
+}
+
+// coldHead tells whether the HEAD request for cacheFile gets answered
+// without filling, there being no entry to answer from.
+func (c *PicoCache) coldHead(r *http.Request, cacheFile, previous string) bool {
+	if c.heads == nil || r.Method != http.MethodHead || previous != "" || c.frozen.Load() || c.offline {
+		return false
+	}
+	if e, ok := c.entries.Load(cacheFile); ok && e.(*cacheEntry).sealed.Load() {
+		return false
+	}
+	return true
+}
+
+// serveColdHead answers a HEAD request for the object of key, without an
+// entry, from what the source tells of it, asking it if not known yet.
+func (c *PicoCache) serveColdHead(w http.ResponseWriter, r *http.Request, key, cacheFile string, rule *Rule, log *slog.Logger, t *timings) {
+	header := w.Header()
+	now := c.now()
+	meta, ok := c.heads.lookup(cacheFile, now)
+	if ok {
+		t.trace("no entry, headers learned %s ago", now.Sub(meta.learned).Round(time.Millisecond))
+		t.outcome = OutcomeMeta
+	} else {
+		if c.originDown() {
+			t.trace("no entry, source down")
+			header.Set("Retry-After", strconv.Itoa(int(c.probe.interval.Seconds())+1))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var err error
+		meta, err = c.headSource(r.Context(), key, t)
+		if errors.Is(err, errRateLimited) || err == nil && meta.status == http.StatusTooManyRequests && c.originRate != nil {
+			t.trace("over the origin request rate limit")
+			c.refuseRateLimited(w, t)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to fetch file headers", slog.String("err", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !c.cacheable(meta.status) {
+			t.trace("source returned %d", meta.status)
+			w.WriteHeader(meta.status)
+			return
+		}
+		t.trace("no entry, source reports %d bytes", meta.size)
+		c.heads.learn(cacheFile, meta, now)
+	}
+
+	if meta.size > c.sizeCap(rule) {
+		if c.redirect != nil {
+			c.redirect.learn(cacheFile, true, now)
+			c.redirectLarge(w, key, log, t)
+			return
+		}
+		t.outcome = OutcomeBypassSize
+	}
+	if meta.size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(meta.size, 10))
+	}
+	if header.Get("Content-Type") == "" && meta.contentType != "" {
+		header.Set("Content-Type", meta.contentType)
+	}
+	if meta.lastModified != "" {
+		header.Set("Last-Modified", meta.lastModified)
+	}
+	if meta.location != "" {
+		header.Set("Location", meta.location)
+	}
+	w.WriteHeader(meta.status)
+}
+
+// headSource sends a HEAD request for the object of key to the source.
+func (c *PicoCache) headSource(ctx context.Context, key string, t *timings) (headMeta, error) {
+	source := c.originURL(key)
+	req, err := c.newOriginRequest(ctx, source)
+	if err != nil {
+		return headMeta{}, err
+	}
+	req.Method = http.MethodHead
+	t.askLanguage(req)
+	fetch := c.startOriginFetch(source, "head", false)
+	fetch.startSpan(t, req)
+	resp, err := c.originDo(req)
+	t.originFirstByte = time.Since(fetch.start)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return headMeta{}, err
+	}
+	resp.Body.Close()
+	fetch.done(resp.StatusCode, 0, nil)
+
+	return headMeta{
+		key:          key,
+		status:       resp.StatusCode,
+		size:         resp.ContentLength,
+		contentType:  resp.Header.Get("Content-Type"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		location:     resp.Header.Get("Location"),
+	}, nil
+}
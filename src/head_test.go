@@ -0,0 +1,147 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeadMetadata(t *testing.T) {
+	mu := sync.Mutex{}
+	requests := map[string]int{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		size := 5
+		if strings.HasPrefix(r.URL.Path, "/big") {
+			size = 100
+		}
+		w.Header().Set("Content-Type", "application/x-thing")
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Write(bytes.Repeat([]byte("A"), size))
+	}))
+	defer origin.Close()
+	count := func(request string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[request]
+	}
+
+	now := time.Now()
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithRules(Rule{Prefix: "/", MaxSize: 10}), WithHeadMetadata(time.Minute), WithPrefixPurge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.now = func() time.Time { return now }
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// HEAD then GET
+	for _, cacheStatus := range []string{"MISS", "META"} {
+		w := serve(http.MethodHead, "/a")
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != cacheStatus || w.Header().Get("Content-Length") != "5" ||
+			w.Header().Get("Content-Type") != "application/x-thing" || w.Header().Get("Last-Modified") == "" {
+			t.Fatalf("unexpected HEAD response %d %v", w.Code, w.Header())
+		}
+	}
+	if count("HEAD /a") != 1 || count("GET /a") != 0 || cache.Stats().Entries != 0 {
+		t.Fatalf("expected a single HEAD request and no fill, got %v", requests)
+	}
+	if w := serve(http.MethodGet, "/a"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "AAAAA" {
+		t.Fatalf("expected the GET filled from the source, got %d %v", w.Code, w.Header())
+	}
+	if w := serve(http.MethodHead, "/a"); w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Length") != "5" {
+		t.Fatalf("expected the entry to answer HEAD requests once filled, got %v", w.Header())
+	}
+	if _, ok := cache.heads.lookup(cache.getCacheFilename("/a"), now); ok {
+		t.Fatal("expected the metadata dropped once filled")
+	}
+
+	// GET then HEAD
+	serve(http.MethodGet, "/b")
+	if w := serve(http.MethodHead, "/b"); w.Header().Get("X-Cache") != "HIT" || count("HEAD /b") != 0 {
+		t.Fatalf("expected the entry to answer, got %v %v", w.Header(), requests)
+	}
+
+	// HEAD of a too large object, the GET not even trying to fill
+	if w := serve(http.MethodHead, "/big.bin"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS-SIZE" || w.Header().Get("Content-Length") != "100" {
+		t.Fatalf("unexpected HEAD response %d %v", w.Code, w.Header())
+	}
+	if w := serve(http.MethodGet, "/big.bin"); w.Header().Get("X-Cache") != "BYPASS-SIZE" || w.Body.Len() != 100 {
+		t.Fatalf("unexpected GET response %d %v", w.Code, w.Header())
+	}
+	if count("GET /big.bin") != 1 {
+		t.Fatalf("expected the object streamed through without trying to fill, got %v", requests)
+	}
+
+	// Statuses are passed on, not remembered
+	for range 2 {
+		if w := serve(http.MethodHead, "/missing"); w.Code != http.StatusNotFound {
+			t.Fatalf("expected the source status, got %d", w.Code)
+		}
+	}
+	if count("HEAD /missing") != 2 {
+		t.Fatalf("expected errors not remembered, got %v", requests)
+	}
+
+	// Purges and expiry forget
+	serve(http.MethodHead, "/c")
+	cache.PurgePath("/c")
+	serve(http.MethodHead, "/dir/d")
+	if _, err := cache.PurgePrefix("/dir/"); err != nil {
+		t.Fatal(err)
+	}
+	serve(http.MethodHead, "/e")
+	now = now.Add(time.Minute)
+	for _, path := range []string{"/c", "/dir/d", "/e"} {
+		if w := serve(http.MethodHead, path); w.Header().Get("X-Cache") != "MISS" || count("HEAD "+path) != 2 {
+			t.Fatalf("%s: expected the source asked again, got %v %v", path, w.Header(), requests)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestHeadMetadataRedirect(t *testing.T) {
+	requests := map[string]int{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.Method+" "+r.URL.Path]++
+		w.Header().Set("Content-Length", "100")
+		w.Write(bytes.Repeat([]byte("A"), 100))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithRules(Rule{Prefix: "/", MaxSize: 10}),
+		WithHeadMetadata(time.Minute), WithLargeObjectRedirect("", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(method, "/big.bin", nil))
+		if w.Code != http.StatusFound || w.Header().Get("Location") != origin.URL+"/big.bin" {
+			t.Fatalf("%s: unexpected response %d %v", method, w.Code, w.Header())
+		}
+	}
+	if requests["HEAD /big.bin"] != 1 || requests["GET /big.bin"] != 0 {
+		t.Fatalf("expected a single HEAD request, got %v", requests)
+	}
+}
@@ -0,0 +1,72 @@
+package picocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// EntryDetails describes a cached entry, see Range and serveInspect.
+type EntryDetails struct {
+	Key         string     `json:"key"`
+	Path        string     `json:"path,omitempty"`         // when known, see WithPrefixPurge
+	ContentType string     `json:"content_type,omitempty"` // when the path is known
+	Size        int64      `json:"size"`
+	DiskSize    int64      `json:"disk_size"`
+	Encoding    string     `json:"encoding,omitempty"`
+	DecodedSize int64      `json:"decoded_size,omitempty"`
+	Status      int        `json:"status"`
+	Location    string     `json:"location,omitempty"`
+	Origin      string     `json:"origin,omitempty"` // source it was filled from, when recorded
+	Filled      time.Time  `json:"filled"`           // last used instead, once rebuilt
+	LastUsed    time.Time  `json:"last_used"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	TTL         int64      `json:"ttl,omitempty"`       // seconds, when adapted, see WithAdaptiveTTL
+	Unchanged   int        `json:"unchanged,omitempty"` // revalidations in a row finding it unchanged
+	Changed     *time.Time `json:"changed,omitempty"`   // last found changed at the source
+	Hits        int64      `json:"hits"`
+	Protected   bool       `json:"protected"`
+	Pinned      bool       `json:"pinned"`  // see WithSelfTest
+	Readers     int64      `json:"readers"` // right now
+	Hash        string     `json:"hash,omitempty"`
+
+	Headers http.Header `json:"headers,omitempty"` // see WithPassthroughHeaders
+}
+
+// serveInspect describes the entry of the path or key query parameter, or
+// lists the fills in progress with fills=1, for trusted clients.
+func (c *PicoCache) serveInspect(w http.ResponseWriter, r *http.Request) {
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	key := query.Get("key")
+	switch {
+	case query.Get("fills") == "1":
+		c.serveFills(w)
+		return
+	case key != "" && !validKey(key):
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	case key == "" && query.Get("path") != "":
+		var err error
+		if key, err = c.pathKey(query.Get("path")); err != nil {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+	case key == "":
+		http.Error(w, "path or key is required", http.StatusBadRequest)
+		return
+	}
+
+	e, ok := c.entries.Load(c.keyFile(key))
+	if !ok || !e.(*cacheEntry).sealed.Load() {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.details(e.(*cacheEntry)))
+}
@@ -0,0 +1,74 @@
+package picocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const integrityTrailer = "X-Content-SHA256"
+
+// WithIntegrityTrailer sends the SHA-256 of whole bodies served from the
+// cache in a trailer, to clients able to receive one.
+func WithIntegrityTrailer() Option {
+	return func(c *PicoCache) {
+		c.integrityTrailer = true
+	}
+}
+
+// acceptsTrailers reports whether the client can receive trailers: always
+// over HTTP/2, over HTTP/1.1 only when it says so with TE, the body being
+// then chunked.
+func acceptsTrailers(r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		return false
+	}
+	for _, value := range r.Header.Values("TE") {
+		for _, part := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bodyDigest computes the digest of a body being sent, unless it is known
+// beforehand.
+type bodyDigest struct {
+	known string
+	hash  hash.Hash
+}
+
+// digestBody declares the integrity trailer and returns what to send in
+// place of body. asStored tells whether body is the file as stored, whose
+// hash may already be known.
+func (c *PicoCache) digestBody(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body io.Reader, asStored bool) (io.Reader, *bodyDigest) {
+	header := w.Header()
+	header.Set("Trailer", integrityTrailer)
+	if r.ProtoMajor == 1 {
+		// Trailers only follow chunked bodies
+		header.Del("Content-Length")
+	}
+
+	if asStored && entry.hash != "" {
+		return body, &bodyDigest{known: entry.hash}
+	}
+	d := &bodyDigest{hash: sha256.New()}
+	return io.TeeReader(body, d.hash), d
+}
+
+func (d *bodyDigest) send(w http.ResponseWriter) {
+	sum := d.known
+	if sum == "" {
+		sum = hex.EncodeToString(d.hash.Sum(nil))
+	}
+	w.Header().Set(integrityTrailer, sum)
+}
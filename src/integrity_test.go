@@ -0,0 +1,74 @@
+package picocache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIntegrityTrailer(t *testing.T) {
+	body := bytes.Repeat([]byte("Yay"), 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	sum := sha256.Sum256(body)
+	expected := hex.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"hashed", []Option{WithIntegrityTrailer()}},
+		{"stored", []Option{WithIntegrityTrailer(), WithDedup()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewServer(cache)
+			defer server.Close()
+
+			get := func(te string) *http.Response {
+				t.Helper()
+				req, _ := http.NewRequest(http.MethodGet, server.URL+"/yay", nil)
+				if te != "" {
+					req.Header.Set("TE", te)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				got, err := io.ReadAll(resp.Body)
+				if err != nil || !bytes.Equal(got, body) {
+					t.Fatalf("unexpected body (%v)", err)
+				}
+				return resp
+			}
+
+			for _, outcome := range []string{"MISS", "HIT"} {
+				resp := get("trailers")
+				if resp.Header.Get("X-Cache") != outcome {
+					t.Fatalf("expected a %s, got %s", outcome, resp.Header.Get("X-Cache"))
+				}
+				if got := resp.Trailer.Get(integrityTrailer); got != expected {
+					t.Fatalf("%s: expected digest %s, got %q", outcome, expected, got)
+				}
+			}
+
+			// Clients not accepting trailers keep their Content-Length
+			resp := get("")
+			if resp.ContentLength != int64(len(body)) || resp.Trailer.Get(integrityTrailer) != "" {
+				t.Fatalf("unexpected length %d and trailers %v", resp.ContentLength, resp.Trailer)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package picocache_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"testing"
+)
+
+// The key derivation must never change silently: it names entries on disk
+// and routing layers compute it on their own.
+func TestKeyForPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"":              "WERC8GMRZGE196QVYK49JVXS4GKTWGF4CJDS6K54JPCHPY2JQ1AG",
+		"/hi":           "59R30E5W18SMJA3J1YJHD2D2Y08EZ15EVMSRF9BZRME2SJAKMP0G",
+		"/img/logo.png": "VSBXF1A9ZG1QJXH8C868X46W0WFJJEWW5D0CCHGYZ44151828MB0",
+		"/img?size=200": "G8A9DSYNX2ATDRC884VXH7AXWX65Y1C4TMZ96QKEPX27N4TPJFP0",
+	} {
+		if got := picocache.KeyForPath(path); got != expected {
+			t.Errorf("%q: expected %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestCacheKeyHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := picocache.KeyForPath("/hi")
+	for _, expect := range []string{"", key, "WRONGKEY"} {
+		req := httptest.NewRequest(http.MethodGet, "/hi", nil)
+		if expect != "" {
+			req.Header.Set("X-Picocache-Expect-Key", expect)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, req)
+		if got := w.Header().Get("X-Cache-Key"); got != key {
+			t.Fatalf("expected X-Cache-Key %s, got %s", key, got)
+		}
+	}
+
+	if n := cache.Stats().KeyMismatches; n != 1 {
+		t.Fatalf("expected 1 key mismatch, got %d", n)
+	}
+}
@@ -0,0 +1,237 @@
+package picocache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultKeyFloodWindow = time.Minute
+
+// maxFloodClients bounds how many clients the key flood guard tracks at
+// once, the others only counting against the global threshold.
+const maxFloodClients = 100_000
+
+// KeyFloodMode is how requests for new keys over the thresholds of the key
+// flood guard are answered, see WithKeyFloodGuard.
+type KeyFloodMode int
+
+const (
+	KeyFloodReject      KeyFloodMode = iota // 429
+	KeyFloodPassThrough                     // streamed from the source, uncached
+)
+
+// ParseKeyFloodMode parses reject or pass-through.
+func ParseKeyFloodMode(s string) (KeyFloodMode, error) {
+	switch s {
+	case "reject":
+		return KeyFloodReject, nil
+	case "pass-through":
+		return KeyFloodPassThrough, nil
+	}
+	return KeyFloodReject, fmt.Errorf("invalid key flood mode %q, expected reject or pass-through", s)
+}
+
+// WithKeyFloodGuard bounds how many keys not held in the cache a client,
+// by address, and all clients together may request within a sliding
+// window, so that random paths can't churn the cache nor pound the source.
+// Requests for new keys over either threshold are answered as
+// WithKeyFloodMode says, while requests for keys held go on. A zero
+// threshold doesn't apply, a zero window defaults to a minute. Trusted
+// clients aren't counted.
+func WithKeyFloodGuard(perClient, global int, window time.Duration) Option {
+	return func(c *PicoCache) {
+		if perClient <= 0 && global <= 0 {
+			c.keyFlood = nil
+			return
+		}
+		if window <= 0 {
+			window = defaultKeyFloodWindow
+		}
+		c.keyFlood = newKeyFlood(perClient, global, window)
+	}
+}
+
+// WithKeyFloodMode sets how requests for new keys over the thresholds of
+// the key flood guard are answered.
+func WithKeyFloodMode(mode KeyFloodMode) Option {
+	return func(c *PicoCache) {
+		c.keyFloodMode = mode
+	}
+}
+
+// keySet holds the hashes of the keys requested over the current window
+// and the previous one, the latter weighing less as the current one goes,
+// so that the count slides.
+type keySet struct {
+	current, previous map[uint64]struct{}
+}
+
+func newKeySet() *keySet {
+	return &keySet{current: map[uint64]struct{}{}, previous: map[uint64]struct{}{}}
+}
+
+func (s *keySet) has(h uint64) bool {
+	_, current := s.current[h]
+	_, previous := s.previous[h]
+	return current || previous
+}
+
+// estimate returns how many keys were requested over the last window,
+// progress being how far into the current one it is, from 0 to 1.
+func (s *keySet) estimate(progress float64) float64 {
+	return float64(len(s.current)) + float64(len(s.previous))*(1-progress)
+}
+
+// keyFlood counts the new keys requested by each client and by all of
+// them. Keys are only recorded while under the threshold, bounding memory.
+type keyFlood struct {
+	perClient, global int
+	window            time.Duration
+
+	mu       sync.Mutex
+	seed     maphash.Seed
+	all      *keySet
+	clients  map[string]*keySet
+	rotated  time.Time
+	byClient int64 // requests refused over the per-client threshold
+	byGlobal int64 // requests refused over the global one
+}
+
+func newKeyFlood(perClient, global int, window time.Duration) *keyFlood {
+	return &keyFlood{
+		perClient: perClient,
+		global:    global,
+		window:    window,
+		seed:      maphash.MakeSeed(),
+		all:       newKeySet(),
+		clients:   map[string]*keySet{},
+	}
+}
+
+// rotate starts a new window once the current one is over, holding mu, and
+// returns how far into it now is.
+func (g *keyFlood) rotate(now time.Time) float64 {
+	if elapsed := now.Sub(g.rotated); elapsed >= g.window {
+		stale := elapsed >= 2*g.window
+		for client, s := range g.clients {
+			if stale || len(s.current) == 0 {
+				delete(g.clients, client)
+				continue
+			}
+			s.previous, s.current = s.current, map[uint64]struct{}{}
+		}
+		if stale {
+			g.all = newKeySet()
+			g.rotated = now
+		} else {
+			g.all.previous, g.all.current = g.all.current, map[uint64]struct{}{}
+			g.rotated = g.rotated.Add(g.window)
+		}
+	}
+	return float64(now.Sub(g.rotated)) / float64(g.window)
+}
+
+// allow records a request of client for key, not held in the cache, unless
+// over a threshold, returning which one it is over, client or global, empty
+// if none. Keys already counted are always allowed.
+func (g *keyFlood) allow(client, key string, now time.Time) string {
+	h := maphash.String(g.seed, key)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	progress := g.rotate(now)
+	s := g.clients[client]
+	if s != nil && s.has(h) || s == nil && g.all.has(h) {
+		return ""
+	}
+	if g.perClient > 0 && s != nil && s.estimate(progress) >= float64(g.perClient) {
+		return "client"
+	}
+	if g.global > 0 && !g.all.has(h) && g.all.estimate(progress) >= float64(g.global) {
+		return "global"
+	}
+	if s == nil && g.perClient > 0 && len(g.clients) < maxFloodClients {
+		s = newKeySet()
+		g.clients[client] = s
+	}
+	if s != nil {
+		s.current[h] = struct{}{}
+	}
+	if g.global > 0 {
+		// Not needed otherwise, and holding every key of every client
+		g.all.current[h] = struct{}{}
+	}
+	return ""
+}
+
+// refused counts a request refused over the threshold allow returned.
+func (g *keyFlood) refused(threshold string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if threshold == "client" {
+		g.byClient++
+	} else {
+		g.byGlobal++
+	}
+}
+
+// KeyFloodStats is the state of the key flood guard.
+type KeyFloodStats struct {
+	NewKeys  int64         `json:"new_keys"` // requested over the last window by all clients, estimated, with a global threshold
+	Window   time.Duration `json:"window"`
+	Clients  int           `json:"clients"`   // tracked, having requested new keys lately
+	ByClient int64         `json:"by_client"` // requests refused over the per-client threshold
+	ByGlobal int64         `json:"by_global"` // over the global one
+}
+
+func (g *keyFlood) stats(now time.Time) *KeyFloodStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	progress := g.rotate(now)
+	return &KeyFloodStats{
+		NewKeys:  int64(g.all.estimate(progress)),
+		Window:   g.window,
+		Clients:  len(g.clients),
+		ByClient: g.byClient,
+		ByGlobal: g.byGlobal,
+	}
+}
+
+// guardKeys checks the request of s against the key flood guard when its
+// entry isn't held, reporting false once it answered it on its own.
+func (c *PicoCache) guardKeys(s *requestState) bool {
+	if c.keyFlood == nil || c.trusted(s.r) {
+		return true
+	}
+	if _, held := c.entries.Load(s.cacheFile); held {
+		return true
+	}
+	client, _, err := net.SplitHostPort(s.r.RemoteAddr)
+	if err != nil {
+		client = s.r.RemoteAddr
+	}
+	over := c.keyFlood.allow(client, s.cacheFile, c.steadyNow())
+	if over == "" || !c.enforced(PolicyKeyFlood, s.t, "new key over the key flood guard thresholds",
+		slog.String("client", client), slog.String("threshold", over)) {
+		return true
+	}
+	c.keyFlood.refused(over)
+	s.t.trace("new key over the key flood guard thresholds")
+	if c.keyFloodMode == KeyFloodPassThrough {
+		s.t.outcome = OutcomeBypassFlood
+		c.passThrough(s.w, s.r, c.originURL(s.key), s.log, s.t)
+		return false
+	}
+	s.t.outcome = OutcomeFlood
+	s.w.Header().Set("Retry-After", strconv.Itoa(int(c.keyFlood.window.Seconds())))
+	s.w.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,110 @@
+package picocache_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"testing"
+	"time"
+)
+
+func TestKeyFloodGuard(t *testing.T) {
+	origin := NewFakeOrigin(t)
+	cache := NewTestCache(t, origin, 1<<20, picocache.WithKeyFloodGuard(10, 25, time.Minute))
+	get := func(client, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(client, path string, code int, outcome string) {
+		t.Helper()
+		if w := get(client, path); w.Code != code || w.Header().Get("X-Cache") != outcome {
+			t.Fatalf("%s %s: expected %d %s, got %d %s", client, path, code, outcome, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+	random := func() string {
+		return fmt.Sprintf("/flood/%x", rand.Uint64())
+	}
+
+	// The first new key of 192.0.2.1, the address of test requests
+	cache.Expect("/held", "MISS", "/held")
+	refused := 0
+	for i := range 100 {
+		switch w := get("192.0.2.1", random()); {
+		case i < 9 && w.Header().Get("X-Cache") != "MISS":
+			t.Fatalf("request %d: expected a miss under the threshold, got %d %s", i, w.Code, w.Header().Get("X-Cache"))
+		case w.Code == http.StatusTooManyRequests && w.Header().Get("X-Cache") == "FLOOD" && w.Header().Get("Retry-After") == "60":
+			refused++
+		}
+		// Keys held keep being served, to the flooding client too
+		expect("192.0.2.1", "/held", http.StatusOK, "HIT")
+		expect("192.0.2.2", "/held", http.StatusOK, "HIT")
+	}
+	if refused != 91 {
+		t.Fatalf("expected the new keys over the threshold refused, got %d refusals", refused)
+	}
+
+	// Keys already counted aren't new anymore
+	expect("192.0.2.2", "/held", http.StatusOK, "HIT")
+	for i := range 15 {
+		expect(fmt.Sprintf("192.0.2.%d", 10+i), random(), http.StatusOK, "MISS")
+	}
+	expect("192.0.2.9", random(), http.StatusTooManyRequests, "FLOOD")
+	s := cache.Stats().KeyFlood
+	if s == nil || s.NewKeys != 25 || s.Clients != 16 || s.ByClient != 91 || s.ByGlobal != 1 {
+		t.Fatalf("unexpected key flood stats %+v", s)
+	}
+
+	// The window slides
+	cache.Clock.Advance(90 * time.Second)
+	expect("192.0.2.1", random(), http.StatusOK, "MISS")
+	cache.Clock.Advance(time.Minute)
+	for range 10 {
+		expect("192.0.2.1", random(), http.StatusOK, "MISS")
+	}
+	expect("192.0.2.1", random(), http.StatusTooManyRequests, "FLOOD")
+
+	// They may be streamed uncached instead
+	held := cache.Len()
+	cache.opts = append(cache.opts, picocache.WithKeyFloodMode(picocache.KeyFloodPassThrough))
+	cache.Reopen()
+	for range 10 {
+		expect("192.0.2.1", random(), http.StatusOK, "MISS")
+	}
+	for range 5 {
+		expect("192.0.2.1", random(), http.StatusOK, "BYPASS-FLOOD")
+	}
+	expect("192.0.2.1", "/held", http.StatusOK, "HIT")
+	if n := cache.Len(); n != held+10 {
+		t.Fatalf("expected only the keys under the threshold cached, got %d entries over %d", n, held)
+	}
+}
+
+func TestKeyFloodPerClientOnly(t *testing.T) {
+	origin := NewFakeOrigin(t)
+	cache := NewTestCache(t, origin, 1<<20, picocache.WithKeyFloodGuard(10, 0, time.Minute))
+	for client := range 20 {
+		for i := range 11 {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d/%d", client, i), nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", client+1)
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, r)
+			expected := http.StatusOK
+			if i == 10 {
+				expected = http.StatusTooManyRequests
+			}
+			if w.Code != expected {
+				t.Fatalf("request %d of client %d: expected %d, got %d", i, client, expected, w.Code)
+			}
+		}
+	}
+	// Keys aren't tracked for all clients without a global threshold
+	if s := cache.Stats().KeyFlood; s.NewKeys != 0 || s.Clients != 20 || s.ByClient != 20 {
+		t.Fatalf("unexpected key flood stats %+v", s)
+	}
+}
@@ -0,0 +1,85 @@
+package picocache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WithLanguages varies the entries of the paths matched by a rule with the
+// lang setting by the Accept-Language of requests, normalized to one of
+// languages, such as en or pt-br. Requests asking for none of them get the
+// first one. The source is asked for the normalized language, and its
+// Content-Language sent back along with Vary: Accept-Language. Other paths
+// get a single entry whatever the language.
+func WithLanguages(languages ...string) Option {
+	return func(c *PicoCache) {
+		c.languages = nil
+		for _, l := range languages {
+			if l = strings.ToLower(strings.TrimSpace(l)); l != "" {
+				c.languages = append(c.languages, l)
+			}
+		}
+	}
+}
+
+// language returns the language the entry of a request matching rule
+// varies by, from its Accept-Language header, or an empty string if it
+// doesn't.
+func (c *PicoCache) language(acceptLanguage string, rule *Rule) string {
+	if len(c.languages) == 0 || rule == nil || !rule.Language {
+		return ""
+	}
+
+	best, bestQ := c.languages[0], 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		primary, _, _ := strings.Cut(tag, "-")
+		for _, candidate := range []string{tag, primary} {
+			if slices.Contains(c.languages, candidate) {
+				best, bestQ = candidate, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// languageKey returns the key of the variant of key in language. Request
+// keys never carry a fragment.
+func languageKey(key, language string) string {
+	return key + "#lang=" + language
+}
+
+// languageKeys returns the cache keys of the language variants of the
+// request key of path, none if it doesn't vary by language.
+func (c *PicoCache) languageKeys(path, key string) []string {
+	if c.language("", c.matchRule(path)) == "" {
+		return nil
+	}
+	keys := make([]string, len(c.languages))
+	for i, l := range c.languages {
+		keys[i] = KeyForPath(languageKey(key, l))
+	}
+	return keys
+}
+
+// askLanguage asks the source for the language of the request, if its
+// entry varies by it.
+func (t *timings) askLanguage(req *http.Request) {
+	if t.language != "" {
+		req.Header.Set("Accept-Language", t.language)
+	}
+}
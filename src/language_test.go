@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestLanguages(t *testing.T) {
+	var mu sync.Mutex
+	asked := map[string]int{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := r.Header.Get("Accept-Language")
+		mu.Lock()
+		asked[r.URL.Path+" "+lang]++
+		mu.Unlock()
+		w.Header().Set("Vary", "Accept-Language")
+		switch lang {
+		case "fr":
+			w.Header().Set("Content-Language", "fr")
+			w.Write([]byte("Bonjour"))
+		case "de":
+			w.Header().Set("Content-Language", "de")
+			w.Write([]byte("Hallo"))
+		default:
+			w.Header().Set("Content-Language", "en")
+			w.Write([]byte("Hello"))
+		}
+	}))
+	defer origin.Close()
+
+	rules, err := ParseRules("/docs/ lang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	open := func() *PicoCache {
+		cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithRules(rules...), WithLanguages("en", "fr", "de"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	get := func(cache *PicoCache, path, acceptLanguage, cacheStatus, body, language string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptLanguage != "" {
+			r.Header.Set("Accept-Language", acceptLanguage)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		if w.Header().Get("X-Cache") != cacheStatus || w.Body.String() != body || w.Header().Get("Content-Language") != language {
+			t.Fatalf("%s in %q: expected %s %q in %q, got %s %q in %q", path, acceptLanguage, cacheStatus, body, language,
+				w.Header().Get("X-Cache"), w.Body.String(), w.Header().Get("Content-Language"))
+		}
+		return w
+	}
+
+	cache := open()
+	w := get(cache, "/docs/a", "fr", "MISS", "Bonjour", "fr")
+	if w.Header().Get("Vary") != "Accept-Language" {
+		t.Errorf("expected Vary: Accept-Language, got %q", w.Header().Get("Vary"))
+	}
+	get(cache, "/docs/a", "fr-CA, en;q=0.5", "HIT", "Bonjour", "fr")
+	get(cache, "/docs/a", "en;q=0.2, fr;q=0.9", "HIT", "Bonjour", "fr")
+	get(cache, "/docs/a", "de", "MISS", "Hallo", "de")
+	get(cache, "/docs/a", "de-AT", "HIT", "Hallo", "de")
+	get(cache, "/docs/a", "es", "MISS", "Hello", "en")
+	get(cache, "/docs/a", "", "HIT", "Hello", "en")
+	get(cache, "/docs/a", "fr;q=0, es", "HIT", "Hello", "en")
+
+	// Other paths get a single entry
+	w = get(cache, "/img/a.png", "fr", "MISS", "Hello", "en")
+	if w.Header().Get("Vary") != "" {
+		t.Errorf("expected no Vary, got %q", w.Header().Get("Vary"))
+	}
+	get(cache, "/img/a.png", "de", "HIT", "Hello", "en")
+
+	mu.Lock()
+	for request, n := range map[string]int{"/docs/a fr": 1, "/docs/a de": 1, "/docs/a en": 1, "/img/a.png ": 1} {
+		if asked[request] != n {
+			t.Errorf("%s: expected %d source requests, got %d", request, n, asked[request])
+		}
+	}
+	mu.Unlock()
+	if s := cache.Stats(); s.Entries != 4 {
+		t.Errorf("expected an entry per language and one for the image, got %d", s.Entries)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// Content-Language is kept across restarts
+	cache = open()
+	defer cache.Close()
+	get(cache, "/docs/a", "de", "HIT", "Hallo", "de")
+	if purged := cache.PurgePath("/docs/a"); purged != Purged {
+		t.Fatalf("expected the variants purged, got %s", purged)
+	}
+	if s := cache.Stats(); s.Entries != 1 {
+		t.Errorf("expected the image left only, got %d entries", s.Entries)
+	}
+	get(cache, "/docs/a", "fr", "MISS", "Bonjour", "fr")
+	verifyConsistency(t, cache, dir)
+}
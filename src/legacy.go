@@ -0,0 +1,258 @@
+package picocache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// legacyQueueSize bounds the legacy entries waiting for their upgrade, those
+// hit while it's full getting queued on a later hit.
+const legacyQueueSize = 1024
+
+// WithLegacyUpgrades upgrades legacy entries, cache files found on startup
+// without metadata, as the cache directory of an older version or bare files
+// dropped in it have, once they get hit: their metadata gets written in the
+// background, up to perSecond a second, recording their size, checksum and
+// sniffed content type. With validate, the source is sent a HEAD request for
+// each of them too, whose ETag and Last-Modified are kept when its
+// Content-Length matches the file, so that they can be revalidated. Legacy
+// entries are served as they always were meanwhile, and afterwards too: by
+// the type their path tells, with their key as ETag.
+func WithLegacyUpgrades(perSecond float64, validate bool) Option {
+	return func(c *PicoCache) {
+		if perSecond <= 0 {
+			c.upgrades = nil
+			return
+		}
+		c.upgrades = &legacyUpgrades{
+			every:    time.Duration(float64(time.Second) / perSecond),
+			validate: validate,
+			queue:    make(chan legacyHit, legacyQueueSize),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// legacyUpgrades queues the legacy entries hit for their upgrade.
+type legacyUpgrades struct {
+	every    time.Duration // between upgrades
+	validate bool
+	queue    chan legacyHit
+	queued   sync.Map // of *cacheEntry, in queue
+	done     chan struct{}
+
+	upgraded  atomic.Int64
+	validated atomic.Int64 // of those, bound to the validators of the source
+	failed    atomic.Int64
+}
+
+// legacyHit is a legacy entry hit for the request key, which named it
+// unless empty.
+type legacyHit struct {
+	entry *cacheEntry
+	key   string
+}
+
+// queueUpgrade queues the legacy entry hit for key for its upgrade, unless
+// already queued or the queue is full.
+func (c *PicoCache) queueUpgrade(entry *cacheEntry, key string) {
+	if c.upgrades == nil {
+		return
+	}
+	if _, queued := c.upgrades.queued.LoadOrStore(entry, struct{}{}); queued {
+		return
+	}
+	if c.getCacheFilename(key) != entry.filename {
+		// Keyed by the client or a language variant, the key doesn't
+		// tell what to ask the source for
+		key = ""
+	}
+	select {
+	case c.upgrades.queue <- legacyHit{entry, key}:
+	default:
+		c.upgrades.queued.Delete(entry)
+	}
+}
+
+// upgradeLegacy upgrades the queued legacy entries until the cache closes,
+// one every so often.
+func (c *PicoCache) upgradeLegacy() {
+	defer close(c.upgrades.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(c.upgrades.every)
+	defer ticker.Stop()
+	for {
+		var hit legacyHit
+		select {
+		case <-c.closed:
+			return
+		case hit = <-c.upgrades.queue:
+		}
+		entry := hit.entry
+		c.upgrades.queued.Delete(entry)
+		if !c.frozen.Load() && !c.readOnly.Load() && entry.legacy.Load() {
+			if err := c.upgrade(ctx, entry, hit.key); err != nil && ctx.Err() == nil {
+				c.upgrades.failed.Add(1)
+				c.log.Warn("Failed to upgrade legacy entry", slog.String("file", entry.filename), slog.String("err", err.Error()))
+			}
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var errLegacyChanged = errors.New("legacy file changed while being upgraded")
+
+// upgrade writes the metadata of the legacy entry old, hit for key if not
+// empty, replacing it by an entry recording key, and bound to the validators
+// of the source when checked against it. It does nothing if old got replaced
+// or evicted meanwhile.
+func (c *PicoCache) upgrade(ctx context.Context, old *cacheEntry, key string) error {
+	// The file of an entry only changes once it got replaced, no need to
+	// hold its lock while reading it
+	file, err := c.open(old.filename)
+	if err != nil {
+		return err
+	}
+	sniff := make([]byte, 512)
+	read, _ := io.ReadFull(file, sniff)
+	hash := sha256.New()
+	hash.Write(sniff[:read])
+	n, err := io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if int64(read)+n != old.size {
+		return errLegacyChanged
+	}
+	meta := &entryMeta{
+		Path:        key,
+		Size:        &old.size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		SniffedType: http.DetectContentType(sniff[:read]),
+	}
+
+	etag, lastModified := "", ""
+	if c.upgrades.validate && !c.offline && key != "" {
+		if etag, lastModified, err = c.legacyValidators(ctx, key, old.size); err != nil {
+			return err
+		}
+	}
+
+	defer c.lockFile(old.filename)()
+	if e, ok := c.entries.Load(old.filename); !ok || e != old || !old.legacy.Load() {
+		return nil
+	}
+	entry := &cacheEntry{
+		filename:      old.filename,
+		size:          old.size,
+		diskSize:      old.diskSize,
+		encoding:      old.encoding,
+		decodedSize:   old.decodedSize,
+		sourceEncoded: old.sourceEncoded,
+		expires:       old.expires,
+		hash:          old.hash,
+		filled:        old.filled,
+		path:          key,
+		status:        old.status,
+		location:      old.location,
+		language:      old.language,
+		contentType:   old.contentType,
+		etag:          old.etag,
+		lastModified:  old.lastModified,
+		adaptive:      old.adaptive,
+		origin:        old.origin,
+		staleIfError:  old.staleIfError,
+		headers:       old.headers,
+	}
+	entry.lastUsed.Store(old.lastUsed.Load())
+	entry.hits.Store(old.hits.Load())
+	entry.protected.Store(old.protected.Load())
+	entry.unverified.Store(old.unverified.Load())
+	if etag != "" || lastModified != "" {
+		entry.etag, entry.lastModified, entry.origin = etag, lastModified, c.originID
+		meta.SourceETag, meta.LastModified, meta.Origin = etag, lastModified, entry.origin
+	}
+	if err := c.writeMeta(old.filename, meta); err != nil {
+		return err
+	}
+	entry.sealed.Store(true)
+	if !c.entries.CompareAndSwap(old.filename, old, entry) {
+		return nil
+	}
+	old.legacy.Store(false)
+	c.account(entry)
+	c.unaccount(old)
+	if entry.etag != old.etag || entry.lastModified != old.lastModified {
+		c.upgrades.validated.Add(1)
+	}
+	c.upgrades.upgraded.Add(1)
+	return nil
+}
+
+// legacyValidators returns the validators the source has for the object of
+// key, if its Content-Length says it still is the size bytes held.
+func (c *PicoCache) legacyValidators(ctx context.Context, key string, size int64) (etag, lastModified string, err error) {
+	source := c.originURL(key)
+	req, err := c.newOriginRequest(ctx, source)
+	if err != nil {
+		return "", "", err
+	}
+	req.Method = http.MethodHead
+	req.Header.Set("Accept-Encoding", "identity")
+	fetch := c.startOriginFetch(source, "legacy upgrade", false)
+	resp, err := c.originDo(req)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return "", "", err
+	}
+	resp.Body.Close()
+	fetch.done(resp.StatusCode, 0, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size {
+		// Not the same object anymore, or can't tell: left to expire as is
+		return "", "", nil
+	}
+	return resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+// LegacyStats is the progress of the upgrade of legacy entries, see
+// WithLegacyUpgrades.
+type LegacyStats struct {
+	Remaining int64 `json:"remaining"` // legacy entries held
+	Queued    int   `json:"queued"`
+	Upgraded  int64 `json:"upgraded"`
+	Validated int64 `json:"validated"` // of those, bound to the validators of the source
+	Failed    int64 `json:"failed"`
+}
+
+func (c *PicoCache) legacyStats(remaining int64) LegacyStats {
+	s := LegacyStats{Remaining: remaining}
+	if c.upgrades != nil {
+		s.Queued = len(c.upgrades.queue)
+		s.Upgraded = c.upgrades.upgraded.Load()
+		s.Validated = c.upgrades.validated.Load()
+		s.Failed = c.upgrades.failed.Load()
+	}
+	return s
+}
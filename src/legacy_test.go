@@ -0,0 +1,95 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLegacyUpgrades(t *testing.T) {
+	bodies := map[string]string{"/a.txt": "plain text", "/b.png": "\x89PNG\r\n\x1a\npixels", "/c.txt": "changed at the source"}
+	var heads atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		w.Header().Set("ETag", `"v1`+r.URL.Path+`"`)
+		w.Header().Set("Last-Modified", "Sat, 01 Jun 2024 12:00:00 GMT")
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	legacy := map[string]string{"/a.txt": "plain text", "/b.png": "\x89PNG\r\n\x1a\npixels", "/c.txt": "old"}
+	for path, body := range legacy {
+		if err := os.WriteFile(filepath.Join(dir, KeyForPath(path)), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithLegacyUpgrades(1000, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != legacy[path] || w.Header().Get("ETag") != KeyForPath(path) {
+			t.Fatalf("expected %s served from its legacy file, got %s %q, ETag %s", path, w.Header().Get("X-Cache"), w.Body.String(), w.Header().Get("ETag"))
+		}
+		return w
+	}
+
+	if s := cache.Stats().Legacy; s.Remaining != 3 || s.Upgraded != 0 {
+		t.Fatalf("expected 3 legacy entries, got %+v", s)
+	}
+	types := map[string]string{}
+	for path := range legacy {
+		types[path] = serve(path).Header().Get("Content-Type")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Stats().Legacy.Upgraded != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the legacy entries upgraded, got %+v", cache.Stats().Legacy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := cache.Stats().Legacy; s.Remaining != 0 || s.Validated != 2 || s.Failed != 0 || heads.Load() != 3 {
+		t.Fatalf("expected 3 upgraded, 2 of them validated, after 3 HEAD requests, got %+v, %d", s, heads.Load())
+	}
+
+	// Served the same afterwards
+	for path := range legacy {
+		if got := serve(path).Header().Get("Content-Type"); got != types[path] {
+			t.Fatalf("expected %s still served as %s, got %s", path, types[path], got)
+		}
+	}
+
+	meta, err := readMeta(cache.getCacheFilename("/b.png"))
+	if err != nil || meta == nil {
+		t.Fatalf("expected metadata written, got %v", err)
+	}
+	if meta.Path != "/b.png" || meta.SniffedType != "image/png" || len(meta.Checksum) != 64 || meta.SourceETag != `"v1/b.png"` {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if meta, _ := readMeta(cache.getCacheFilename("/c.txt")); meta == nil || meta.SourceETag != "" || meta.SniffedType != "text/plain; charset=utf-8" {
+		t.Fatalf("expected the changed object upgraded without validators, got %+v", meta)
+	}
+
+	// Upgrades stick over restarts
+	cache.Close()
+	reopened, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if s := reopened.Stats().Legacy; s.Remaining != 0 {
+		t.Fatalf("expected no legacy entries left, got %+v", s)
+	}
+}
@@ -0,0 +1,132 @@
+package picocache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithMaxRequests bounds how many requests are served at once. A hitShare
+// of that budget is kept for requests whose entry is cached, so that misses
+// piling up on a slow source don't starve hits. Requests over the limit wait
+// up to queue for a slot, and get a 503 if none frees up.
+func WithMaxRequests(n int, hitShare float64, queue time.Duration) Option {
+	return func(c *PicoCache) {
+		c.limit = &requestLimit{
+			max:       int64(n),
+			maxMisses: int64(float64(n) * (1 - hitShare)),
+			queue:     queue,
+		}
+	}
+}
+
+// requestClasses are the classes of requests admitted under the limit.
+var requestClasses = [...]string{"hit", "miss"}
+
+const (
+	classHit = iota
+	classMiss
+)
+
+type requestLimit struct {
+	max       int64
+	maxMisses int64
+	queue     time.Duration
+
+	mu       sync.Mutex
+	inFlight int64
+	misses   int64 // of inFlight
+
+	admitted [len(requestClasses)]atomic.Int64
+	shed     [len(requestClasses)]atomic.Int64
+}
+
+func (l *requestLimit) tryAcquire(class int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= l.max || (class == classMiss && l.misses >= l.maxMisses) {
+		return false
+	}
+	l.inFlight++
+	if class == classMiss {
+		l.misses++
+	}
+	return true
+}
+
+func (l *requestLimit) release(class int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if class == classMiss {
+		l.misses--
+	}
+}
+
+// summary returns the requests admitted and shed, by class.
+func (l *requestLimit) summary() (admitted, shed map[string]int64) {
+	admitted, shed = map[string]int64{}, map[string]int64{}
+	for i, class := range requestClasses {
+		admitted[class] = l.admitted[i].Load()
+		shed[class] = l.shed[i].Load()
+	}
+	return admitted, shed
+}
+
+// requestClass tells whether a request for cacheFile is likely a hit, only
+// looking at the index.
+func (c *PicoCache) requestClass(cacheFile string) int {
+	if e, ok := c.entries.Load(cacheFile); ok {
+		if entry := e.(*cacheEntry); entry.sealed.Load() && !entry.expired(c.steadyNow()) {
+			return classHit
+		}
+	}
+	return classMiss
+}
+
+// admitRequest takes a slot under the request limit for a request for
+// cacheFile, once one is free for its class.
+func (c *PicoCache) admitRequest(ctx context.Context, cacheFile string, t *timings) (release func(), ok bool) {
+	l := c.limit
+	if l == nil {
+		return func() {}, true
+	}
+
+	class := c.requestClass(cacheFile)
+	deadline := time.Now().Add(l.queue)
+	var end func() time.Duration
+	defer func() {
+		if end != nil {
+			end()
+		}
+	}()
+	for {
+		if l.tryAcquire(class) {
+			// Hits turned misses meanwhile don't get to fill from the slots
+			// kept for hits
+			if class == classHit && c.requestClass(cacheFile) == classMiss {
+				l.release(class)
+				class = classMiss
+				continue
+			}
+			l.admitted[class].Add(1)
+			return func() { l.release(class) }, true
+		}
+		if end == nil {
+			end = c.waits.begin(cacheFile, waitAdmission, t)
+		}
+		if !time.Now().Before(deadline) {
+			t.trace("shed as a %s, over the request limit", requestClasses[class])
+			l.shed[class].Add(1)
+			return nil, false
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(readerPollInterval):
+		}
+	}
+}
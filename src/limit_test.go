@@ -0,0 +1,103 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxRequestsKeepsHitsFast(t *testing.T) {
+	unblock := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/warm" {
+			<-unblock
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithMaxRequests(4, 0.5, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if code := get("/warm"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	// Saturate the misses budget with fills stuck on the source
+	wg := sync.WaitGroup{}
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := get(fmt.Sprintf("/stuck%d", i)); code != http.StatusOK {
+				t.Errorf("unexpected status %d", code)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); cache.Stats().Admitted["miss"] < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("misses not admitted")
+		}
+	}
+
+	if code := get("/more"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected misses over their budget to be shed, got %d", code)
+	}
+	for range 20 {
+		start := time.Now()
+		if code := get("/warm"); code != http.StatusOK {
+			t.Fatalf("expected hits to be served, got %d", code)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Fatalf("hit took %s", d)
+		}
+	}
+
+	close(unblock)
+	wg.Wait()
+	s := cache.Stats()
+	if s.Admitted["hit"] != 20 || s.Admitted["miss"] != 3 || s.Shed["miss"] != 1 || s.Shed["hit"] != 0 {
+		t.Fatalf("unexpected admissions %v, shedding %v", s.Admitted, s.Shed)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestMaxRequestsQueue(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithMaxRequests(1, 0, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/queued%d", i), nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("expected queued requests to be served, got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if s := cache.Stats(); s.Admitted["miss"] != 3 {
+		t.Fatalf("unexpected admissions %v", s.Admitted)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,118 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithIgnoreLock starts the cache even though another instance seems to be
+// using its directory, to recover from a lock wrongly thought held.
+func WithIgnoreLock() Option {
+	return func(c *PicoCache) {
+		c.ignoreLock = true
+	}
+}
+
+const dirLockFile = "picocache.lock"
+
+var (
+	errDirLocked       = errors.New("cache directory used by another instance")
+	errLockUnsupported = errors.New("file locks unsupported")
+)
+
+// isControlFile reports whether name is one of the files of the cache
+// directory which isn't an entry.
+func isControlFile(name string) bool {
+	return name == manifestFile || name == dirLockFile
+}
+
+// lockHolder is what a lock file records of the instance holding it.
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Dir     string    `json:"dir"`
+}
+
+func (h *lockHolder) String() string {
+	return fmt.Sprintf("pid %d since %s", h.PID, h.Started.Format(time.RFC3339))
+}
+
+// dirLock is the exclusive lock of a cache directory, held by a single
+// instance at once.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir locks dir with lock, failing with errDirLocked when another
+// instance holds it, unless ignored. When lock isn't supported, the lock
+// is held as long as the process recorded in the file is alive.
+func lockDir(dir string, ignore bool, log *slog.Logger, lock func(*os.File) error) (*dirLock, error) {
+	path := filepath.Join(dir, dirLockFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := readLockHolder(file)
+	switch err := lock(file); {
+	case err == nil:
+	case errors.Is(err, errLockUnsupported) && (holder == nil || !processAlive(holder.PID)):
+		if holder != nil {
+			log.Warn("Taking over stale cache directory lock", slog.String("holder", holder.String()))
+		}
+	case ignore:
+		log.Warn("Ignoring cache directory lock", slog.String("err", err.Error()))
+	case holder != nil:
+		file.Close()
+		return nil, fmt.Errorf("%w, %s", errDirLocked, holder)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("%w: %w", errDirLocked, err)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	b, err := json.Marshal(&lockHolder{PID: os.Getpid(), Started: time.Now(), Dir: abs})
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(b, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &dirLock{file: file}, nil
+}
+
+// readLockHolder returns who holds the lock according to its file, nil if
+// nobody does.
+func readLockHolder(file *os.File) *lockHolder {
+	b, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	holder := &lockHolder{}
+	if err := json.Unmarshal(b, holder); err != nil || holder.PID == 0 {
+		return nil
+	}
+	return holder
+}
+
+// release releases the lock, emptying its file for those relying on it.
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	return l.file.Close()
+}
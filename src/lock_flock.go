@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package picocache
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive lock on file without waiting, released by the
+// kernel should the process die.
+func flock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.ENOLCK) || errors.Is(err, syscall.EOPNOTSUPP) {
+		return errLockUnsupported
+	}
+	return err
+}
+
+// processAlive reports whether the process pid runs, or may.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
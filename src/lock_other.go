@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package picocache
+
+import "os"
+
+// flock returns errLockUnsupported, file locks being left out on this
+// platform.
+func flock(file *os.File) error {
+	return errLockUnsupported
+}
+
+// processAlive returns true, whether pid runs can't be told on this
+// platform.
+func processAlive(pid int) bool {
+	return true
+}
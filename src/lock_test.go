@@ -0,0 +1,97 @@
+package picocache
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDirLock(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	if _, err := NewCache(slog.Default(), origin.URL, dir, 1<<20); !errors.Is(err, errDirLocked) {
+		t.Fatalf("expected the second instance to fail, got %v", err)
+	}
+	if s := cache.Stats(); s.Entries != 1 || s.TotalSize != 3 {
+		t.Fatalf("lock file taken for an entry %+v", s)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1))
+	if err != nil {
+		t.Fatalf("expected the lock released on close, got %v", err)
+	}
+	defer restarted.Close()
+	if s := restarted.Stats(); s.Entries != 1 || s.TotalSize != 3 {
+		t.Fatalf("lock file taken for an entry %+v", s)
+	}
+	ignoring, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithIgnoreLock())
+	if err != nil {
+		t.Fatalf("expected the lock ignored, got %v", err)
+	}
+	ignoring.Close()
+}
+
+func TestStaleDirLock(t *testing.T) {
+	// A process which is gone, its pid not reused in the meantime
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("can't run true:", err)
+	}
+	dead := exited.ProcessState.Pid()
+	unsupported := func(*os.File) error { return errLockUnsupported }
+
+	dir := t.TempDir()
+	write := func(pid int) {
+		b := []byte(`{"pid":` + strconv.Itoa(pid) + `,"started":"2024-01-01T00:00:00Z"}`)
+		if err := os.WriteFile(filepath.Join(dir, dirLockFile), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(dead)
+	lock, err := lockDir(dir, false, slog.Default(), unsupported)
+	if err != nil {
+		t.Fatalf("expected the stale lock taken over, got %v", err)
+	}
+	if holder := readLockHolder(lock.file); holder == nil || holder.PID != os.Getpid() {
+		t.Fatalf("expected the lock file to record this process, got %v", holder)
+	}
+	if _, err := lockDir(dir, false, slog.Default(), unsupported); !errors.Is(err, errDirLocked) {
+		t.Fatalf("expected a live holder to keep its lock, got %v", err)
+	}
+	lock.release()
+
+	// The kernel knows better when file locks are supported
+	write(os.Getppid())
+	if lock, err = lockDir(dir, false, slog.Default(), flock); err != nil {
+		t.Fatalf("expected an unheld lock taken, got %v", err)
+	}
+	lock.release()
+
+	write(os.Getppid())
+	if _, err := lockDir(dir, false, slog.Default(), unsupported); !errors.Is(err, errDirLocked) {
+		t.Fatalf("expected a live holder to keep its lock, got %v", err)
+	}
+	lock, err = lockDir(dir, true, slog.Default(), unsupported)
+	if err != nil {
+		t.Fatalf("expected the lock ignored, got %v", err)
+	}
+	lock.release()
+}
@@ -0,0 +1,154 @@
+package picocache
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithLogSuppression logs identical warnings and errors only once per
+// window, like one per failed request while the source is down. How many
+// got suppressed is logged once the window is over.
+func WithLogSuppression(window time.Duration) Option {
+	return func(c *PicoCache) {
+		c.logSuppressWindow = window
+	}
+}
+
+// suppressedLines is a log line seen during its window.
+type suppressedLines struct {
+	start   time.Time
+	handler slog.Handler // the line went through, along with its attributes
+	record  slog.Record
+	count   int64 // seen again since the start
+}
+
+// logSuppressor tracks the lines seen by suppressingHandlers, by
+// suppressionKey.
+type logSuppressor struct {
+	window     time.Duration
+	now        func() time.Time
+	suppressed atomic.Int64
+
+	mu    sync.Mutex
+	lines map[string]*suppressedLines
+}
+
+func newLogSuppressor(window time.Duration, now func() time.Time) *logSuppressor {
+	return &logSuppressor{window: window, now: now, lines: map[string]*suppressedLines{}}
+}
+
+// requestError matches the method and URL Go's client prefixes its errors
+// with, which differ from one request to the next.
+var requestError = regexp.MustCompile(`^[A-Z][a-z]* "[^"]*": `)
+
+// suppressionKey returns what makes lines identical: their level and
+// message, the host of their url and their err, if any.
+func suppressionKey(r slog.Record) string {
+	key := r.Level.String() + "\x00" + r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "url":
+			if u, err := url.Parse(a.Value.String()); err == nil && u.Host != "" {
+				key += "\x00" + u.Host
+			}
+		case "err":
+			key += "\x00" + requestError.ReplaceAllString(a.Value.String(), "")
+		}
+		return true
+	})
+	return key
+}
+
+// flush logs how many lines got suppressed during the windows which are
+// over, or all of them with all set.
+func (s *logSuppressor) flush(all bool) {
+	now := s.now()
+	s.mu.Lock()
+	over := []*suppressedLines{}
+	for key, lines := range s.lines {
+		if all || now.Sub(lines.start) >= s.window {
+			delete(s.lines, key)
+			over = append(over, lines)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, lines := range over {
+		if lines.count > 0 {
+			s.summarize(lines, now)
+		}
+	}
+}
+
+func (s *logSuppressor) summarize(lines *suppressedLines, now time.Time) {
+	r := slog.NewRecord(now, lines.record.Level, "Suppressed similar log lines", 0)
+	r.AddAttrs(slog.String("message", lines.record.Message), slog.Int64("suppressed", lines.count),
+		slog.Duration("window", now.Sub(lines.start).Round(time.Second)))
+	lines.record.Attrs(func(a slog.Attr) bool {
+		if a.Key == "err" {
+			r.AddAttrs(a)
+		}
+		return true
+	})
+	lines.handler.Handle(context.Background(), r)
+}
+
+// suppressingHandler is a handler letting a logSuppressor drop repeated
+// warnings and errors.
+type suppressingHandler struct {
+	slog.Handler
+	s *logSuppressor
+}
+
+func (h *suppressingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	key := suppressionKey(r)
+	now := h.s.now()
+	h.s.mu.Lock()
+	lines := h.s.lines[key]
+	if lines != nil && now.Sub(lines.start) < h.s.window {
+		lines.count++
+		h.s.mu.Unlock()
+		h.s.suppressed.Add(1)
+		return nil
+	}
+	h.s.lines[key] = &suppressedLines{start: now, handler: h.Handler, record: r.Clone()}
+	h.s.mu.Unlock()
+
+	if lines != nil && lines.count > 0 {
+		h.s.summarize(lines, now)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *suppressingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &suppressingHandler{h.Handler.WithAttrs(attrs), h.s}
+}
+
+func (h *suppressingHandler) WithGroup(name string) slog.Handler {
+	return &suppressingHandler{h.Handler.WithGroup(name), h.s}
+}
+
+// flushSuppressedLogs summarizes the suppressed lines once their window is
+// over, until the cache is closed, see Close for the rest.
+func (c *PicoCache) flushSuppressedLogs() {
+	ticker := time.NewTicker(max(c.logSuppressor.window/10, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.logSuppressor.flush(false)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package picocache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHandler keeps the records logged through it.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.records = append(h.records, r)
+	h.mu.Unlock()
+	return nil
+}
+
+func attr(r slog.Record, key string) slog.Value {
+	var v slog.Value
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v = a.Value
+		}
+		return a.Key != key
+	})
+	return v
+}
+
+func TestLogSuppression(t *testing.T) {
+	h := &recordingHandler{}
+	now := time.Now()
+	s := newLogSuppressor(time.Minute, func() time.Time { return now })
+	log := slog.New(&suppressingHandler{h, s})
+
+	for i := range 10_000 {
+		url := fmt.Sprintf("http://source/%d", i)
+		err := fmt.Errorf(`Get "%s": dial tcp: connection refused`, url)
+		log.With(slog.String("url", fmt.Sprint(i))).Error("Failed to fetch file", slog.String("url", url), slog.String("err", err.Error()))
+		log.Info("Origin fetch", slog.String("url", url))
+	}
+	log.Error("Failed to fetch file", slog.String("url", "http://other/0"), slog.String("err", "dial tcp: connection refused"))
+	log.Error("Failed to fetch file", slog.String("url", "http://source/0"), slog.String("err", "dial tcp: i/o timeout"))
+	if len(h.records) != 10_003 {
+		t.Fatalf("expected 3 errors and every info line, got %d lines", len(h.records))
+	}
+	if n := s.suppressed.Load(); n != 9_999 {
+		t.Fatalf("expected 9999 lines suppressed, got %d", n)
+	}
+
+	now = now.Add(30 * time.Second)
+	s.flush(false)
+	if len(h.records) != 10_003 {
+		t.Fatalf("expected no summary before the end of the window, got %d lines", len(h.records))
+	}
+
+	now = now.Add(30 * time.Second)
+	s.flush(false)
+	if len(h.records) != 10_004 {
+		t.Fatalf("expected a single summary, got %d lines", len(h.records)-10_003)
+	}
+	summary := h.records[len(h.records)-1]
+	if summary.Level != slog.LevelError || summary.Message != "Suppressed similar log lines" ||
+		attr(summary, "message").String() != "Failed to fetch file" || attr(summary, "suppressed").Int64() != 9_999 ||
+		attr(summary, "window").Duration() != time.Minute {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+
+	// A new window once the previous one is over
+	log.Error("Failed to fetch file", slog.String("url", "http://source/0"), slog.String("err", `Get "http://source/0": dial tcp: connection refused`))
+	if len(h.records) != 10_005 {
+		t.Fatalf("expected the error logged again, got %d lines", len(h.records)-10_004)
+	}
+}
+
+func TestLogSuppressionStats(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	origin.Close()
+
+	h := &recordingHandler{}
+	cache, err := NewCache(slog.New(h), origin.URL, t.TempDir(), 1<<20, WithLogSuppression(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 50 {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected the fill to fail, got %d", w.Code)
+		}
+	}
+	if s := cache.Stats(); s.Misses != 50 || s.LogSuppressed < 49 {
+		t.Fatalf("expected every failure counted and repeated errors suppressed, got %+v", s)
+	}
+	errorLines := 0
+	for _, r := range h.records {
+		if r.Level == slog.LevelError {
+			errorLines++
+		}
+	}
+	if errorLines != 1 {
+		t.Fatalf("expected a single error line, got %d", errorLines)
+	}
+
+	cache.Close()
+	if last := h.records[len(h.records)-1]; last.Message != "Suppressed similar log lines" {
+		t.Fatalf("expected the suppressed lines summarized on close, got %q", last.Message)
+	}
+}
@@ -0,0 +1,283 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Window is a daily maintenance window, from Start to End past midnight. It
+// wraps around midnight when End comes before Start.
+type Window struct {
+	Start, End time.Duration
+}
+
+// ParseWindows parses comma separated HH:MM-HH:MM windows, e.g.
+// 03:00-05:00,22:30-23:00.
+func ParseWindows(s string) ([]Window, error) {
+	windows := []Window{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		start, end, ok := strings.Cut(field, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", field)
+		}
+		w := Window{}
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", field, err)
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", field, err)
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("invalid window %q, empty", field)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseClock parses HH:MM into the time past midnight.
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	hours, err := strconv.Atoi(hh)
+	if !ok || err != nil || len(hh) != 2 || hours > 23 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	minutes, err := strconv.Atoi(mm)
+	if err != nil || len(mm) != 2 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func (w Window) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+// contains reports whether the wall clock of t is within the window.
+func (w Window) contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start < w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
+}
+
+// WithMaintenanceWindows restricts background maintenance, like scrubbing,
+// to the given daily windows in loc, local time when nil. Eviction still
+// runs whenever the cache is over its size.
+func WithMaintenanceWindows(loc *time.Location, windows ...Window) Option {
+	return func(c *PicoCache) {
+		if loc == nil {
+			loc = time.Local
+		}
+		c.maintenance.loc, c.maintenance.windows = loc, windows
+	}
+}
+
+// WithScrub verifies a random sample of entries every interval, purging the
+// corrupt ones, see Verify. Scrubs run within maintenance windows.
+func WithScrub(sample int, every time.Duration) Option {
+	return func(c *PicoCache) {
+		c.scrubSample, c.scrubEvery = sample, every
+	}
+}
+
+// maintenanceTask is background work on the cache directory. Runs of a task
+// never overlap: one asked for while another runs makes the latter go
+// again.
+type maintenanceTask struct {
+	name     string
+	priority int           // higher runs first
+	every    time.Duration // 0 for tasks only run when asked for
+	urgent   func() bool   // whether it can't wait for a window, if set
+	run      func(stop func() bool, progress *atomic.Int64)
+
+	mu       sync.Mutex // held while running
+	pending  atomic.Bool
+	running  atomic.Bool
+	runs     atomic.Int64
+	lastRun  atomic.Int64 // unix nanoseconds, when the last run started
+	progress atomic.Int64 // entries handled by the current or last run
+}
+
+// maintenance schedules the maintenance tasks, running the ones which can
+// wait within the windows only, if any.
+type maintenance struct {
+	loc     *time.Location
+	windows []Window
+	tasks   []*maintenanceTask // by decreasing priority
+}
+
+// register adds a task, before the cache starts.
+func (m *maintenance) register(task *maintenanceTask) {
+	m.tasks = append(m.tasks, task)
+	sort.SliceStable(m.tasks, func(i, j int) bool {
+		return m.tasks[i].priority > m.tasks[j].priority
+	})
+}
+
+// open reports whether now is within a maintenance window.
+func (m *maintenance) open(now time.Time) bool {
+	now = now.In(m.loc)
+	for _, w := range m.windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow reports whether maintenance can run right now, always true
+// without any window.
+func (c *PicoCache) inWindow() bool {
+	return len(c.maintenance.windows) == 0 || c.maintenance.open(c.now())
+}
+
+// registerMaintenance registers the maintenance tasks of the cache.
+func (c *PicoCache) registerMaintenance() {
+	c.evictTask = &maintenanceTask{
+		name:     "evict",
+		priority: 100,
+		urgent: func() bool {
+			return c.overLimit()
+		},
+		run: func(stop func() bool, progress *atomic.Int64) {
+			progress.Add(int64(c.evict()))
+		},
+	}
+	c.maintenance.register(c.evictTask)
+
+	c.maintenance.register(&maintenanceTask{
+		name:     "aux sweep",
+		priority: 50,
+		every:    auxSweepEvery,
+		run: func(stop func() bool, progress *atomic.Int64) {
+			progress.Add(int64(c.sweepAux()))
+		},
+	})
+
+	if c.scrubSample > 0 {
+		c.maintenance.register(&maintenanceTask{
+			name:     "scrub",
+			priority: 10,
+			every:    c.scrubEvery,
+			run: func(stop func() bool, progress *atomic.Int64) {
+				report := c.verify(c.scrubSample, true, stop, progress)
+				c.log.Info("Cache scrubbed", slog.Int("checked", report.Checked), slog.Int("corrupt", len(report.Corrupt)))
+			},
+		})
+	}
+}
+
+// request asks for task to run, right away when urgent or within a window,
+// else once the next one opens.
+func (c *PicoCache) request(task *maintenanceTask) {
+	task.pending.Store(true)
+	if c.draining() {
+		return
+	}
+	if c.inWindow() || task.urgent != nil && task.urgent() {
+		c.runTask(task)
+	}
+}
+
+// runTask runs task while pending, unless it's already running. Runs which
+// can wait get stopped once their window closes.
+func (c *PicoCache) runTask(task *maintenanceTask) {
+	stop := func() bool {
+		select {
+		case <-c.closed:
+			return true
+		default:
+		}
+		return c.draining() || !c.inWindow() && (task.urgent == nil || !task.urgent())
+	}
+	for task.pending.Load() && task.mu.TryLock() {
+		for task.pending.Swap(false) {
+			task.running.Store(true)
+			// Only periodic tasks get due by the cache clock, the others
+			// run from whichever goroutine asked for them
+			started := time.Now()
+			if task.every > 0 {
+				started = c.now()
+			}
+			task.lastRun.Store(started.UnixNano())
+			task.progress.Store(0)
+			task.run(stop, &task.progress)
+			task.runs.Add(1)
+			task.running.Store(false)
+		}
+		task.mu.Unlock()
+	}
+}
+
+// maintain runs the tasks due or asked for, by priority, if they can
+// right now. None does while draining.
+func (c *PicoCache) maintain() {
+	if c.draining() {
+		return
+	}
+	for _, task := range c.maintenance.tasks {
+		now := c.now()
+		if task.every > 0 && now.Sub(time.Unix(0, task.lastRun.Load())) >= task.every {
+			task.pending.Store(true)
+		}
+		if task.pending.Load() && (c.inWindow() || task.urgent != nil && task.urgent()) {
+			c.runTask(task)
+		}
+	}
+}
+
+// maintainPeriodically runs maintain every minute.
+func (c *PicoCache) maintainPeriodically() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.maintain()
+		}
+	}
+}
+
+// MaintenanceStats is the state of a maintenance task.
+type MaintenanceStats struct {
+	Task     string    `json:"task"`
+	Pending  bool      `json:"pending"` // waiting for a window
+	Running  bool      `json:"running"`
+	Runs     int64     `json:"runs"`
+	LastRun  time.Time `json:"last_run,omitzero"`
+	Progress int64     `json:"progress"` // entries handled by the current or last run
+}
+
+func (m *maintenance) summary() []MaintenanceStats {
+	summary := make([]MaintenanceStats, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		s := MaintenanceStats{
+			Task:     task.name,
+			Pending:  task.pending.Load(),
+			Running:  task.running.Load(),
+			Runs:     task.runs.Load(),
+			Progress: task.progress.Load(),
+		}
+		if last := task.lastRun.Load(); last != 0 {
+			s.LastRun = time.Unix(0, last)
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
@@ -0,0 +1,154 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("03:00-05:00, 23:30-00:15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(windows) != "[03:00-05:00 23:30-00:15]" {
+		t.Fatalf("unexpected windows %v", windows)
+	}
+	for _, tc := range []struct {
+		clock  string
+		window int
+		inside bool
+	}{
+		{"02:59", 0, false},
+		{"03:00", 0, true},
+		{"04:59", 0, true},
+		{"05:00", 0, false},
+		{"23:29", 1, false},
+		{"23:30", 1, true},
+		{"00:00", 1, true},
+		{"00:15", 1, false},
+	} {
+		at, _ := time.Parse("15:04", tc.clock)
+		if got := windows[tc.window].contains(at); got != tc.inside {
+			t.Errorf("%s in %v: expected %v", tc.clock, windows[tc.window], tc.inside)
+		}
+	}
+
+	for _, s := range []string{"", "03:00", "3:00-05:00", "03:00-24:00", "03:60-05:00", "03:00-03:00"} {
+		if _, err := ParseWindows(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	windows, err := ParseWindows("03:00-05:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 30, WithBlockSize(1), WithScrub(100, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := func(name string) MaintenanceStats {
+		for _, s := range cache.Stats().Maintenance {
+			if s.Task == name {
+				return s
+			}
+		}
+		t.Fatalf("no %s task", name)
+		return MaintenanceStats{}
+	}
+
+	// Windowed once the startup cleanup ran, for the clock to be injected
+	for task("evict").Runs == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var mu sync.Mutex
+	now := time.Date(2024, 6, 1, 2, 59, 0, 0, zone)
+	step := time.Duration(0) // per reading
+	set := func(t time.Time) {
+		mu.Lock()
+		now = t
+		mu.Unlock()
+	}
+	cache.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(step)
+		return now
+	}
+	WithMaintenanceWindows(zone, windows...)(cache)
+
+	// Size pressure doesn't wait for the window
+	for i := range 20 {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil))
+	}
+	cache.cleanupOldEntries()
+	cache.evictTask.mu.Lock()
+	cache.evictTask.mu.Unlock()
+	if size := cache.totalSize.Load(); size > 30 {
+		t.Fatalf("expected eviction outside of the window, cache at %d bytes", size)
+	}
+	if task("evict").Runs == 0 {
+		t.Fatal("expected eviction runs counted")
+	}
+
+	var corrupt *cacheEntry
+	cache.entries.Range(func(key, value any) bool {
+		corrupt = value.(*cacheEntry)
+		return false
+	})
+	if err := os.WriteFile(corrupt.filename, []byte("Nay!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.maintain()
+	if s := task("scrub"); !s.Pending || s.Runs != 0 || cache.Stats().MaintenanceOpen {
+		t.Fatalf("expected the scrub to wait for the window, got %+v", s)
+	}
+
+	set(time.Date(2024, 6, 1, 3, 0, 0, 0, zone))
+	cache.maintain()
+	if s := task("scrub"); s.Pending || s.Runs != 1 || !s.LastRun.Equal(cache.now()) || s.Progress != 10 {
+		t.Fatalf("expected a scrub once the window opened, got %+v", s)
+	}
+	if _, ok := cache.entries.Load(corrupt.filename); ok {
+		t.Fatal("expected the corrupt entry scrubbed")
+	}
+
+	set(time.Date(2024, 6, 1, 3, 30, 0, 0, zone))
+	cache.maintain()
+	if s := task("scrub"); s.Runs != 1 {
+		t.Fatalf("expected no scrub before it's due, got %+v", s)
+	}
+
+	set(time.Date(2024, 6, 1, 6, 0, 0, 0, zone))
+	cache.maintain()
+	if s := task("scrub"); !s.Pending || s.Runs != 1 {
+		t.Fatalf("expected the due scrub to wait for the next window, got %+v", s)
+	}
+
+	// Stepping across the end of the window while scrubbing
+	set(time.Date(2024, 6, 2, 4, 59, 0, 0, zone))
+	mu.Lock()
+	step = 5 * time.Second
+	mu.Unlock()
+	cache.maintain()
+	if s := task("scrub"); s.Runs != 2 || s.Progress == 0 || s.Progress >= 9 {
+		t.Fatalf("expected the scrub stopped as the window closed, got %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,104 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const metaSuffix = ".meta"
+const tempSuffix = ".tmp"
+
+// entryMeta holds what can't be derived from a cache file itself. It is
+// stored as JSON next to the file, only for entries which need it.
+type entryMeta struct {
+	Encoding        string `json:"encoding,omitempty"`
+	DecodedSize     int64  `json:"decoded_size,omitempty"`
+	SourceEncoded   bool   `json:"source_encoded,omitempty"` // the source sent Encoding, see WithOriginCompression
+	Expires         int64  `json:"expires,omitempty"`        // unix time
+	Hash            string `json:"hash,omitempty"`           // of the body, see WithDedup
+	Key             string `json:"key,omitempty"`            // when set by the client
+	Path            string `json:"path,omitempty"`           // the entry was fetched from, along with Key
+	Size            *int64 `json:"size,omitempty"`           // of the file, when synced to disk
+	Status          int    `json:"status,omitempty"`         // when not 200, see WithCacheableStatus
+	Location        string `json:"location,omitempty"`
+	ContentLanguage string `json:"content_language,omitempty"` // see WithLanguages
+	ContentType     string `json:"content_type,omitempty"`     // of the source response, see WithSourceContentType
+	SourceETag      string `json:"source_etag,omitempty"`      // validators of the source response, see revalidate
+	LastModified    string `json:"last_modified,omitempty"`
+	Origin          string `json:"origin,omitempty"`         // source it was filled from, see originIdentity
+	StaleIfError    int64  `json:"stale_if_error,omitempty"` // seconds, of the source response, see WithStaleIfError
+	AdaptiveTTL     int64  `json:"adaptive_ttl,omitempty"`   // seconds, see WithAdaptiveTTL
+	Unchanged       int    `json:"unchanged,omitempty"`      // revalidations in a row finding it unchanged
+	Changed         int64  `json:"changed,omitempty"`        // unix time it last was found changed
+	Checksum        string `json:"checksum,omitempty"`       // SHA-256 of the file, of upgraded legacy entries, see WithLegacyUpgrades
+	SniffedType     string `json:"sniffed_type,omitempty"`   // as told by the first bytes of the file, of those too
+
+	Headers http.Header `json:"headers,omitempty"` // see WithPassthroughHeaders
+}
+
+// empty tells whether meta holds nothing, not worth storing.
+func (m *entryMeta) empty() bool {
+	return reflect.ValueOf(*m).IsZero()
+}
+
+// isAuxFile reports whether path is a metadata or temporary file rather than
+// a cached body.
+func isAuxFile(path string) bool {
+	return strings.HasSuffix(path, metaSuffix) || strings.HasSuffix(path, tempSuffix)
+}
+
+func (c *PicoCache) writeMeta(cacheFile string, meta *entryMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tempFile := cacheFile + metaSuffix + tempSuffix
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = c.syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err := os.Rename(tempFile, cacheFile+metaSuffix); err != nil {
+		return err
+	}
+	return c.renamed(cacheFile + metaSuffix)
+}
+
+// readMeta returns the metadata stored for cacheFile, nil if it has none.
+func readMeta(cacheFile string) (*entryMeta, error) {
+	b, err := os.ReadFile(cacheFile + metaSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &entryMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// removeFiles deletes the body and metadata of entry from disk.
+func removeFiles(entry *cacheEntry) {
+	os.Remove(entry.filename)
+	os.Remove(entry.filename + metaSuffix)
+}
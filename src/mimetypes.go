@@ -0,0 +1,152 @@
+package picocache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// builtinMIMETypes supplements the system table, which misses some types
+// or differs between systems. They take precedence over it.
+var builtinMIMETypes = map[string]string{
+	".avif":  "image/avif",
+	".heic":  "image/heic",
+	".jxl":   "image/jxl",
+	".webp":  "image/webp",
+	".svg":   "image/svg+xml",
+	".mp4":   "video/mp4",
+	".m4a":   "audio/mp4",
+	".m4s":   "video/iso.segment",
+	".webm":  "video/webm",
+	".opus":  "audio/ogg",
+	".ts":    "video/mp2t",
+	".m3u8":  "application/vnd.apple.mpegurl",
+	".mpd":   "application/dash+xml",
+	".vtt":   "text/vtt; charset=utf-8",
+	".wasm":  "application/wasm",
+	".mjs":   "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".woff2": "font/woff2",
+}
+
+// WithMIMETypes adds or overrides the content types sent per extension,
+// keyed with their leading dot. They take precedence over the built-in
+// and system ones.
+func WithMIMETypes(types map[string]string) Option {
+	return func(c *PicoCache) {
+		if c.mimeTypes == nil {
+			c.mimeTypes = map[string]string{}
+		}
+		for ext, typ := range types {
+			c.mimeTypes[strings.ToLower(ext)] = typ
+		}
+	}
+}
+
+// contentType returns the content type of path from its extension, an
+// empty string when unknown.
+func (c *PicoCache) contentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return ""
+	}
+	if typ, ok := c.mimeTypes[ext]; ok {
+		return typ
+	}
+	if typ, ok := builtinMIMETypes[ext]; ok {
+		return typ
+	}
+	typ := mime.TypeByExtension(ext)
+	if typ == "" {
+		c.log.Debug("Unknown extension", slog.String("ext", ext))
+	}
+	return typ
+}
+
+// ParseMIMETypes parses content types for WithMIMETypes: either inline,
+// as comma-separated ext=type pairs such as avif=image/avif, or the path to
+// an nginx mime.types file.
+func ParseMIMETypes(s string) (map[string]string, error) {
+	if !strings.Contains(s, "=") {
+		f, err := os.Open(s)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseNginxMIMETypes(f)
+	}
+
+	types := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		ext, typ, found := strings.Cut(strings.TrimSpace(pair), "=")
+		ext, typ = strings.TrimSpace(ext), strings.TrimSpace(typ)
+		if !found || ext == "" || typ == "" {
+			return nil, fmt.Errorf("invalid MIME type %q, expected ext=type", pair)
+		}
+		types[withDot(ext)] = typ
+	}
+	return types, nil
+}
+
+// ParseNginxMIMETypes parses a mime.types file in the nginx format:
+//
+//	types {
+//	    text/html  html htm;
+//	    image/avif avif;
+//	}
+//
+// The types block is optional, comments start with #.
+func ParseNginxMIMETypes(r io.Reader) (map[string]string, error) {
+	tokens := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		for _, sep := range []string{";", "{", "}"} {
+			line = strings.ReplaceAll(line, sep, " "+sep+" ")
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(tokens) >= 2 && tokens[0] == "types" && tokens[1] == "{" {
+		if tokens[len(tokens)-1] != "}" {
+			return nil, errors.New("unterminated types block")
+		}
+		tokens = tokens[2 : len(tokens)-1]
+	}
+
+	types := map[string]string{}
+	entry := []string{}
+	for _, token := range tokens {
+		switch token {
+		case "{", "}":
+			return nil, fmt.Errorf("unexpected %q", token)
+		case ";":
+			if len(entry) < 2 {
+				return nil, fmt.Errorf("expected a type and extensions, got %q", strings.Join(entry, " "))
+			}
+			for _, ext := range entry[1:] {
+				types[withDot(ext)] = entry[0]
+			}
+			entry = entry[:0]
+		default:
+			entry = append(entry, token)
+		}
+	}
+	if len(entry) > 0 {
+		return nil, fmt.Errorf("missing ; after %q", strings.Join(entry, " "))
+	}
+	return types, nil
+}
+
+func withDot(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+}
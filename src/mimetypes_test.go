@@ -0,0 +1,84 @@
+package picocache
+
+import (
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNginxMIMETypes(t *testing.T) {
+	types, err := ParseNginxMIMETypes(strings.NewReader(`
+# Our types
+types {
+    text/html                 html htm shtml;
+    image/avif avif;   # not known everywhere
+    application/vnd.apple.mpegurl
+                              m3u8;
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		".html": "text/html", ".htm": "text/html", ".shtml": "text/html",
+		".avif": "image/avif", ".m3u8": "application/vnd.apple.mpegurl",
+	}
+	if !maps.Equal(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+
+	// The types block is optional
+	if types, err := ParseNginxMIMETypes(strings.NewReader("image/avif AVIF;")); err != nil || types[".avif"] != "image/avif" {
+		t.Fatalf("unexpected types %v (%v)", types, err)
+	}
+
+	for _, invalid := range []string{
+		"types { image/avif avif;",
+		"image/avif avif",
+		"image/avif;",
+		"types { types { image/avif avif; } }",
+	} {
+		if _, err := ParseNginxMIMETypes(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestParseMIMETypes(t *testing.T) {
+	types, err := ParseMIMETypes("avif=image/avif, .M4S = video/iso.segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(types, map[string]string{".avif": "image/avif", ".m4s": "video/iso.segment"}) {
+		t.Fatalf("unexpected types %v", types)
+	}
+	if _, err := ParseMIMETypes("avif=image/avif,m4s"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	path := filepath.Join(t.TempDir(), "mime.types")
+	os.WriteFile(path, []byte("types { image/jxl jxl; }"), 0644)
+	if types, err := ParseMIMETypes(path); err != nil || types[".jxl"] != "image/jxl" {
+		t.Fatalf("unexpected types %v (%v)", types, err)
+	}
+}
+
+func TestMIMETypesPrecedence(t *testing.T) {
+	c := &PicoCache{log: slog.Default()}
+	WithMIMETypes(map[string]string{".avif": "image/x-avif"})(c)
+
+	for path, expected := range map[string]string{
+		"/img/a.AVIF":  "image/x-avif",             // overridden
+		"/live/seg.ts": "video/mp2t",               // built-in, whatever the system says
+		"/index.html":  "text/html; charset=utf-8", // system
+		"/noext":       "",
+		"/a.unknownxt": "",
+	} {
+		if got := c.contentType(path); got != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package picocache
+
+import (
+	"strings"
+)
+
+// WithPathNormalization collapses duplicate slashes and strips a trailing
+// slash from request paths, and lowercases them too if lowercase is set,
+// before deriving cache keys and source URLs. Enabling it changes the keys
+// of existing entries: paths which weren't already normalized get fetched
+// again, and their old entries age out through eviction.
+func WithPathNormalization(lowercase bool) Option {
+	return func(c *PicoCache) {
+		c.normalizePaths = true
+		c.lowercasePaths = lowercase
+	}
+}
+
+// normalizePath returns the normalized form of path, see WithPathNormalization.
+func (c *PicoCache) normalizePath(path string) string {
+	if !c.normalizePaths {
+		return path
+	}
+
+	normalized := normalized(path, c.lowercasePaths)
+	if normalized != path {
+		c.stats.normalizedRequests.Add(1)
+	}
+	return normalized
+}
+
+func normalized(path string, lowercase bool) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	if lowercase {
+		path = strings.ToLower(path)
+	}
+	return path
+}
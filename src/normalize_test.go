@@ -0,0 +1,73 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	off := &PicoCache{}
+	on := &PicoCache{normalizePaths: true}
+	lower := &PicoCache{normalizePaths: true, lowercasePaths: true}
+
+	for _, tc := range []struct {
+		cache          *PicoCache
+		path, expected string
+	}{
+		{off, "/img//logo.png", "/img//logo.png"},
+		{off, "/img/logo.png/", "/img/logo.png/"},
+		{on, "/img/logo.png", "/img/logo.png"},
+		{on, "/img//logo.png", "/img/logo.png"},
+		{on, "//img///logo.png", "/img/logo.png"},
+		{on, "/img/logo.png/", "/img/logo.png"},
+		{on, "/img/logo.png//", "/img/logo.png"},
+		{on, "/", "/"},
+		{on, "//", "/"},
+		{on, "/Img/Logo.PNG", "/Img/Logo.PNG"},
+		{lower, "/Img//Logo.PNG/", "/img/logo.png"},
+	} {
+		if got := tc.cache.normalizePath(tc.path); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.path, tc.expected, got)
+		}
+	}
+
+	if n := on.stats.normalizedRequests.Load(); n != 5 {
+		t.Errorf("expected 5 normalized requests, got %d", n)
+	}
+}
+
+func TestNormalizedPathsShareEntries(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithPathNormalization(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ path, expected string }{
+		{"/img//logo.png", "MISS"},
+		{"/img/logo.png/", "HIT"},
+		{"/img/logo.png", "HIT"},
+	} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := w.Header().Get("X-Cache"); got != tc.expected {
+			t.Fatalf("%s: expected %s, got %s", tc.path, tc.expected, got)
+		}
+	}
+
+	if len(fetched) != 1 || fetched[0] != "/img/logo.png" {
+		t.Fatalf("expected a single fetch of the normalized path, got %v", fetched)
+	}
+	if s := cache.Stats(); s.NormalizedRequests != 2 {
+		t.Fatalf("expected 2 normalized requests, got %d", s.NormalizedRequests)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,54 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultOfflineMissStatus = http.StatusNotFound
+
+// offlineWarning is sent along with entries served offline, whatever their
+// age.
+const offlineWarning = `112 - "Disconnected operation"`
+
+var errOffline = errors.New("cache is offline, without a source")
+
+// WithOffline serves the cache directory without any source, e.g. a volume
+// carried where the source can't be reached: no client to it is kept, so
+// that nothing ever dials it, and the source given to NewCache may be
+// empty. Entries are served whatever their age, as HIT-OFFLINE, misses get
+// the status of WithOfflineMissStatus, and refreshes and revalidations are
+// refused. Hits still record their use, and eviction still holds the size
+// limit.
+func WithOffline() Option {
+	return func(c *PicoCache) {
+		c.offline = true
+	}
+}
+
+// ParseOfflineMissStatus parses the status misses get while offline, an
+// error one.
+func ParseOfflineMissStatus(s string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || code < 400 || code > 599 {
+		return 0, fmt.Errorf("invalid offline miss status %q, expected a 4xx or 5xx", s)
+	}
+	return code, nil
+}
+
+// WithOfflineMissStatus sets the status misses get while offline, 404 by
+// default.
+func WithOfflineMissStatus(code int) Option {
+	return func(c *PicoCache) {
+		c.offlineMissStatus = code
+	}
+}
+
+// refuseOffline answers a request which would need the source while
+// offline.
+func (c *PicoCache) refuseOffline(w http.ResponseWriter, path string) {
+	http.Error(w, "picocache is offline, without a source to fetch "+path+" from", c.offlineMissStatus)
+}
@@ -0,0 +1,107 @@
+package picocache_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOffline(t *testing.T) {
+	rules, err := picocache.ParseRules(".txt ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := NewFakeOrigin(t)
+	filled := NewTestCache(t, origin, 1<<20, picocache.WithRules(rules...))
+	for _, path := range []string{"/a.txt", "/b.txt", "/c"} {
+		filled.Expect(path, "MISS", path)
+	}
+	filled.Close()
+	origin.Close()
+
+	// Anything dialing the source gets counted, and fails
+	var dials atomic.Int64
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("no network")
+	}}}
+	clock := NewFakeClock()
+	clock.Advance(2 * time.Hour)
+	cache, err := picocache.NewCache(slog.Default(), "", filled.Dir, 1<<20, picocache.WithOffline(), picocache.WithOriginClient(client),
+		picocache.WithRules(rules...), picocache.WithBlockSize(1), picocache.WithClock(clock.Now), picocache.WithOriginProbe(time.Millisecond, "", "/health"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	get := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// Expired entries are served all the same
+	for _, path := range []string{"/a.txt", "/b.txt", "/c"} {
+		w := get(http.MethodGet, path)
+		if w.Code != http.StatusOK || w.Body.String() != path || w.Header().Get("X-Cache") != "HIT-OFFLINE" || !strings.HasPrefix(w.Header().Get("Warning"), "112 ") {
+			t.Fatalf("%s: expected an offline hit, got %d %s %q, Warning %q", path, w.Code, w.Header().Get("X-Cache"), w.Body.String(), w.Header().Get("Warning"))
+		}
+	}
+
+	start := time.Now()
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := get(method, "/missing"); w.Code != http.StatusNotFound || method == http.MethodGet && !strings.Contains(w.Body.String(), "offline") {
+			t.Fatalf("%s: expected a 404 explaining offline mode, got %d %q", method, w.Code, w.Body.String())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("misses took %s", elapsed)
+	}
+	if _, err := cache.Refresh(context.Background(), "/a.txt"); err == nil {
+		t.Fatal("expected refreshes refused offline")
+	}
+	if _, _, err := cache.Get(context.Background(), "/missing"); !errors.Is(err, picocache.ErrNotCached) {
+		t.Fatalf("expected ErrNotCached, got %v", err)
+	}
+
+	// Hits still record their use, the least recently used going first
+	clock.Advance(time.Second)
+	get(http.MethodGet, "/a.txt")
+	if err := cache.Resize(7); err != nil {
+		t.Fatal(err)
+	}
+	// Shrinking goes at its rate on the cache clock
+	Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return cache.Len() == 1
+	})
+	if w := get(http.MethodGet, "/a.txt"); w.Header().Get("X-Cache") != "HIT-OFFLINE" {
+		t.Fatalf("expected the last used entry kept, got %s", w.Header().Get("X-Cache"))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n := dials.Load(); n != 0 {
+		t.Fatalf("expected the source never dialed, got %d dials", n)
+	}
+	if s := cache.Stats(); !s.Offline || s.OfflineMisses != 3 || s.Outcomes["hit-offline"] != 5 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	cache.Close()
+
+	// Misses may get another status
+	cache, err = picocache.NewCache(slog.Default(), "", filled.Dir, 1<<20, picocache.WithOffline(), picocache.WithOfflineMissStatus(http.StatusServiceUnavailable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if w := get(http.MethodGet, "/missing"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503, got %d", w.Code)
+	}
+}
@@ -0,0 +1,4 @@
+package picocache
+
+// Option configures optional behaviours of a PicoCache, see NewCache.
+type Option func(*PicoCache)
@@ -0,0 +1,262 @@
+package picocache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+func newOriginTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = defaultOriginMaxHeaderBytes
+	// Bodies are stored as the source sent them, see WithOriginCompression
+	transport.DisableCompression = true
+	return transport
+}
+
+// WithOriginClient replaces the client used to fetch from the source. The
+// WithOrigin* transport options only apply to the built-in client.
+func WithOriginClient(client *http.Client) Option {
+	return func(c *PicoCache) {
+		c.origin = client
+	}
+}
+
+// WithOriginMaxIdleConns sets how many idle connections to the source are
+// kept around for reuse.
+func WithOriginMaxIdleConns(n int) Option {
+	return func(c *PicoCache) {
+		c.transport.MaxIdleConns = n
+		c.transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithOriginIdleTimeout sets how long an idle connection to the source is
+// kept before being closed.
+func WithOriginIdleTimeout(d time.Duration) Option {
+	return func(c *PicoCache) {
+		c.transport.IdleConnTimeout = d
+	}
+}
+
+// WithOriginMaxConnsPerHost limits the number of connections to the source,
+// zero meaning no limit.
+func WithOriginMaxConnsPerHost(n int) Option {
+	return func(c *PicoCache) {
+		c.transport.MaxConnsPerHost = n
+	}
+}
+
+// WithOriginTLSConfig sets the TLS configuration used to reach the source,
+// e.g. to trust a private CA.
+func WithOriginTLSConfig(config *tls.Config) Option {
+	return func(c *PicoCache) {
+		c.transport.TLSClientConfig = config
+	}
+}
+
+// OriginProtocol is the HTTP version spoken to the source, see
+// WithOriginProtocol.
+type OriginProtocol int
+
+const (
+	OriginAuto  OriginProtocol = iota // HTTP/2 when negotiated over TLS
+	OriginHTTP1                       // HTTP/1.1 only
+	OriginHTTP2                       // HTTP/2 only, in cleartext (h2c) for http sources
+)
+
+// ParseOriginProtocol parses auto, h1 or h2.
+func ParseOriginProtocol(s string) (OriginProtocol, error) {
+	switch s {
+	case "auto":
+		return OriginAuto, nil
+	case "h1":
+		return OriginHTTP1, nil
+	case "h2":
+		return OriginHTTP2, nil
+	}
+	return OriginAuto, fmt.Errorf("invalid origin protocol %q, expected auto, h1 or h2", s)
+}
+
+// WithOriginProtocol sets the HTTP version spoken to the source.
+func WithOriginProtocol(p OriginProtocol) Option {
+	return func(c *PicoCache) {
+		c.originProtocol = p
+	}
+}
+
+// applyOriginProtocol configures the transport for the origin protocol,
+// once all options are known.
+func (c *PicoCache) applyOriginProtocol() {
+	switch c.originProtocol {
+	case OriginHTTP1:
+		c.transport.Protocols = &http.Protocols{}
+		c.transport.Protocols.SetHTTP1(true)
+		if config := c.transport.TLSClientConfig; config != nil && len(config.NextProtos) > 0 {
+			// Don't let a given configuration offer h2 anyway
+			config = config.Clone()
+			config.NextProtos = []string{"http/1.1"}
+			c.transport.TLSClientConfig = config
+		}
+	case OriginHTTP2:
+		c.transport.ForceAttemptHTTP2 = true
+		c.transport.Protocols = &http.Protocols{}
+		c.transport.Protocols.SetHTTP2(true)
+		c.transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+// connProtocol returns the protocol spoken over a new connection to the
+// source.
+func (c *PicoCache) connProtocol(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			return "h2"
+		}
+		return "http/1.1"
+	}
+	if c.originProtocol == OriginHTTP2 {
+		return "h2c"
+	}
+	return "http/1.1"
+}
+
+// WithOriginFirstByteTimeout bounds how long a fill waits for the first
+// byte of the source body once it got the headers. On timeout the client
+// gets a 504 and nothing is written to the cache.
+func WithOriginFirstByteTimeout(d time.Duration) Option {
+	return func(c *PicoCache) {
+		c.originFirstByteTimeout = d
+	}
+}
+
+// errPartialContent is a source answering a whole body request with part of
+// it, which mustn't get cached as the whole.
+var errPartialContent = errors.New("source sent partial content to an unranged request")
+
+var errFirstByteTimeout = errors.New("timed out waiting for the first byte of the source body")
+
+// awaitFirstByte waits for body to start flowing or end, returning a reader
+// of the whole of it. cancel aborts the source request on timeout.
+func (c *PicoCache) awaitFirstByte(body io.Reader, cancel context.CancelFunc) (*bufio.Reader, error) {
+	timedOut := atomic.Bool{}
+	if c.originFirstByteTimeout > 0 {
+		timer := time.AfterFunc(c.originFirstByteTimeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	br := bufio.NewReader(body)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		if timedOut.Load() {
+			return nil, errFirstByteTimeout
+		}
+		return nil, err
+	}
+	return br, nil
+}
+
+// newOriginRequest builds a GET request for url on the source.
+func (c *PicoCache) newOriginRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, c.originTrace()), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	return req, nil
+}
+
+// originTrace counts how connections to the source get (re)used.
+func (c *PicoCache) originTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.stats.originConnsReused.Add(1)
+				return
+			}
+			c.log.Info("Origin connection",
+				slog.String("addr", info.Conn.RemoteAddr().String()),
+				slog.String("protocol", c.connProtocol(info.Conn)))
+		},
+		ConnectStart: func(network, addr string) {
+			c.stats.originDials.Add(1)
+		},
+		TLSHandshakeStart: func() {
+			c.stats.originTLSHandshakes.Add(1)
+		},
+	}
+}
+
+// originFetch measures one request to the source, see done.
+type originFetch struct {
+	c     *PicoCache
+	url   string
+	kind  string
+	retry bool
+	start time.Time
+	fill  *fill // whose final figures get logged, once the body is over
+	span  span
+}
+
+func (c *PicoCache) startOriginFetch(url string, kind string, retry bool) *originFetch {
+	return &originFetch{c: c, url: url, kind: kind, retry: retry, start: time.Now()}
+}
+
+// startSpan traces the fetch as part of the request of t, propagating its
+// span with req.
+func (f *originFetch) startSpan(t *timings, req *http.Request) {
+	var ctx context.Context
+	ctx, f.span = t.startSpan(SpanOriginFetch)
+	t.inject(ctx, req.Header)
+}
+
+// done logs the fetch and accounts the body bytes it pulled from the source.
+func (f *originFetch) done(status int, bytes int64, err error) {
+	duration := time.Since(f.start)
+	f.span.end(err, slog.String("picocache.fetch", f.kind), slog.Int("http.response.status_code", status),
+		slog.Int64("picocache.bytes", bytes), slog.Bool("picocache.retry", f.retry))
+	f.c.stats.originBytes.Add(bytes)
+	f.c.originBytes.add(bytes)
+
+	attrs := []any{
+		slog.String("url", f.url),
+		slog.Int("status", status),
+		slog.Int64("bytes", bytes),
+		slog.Duration("duration", duration),
+		slog.Float64("mbps", float64(bytes)/1e6/max(duration.Seconds(), 1e-9)),
+		slog.String("kind", f.kind),
+		slog.Bool("retry", f.retry),
+	}
+	if f.fill != nil {
+		p := f.fill.progress()
+		attrs = append(attrs, slog.Int64("received", p.Received), slog.Int64("expected", p.Expected),
+			slog.Duration("fill_duration", time.Since(p.Started)))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+	f.c.log.Info("Origin fetch", attrs...)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
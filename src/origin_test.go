@@ -0,0 +1,224 @@
+package picocache_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	picocache "picocache/src"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOriginConnectionReuse(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		picocache.WithOriginTLSConfig(origin.Client().Transport.(*http.Transport).TLSClientConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/first", "/second"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("%s: unexpected response %d %s", path, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.OriginDials != 1 || stats.OriginTLSHandshakes != 1 || stats.OriginConnsReused != 1 {
+		t.Fatalf("second miss didn't reuse the connection: %+v", stats)
+	}
+	if stats.OriginBytes != 6 || stats.OriginBytes1m != 6 || stats.OriginBytes1h != 6 {
+		t.Fatalf("origin bytes not accounted: %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/__picocache/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\npicocache_origin_conns_reused_total 1\n") {
+		t.Fatalf("reuse missing from metrics:\n%s", w.Body.String())
+	}
+}
+
+func TestOriginFirstByteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("size") == "200" {
+			// Headers right away, then a stalled body
+			w.Header().Set("Content-Length", "3")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	dir := t.TempDir()
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, dir, 1<<20,
+		picocache.WithKeptQueryParams("size"),
+		picocache.WithOriginFirstByteTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	stalled := make([]*httptest.ResponseRecorder, 2)
+	for i := range stalled {
+		stalled[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.ServeHTTP(stalled[i], httptest.NewRequest(http.MethodGet, "/img?size=200", nil))
+		}()
+	}
+
+	// Another resolution of the same path doesn't wait for the stalled one
+	start := time.Now()
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img?size=400", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("other resolution blocked for %s", elapsed)
+	}
+
+	wg.Wait()
+	for _, w := range stalled {
+		if w.Code != http.StatusGatewayTimeout {
+			t.Fatalf("expected 504, got %d", w.Code)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = slices.DeleteFunc(files, func(f os.DirEntry) bool {
+		return f.Name() == "picocache.manifest" || f.Name() == "picocache.lock" || strings.HasSuffix(f.Name(), ".meta")
+	})
+	if len(files) != 1 {
+		t.Fatalf("expected only the other resolution cached, got %d files", len(files))
+	}
+}
+
+func TestOriginProtocol(t *testing.T) {
+	protos := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+		w.Write([]byte("Yay"))
+	})
+
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	for _, tc := range []struct {
+		origin   *httptest.Server
+		protocol string
+		expected string
+		logged   string
+	}{
+		{h2c, "auto", "HTTP/1.1", "http/1.1"},
+		{h2c, "h1", "HTTP/1.1", "http/1.1"},
+		{h2c, "h2", "HTTP/2.0", "h2c"},
+		{h2, "auto", "HTTP/2.0", "h2"},
+		{h2, "h1", "HTTP/1.1", "http/1.1"},
+		{h2, "h2", "HTTP/2.0", "h2"},
+	} {
+		protocol, err := picocache.ParseOriginProtocol(tc.protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs := &strings.Builder{}
+		opts := []picocache.Option{picocache.WithOriginProtocol(protocol)}
+		if tc.origin.TLS != nil {
+			opts = append(opts, picocache.WithOriginTLSConfig(tc.origin.Client().Transport.(*http.Transport).TLSClientConfig))
+		}
+		cache, err := picocache.NewCache(slog.New(slog.NewTextHandler(logs, nil)), tc.origin.URL, t.TempDir(), 1<<20, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/yay", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: unexpected status %d", tc.origin.URL, tc.protocol, w.Code)
+		}
+		if proto := <-protos; proto != tc.expected {
+			t.Errorf("%s %s: expected %s, got %s", tc.origin.URL, tc.protocol, tc.expected, proto)
+		}
+		if !strings.Contains(logs.String(), "protocol="+tc.logged+"\n") {
+			t.Errorf("%s %s: %s connection not logged:\n%s", tc.origin.URL, tc.protocol, tc.logged, logs.String())
+		}
+	}
+}
+
+func TestOriginSpuriousPartialContent(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" || r.URL.Path == "/resumed.bin" {
+			// Resuming a transfer nobody asked for
+			w.Header().Set("Content-Range", "bytes 5-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("56789"))
+			return
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/resumed.bin", nil))
+		if w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != "bytes 5-9/10" ||
+			w.Body.String() != "56789" || w.Header().Get("X-Cache") != "BYPASS-PARTIAL" {
+			t.Fatalf("unexpected response %d %v %q", w.Code, w.Header(), w.Body.String())
+		}
+	}
+	if s := cache.Stats(); s.Entries != 0 || s.PartialResponses != 2 {
+		t.Fatalf("expected partial content to be left uncached, got %+v", s)
+	}
+
+	// Ranges asked for by clients streamed without caching aren't spurious
+	cache, err = picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, picocache.WithAdmitAfter(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/whole.bin", nil)
+	r.Header.Set("Range", "bytes=5-")
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Header().Get("X-Cache") != "BYPASS-ADMISSION" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	if s := cache.Stats(); s.PartialResponses != 0 {
+		t.Fatalf("expected no partial responses, got %d", s.PartialResponses)
+	}
+}
@@ -0,0 +1,152 @@
+package picocache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcome is how the cache handled a request, sent to clients as X-Cache,
+// e.g. X-Cache: HIT, and reported in RequestEvent, EntryInfo and Stats.
+type Outcome uint8
+
+const (
+	OutcomeNone               Outcome = iota // not a request for an object, e.g. an error before its lookup
+	OutcomeHit                               // served from an entry
+	OutcomeHitOffline                        // served from an entry whatever its age, see WithOffline
+	OutcomeMiss                              // filled from the source, or failed to be
+	OutcomeStale                             // served from an expired entry
+	OutcomeRevalidated                       // served from an expired entry the source told unchanged
+	OutcomeMeta                              // a HEAD request answered from what the source told of the object
+	OutcomeFrozen                            // a miss refused while frozen, see Freeze
+	OutcomeBudget                            // a miss refused over the origin byte budget
+	OutcomeRateLimited                       // a miss refused over the origin request rate limit
+	OutcomeBypassAdmission                   // streamed from the source, not admitted yet
+	OutcomeBypassReadOnly                    // streamed from the source, the cache directory being read-only
+	OutcomeBypassFrozen                      // streamed from the source while frozen
+	OutcomeBypassSize                        // streamed from the source, over the size cap
+	OutcomeBypassPartial                     // streamed from the source, which sent partial content
+	OutcomeBypassQuarantine                  // streamed from the source, the entry being quarantined
+	OutcomeBypassRedirect                    // the client sent to the source, over the size cap
+	OutcomeBypassRejected                    // streamed from the source, which sent an error page
+	OutcomeBypassEncoding                    // streamed from the source, the client not accepting the coding of the entry
+	OutcomeBypassDraining                    // streamed from the source while draining, see Drain
+	OutcomeBypassPrecondition                // streamed from the source along with preconditions, the entry not being held
+	OutcomeBypassBudget                      // streamed from the source over the fill byte budget, see WithFillByteBudget
+	OutcomeFlood                             // a request for a new key refused by the key flood guard, see WithKeyFloodGuard
+	OutcomeBypassFlood                       // streamed from the source, a new key over the key flood guard thresholds
+	OutcomeBypassProxy                       // proxied to the source, whatever the method, see WithProxyPaths
+
+	outcomeCount
+)
+
+var outcomeNames = [outcomeCount]string{
+	OutcomeNone:               "",
+	OutcomeHit:                "HIT",
+	OutcomeHitOffline:         "HIT-OFFLINE",
+	OutcomeMiss:               "MISS",
+	OutcomeStale:              "STALE",
+	OutcomeRevalidated:        "REVALIDATED",
+	OutcomeMeta:               "META",
+	OutcomeFrozen:             "FROZEN",
+	OutcomeBudget:             "BUDGET",
+	OutcomeRateLimited:        "RATE-LIMITED",
+	OutcomeBypassAdmission:    "BYPASS-ADMISSION",
+	OutcomeBypassReadOnly:     "BYPASS-READONLY",
+	OutcomeBypassFrozen:       "BYPASS-FROZEN",
+	OutcomeBypassSize:         "BYPASS-SIZE",
+	OutcomeBypassPartial:      "BYPASS-PARTIAL",
+	OutcomeBypassQuarantine:   "BYPASS-QUARANTINE",
+	OutcomeBypassRedirect:     "BYPASS-REDIRECT",
+	OutcomeBypassRejected:     "BYPASS-REJECTED",
+	OutcomeBypassEncoding:     "BYPASS-ENCODING",
+	OutcomeBypassDraining:     "BYPASS-DRAINING",
+	OutcomeBypassPrecondition: "BYPASS-PRECONDITION",
+	OutcomeBypassBudget:       "BYPASS-BUDGET",
+	OutcomeFlood:              "FLOOD",
+	OutcomeBypassFlood:        "BYPASS-FLOOD",
+	OutcomeBypassProxy:        "BYPASS-PROXY",
+}
+
+// String returns the outcome as sent in X-Cache, empty for OutcomeNone.
+func (o Outcome) String() string {
+	if o >= outcomeCount {
+		return "Outcome(" + strconv.Itoa(int(o)) + ")"
+	}
+	return outcomeNames[o]
+}
+
+// ParseOutcome parses an X-Cache value, or the outcome parameter of
+// X-Cache-Status, case insensitively.
+func ParseOutcome(s string) (Outcome, error) {
+	for o, name := range outcomeNames {
+		if o != int(OutcomeNone) && strings.EqualFold(s, name) {
+			return Outcome(o), nil
+		}
+	}
+	return OutcomeNone, fmt.Errorf("unknown cache outcome %q", s)
+}
+
+// Bypass tells whether the object was streamed from the source, or the
+// client sent to it, without being cached.
+func (o Outcome) Bypass() bool {
+	return strings.HasPrefix(o.String(), "BYPASS-")
+}
+
+// ttfb returns the index in ttfbOutcomes of o, -1 if it isn't tracked.
+func (o Outcome) ttfb() int {
+	switch {
+	case o == OutcomeHit, o == OutcomeHitOffline:
+		return 0
+	case o == OutcomeMiss:
+		return 1
+	case o == OutcomeStale:
+		return 2
+	case o.Bypass():
+		return 3
+	}
+	return -1
+}
+
+// formatCacheStatus formats X-Cache-Status, whose grammar is fixed:
+//
+//	outcome=<outcome>[; age=<seconds>]; key=<cache key>
+//
+// the outcome in lower case, the age of the entry served in whole seconds,
+// only when one is, parameters always in this order.
+func formatCacheStatus(o Outcome, age time.Duration, aged bool, key string) string {
+	var b strings.Builder
+	b.WriteString("outcome=")
+	b.WriteString(strings.ToLower(o.String()))
+	if aged {
+		b.WriteString("; age=")
+		b.WriteString(strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	b.WriteString("; key=")
+	b.WriteString(key)
+	return b.String()
+}
+
+// stampOutcome sets X-Cache and X-Cache-Status from the outcome of the
+// request, once, as its headers are about to be sent.
+func (t *timings) stampOutcome(header http.Header) {
+	if t.stamped || t.outcome == OutcomeNone {
+		return
+	}
+	t.stamped = true
+	header.Set("X-Cache", t.outcome.String())
+	header.Set("X-Cache-Status", formatCacheStatus(t.outcome, t.age, t.aged, header.Get("X-Cache-Key")))
+}
+
+// served records entry as the one the request is answered with.
+func (t *timings) served(c *PicoCache, entry *cacheEntry) {
+	t.age, t.aged = c.entryAge(entry), true
+}
+
+// entryAge returns the time since entry got filled, or last used before a
+// restart.
+func (c *PicoCache) entryAge(entry *cacheEntry) time.Duration {
+	return max(c.steadyNow().Sub(entry.filled), 0)
+}
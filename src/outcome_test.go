@@ -0,0 +1,94 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutcomeParse(t *testing.T) {
+	for o := OutcomeHit; o < outcomeCount; o++ {
+		parsed, err := ParseOutcome(o.String())
+		if err != nil || parsed != o {
+			t.Errorf("%s: parsed back as %s, %v", o, parsed, err)
+		}
+	}
+	if o, err := ParseOutcome("bypass-size"); err != nil || o != OutcomeBypassSize {
+		t.Errorf("expected lower case parsed, got %s %v", o, err)
+	}
+	for _, s := range []string{"", "HIT-MEM", "BYPASS"} {
+		if _, err := ParseOutcome(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if !OutcomeBypassRedirect.Bypass() || OutcomeMiss.Bypass() {
+		t.Error("unexpected bypass outcomes")
+	}
+}
+
+func TestOutcomeHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte("way too large"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("Yay"))
+		}
+	}))
+	defer origin.Close()
+
+	var events []RequestEvent
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithMaxContentLength(5),
+		WithEvents(func(ev RequestEvent) { events = append(events, ev) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		path    string
+		advance time.Duration
+		code    int
+		outcome Outcome
+		status  string
+	}{
+		{"/a", 0, http.StatusOK, OutcomeMiss, "outcome=miss; age=0; key="},
+		{"/a", 90 * time.Second, http.StatusOK, OutcomeHit, "outcome=hit; age=90; key="},
+		{"/large", 0, http.StatusOK, OutcomeBypassSize, "outcome=bypass-size; key="},
+		{"/missing", 0, http.StatusInternalServerError, OutcomeMiss, "outcome=miss; key="},
+		{"/", 0, http.StatusNotFound, OutcomeNone, ""},
+	} {
+		now = now.Add(tc.advance)
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.code, w.Code)
+		}
+		if values := w.Header().Values("X-Cache"); tc.outcome == OutcomeNone && len(values) != 0 || tc.outcome != OutcomeNone && (len(values) != 1 || values[0] != tc.outcome.String()) {
+			t.Errorf("%s: expected X-Cache %s once, got %q", tc.path, tc.outcome, values)
+		}
+		status := tc.status
+		if status != "" {
+			status += w.Header().Get("X-Cache-Key")
+		}
+		if got := w.Header().Get("X-Cache-Status"); got != status || len(w.Header().Values("X-Cache-Status")) > 1 {
+			t.Errorf("%s: expected X-Cache-Status %q, got %q", tc.path, status, got)
+		}
+		if ev := events[len(events)-1]; ev.Cache != tc.outcome {
+			t.Errorf("%s: expected the event to tell %s, got %s", tc.path, tc.outcome, ev.Cache)
+		}
+	}
+
+	s := cache.Stats()
+	if s.Outcomes["miss"] != 2 || s.Outcomes["hit"] != 1 || s.Outcomes["bypass-size"] != 1 {
+		t.Errorf("unexpected outcome counts %v", s.Outcomes)
+	}
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,182 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithPeers forwards the purges of trusted clients to other instances, given
+// by their base URL, with the admin token of this one. Peers forward them in
+// turn, up to a hop limit, see WithPeerHopLimit.
+func WithPeers(peers ...string) Option {
+	return func(c *PicoCache) {
+		c.peers = nil
+		for _, url := range peers {
+			c.peers = append(c.peers, &peer{url: strings.TrimSuffix(url, "/"), queue: make(chan *peerPurge, peerQueueSize)})
+		}
+	}
+}
+
+// WithPeerHopLimit sets how many times a purge gets forwarded from peer to
+// peer, 1 by default: peers knowing all the others don't forward further.
+func WithPeerHopLimit(hops int) Option {
+	return func(c *PicoCache) {
+		c.peerHops = hops
+	}
+}
+
+const (
+	peerHopsHeader   = "X-Picocache-Hop-Limit"
+	defaultPeerHops  = 1
+	peerQueueSize    = 256
+	peerAttempts     = 4
+	peerRetryDelay   = 250 * time.Millisecond // doubling on each attempt
+	peerResultsWait  = time.Second
+	peerFetchTimeout = 5 * time.Second
+)
+
+// peer is another instance purges get forwarded to, one at a time.
+type peer struct {
+	url   string
+	queue chan *peerPurge
+}
+
+// peerPurge is a purge to forward, reporting how it went on done.
+type peerPurge struct {
+	method string
+	target string // path and query
+	hops   int    // left for the peer
+	done   chan error
+}
+
+// PeerResult is how forwarding a purge to a peer went: ok, failed, or still
+// pending retries or dropped as too many were queued.
+type PeerResult struct {
+	Peer   string `json:"peer"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// hopLimit returns how many more times the purge r should be forwarded.
+func (c *PicoCache) hopLimit(r *http.Request) int {
+	if s := r.Header.Get(peerHopsHeader); s != "" {
+		hops, err := strconv.Atoi(s)
+		if err != nil {
+			return 0
+		}
+		return hops
+	}
+	if c.peerHops == 0 {
+		return defaultPeerHops
+	}
+	return c.peerHops
+}
+
+// propagate forwards the purge r to the peers, returning how it went for
+// each after waiting for them a little, unless r got forwarded itself.
+// Peers slow to answer are retried in the background.
+func (c *PicoCache) propagate(r *http.Request) []PeerResult {
+	hops := c.hopLimit(r)
+	if len(c.peers) == 0 || hops <= 0 {
+		return nil
+	}
+
+	results := make([]PeerResult, len(c.peers))
+	purges := make([]*peerPurge, len(c.peers))
+	for i, p := range c.peers {
+		results[i] = PeerResult{Peer: p.url, Status: "dropped"}
+		purge := &peerPurge{method: r.Method, target: r.URL.RequestURI(), hops: hops - 1, done: make(chan error, 1)}
+		select {
+		case p.queue <- purge:
+			purges[i] = purge
+			results[i].Status = "pending"
+		default:
+			c.log.Warn("Dropping purge for a peer falling behind", slog.String("peer", p.url))
+		}
+	}
+
+	if r.Header.Get(peerHopsHeader) != "" {
+		// Waiting along a chain of peers could come back around to a queue
+		// waiting for us
+		return results
+	}
+	deadline := time.NewTimer(peerResultsWait)
+	defer deadline.Stop()
+	for i, purge := range purges {
+		if purge == nil {
+			continue
+		}
+		select {
+		case err := <-purge.done:
+			results[i].Status = "ok"
+			if err != nil {
+				results[i].Status, results[i].Error = "failed", err.Error()
+			}
+		case <-deadline.C:
+			return results
+		}
+	}
+	return results
+}
+
+// forwardPurges forwards the purges queued for p until the cache is closed,
+// retrying them for a short while.
+func (c *PicoCache) forwardPurges(p *peer) {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case purge := <-p.queue:
+			var err error
+			delay := peerRetryDelay
+			for attempt := 1; ; attempt++ {
+				err = c.forwardPurge(p, purge)
+				if err == nil || errors.Is(err, errPeerRefused) || attempt == peerAttempts {
+					break
+				}
+				select {
+				case <-c.closed:
+					return
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+			if err != nil {
+				c.log.Warn("Failed to forward purge to peer", slog.String("peer", p.url),
+					slog.String("target", purge.target), slog.String("err", err.Error()))
+			}
+			purge.done <- err
+		}
+	}
+}
+
+var errPeerRefused = errors.New("purge refused by peer")
+
+func (c *PicoCache) forwardPurge(p *peer, purge *peerPurge) error {
+	req, err := http.NewRequest(purge.method, p.url+purge.target, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errPeerRefused, err)
+	}
+	req.Header.Set(peerHopsHeader, strconv.Itoa(purge.hops))
+	if c.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+	resp, err := c.peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("peer answered %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w with %d", errPeerRefused, resp.StatusCode)
+	}
+}
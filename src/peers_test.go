@@ -0,0 +1,191 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// peerNodes starts n caches, each peering with the ones peers returns,
+// counting the purges forwarded to each.
+func peerNodes(t *testing.T, n int, peers func(i int, urls []string) []string, opts ...Option) ([]*PicoCache, []string, []*atomic.Int64) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	t.Cleanup(origin.Close)
+
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+	for i := range n {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	caches := make([]*PicoCache, n)
+	forwarded := make([]*atomic.Int64, n)
+	for i := range n {
+		cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+			append([]Option{WithAdminToken("s3cret"), WithPrefixPurge(), WithPeers(peers(i, urls)...)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caches[i], forwarded[i] = cache, &atomic.Int64{}
+		servers[i].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(peerHopsHeader) != "" {
+				forwarded[i].Add(1)
+			}
+			cache.ServeHTTP(w, r)
+		})
+		servers[i].Start()
+		t.Cleanup(servers[i].Close)
+		t.Cleanup(func() { cache.Close() })
+	}
+	return caches, urls, forwarded
+}
+
+func cacheStatus(t *testing.T, url, path string) string {
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("X-Cache")
+}
+
+func purgeRequest(t *testing.T, method, url string, result any) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: unexpected status %d", method, url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerPurges(t *testing.T) {
+	others := func(i int, urls []string) []string {
+		peers := []string{}
+		for j, url := range urls {
+			if j != i {
+				peers = append(peers, url)
+			}
+		}
+		return peers
+	}
+	caches, urls, forwarded := peerNodes(t, 3, others)
+	fill := func(paths ...string) {
+		for _, url := range urls {
+			for _, path := range paths {
+				cacheStatus(t, url, path)
+			}
+		}
+	}
+	purged := func(path string) {
+		t.Helper()
+		for i, url := range urls {
+			if got := cacheStatus(t, url, path); got != "MISS" {
+				t.Errorf("node %d: expected %s purged, got %s", i, path, got)
+			}
+		}
+	}
+
+	fill("/a", "/b", "/dir/c", "/dir/d")
+	single := purgeResult{}
+	purgeRequest(t, "PURGE", urls[0]+"/a", &single)
+	if len(single.Peers) != 2 || single.Peers[0].Status != "ok" || single.Peers[1].Status != "ok" {
+		t.Fatalf("expected the purge forwarded to both peers, got %+v", single.Peers)
+	}
+	purged("/a")
+
+	purgeRequest(t, http.MethodPost, urls[1]+"/__picocache/purge?path=/b", &single)
+	purged("/b")
+
+	prefix := prefixPurgeResult{}
+	purgeRequest(t, "PURGE", urls[2]+"/dir/?prefix=1", &prefix)
+	if prefix.Purged != 2 || len(prefix.Peers) != 2 {
+		t.Fatalf("unexpected prefix purge %+v", prefix)
+	}
+	purged("/dir/c")
+	purged("/dir/d")
+
+	// Purging everything
+	purgeRequest(t, "PURGE", urls[0]+"/?prefix=1", &prefix)
+	for i, cache := range caches {
+		if s := cache.Stats(); s.Entries != 0 {
+			t.Errorf("node %d: expected every entry purged, got %d", i, s.Entries)
+		}
+	}
+
+	// Out of the 4 purges, node 0 got 2 itself
+	for i, n := range forwarded {
+		if expected := []int64{2, 3, 3}[i]; n.Load() != expected {
+			t.Errorf("node %d: expected %d purges forwarded from its peers, got %d", i, expected, n.Load())
+		}
+	}
+	for _, cache := range caches {
+		verifyConsistency(t, cache, cache.cacheDir)
+	}
+}
+
+func TestPeerHopLimit(t *testing.T) {
+	next := func(i int, urls []string) []string {
+		return []string{urls[(i+1)%len(urls)]}
+	}
+	_, urls, forwarded := peerNodes(t, 3, next, WithPeerHopLimit(5))
+
+	for _, url := range urls {
+		cacheStatus(t, url, "/a")
+	}
+	result := purgeResult{}
+	purgeRequest(t, "PURGE", urls[0]+"/a", &result)
+
+	total := func() int64 {
+		total := int64(0)
+		for _, n := range forwarded {
+			total += n.Load()
+		}
+		return total
+	}
+	for deadline := time.Now().Add(time.Second); total() < 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Some more time to forward any further
+	time.Sleep(50 * time.Millisecond)
+	if total := total(); total != 5 {
+		t.Fatalf("expected the purge forwarded 5 times around the ring, got %d", total)
+	}
+	for i, url := range urls {
+		if got := cacheStatus(t, url, "/a"); got != "MISS" {
+			t.Errorf("node %d: expected /a purged, got %s", i, got)
+		}
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	dead := httptest.NewServer(nil)
+	dead.Close()
+	_, urls, _ := peerNodes(t, 1, func(int, []string) []string { return []string{dead.URL} })
+
+	cacheStatus(t, urls[0], "/a")
+	start := time.Now()
+	result := purgeResult{}
+	purgeRequest(t, "PURGE", urls[0]+"/a", &result)
+	if time.Since(start) > 2*peerResultsWait {
+		t.Errorf("purge held for %v by a dead peer", time.Since(start))
+	}
+	if !result.Purged || len(result.Peers) != 1 || result.Peers[0].Status == "ok" {
+		t.Fatalf("expected the purge applied locally and the peer failing, got %+v", result)
+	}
+}
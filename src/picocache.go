@@ -1,18 +1,22 @@
 package picocache
 
 import (
+	"compress/gzip"
+	"container/list"
+	"context"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
-	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,30 +26,283 @@ import (
 )
 
 type cacheEntry struct {
-	filename string
-	size     int64
-	lastUsed time.Time
+	filename      string
+	size          int64
+	diskSize      int64         // size rounded up to the filesystem block size
+	lastUsed      atomic.Int64  // unix nanoseconds, whatever the mtime granularity of the filesystem
+	encoding      string        // content coding of the file on disk, if any
+	decodedSize   int64         // size once decoded, when encoding is set, -1 if unknown
+	sourceEncoded bool          // encoding set by the source, see WithOriginCompression
+	protected     atomic.Bool   // in the SLRU protected segment, see evictionPolicy
+	demoted       uint64        // eviction pass it last got demoted in, see evictionPolicy.demote
+	hits          atomic.Int64  // since filled, for LFU
+	sealed        atomic.Bool   // filled and not evicted, see lookup
+	expires       time.Time     // zero when it never expires, see Rule
+	hash          string        // of the body on disk, when deduplicating
+	readers       atomic.Int64  // clients being sent it, see acquireReader
+	filled        time.Time     // last used instead, once rebuilt
+	path          string        // request key filled for, if known, see WithPrefixPurge
+	status        int           // of the source response when not 200, see WithCacheableStatus
+	location      string        // Location header of the source response, if any
+	language      string        // Content-Language header of the source response, if any
+	contentType   string        // Content-Type header of the source response, if any, see WithSourceContentType
+	etag          string        // of the source response, to revalidate it
+	lastModified  string        // of the source response, to revalidate it
+	origin        string        // source it was filled from, if recorded, see originIdentity
+	staleIfError  time.Duration // of the source response, see WithStaleIfError
+	headers       http.Header   // application headers of the source response, see WithPassthroughHeaders
+	unverified    atomic.Bool   // found on disk on startup, see WithStartupRevalidation
+	legacy        atomic.Bool   // found on disk on startup without metadata, see WithLegacyUpgrades
+	condemned     *fill         // purged while filling, its file to be released once opened, see PurgedFilling
+	adaptive      adaptiveState // revalidation history, see WithAdaptiveTTL
 }
 
 type PicoCache struct {
-	log          *slog.Logger
-	source       string
-	cacheDir     string
-	maxCacheSize int64
-	entries      sync.Map
-	totalSize    atomic.Int64
-	downloading  sync.Map   // Track ongoing downloads
-	cleanupMutex sync.Mutex // Prevent concurrent cleanups
+	log            *slog.Logger
+	source         string
+	sourceTemplate bool   // source has placeholders, see originURL
+	originID       string // source as entries record it, see WithStrictOrigin
+	strictOrigin   bool
+	cacheDir       string
+	extraDirs      []CacheDir   // see WithCacheDirs
+	dirs           []*dirState  // that of cacheDir first
+	maxCacheSize   atomic.Int64 // see Resize
+	shrinkRate     int64
+	shrinking      atomic.Pointer[shrink] // nil unless shrinking
+	shrinkRunning  atomic.Bool
+	paths          *pathIndex // nil unless purging by prefix
+	keyMigration   KeyMigration
+	previousScheme *keyScheme           // being migrated from, see MigrateDualRead
+	userAgent      string               // sent to the source
+	servedBy       string               // see WithServedBy
+	limit          *requestLimit        // nil unless limiting requests
+	traceFile      *traceFile           // nil unless recording requests
+	redirect       *largeObjectRedirect // nil unless redirecting large objects
+	heads          *headMetadata        // nil unless answering HEAD misses from the source
+	languages      []string             // entries may vary by, see WithLanguages
+
+	validateContentType  bool
+	sourceContentType    bool
+	appHeaders           []string        // canonical, see WithPassthroughHeaders
+	tracer               Tracer          // nil unless tracing requests
+	upgrades             *legacyUpgrades // nil unless upgrading legacy entries
+	proxyPaths           []string        // path prefixes proxied to the source, see WithProxyPaths
+	shadow               shadowPolicies  // see WithPolicyMode
+	warm                 *warmer         // nil unless warming from a listing
+	metadataRefreshRate  float64         // source HEAD requests per second, see RefreshMetadata
+	refreshing           atomic.Bool
+	bodyBlocklist        [][]byte
+	rejectedAsBadGateway bool
+	budget               *byteBudget   // nil unless capping origin bytes
+	fillBudget           *byteBudget   // nil unless capping cache file writes
+	staleIfError         time.Duration // see WithStaleIfError
+	originRate           *rateLimiter  // nil unless pacing origin requests
+	startupRevalidation  bool
+	adaptiveTTL          *AdaptiveTTL  // nil unless adapting TTLs to changes at the source
+	resumeTTL            time.Duration // partial bodies are kept for, see WithResumableFills
+	originCompression    bool
+	encodingFallback     EncodingFallback
+	releaseManifest      string
+	release              atomic.Pointer[map[string]releaseEntry] // nil unless serving a release manifest only
+	entries              sync.Map                                // frees what deleted keys used, nothing to compact
+	totalSize            atomic.Int64                            // physical size, used for eviction
+	logicalSize          atomic.Int64
+	blockSize            int64
+	downloading          sync.Map // Track ongoing downloads, see fill
+	refetches            sync.Map // see Refresh
+	evictTask            *maintenanceTask
+	evictBatch           int            // victims picked at a time, see evict
+	aux                  auxEntries     // negative entries, see WithMaxAuxEntries
+	evictPasses          uint64         // eviction passes so far, only evict touches it
+	fileLocks            [64]sync.Mutex // see lockFile
+	fileUnlocks          [64]func()     // their Unlock, bound once so locking doesn't allocate
+	transport            *http.Transport
+	origin               *http.Client
+	stats                stats
+	originBytes          *rollingCounter
+	admission            *admission
+	compress             bool
+
+	normalizePaths bool
+	lowercasePaths bool
+	query          *queryFilter
+	rules          []Rule
+
+	abandonedCompleteOver float64 // see WithAbandonedFill
+
+	maxContentLength       int64 // see WithMaxContentLength
+	ghosts                 *ghostIndex
+	fsync                  FsyncPolicy
+	fsyncInterval          time.Duration
+	pendingSync            syncBatch
+	maxReaders             int64
+	integrityTrailer       bool
+	originProtocol         OriginProtocol
+	mimeTypes              map[string]string // see WithMIMETypes
+	expiryJitter           float64
+	revalidations          *tokenBucket // nil when unbounded
+	staleGrace             time.Duration
+	readerQueue            time.Duration
+	originFirstByteTimeout time.Duration
+
+	dedup       bool
+	bodies      map[string][]*sharedBody // by hash, see WithDedup
+	bodiesMutex sync.Mutex
+
+	adminToken     string
+	trustedProxies []netip.Prefix
+	hosts          []string // served, see WithHosts
+
+	purgeDropDir        string // watched for purge files, see WithPurgeDrop
+	purgeDropQuiescence time.Duration
+
+	selfTestPath string
+
+	now      func() time.Time
+	clock    steadyClock // expiry and recency are tracked on, see steadyNow
+	ttfb     [len(ttfbOutcomes)]latencyHistogram
+	lockWait [len(ttfbOutcomes)]latencyHistogram // by outcome, see timings.lockWait
+	waits    waitTracker
+	outcomes [outcomeCount]atomic.Int64 // requests served, by outcome
+	pinned   sync.Map                   // cache files never evicted, see SelfTest
+
+	logSuppressWindow    time.Duration
+	logSuppressor        *logSuppressor // nil unless suppressing repeated lines
+	accessLog            bool
+	accessLogSample      float64
+	slowRequestThreshold time.Duration
+	onRequest            func(RequestEvent)
+
+	policy      evictionPolicy
+	probe       *originProbe
+	maintenance maintenance
+	scrubSample int
+	scrubEvery  time.Duration
+
+	peers      []*peer // see WithPeers
+	peerHops   int
+	peerClient *http.Client
+	dirLock    *dirLock
+	ignoreLock bool
+	closed     chan struct{} // Closed to stop background tasks
+	drained    chan struct{} // Closed once done draining, see Drain
+	drainState atomic.Int32
+	drainGrace time.Duration
+	inFlight   atomic.Int64 // requests being served, outside of the admin API
+	closeOnce  sync.Once
+
+	readOnly              atomic.Bool // Set when the cache directory can't be written to
+	frozen                atomic.Bool // Set by the operator, see Freeze
+	streamFills           bool
+	frozenMisses          FrozenMisses
+	keyFlood              *keyFlood // nil unless guarding against new key floods
+	keyFloodMode          KeyFloodMode
+	uncachedPreconditions UncachedPreconditions
+	offline               bool // see WithOffline
+	offlineMissStatus     int
+	writableProbeInterval time.Duration
+	writeStallTimeout     time.Duration
+	cacheableStatus       map[int]bool // nil for 200 only
+	create                func(name string) (*os.File, error)
+	open                  func(name string) (*os.File, error) // of entries being served
+	link                  func(oldname, newname string) error // of shared bodies, see WithDedup
+
+	quarantineFailures int
+	quarantineFor      time.Duration
+	avoid              quarantine // cache files not filled again yet
+	failing            sync.Map   // *cacheEntry to *entryFailures, see WithQuarantine
 }
 
-func NewCache(logger *slog.Logger, source string, cacheDir string, maxCacheSize int64) (*PicoCache, error) {
+func NewCache(logger *slog.Logger, source string, cacheDir string, maxCacheSize int64, opts ...Option) (*PicoCache, error) {
+	transport := newOriginTransport()
 	cache := &PicoCache{
-		log:          logger,
-		source:       source,
-		cacheDir:     cacheDir,
-		maxCacheSize: maxCacheSize,
-		entries:      sync.Map{},
-		downloading:  sync.Map{},
+		log:         logger,
+		source:      source,
+		cacheDir:    cacheDir,
+		entries:     sync.Map{},
+		downloading: sync.Map{},
+		transport:   transport,
+		origin:      &http.Client{Transport: transport},
+		originBytes: newRollingCounter(time.Now),
+
+		bodies:      map[string][]*sharedBody{},
+		pendingSync: syncBatch{files: map[string]struct{}{}},
+		policy:      evictionPolicy{protectedShare: defaultProtectedShare},
+		evictBatch:  evictBatch,
+		aux:         auxEntries{max: defaultMaxAuxEntries, order: list.New(), elems: map[*cacheEntry]*list.Element{}},
+		closed:      make(chan struct{}),
+		drained:     make(chan struct{}),
+		drainGrace:  defaultDrainGrace,
+
+		writableProbeInterval: defaultWritableProbeInterval,
+		metadataRefreshRate:   defaultMetadataRefreshRate,
+		writeStallTimeout:     defaultWriteStallTimeout,
+		create:                os.Create,
+		open:                  os.Open,
+		link:                  os.Link,
+		now:                   time.Now,
+
+		offlineMissStatus: defaultOfflineMissStatus,
+
+		quarantineFailures: defaultQuarantineFailures,
+		quarantineFor:      defaultQuarantineFor,
+		avoid:              quarantine{until: map[string]time.Time{}},
+	}
+	cache.maxCacheSize.Store(maxCacheSize)
+	cache.shrinkRate = defaultShrinkRate
+	for i := range cache.fileLocks {
+		cache.fileUnlocks[i] = cache.fileLocks[i].Unlock
+	}
+	cache.userAgent = Product()
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if cache.logSuppressWindow > 0 {
+		cache.logSuppressor = newLogSuppressor(cache.logSuppressWindow, time.Now)
+		cache.log = slog.New(&suppressingHandler{cache.log.Handler(), cache.logSuppressor})
+	}
+	if cache.heads != nil {
+		cache.heads.max = cache.aux.max
+	}
+	cache.registerMaintenance()
+	if cache.offline {
+		// Nothing may dial the source, whatever the options said of it
+		cache.origin, cache.transport, cache.probe = nil, nil, nil
+		cache.log.Warn("Offline, serving the cache directory without a source")
+	} else {
+		cache.applyOriginProtocol()
+		for code := range cache.cacheableStatus {
+			if code >= 300 && code < 400 {
+				cache.keepRedirects()
+				break
+			}
+		}
+	}
+
+	var err error
+	if !cache.offline {
+		if cache.sourceTemplate, err = parseSourceTemplate(source); err != nil {
+			return nil, err
+		}
+		if !cache.sourceTemplate {
+			if cache.source, err = normalizeSource(source); err != nil {
+				return nil, err
+			}
+		}
+		if u, err := url.Parse(cache.source); err == nil {
+			cache.log.Info("Fetching from source", slog.String("source", u.Redacted()))
+		}
+		cache.originID = originIdentity(cache.source)
+	}
+	if cache.redirect != nil {
+		if cache.redirect.locationTemplate, err = parseSourceTemplate(cache.redirect.location); err != nil {
+			return nil, err
+		}
+		if !cache.redirect.locationTemplate && cache.redirect.location != "" {
+			if cache.redirect.location, err = normalizeSource(cache.redirect.location); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	cache.log.Info("Creating cache folder if it doesn't exists...")
@@ -53,80 +310,307 @@ func NewCache(logger *slog.Logger, source string, cacheDir string, maxCacheSize
 		return nil, err
 	}
 
+	if cache.dirLock, err = lockDir(cacheDir, cache.ignoreLock, cache.log, flock); err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*PicoCache, error) {
+		cache.dirLock.release()
+		return nil, err
+	}
+
+	cache.openDirs()
+
+	if cache.blockSize == 0 {
+		cache.blockSize = fsBlockSize(cacheDir)
+	}
+	if cache.maxContentLength == 0 {
+		cache.maxContentLength = maxCacheSize
+	}
+
+	if err := cache.checkKeyScheme(); err != nil {
+		return fail(err)
+	}
+
+	if cache.releaseManifest != "" {
+		n, err := cache.ReloadReleaseManifest()
+		if err != nil {
+			return fail(err)
+		}
+		cache.log.Info("Serving the release manifest only", slog.String("file", cache.releaseManifest), slog.Int("paths", n))
+	}
+
 	cache.log.Info("Rebuilding index with already existing cache entries...")
 	if err := cache.rebuildCache(); err != nil {
-		return nil, err
+		return fail(err)
+	}
+	if cache.upgrades != nil {
+		go cache.upgradeLegacy()
+	}
+	if cache.warm != nil {
+		go cache.warmLoop()
+	}
+	if cache.resumeTTL > 0 {
+		go cache.collectPartials()
+	} else if !cache.frozen.Load() {
+		for _, d := range cache.dirs {
+			if !d.offline.Load() {
+				os.RemoveAll(filepath.Join(d.Path, resumeDir))
+			}
+		}
 	}
-	cache.log.Info("All good, starting cache!")
+	if cache.probe != nil {
+		go cache.probeOrigin()
+	}
+	if cache.fsync != FsyncNone && cache.fsyncInterval > 0 {
+		go cache.syncPeriodically()
+	}
+	if len(cache.maintenance.windows) > 0 || cache.scrubSample > 0 {
+		go cache.maintainPeriodically()
+	}
+	if cache.logSuppressor != nil {
+		go cache.flushSuppressedLogs()
+	}
+	cache.peerClient = &http.Client{Timeout: peerFetchTimeout}
+	for _, p := range cache.peers {
+		go cache.forwardPurges(p)
+	}
+	if cache.purgeDropDir != "" {
+		if err := os.MkdirAll(cache.purgeDropDir, 0755); err != nil {
+			return fail(err)
+		}
+		go cache.watchPurgeDrop()
+	}
+	if cache.traceFile != nil {
+		if err := cache.traceFile.open(); err != nil {
+			return fail(err)
+		}
+		go cache.writeTraces()
+	}
+	cache.log.Info("All good, starting cache!", slog.String("version", Version), slog.String("commit", Commit))
 
 	return cache, nil
 }
 
+// Close stops the background tasks of the cache.
+func (c *PicoCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.logSuppressor != nil {
+			c.logSuppressor.flush(true)
+		}
+		c.dirLock.release()
+	})
+	if c.traceFile != nil {
+		<-c.traceFile.done
+	}
+	if c.upgrades != nil {
+		<-c.upgrades.done
+	}
+	if c.warm != nil {
+		<-c.warm.done
+	}
+	return nil
+}
+
 const crockfordBase32 string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
 
 var b32 = base32.NewEncoding(crockfordBase32).WithPadding(base32.NoPadding)
 
-func (c *PicoCache) getCacheFilename(r *http.Request) string {
-	hash := sha256.Sum256([]byte(r.URL.Path))
-	return filepath.Join(c.cacheDir, b32.EncodeToString(hash[:]))
+// KeyForPath returns the cache key of a request path, including the query
+// string when it takes part in keys. It names the entry on disk and is sent
+// back as X-Cache-Key, so routing layers can compute it too.
+func KeyForPath(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return b32.EncodeToString(hash[:])
 }
 
-func (c *PicoCache) cleanupOldEntries() {
-	if !c.cleanupMutex.TryLock() {
-		return
-	}
-	defer c.cleanupMutex.Unlock()
+func (c *PicoCache) getCacheFilename(path string) string {
+	return c.keyFile(KeyForPath(path))
+}
 
-	if c.totalSize.Load() < c.maxCacheSize {
-		return
+// lockFile serializes changes to the files of cacheFile, so that evicting
+// an entry never removes the files of the one replacing it.
+func (c *PicoCache) lockFile(cacheFile string) (unlock func()) {
+	return c.lockFileTimed(cacheFile, nil)
+}
+
+// fileLock returns the index of the lock of cacheFile in fileLocks,
+// hashing it with FNV-1a.
+func (c *PicoCache) fileLock(cacheFile string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(cacheFile); i++ {
+		h ^= uint32(cacheFile[i])
+		h *= 16777619
 	}
+	return int(h % uint32(len(c.fileLocks)))
+}
 
-	c.log.Info("Starting cache cleanup...")
+// cleanupOldEntries evicts entries until the cache fits again. Cleanups
+// never run concurrently: one asked for while another runs makes the
+// running one go through another pass once over. They don't wait for a
+// maintenance window while the cache is over its size.
+func (c *PicoCache) cleanupOldEntries() {
+	c.request(c.evictTask)
+}
+
+// evict evicts entries down to the eviction limit, returning how many.
+func (c *PicoCache) evict() int {
+	if c.frozen.Load() || c.draining() {
+		return 0
+	}
+	// Concurrent fills don't change how much this pass frees
+	limit := c.evictionLimit()
+	if len(c.dirs) <= 1 {
+		return c.evictFrom(nil, c.totalSize.Load()-limit, c.maxCacheSize.Load())
+	}
+	removed := 0
+	for _, d := range c.dirs {
+		if !d.offline.Load() {
+			removed += c.evictFrom(d, d.size.Load()-c.dirLimit(d, limit), c.dirLimit(d, c.maxCacheSize.Load()))
+		}
+	}
+	return removed
+}
 
-	type entryWithURL struct {
-		filename string
-		entry    *cacheEntry
+// evictFrom evicts toFree bytes worth of the entries of d, all of them when
+// nil, whose share of the max size is maxSize. It returns how many it did.
+func (c *PicoCache) evictFrom(d *dirState, toFree, maxSize int64) int {
+	if toFree < 0 {
+		return 0
 	}
 
-	sortedEntries := []*entryWithURL{}
-	c.entries.Range(func(key, value any) bool {
-		sortedEntries = append(sortedEntries, &entryWithURL{key.(string), value.(*cacheEntry)})
-		return true
-	})
+	c.log.Info("Starting cache cleanup...")
 
-	slices.SortFunc(sortedEntries, func(a, b *entryWithURL) int {
-		if a.entry.lastUsed.Before(b.entry.lastUsed) {
-			return -1
+	candidates := func(yield func(*cacheEntry) bool) {
+		for entry := range c.allEntries {
+			if d != nil && c.dirOf(entry.filename) != d {
+				continue
+			}
+			if _, pinned := c.pinned.Load(entry.filename); pinned {
+				continue
+			}
+			if entry.readers.Load() > 0 {
+				// Busy, and hot anyway
+				continue
+			}
+			if entry.negative() {
+				// Capped on their own, see trimAux
+				continue
+			}
+			if _, filling := c.downloading.Load(entry.filename); filling || !entry.sealed.Load() {
+				// Being filled again, or replaced by its fill
+				continue
+			}
+			if !yield(entry) {
+				return
+			}
 		}
-		return +1
-	})
+	}
+	c.evictPasses++
+	pass := c.evictPasses
+	c.policy.demote(candidates, c.evictBatch, maxSize, pass)
 
+	// Victims are picked a batch at a time, each one let go of before
+	// picking the next
 	removedCount := 0
 	removedSize := int64(0)
-	for _, e := range sortedEntries {
-		os.Remove(e.entry.filename)
-		c.entries.Delete(e.filename)
-		removedSize += e.entry.size
-		removedCount++
-		if c.totalSize.Add(-e.entry.size) <= c.maxCacheSize {
+	freed := int64(0)
+	batches := 0
+evicting:
+	for {
+		batch := c.policy.victims(candidates, c.evictBatch, pass)
+		if len(batch) == 0 {
+			break
+		}
+		batches++
+		c.stats.evictionBatches.Add(1)
+		removed := 0
+		for _, entry := range batch {
+			unlock := c.lockFile(entry.filename)
+			// The entry may have been replaced by a newer fill meanwhile
+			if !c.entries.CompareAndDelete(entry.filename, entry) {
+				unlock()
+				continue
+			}
+			entry.sealed.Store(false)
+			removeFiles(entry)
+			unlock()
+
+			if c.ghosts != nil {
+				c.ghosts.lost(entry.filename, entry.size, lostEvicted, c.now())
+			}
+			removedSize += entry.size
+			removedCount++
+			removed++
+			if freed += c.unaccount(entry); freed >= toFree {
+				break evicting
+			}
+		}
+		if removed == 0 || c.draining() {
+			// Only replaced entries, which the next batch would pick again
 			break
 		}
 	}
 
 	c.log.Info("Cache cleanup completed",
+		slog.Int("batches", batches),
 		slog.Int("removed_files", removedCount),
 		slog.Int64("removed_size", removedSize),
 		slog.Int64("current_size", c.totalSize.Load()))
+	return removedCount
 }
 
 func (c *PicoCache) rebuildCache() error {
 	c.totalSize.Store(0)
+	c.logicalSize.Store(0)
 
-	err := filepath.WalkDir(c.cacheDir, func(path string, d fs.DirEntry, err error) error {
+	for _, d := range c.dirs {
+		d.size.Store(0)
+	}
+
+	unbound := 0 // entries not recording their source
+	for _, d := range c.dirs {
+		if d.offline.Load() {
+			// Indexed once back, see probeOffline
+			continue
+		}
+		n, err := c.indexDir(d.Path, true)
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
+		unbound += n
+	}
+	if c.strictOrigin && unbound > 0 {
+		c.log.Info("Serving entries not recording their source as they are", slog.Int("grandfathered", unbound))
+	}
+	c.trimAux()
+
+	go c.cleanupOldEntries()
+
+	return nil
+}
+
+// indexDir adds the entries found in dir to the index, returning how many
+// don't record their source. Leftovers of interrupted fills are removed on
+// startup, while entries indexed already are left alone otherwise.
+func (c *PicoCache) indexDir(dir string, startup bool) (unbound int, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == quarantineDir || d.Name() == resumeDir) && path != dir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || isControlFile(d.Name()) {
+			return nil
+		}
+		if isAuxFile(path) {
+			if startup && !c.frozen.Load() {
+				c.removeLeftover(path)
+			}
+			return nil
+		}
+		if _, indexed := c.entries.Load(path); indexed {
 			return nil
 		}
 
@@ -135,181 +619,749 @@ func (c *PicoCache) rebuildCache() error {
 			return err
 		}
 
-		c.entries.Store(path, &cacheEntry{
+		entry := &cacheEntry{
 			filename: path,
 			size:     info.Size(),
-			lastUsed: info.ModTime(),
-		})
-		c.totalSize.Add(info.Size())
+			diskSize: c.roundToBlock(info.Size()),
+		}
+		entry.unverified.Store(true)
+		modified := c.fromWall(info.ModTime())
+		entry.lastUsed.Store(modified.UnixNano())
+		entry.filled = modified
+		meta, err := readMeta(path)
+		if err != nil {
+			c.log.Warn("Ignoring unreadable metadata", slog.String("file", path), slog.String("err", err.Error()))
+		} else if meta == nil {
+			entry.legacy.Store(true)
+		} else {
+			entry.encoding = meta.Encoding
+			entry.decodedSize = meta.DecodedSize
+			entry.sourceEncoded = meta.SourceEncoded
+			if meta.Expires != 0 {
+				entry.expires = c.fromWall(time.Unix(meta.Expires, 0))
+			}
+			entry.hash = meta.Hash
+			entry.path = meta.Path
+			entry.status, entry.location = meta.Status, meta.Location
+			entry.language, entry.contentType = meta.ContentLanguage, meta.ContentType
+			entry.etag, entry.lastModified = meta.SourceETag, meta.LastModified
+			entry.origin = meta.Origin
+			entry.staleIfError = time.Duration(meta.StaleIfError) * time.Second
+			entry.headers = meta.Headers
+			entry.adaptive = loadAdaptiveState(meta)
+			if meta.Size != nil && *meta.Size != entry.size {
+				c.log.Warn("Removing torn cache file", slog.String("file", path),
+					slog.Int64("size", entry.size), slog.Int64("expected", *meta.Size))
+				if !c.frozen.Load() {
+					removeFiles(entry)
+				}
+				return nil
+			}
+		}
+		if entry.origin == "" {
+			unbound++
+		}
+		entry.sealed.Store(true)
+		if _, indexed := c.entries.LoadOrStore(path, entry); indexed {
+			return nil
+		}
+		c.account(entry)
 		return nil
 	})
+	return unbound, err
+}
 
-	if err != nil {
-		return err
+// downloadFile fills cacheFile from url on behalf of the client whose
+// request ctx is, or waits for the fill in progress for it. The request key
+// is recorded in the metadata for entries whose file doesn't derive from it,
+// or all of them with WithPrefixPurge. Entries returned with condemned set
+// aren't cached, their file is to be opened then released.
+func (c *PicoCache) downloadFile(ctx context.Context, url string, cacheFile string, key string, rule *Rule, t *timings) (entry *cacheEntry, err error) {
+	if c.readOnly.Load() {
+		t.trace("cache read-only")
+		return nil, errReadOnly
 	}
 
-	go c.cleanupOldEntries()
+	fillCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := newFill(filepath.Base(cacheFile), key, cancel)
 
-	return nil
-}
-
-func (c *PicoCache) downloadFile(url string, cacheFile string) (*cacheEntry, error) {
 	// Check if download is already in progress
-	if _, exists := c.downloading.LoadOrStore(cacheFile, true); exists {
+	if existing, exists := c.downloading.LoadOrStore(cacheFile, f); exists {
+		f = existing.(*fill)
+		defer c.attach(ctx, f)()
+		held := f.hold()
+		defer func() {
+			if held && (entry == nil || entry.condemned != f) {
+				f.release()
+			}
+		}()
+
 		// Wait for other download to complete
+		end := c.waits.begin(cacheFile, waitFill, t)
+		defer func() {
+			t.trace("waited %s for a concurrent fill", end().Round(time.Millisecond))
+		}()
 		for {
-			if entry, ok := c.entries.Load(cacheFile); ok {
-				c.downloading.Delete(cacheFile)
-				return entry.(*cacheEntry), nil
+			if condemned := f.result.Load(); held && condemned != nil {
+				return condemned, nil
+			}
+			if g := f.growing.Load(); g != nil && t.tail != nil {
+				t.tail(g)
+				t.tail = nil
+			}
+			if e, ok := c.entries.Load(cacheFile); ok {
+				if entry := e.(*cacheEntry); entry.sealed.Load() && !entry.expired(c.steadyNow()) && !c.refusedForeign(entry) {
+					c.downloading.CompareAndDelete(cacheFile, f)
+					return entry, nil
+				}
+			}
+			if current, ok := c.downloading.Load(cacheFile); !ok || current != f {
+				if c.readOnly.Load() {
+					return nil, errReadOnly
+				}
+				if f.timedOut.Load() {
+					return nil, errFirstByteTimeout
+				}
+				if f.partial.Load() {
+					return nil, errPartialContent
+				}
+				if f.over.Load() {
+					return nil, errBudgetExhausted
+				}
+				if f.unbudget.Load() {
+					return nil, errFillBudget
+				}
+				if f.limited.Load() {
+					return nil, errRateLimited
+				}
+				if f.rejected.Load() {
+					return nil, errRejected
+				}
+				if f.differed.Load() {
+					return nil, errReleaseMismatch
+				}
+				if f.failed.Load() {
+					return nil, errSourceFailed
+				}
+				return nil, fmt.Errorf("concurrent download failed")
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
 			}
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
-	defer c.downloading.Delete(cacheFile)
+	defer c.downloading.CompareAndDelete(cacheFile, f)
+	defer c.attach(ctx, f)()
+	defer func() {
+		if entry == nil || entry.condemned != f {
+			f.release()
+		}
+	}()
+
+	listed, _ := c.released(key)
+	checked := listed.size >= 0 || listed.sha256 != nil
 
 	// Try download up to 3 times
 	for attempts := 0; attempts < 3; attempts++ {
-		resp, err := http.Get(url)
+		if fillCtx.Err() != nil {
+			return nil, errAbandoned
+		}
+		reqCtx, cancelReq := context.WithCancel(fillCtx)
+		defer cancelReq()
+		req, err := c.newOriginRequest(reqCtx, url)
+		if err != nil {
+			return nil, err
+		}
+		t.askLanguage(req)
+		resume := c.loadResume(cacheFile, url)
+		if resume != nil {
+			t.trace("resuming from byte %d", resume.Written)
+			resume.ask(req)
+		} else if c.originCompression {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		if req.Header.Get("Accept-Encoding") == "" {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		fetch := c.startOriginFetch(url, "fill", attempts > 0)
+		fetch.startSpan(t, req)
+		resp, err := c.originDo(req)
+		t.originFirstByte = time.Since(fetch.start)
 		if err != nil {
+			fetch.done(0, 0, err)
+			if errors.Is(err, errRateLimited) {
+				t.trace("over the origin request rate limit")
+				f.limited.Store(true)
+				return nil, err
+			}
+			if isOriginViolation(err) {
+				c.originViolation(url, err.Error())
+				return nil, errors.Join(errOriginViolation, err)
+			}
 			continue
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
+		if c.throttled(resp) {
+			t.trace("source answered 429")
+			fetch.done(resp.StatusCode, 0, nil)
+			f.limited.Store(true)
+			return nil, errRateLimited
+		}
+
+		if resume != nil && !resume.continuedBy(resp) {
+			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+				t.trace("source changed or doesn't resume, starting over")
+				c.dropPartial(cacheFile)
+			}
+			if resp.StatusCode == http.StatusPartialContent {
+				fetch.done(resp.StatusCode, 0, nil)
+				continue
+			}
+			resume = nil
+		}
+		if resp.StatusCode == http.StatusPartialContent && resume == nil {
+			t.trace("source returned partial content %s", resp.Header.Get("Content-Range"))
+			fetch.done(resp.StatusCode, 0, nil)
+			c.stats.partialResponses.Add(1)
+			c.log.Warn("Source sent partial content to an unranged request", slog.String("url", url),
+				slog.String("content_range", resp.Header.Get("Content-Range")))
+			f.partial.Store(true)
+			return nil, errPartialContent
+		}
+		if !c.cacheable(resp.StatusCode) && resume == nil {
+			t.trace("source returned %d", resp.StatusCode)
+			fetch.done(resp.StatusCode, 0, nil)
+			if resp.StatusCode >= http.StatusInternalServerError {
+				f.failed.Store(true)
+				return nil, fmt.Errorf("%w, returning status %d", errSourceFailed, resp.StatusCode)
+			}
 			return nil, fmt.Errorf("source returned status %d", resp.StatusCode)
 		}
+		length := c.bodyLength(url, resp)
+		total, offset := length, int64(0)
+		if resume != nil {
+			total, offset = resume.Length, resume.Written
+		}
+		if rule != nil && rule.MaxSize > 0 && total > rule.MaxSize {
+			t.trace("%d bytes, over the rule max size", total)
+			fetch.done(resp.StatusCode, 0, nil)
+			return nil, errTooLarge
+		}
+		if c.overBudget(length) {
+			t.trace("%d bytes, over the origin byte budget", length)
+			fetch.done(resp.StatusCode, 0, nil)
+			f.over.Store(true)
+			return nil, errBudgetExhausted
+		}
+		if length >= 0 && c.overFillBudget(length) {
+			t.trace("%d bytes, over the fill byte budget", length)
+			fetch.done(resp.StatusCode, 0, nil)
+			f.unbudget.Store(true)
+			return nil, errFillBudget
+		}
+		path, _, _ := strings.Cut(key, "?")
+		if resp.StatusCode == http.StatusOK && c.rejectedType(url, path, resp.Header.Get("Content-Type"), t) {
+			t.trace("source sent %s, rejected", resp.Header.Get("Content-Type"))
+			fetch.done(resp.StatusCode, 0, nil)
+			f.rejected.Store(true)
+			return nil, errRejected
+		}
+		f.attempt(total, offset)
+
+		// Only touch the disk once the body starts flowing
+		body, err := c.awaitFirstByte(resp.Body, cancelReq)
+		if err != nil {
+			fetch.done(resp.StatusCode, 0, err)
+			if fillCtx.Err() != nil {
+				return nil, errAbandoned
+			}
+			if errors.Is(err, errFirstByteTimeout) {
+				t.trace("source body didn't start in time")
+				f.timedOut.Store(true)
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusOK && c.rejectedBody(url, body, t) {
+			t.trace("source body starts with a blocked prefix, rejected")
+			fetch.done(resp.StatusCode, 0, nil)
+			f.rejected.Store(true)
+			return nil, errRejected
+		}
 
-		tempFile := cacheFile + ".tmp"
-		file, err := os.Create(tempFile)
+		tempFile := cacheFile + tempSuffix
+		var file *os.File
+		if resume != nil {
+			tempFile = c.partialFile(cacheFile)
+			file, err = os.OpenFile(tempFile, os.O_WRONLY|os.O_APPEND, 0)
+		} else {
+			file, err = c.create(tempFile)
+		}
 		if err != nil {
+			if c.dirFailed(tempFile, err) {
+				return nil, errors.Join(errReadOnly, err)
+			}
+			if isReadOnlyErr(err) {
+				c.degrade(err)
+				return nil, errors.Join(errReadOnly, err)
+			}
 			return nil, err
 		}
 
-		n, err := io.Copy(file, resp.Body)
-		file.Close()
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			path, _, _ := strings.Cut(url, "?")
+			contentType = c.contentType(path)
+		}
 
-		if err != nil || n != resp.ContentLength {
-			os.Remove(tempFile)
-			continue
+		var dst io.Writer = c.fillBudgeted(file, length)
+		hash := sha256.New()
+		if c.dedup {
+			dst = io.MultiWriter(dst, hash)
+		}
+		encoding := sourceEncoding(resp)
+		if resume != nil {
+			encoding = ""
+		}
+		var decoded *decodedCounter
+		if encoding == "gzip" {
+			decoded = newDecodedCounter()
+			dst = io.MultiWriter(dst, decoded)
+		}
+		var gz *gzip.Writer
+		if c.compress && compressible(contentType) && length != 0 && resume == nil && encoding == "" {
+			gz = gzip.NewWriter(dst)
+			dst = gz
 		}
+		var g *growingFile
+		if c.streamFills && gz == nil && encoding == "" && resp.StatusCode == http.StatusOK && !checked && (c.fillBudget == nil || length >= 0) {
+			g = newGrowingFile(tempFile, length, &f.written)
+			defer g.finish(errFillFailed)
+			f.growing.Store(g)
+			if t.tail != nil {
+				t.tail(g)
+				t.tail = nil
+			}
+		}
+		dst = io.MultiWriter(dst, fillWriter{f, g})
+
+		fetch.fill = f
+		_, span := t.startSpan(SpanDiskWrite)
+		n, err := io.Copy(dst, io.LimitReader(c.budgeted(body), c.maxContentLength+1))
+		err = c.checkBody(url, length, n, err)
+		if errors.Is(err, errTooLarge) {
+			t.trace("body over the max content length")
+		}
+		fetch.done(resp.StatusCode, n, err)
+		if gz != nil && err == nil {
+			err = gz.Close()
+		}
+		decodedSize := int64(-1)
+		if decoded != nil {
+			var decodeErr error
+			decodedSize, decodeErr = decoded.close(err)
+			if n == 0 {
+				// Nothing to decode
+				encoding = ""
+			} else if err == nil && decodeErr != nil {
+				err = fmt.Errorf("malformed gzip body: %w", decodeErr)
+			}
+		}
+		var info fs.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+		}
+		if err == nil {
+			err = c.syncFile(file)
+		}
+		file.Close()
+		span.end(err, slog.Int64("picocache.bytes", n))
 
-		err = os.Rename(tempFile, cacheFile)
 		if err != nil {
-			os.Remove(tempFile)
-			return nil, err
+			t.trace("fill failed after %d bytes", n)
+			if g != nil {
+				g.finish(errFillFailed)
+			}
+			if gz != nil || encoding != "" || errors.Is(err, errTooLarge) || errors.Is(err, errFillBudget) || !c.keepPartial(cacheFile, tempFile, url, resp, resume, total) {
+				os.Remove(tempFile)
+			} else {
+				t.trace("kept %d bytes to resume", offset+n)
+			}
+			if fillCtx.Err() != nil {
+				return nil, errAbandoned
+			}
+			if errors.Is(err, errTooLarge) {
+				return nil, err
+			}
+			if errors.Is(err, errFillBudget) {
+				t.trace("fill byte budget ran dry, abandoned")
+				c.stats.fillsOverBudget.Add(1)
+				f.unbudget.Store(true)
+				return nil, err
+			}
+			continue
+		}
+		if checked && (resp.StatusCode == http.StatusOK || resume != nil) {
+			if err := checkRelease(listed, tempFile, gz != nil || encoding == "gzip"); err != nil {
+				t.trace("%s", err)
+				os.Remove(tempFile)
+				if resume != nil {
+					c.dropPartial(cacheFile)
+				}
+				if !errors.Is(err, errReleaseMismatch) {
+					continue
+				}
+				c.stats.releaseMismatches.Add(1)
+				c.log.Error("Source body differs from the release manifest, not cached", slog.String("url", url), slog.String("err", err.Error()))
+				f.differed.Store(true)
+				return nil, err
+			}
 		}
 
 		entry := &cacheEntry{
 			filename: cacheFile,
-			size:     resp.ContentLength,
-			lastUsed: time.Now(),
+			size:     info.Size(),
+			diskSize: c.roundToBlock(info.Size()),
+			path:     key,
+			origin:   c.originID,
+		}
+		if resp.StatusCode != http.StatusOK && resume == nil {
+			entry.status, entry.location = resp.StatusCode, resp.Header.Get("Location")
+		}
+		now := c.steadyNow()
+		entry.lastUsed.Store(now.UnixNano())
+		entry.filled = now
+		entry.etag, entry.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		entry.language = resp.Header.Get("Content-Language")
+		entry.staleIfError = parseStaleIfError(resp.Header.Get("Cache-Control"))
+		entry.headers = c.storeAppHeaders(nil, resp.Header)
+		if c.sourceContentType {
+			entry.contentType = resp.Header.Get("Content-Type")
+		}
+		meta := &entryMeta{Status: entry.status, Location: entry.location, ContentLanguage: entry.language, ContentType: entry.contentType,
+			SourceETag: entry.etag, LastModified: entry.lastModified, Origin: entry.origin, StaleIfError: int64(entry.staleIfError / time.Second), Headers: entry.headers}
+		if gz != nil {
+			entry.encoding = "gzip"
+			entry.decodedSize = n
+			meta.Encoding, meta.DecodedSize = entry.encoding, n
+		} else if encoding != "" {
+			entry.encoding, entry.decodedSize, entry.sourceEncoded = encoding, decodedSize, true
+			meta.Encoding, meta.DecodedSize, meta.SourceEncoded = encoding, decodedSize, true
+		}
+		if rule != nil && rule.TTL > 0 {
+			ttl := c.ttl(rule)
+			if c.adaptiveTTL != nil {
+				entry.adaptive = c.adaptiveTTL.filled(rule, t.changed, c.now())
+				entry.adaptive.store(meta)
+				ttl = entry.adaptive.ttl
+			}
+			entry.expires = now.Add(ttl)
+			meta.Expires = c.toWall(entry.expires).Unix()
+		}
+		if keyed(cacheFile, key) {
+			meta.Key, meta.Path = filepath.Base(cacheFile), key
+		} else if c.paths != nil {
+			meta.Path = key
 		}
-		c.entries.Store(cacheFile, entry)
+		if c.dedup {
+			entry.hash = hex.EncodeToString(hash.Sum(nil))
+			meta.Hash = entry.hash
 
-		c.totalSize.Add(resp.ContentLength)
+			linkFile := cacheFile + ".link" + tempSuffix
+			if c.linkBody(entry.hash, cacheFile, linkFile) {
+				os.Remove(tempFile)
+				tempFile = linkFile
+			}
+		}
+		if c.fsync != FsyncNone {
+			// Lets rebuilds tell torn writes, empty bodies included
+			meta.Size = &entry.size
+		}
+		if err := c.publish(entry, tempFile, meta, f, t); err != nil {
+			return nil, err
+		}
+		if resume != nil {
+			os.Remove(tempFile + metaSuffix)
+			c.stats.resumedFills.Add(1)
+		}
+		if g != nil {
+			g.finish(nil)
+		}
+		if entry.condemned != nil {
+			t.trace("filled %d bytes, purged meanwhile so not cached", entry.size)
+			return entry, nil
+		}
+		t.trace("filled %d bytes", entry.size)
+		final := f.progress()
+		t.fill = &final
+		if c.ghosts != nil {
+			c.ghosts.refetched(cacheFile, entry.size)
+		}
 
-		go c.cleanupOldEntries() // Run cleanup in background if needed
+		if entry.negative() {
+			c.trimAux()
+		} else {
+			go c.cleanupOldEntries() // Run cleanup in background if needed
+		}
 
 		return entry, nil
 	}
 
-	return nil, fmt.Errorf("failed to download file after 3 attempts")
+	f.failed.Store(true)
+	return nil, fmt.Errorf("%w after 3 attempts", errSourceFailed)
 }
 
-func (c *PicoCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if r.URL.Path == "/favicon.ico" || r.URL.Path == "/" {
-		w.WriteHeader(http.StatusNotFound)
-		return
+// publish moves the filled tempFile in place of entry, along with its
+// metadata, and makes it the one served, for the request of t if set. The
+// body of f, if set, is only moved aside for its clients once it got
+// condemned.
+func (c *PicoCache) publish(entry *cacheEntry, tempFile string, meta *entryMeta, f *fill, t *timings) error {
+	cacheFile := entry.filename
+	defer c.lockFileTimed(cacheFile, t)()
+
+	if f != nil && f.condemned.Load() {
+		// Another fill may reuse tempFile before the clients open it
+		orphan := cacheFile + ".purged." + strconv.FormatInt(time.Now().UnixNano(), 10) + tempSuffix
+		if err := os.Rename(tempFile, orphan); err != nil {
+			os.Remove(tempFile)
+			return err
+		}
+		entry.filename, entry.condemned = orphan, f
+		f.mu.Lock()
+		f.orphan = orphan
+		f.mu.Unlock()
+		f.result.Store(entry)
+		return nil
 	}
 
-	log := c.log.With(slog.String("url", r.URL.Path))
-	cacheFile := c.getCacheFilename(r)
+	if !meta.empty() {
+		if err := c.writeMeta(cacheFile, meta); err != nil {
+			os.Remove(tempFile)
+			return err
+		}
+	} else {
+		os.Remove(cacheFile + metaSuffix)
+	}
 
-	header := w.Header()
-	header.Set("X-Cache", "MISS")
-	header.Set("Cache-Control", "public, max-age=604800, immutable")
-	header.Set("Content-Type", mime.TypeByExtension(filepath.Ext(r.URL.Path)))
-	header.Set("Accept-Ranges", "bytes")
-	etag := filepath.Base(cacheFile)
-	header.Set("ETag", etag)
+	// An expired entry is being replaced
+	old, replacing := c.entries.Load(cacheFile)
+	if replacing {
+		old.(*cacheEntry).sealed.Store(false)
+	}
+	if err := os.Rename(tempFile, cacheFile); err != nil {
+		os.Remove(tempFile)
+		if replacing {
+			old.(*cacheEntry).sealed.Store(true)
+		}
+		return err
+	}
+	if err := c.renamed(cacheFile); err != nil {
+		c.log.Warn("Failed to sync cache directory", slog.String("file", cacheFile), slog.String("err", err.Error()))
+	}
 
-	if match := r.Header.Get("If-None-Match"); match != "" &&
-		strings.EqualFold(match, etag) {
+	entry.sealed.Store(true)
+	if c.heads != nil {
+		c.heads.forget(cacheFile)
+	}
+	if old, loaded := c.entries.Swap(cacheFile, entry); loaded {
+		c.unaccount(old.(*cacheEntry))
+	}
+	c.account(entry)
+	return nil
+}
 
-		w.WriteHeader(http.StatusNotModified)
+// passThrough streams url from the source to the client without caching it.
+func (c *PicoCache) passThrough(w http.ResponseWriter, r *http.Request, url string, log *slog.Logger, t *timings) {
+	if c.offline {
+		t.trace("offline")
+		c.refuseOffline(w, r.URL.Path)
 		return
 	}
-
-	var entry *cacheEntry
-	if e, ok := c.entries.Load(cacheFile); ok {
-		entry = e.(*cacheEntry)
-		header.Set("X-Cache", "HIT")
-	} else {
-		var err error
-		entry, err = c.downloadFile(c.source+r.URL.Path, cacheFile)
-		if err != nil {
-			log.Error("Failed to download file", slog.String("err", err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	if c.overBudget(-1) {
+		t.trace("over the origin byte budget")
+		c.refuseOverBudget(w, t)
+		return
 	}
-
-	file, err := os.Open(entry.filename)
+	req, err := c.newOriginRequest(r.Context(), url)
 	if err != nil {
-		log.Error("Failed to open cached file", slog.String("err", err.Error()))
+		log.Error("Failed to build source request", slog.String("err", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
-
-	var fileReader io.Reader
 	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
-		// Handle ranged request
-		rang, err := parseRange(rangeHeader, entry.size)
-		if err != nil {
-			log.Debug("Error parsing range", slog.String("err", err.Error()), slog.String("rangeHeader", rangeHeader))
-			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
-			return
+		req.Header.Set("Range", rangeHeader)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	if c.uncachedPreconditions == PreconditionsForward {
+		for _, name := range []string{"If-Match", "If-Unmodified-Since"} {
+			if v := r.Header.Get(name); v != "" {
+				req.Header.Set(name, v)
+			}
 		}
+	}
+	t.askLanguage(req)
 
-		if _, err := file.Seek(rang.start, io.SeekStart); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+	fetch := c.startOriginFetch(url, "passthrough", false)
+	fetch.startSpan(t, req)
+	resp, err := c.originDo(req)
+	t.originFirstByte = time.Since(fetch.start)
+	if err != nil {
+		fetch.done(0, 0, err)
+		if errors.Is(err, errRateLimited) {
+			t.trace("over the origin request rate limit")
+			c.refuseRateLimited(w, t)
 			return
 		}
+		log.Error("Failed to fetch file", slog.String("err", err.Error()))
+		if isOriginViolation(err) {
+			c.originViolation(url, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
 
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rang.start, rang.end, entry.size))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", rang.end-rang.start+1))
-		w.WriteHeader(http.StatusPartialContent)
-
-		fileReader = io.LimitReader(file, rang.end-rang.start+1)
-	} else {
-		fileReader = file
+	if c.throttled(resp) {
+		fetch.done(resp.StatusCode, 0, nil)
+		t.trace("source answered 429")
+		c.refuseRateLimited(w, t)
+		return
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed && c.uncachedPreconditions == PreconditionsForward && hasPreconditions(r) {
+		fetch.done(resp.StatusCode, 0, nil)
+		t.trace("precondition failed at the source")
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+	if !c.cacheable(resp.StatusCode) && resp.StatusCode != http.StatusPartialContent {
+		fetch.done(resp.StatusCode, 0, nil)
+		log.Error("Failed to fetch file", slog.Int("status", resp.StatusCode))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	if _, err := io.Copy(&writerClientError{w}, fileReader); err != nil &&
-		!(errors.Is(err, errClientError) && (errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET))) {
+	length := c.bodyLength(url, resp)
+	if length >= 0 && c.overBudget(length) {
+		t.trace("%d bytes, over the origin byte budget", length)
+		fetch.done(resp.StatusCode, 0, nil)
+		c.refuseOverBudget(w, t)
+		return
+	}
+	if length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if v := resp.Header.Get("Content-Range"); v != "" {
+		w.Header().Set("Content-Range", v)
+	}
+	if v := resp.Header.Get("Location"); v != "" {
+		w.Header().Set("Location", v)
+	}
+	if v := resp.Header.Get("Content-Language"); v != "" {
+		w.Header().Set("Content-Language", v)
+	}
+	if v := resp.Header.Get("Content-Encoding"); v != "" {
+		w.Header().Set("Content-Encoding", v)
+	}
+	if v := resp.Header.Get("Content-Type"); v != "" && c.sourceContentType {
+		w.Header().Set("Content-Type", v)
+	}
+	for _, name := range c.appHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
 
+	body := &countingReader{Reader: c.budgeted(resp.Body)}
+	_, span := t.startSpan(SpanClientCopy)
+	copyStart := time.Now()
+	_, err = c.copyToClient(w, body)
+	t.copy = time.Since(copyStart)
+	span.end(err, slog.Int64("picocache.bytes", body.n))
+	fetch.done(resp.StatusCode, body.n, err)
+	if err != nil {
 		log.Error("Failed to stream file", slog.String("err", err.Error()))
+		// Don't let a truncated body pass for a whole one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (c *PicoCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.servedBy != "" {
+		w.Header().Set("X-Served-By", c.servedBy)
+	}
+	r, ok := c.admitTarget(w, r)
+	if !ok {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		c.serveAdmin(w, r)
+		return
+	}
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	if r.Method == "PURGE" && c.purgeAllowed() {
+		c.servePurgeMethod(w, r)
 		return
 	}
 
-	// Update last used time
-	now := time.Now()
-	os.Chtimes(entry.filename, now, now)
-	entry.lastUsed = now
+	t := &timings{start: c.now(), traced: c.tracing(r)}
+	if c.tracer != nil {
+		t.startRequestSpan(c.tracer, r)
+	}
+	rec := &recorder{ResponseWriter: w, t: t, now: c.now}
+	c.serve(rec, r, t)
+	if rec.status == 0 {
+		// Nothing got written, net/http sends the headers as they are
+		t.stampOutcome(rec.Header())
+	}
+	c.observe(r, rec, t)
 }
 
 var errClientError = errors.New("client error")
 
+// copyToClient streams r to w, returning the bytes written, not reporting
+// the client going away or stalling as an error. The write deadline is
+// pushed back on every write, see WithWriteStallTimeout.
+func (c *PicoCache) copyToClient(w http.ResponseWriter, r io.Reader) (int64, error) {
+	cw := &writerClientError{ResponseWriter: w}
+	if c.writeStallTimeout > 0 {
+		cw.rc = http.NewResponseController(w)
+		cw.stall = c.writeStallTimeout
+		defer func() {
+			// What's still buffered goes out under the deadline too, the
+			// server doesn't reset it for the next request
+			cw.rc.Flush()
+			cw.rc.SetWriteDeadline(time.Time{})
+		}()
+	}
+	n, err := io.Copy(cw, r)
+	if errors.Is(err, errClientError) && errors.Is(err, os.ErrDeadlineExceeded) {
+		c.stats.clientStalls.Add(1)
+		return n, nil
+	}
+	if err != nil && !(errors.Is(err, errClientError) && (errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET))) {
+		return n, err
+	}
+	return n, nil
+}
+
 type writerClientError struct {
 	http.ResponseWriter
+	rc    *http.ResponseController // when stalls get dropped
+	stall time.Duration
 }
 
 func (rcr *writerClientError) Write(p []byte) (n int, err error) {
+	if rcr.rc != nil {
+		rcr.rc.SetWriteDeadline(time.Now().Add(rcr.stall))
+	}
 	n, err = rcr.ResponseWriter.Write(p)
 	if err != nil {
 		err = errors.Join(errClientError, err)
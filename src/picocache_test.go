@@ -1,55 +1,157 @@
 package picocache_test
 
 import (
-	"log/slog"
+	"fmt"
 	"net/http"
-	"net/http/httptest"
-	"net/http/httputil"
 	picocache "picocache/src"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPicocache(t *testing.T) {
-	sourceServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	t.Run("miss then hit", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 900)
+		origin.Handle("/hi", OriginResponse{Body: "Yay", Header: http.Header{"Content-Type": {"text/plain"}}})
+
+		cache.Expect("/hi", "MISS", "Yay")
+		cache.Expect("/hi", "HIT", "Yay")
+		if n := origin.Requests("/hi"); n != 1 {
+			t.Fatalf("expected the source asked once, got %d requests", n)
+		}
+		if s := cache.Stats(); s.Misses != 1 || s.Hits != 1 || s.LogicalSize != 3 {
+			t.Fatalf("unexpected stats %+v", s)
 		}
+	})
 
-		_, err := w.Write([]byte("Yay"))
-		if err != nil {
-			t.Fatal(err)
+	t.Run("not modified", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 900)
+		cache.Expect("/hi", "MISS", "/hi")
+
+		etag := http.Header{"If-None-Match": {picocache.KeyForPath("/hi")}}
+		if w := cache.Get("/hi", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Fatalf("expected a 304, got %d %q", w.Code, w.Body.String())
+		}
+		if w := cache.Get("/hi", http.Header{"If-None-Match": {"other"}}); w.Code != http.StatusOK {
+			t.Fatalf("expected a 200 for another ETag, got %d", w.Code)
 		}
+		if n := origin.Requests("/hi"); n != 1 {
+			t.Fatalf("expected the source asked once, got %d requests", n)
+		}
+	})
 
-		b, err := httputil.DumpRequest(r, true)
-		if err != nil {
-			t.Fatal(err)
+	t.Run("eviction at the size limit", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 1000)
+		body := strings.Repeat("x", 400)
+		for _, path := range []string{"/a", "/b", "/c"} {
+			origin.Handle(path, OriginResponse{Body: body})
+			cache.Expect(path, "MISS", body)
+			cache.Clock.Advance(time.Second)
 		}
+		Eventually(t, func() bool { return cache.Len() == 2 })
+		if s := cache.Stats(); s.TotalSize > s.MaxSize {
+			t.Fatalf("cache over its size: %d bytes of %d", s.TotalSize, s.MaxSize)
+		}
+
+		// The least recently used went first
+		cache.Expect("/c", "HIT", body)
+		cache.Expect("/b", "HIT", body)
+		cache.Expect("/a", "MISS", body)
+	})
 
-		t.Log("SRC: got request:\n" + string(b))
-	}))
+	t.Run("rebuild from an existing directory", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 900)
+		cache.Expect("/kept", "MISS", "/kept")
+		cache.Expect("/gone", "MISS", "/gone")
+		if r := cache.Purge(picocache.KeyForPath("/gone")); r != picocache.Purged {
+			t.Fatalf("expected /gone purged, got %s", r)
+		}
 
-	cacheDir := t.TempDir()
+		cache.Reopen()
+		if n := cache.Len(); n != 1 {
+			t.Fatalf("expected 1 entry rebuilt, got %d", n)
+		}
+		cache.Expect("/kept", "HIT", "/kept")
+		cache.Expect("/gone", "MISS", "/gone")
+		if n := origin.Requests("/kept"); n != 1 {
+			t.Fatalf("expected the rebuilt entry not fetched again, got %d requests", n)
+		}
+	})
 
-	cache, err := picocache.NewCache(slog.Default(), sourceServer.URL, cacheDir, 900)
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Run("expiry on the injected clock", func(t *testing.T) {
+		rules, err := picocache.ParseRules(".txt ttl=1h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 900, picocache.WithRules(rules...))
+		cache.Expect("/a.txt", "MISS", "/a.txt")
+		cache.Clock.Advance(59 * time.Minute)
+		cache.Expect("/a.txt", "HIT", "/a.txt")
+		cache.Clock.Advance(2 * time.Minute)
+		cache.Expect("/a.txt", "MISS", "/a.txt")
+		if n := origin.Requests("/a.txt"); n != 2 {
+			t.Fatalf("expected the expired entry fetched again, got %d requests", n)
+		}
+	})
 
-	server := httptest.NewServer(cache)
+	t.Run("concurrent requests", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 1<<20)
+		origin.Handle("/shared", OriginResponse{Body: "shared", Delay: 50 * time.Millisecond})
 
-	client := server.Client()
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, path := range []string{"/shared", fmt.Sprintf("/own/%d", i)} {
+					want := path
+					if path == "/shared" {
+						want = "shared"
+					}
+					if w := cache.Get(path, nil); w.Code != http.StatusOK || w.Body.String() != want {
+						t.Errorf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n := origin.Requests("/shared"); n != 1 {
+			t.Fatalf("expected concurrent misses to share a fill, got %d requests", n)
+		}
+		if n := cache.Len(); n != 21 {
+			t.Fatalf("expected 21 entries, got %d", n)
+		}
+	})
 
-	resp, err := client.Get(server.URL + "/hi?feur")
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Run("source down", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 900)
+		origin.Handle("/missing", OriginResponse{Status: http.StatusNotFound, Body: "nope"})
+		cache.Expect("/up", "MISS", "/up")
 
-	b, err := httputil.DumpResponse(resp, true)
-	if err != nil {
-		t.Fatal(err)
-	}
+		origin.SetDown(true)
+		if w := cache.Get("/down", nil); w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected the failed fill reported, got %d", w.Code)
+		}
+		cache.Expect("/up", "HIT", "/up")
+		origin.SetDown(false)
+		cache.Expect("/down", "MISS", "/down")
 
-	t.Log("Client:\n" + string(b))
-	t.Fail()
+		// Nor are error statuses of the source cached
+		for range 2 {
+			if w := cache.Get("/missing", nil); w.Code != http.StatusInternalServerError {
+				t.Fatalf("expected the source error reported, got %d", w.Code)
+			}
+		}
+		if n := origin.Requests("/missing"); n != 2 {
+			t.Fatalf("expected the source asked each time, got %d requests", n)
+		}
+	})
 }
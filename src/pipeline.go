@@ -0,0 +1,440 @@
+package picocache
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// requestState is what the stages of serve hand each other for a request.
+type requestState struct {
+	w   http.ResponseWriter
+	r   *http.Request
+	t   *timings // the outcome, the entry and its language among others
+	log *slog.Logger
+
+	path, key string // see requestKey
+	cacheFile string // of the entry requested
+	previous  string // of the entry under the previous key scheme, if any
+	rule      *Rule
+	etag      string
+
+	// Set once fetched, see fetchAndFill
+	entry   *cacheEntry
+	file    *os.File
+	outcome Outcome
+}
+
+// serve runs a request through its stages: resolveKey picks the entry,
+// guardKeys turns floods of new keys away, fetchAndFill gets it from the
+// disk or the source, serveError answers when
+// it couldn't, checkConditional answers the preconditions of the request,
+// and serveHit sends the entry.
+func (c *PicoCache) serve(w http.ResponseWriter, r *http.Request, t *timings) {
+	if c.proxied(r.URL.Path) {
+		c.proxy(w, r, t)
+		return
+	}
+	_, span := t.startSpan(SpanResolveKey)
+	s, ok := c.resolveKey(w, r, t)
+	if !ok {
+		span.end(nil)
+		return
+	}
+	span.end(nil, slog.String("picocache.key", filepath.Base(s.cacheFile)))
+
+	done, ok := c.admitRequest(r.Context(), s.cacheFile, t)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	if !c.guardKeys(s) {
+		return
+	}
+	answered, err := c.fetchAndFill(s)
+	if answered {
+		return
+	}
+	if err != nil {
+		c.serveError(s, err)
+		return
+	}
+	defer s.file.Close()
+	c.describeEntry(s)
+	if c.checkConditional(s) {
+		return
+	}
+	c.serveHit(s)
+}
+
+// resolveKey checks the request and picks the entry it gets, setting the
+// headers every answer about it sends. It reports false once it answered
+// the request on its own.
+func (c *PicoCache) resolveKey(w http.ResponseWriter, r *http.Request, t *timings) (*requestState, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		c.refuseMethod(w)
+		return nil, false
+	}
+	if climbs(r.URL.Path) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return nil, false
+	}
+	path, key := c.requestKey(r.URL)
+	if path == "/favicon.ico" || path == "/" {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	if _, ok := c.released(key); !ok {
+		t.trace("not in the release manifest")
+		c.stats.releaseDenied.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	cacheFile := c.getCacheFilename(key)
+	s := &requestState{
+		w:         w,
+		r:         r,
+		t:         t,
+		log:       c.log.With(slog.String("url", key)),
+		path:      path,
+		key:       key,
+		cacheFile: cacheFile,
+		previous:  c.previousFile(r.URL, cacheFile),
+		rule:      c.matchRule(path),
+	}
+
+	// Trusted clients may dictate the key, e.g. a content hash
+	if override := r.Header.Get("X-Picocache-Key"); override != "" && c.trusted(r) {
+		if !validKey(override) {
+			http.Error(w, "invalid X-Picocache-Key", http.StatusBadRequest)
+			return nil, false
+		}
+		s.cacheFile = c.keyFile(override)
+		s.previous = ""
+		t.trace("key %s set by the client", override)
+	} else if t.language = c.language(r.Header.Get("Accept-Language"), s.rule); t.language != "" {
+		s.cacheFile, s.previous = c.getCacheFilename(languageKey(key, t.language)), ""
+		t.trace("key %s, of the %s variant", filepath.Base(s.cacheFile), t.language)
+	} else {
+		t.trace("key %s", filepath.Base(s.cacheFile))
+	}
+
+	t.cacheFile = s.cacheFile
+	t.staleIfError = parseStaleIfError(r.Header.Get("Cache-Control"))
+
+	if s.rule != nil {
+		t.trace("rule %s", s.rule.matcher())
+	} else {
+		t.trace("no rule")
+	}
+
+	header := w.Header()
+	header.Set("X-Cache-Key", filepath.Base(s.cacheFile))
+	if expected := r.Header.Get("X-Picocache-Expect-Key"); expected != "" && expected != filepath.Base(s.cacheFile) {
+		c.stats.keyMismatches.Add(1)
+		s.log.Warn("Cache key differs from the expected one", slog.String("key", filepath.Base(s.cacheFile)), slog.String("expected", expected))
+	}
+	t.outcome = OutcomeMiss
+	if cacheControl := s.rule.cacheControl(); cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	header.Set("Content-Type", c.contentType(path))
+	if t.language != "" {
+		header.Add("Vary", "Accept-Language")
+	}
+	header.Set("Accept-Ranges", "bytes")
+	s.etag = filepath.Base(s.cacheFile)
+	header.Set("ETag", s.etag)
+	return s, true
+}
+
+// fetchAndFill gets the entry of s, held on the disk or filled from the
+// source, streaming a miss while it fills when it can. It reports true
+// once it answered the request on its own: preconditions forwarded, a cold
+// HEAD, a streamed miss, or an encoding the client doesn't accept. On
+// success, the file of the entry is left for the caller to close.
+func (c *PicoCache) fetchAndFill(s *requestState) (answered bool, err error) {
+	r, t := s.r, s.t
+	if _, held := c.entries.Load(s.cacheFile); !held && !c.offline && c.uncachedPreconditions == PreconditionsForward && hasPreconditions(r) {
+		t.trace("preconditions on an object not held")
+		t.outcome = OutcomeBypassPrecondition
+		c.passThrough(s.w, r, c.originURL(s.key), s.log, t)
+		return true, nil
+	}
+
+	if c.coldHead(r, s.cacheFile, s.previous) {
+		c.serveColdHead(s.w, r, s.key, s.cacheFile, s.rule, s.log, t)
+		return true, nil
+	}
+
+	var streamed *streamedMiss
+	if c.streamable(r) {
+		t.tail = func(g *growingFile) {
+			streamed = c.streamFill(r.Context(), s.w, g)
+		}
+	}
+	s.entry, s.file, s.outcome, err = c.resolve(r.Context(), s.key, s.cacheFile, s.previous, s.rule, t)
+	if streamed != nil {
+		// The fill is over, the client may not be
+		if s.file != nil {
+			s.file.Close()
+		}
+		err := streamed.wait()
+		t.size, t.copy = streamed.bytes, streamed.copy
+		if err != nil && r.Context().Err() == nil {
+			s.log.Error("Failed to stream file being filled", slog.String("err", err.Error()))
+			// Don't let a truncated body pass for a whole one
+			panic(http.ErrAbortHandler)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if s.entry.encoding != "" && c.refetched(r, s.entry) {
+		s.file.Close()
+		t.trace("%s encoded, not accepted", s.entry.encoding)
+		s.w.Header().Add("Vary", "Accept-Encoding")
+		t.outcome = OutcomeBypassEncoding
+		c.passThrough(s.w, r, c.originURL(s.key), s.log, t)
+		return true, nil
+	}
+	return false, nil
+}
+
+// serveError answers a request whose entry fetchAndFill couldn't get,
+// passing it through to the source when the error allows.
+func (c *PicoCache) serveError(s *requestState, err error) {
+	if notCached(err) {
+		c.serveUncached(s, err)
+		return
+	}
+	w, r, log := s.w, s.r, s.log
+	switch {
+	case errors.Is(err, errOriginViolation), errors.Is(err, errReleaseMismatch):
+		log.Error("Failed to download file", slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusBadGateway)
+	case errors.Is(err, errFirstByteTimeout):
+		log.Error("Failed to download file", slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case r.Context().Err() != nil:
+		log.Debug("Client gone while filling", slog.String("err", err.Error()))
+	default:
+		log.Error("Failed to get cached file", slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// serveUncached answers a request whose entry isn't filled for now, see
+// notCached, streaming it from the source or refusing it.
+func (c *PicoCache) serveUncached(s *requestState, err error) {
+	w, r, t, log := s.w, s.r, s.t, s.log
+	switch {
+	case errors.Is(err, errBudgetExhausted):
+		c.refuseOverBudget(w, t)
+	case errors.Is(err, errRateLimited):
+		c.refuseRateLimited(w, t)
+	case errors.Is(err, errOriginDown):
+		log.Debug("Source is down, not trying to fetch")
+		w.Header().Set("Retry-After", strconv.Itoa(int(c.probe.interval.Seconds())+1))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, errNotAdmitted):
+		t.outcome = OutcomeBypassAdmission
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errReadOnly):
+		t.outcome = OutcomeBypassReadOnly
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errOffline):
+		c.refuseOffline(w, s.path)
+	case errors.Is(err, errDraining):
+		t.outcome = OutcomeBypassDraining
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errFrozen) && c.frozenMisses == FrozenPassThrough:
+		t.outcome = OutcomeBypassFrozen
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errFrozen):
+		t.outcome = OutcomeFrozen
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, errTooLarge) && c.redirect != nil:
+		c.redirectLarge(w, s.key, log, t)
+	case errors.Is(err, errTooLarge):
+		t.outcome = OutcomeBypassSize
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errPartialContent):
+		t.outcome = OutcomeBypassPartial
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errRejected) && c.rejectedAsBadGateway:
+		w.WriteHeader(http.StatusBadGateway)
+	case errors.Is(err, errRejected):
+		t.outcome = OutcomeBypassRejected
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errFillBudget):
+		t.outcome = OutcomeBypassBudget
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	case errors.Is(err, errQuarantined):
+		t.outcome = OutcomeBypassQuarantine
+		c.passThrough(w, r, c.originURL(s.key), log, t)
+	}
+}
+
+// describeEntry records the outcome of the entry fetched and sets its
+// headers, sent along with its conditional answers too.
+func (c *PicoCache) describeEntry(s *requestState) {
+	t := s.t
+	t.outcome = s.outcome
+	if s.outcome == OutcomeHitOffline {
+		s.w.Header().Set("Warning", offlineWarning)
+	} else if t.failedOver {
+		s.w.Header().Set("Warning", staleWarning)
+	}
+	t.served(c, s.entry)
+	t.size = s.entry.size
+	s.w.Header().Set("Content-Type", c.entryContentType(s.entry, s.path))
+	sendAppHeaders(s.w.Header(), s.entry)
+}
+
+// checkConditional answers the preconditions of the request, reporting
+// whether it did. They are only answered for entries actually held, once
+// everything before had its say.
+func (c *PicoCache) checkConditional(s *requestState) bool {
+	if s.outcome != OutcomeHit && s.outcome != OutcomeHitOffline {
+		return false
+	}
+	switch status := evaluatePreconditions(s.r, s.entry, s.etag); status {
+	case http.StatusPreconditionFailed:
+		s.t.trace("precondition failed")
+		s.w.WriteHeader(status)
+		return true
+	case http.StatusNotModified:
+		s.t.trace("not modified")
+		s.w.WriteHeader(status)
+		return true
+	}
+	return false
+}
+
+// serveHit sends the entry fetched, whole, decompressed or the range
+// asked, then records its use.
+func (c *PicoCache) serveHit(s *requestState) {
+	w, r, t, log := s.w, s.r, s.t, s.log
+	entry, file := s.entry, s.file
+	header := w.Header()
+
+	release, ok := c.acquireReader(r.Context(), entry, t)
+	if !ok {
+		t.trace("too many readers")
+		header.Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	var fileReader io.Reader
+	whole := true
+	if entry.encoding != "" {
+		// Ranges of compressed entries aren't supported, always send it all
+		header.Set("Accept-Ranges", "none")
+		header.Add("Vary", "Accept-Encoding")
+
+		if acceptsEncoding(r, entry.encoding) {
+			header.Set("Content-Encoding", entry.encoding)
+			header.Set("Content-Length", strconv.FormatInt(entry.size, 10))
+			fileReader = file
+		} else {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				c.failed(entry, err)
+				log.Error("Failed to decompress cached file", slog.String("err", err.Error()))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			header.Set("Content-Length", strconv.FormatInt(entry.decodedSize, 10))
+			fileReader = gz
+		}
+	} else if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && entry.status == 0 {
+		// Handle ranged request
+		rang, err := parseRange(rangeHeader, entry.size)
+		if err != nil {
+			log.Debug("Error parsing range", slog.String("err", err.Error()), slog.String("rangeHeader", rangeHeader))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if _, err := file.Seek(rang.start, io.SeekStart); err != nil {
+			c.failed(entry, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rang.start, rang.end, entry.size))
+		header.Set("Content-Length", fmt.Sprintf("%d", rang.end-rang.start+1))
+		w.WriteHeader(http.StatusPartialContent)
+
+		fileReader = io.LimitReader(file, rang.end-rang.start+1)
+		whole = false
+	} else {
+		header.Set("Content-Length", strconv.FormatInt(entry.size, 10))
+		fileReader = file
+	}
+
+	var digest *bodyDigest
+	if c.integrityTrailer && whole && r.Method == http.MethodGet && acceptsTrailers(r) {
+		fileReader, digest = c.digestBody(w, r, entry, fileReader, fileReader == io.Reader(file))
+	}
+	if whole {
+		if entry.status != 0 {
+			header.Set("Accept-Ranges", "none")
+		}
+		if entry.location != "" {
+			header.Set("Location", entry.location)
+		}
+		if entry.language != "" {
+			header.Set("Content-Language", entry.language)
+		}
+		// Empty bodies don't write anything that would send the headers
+		w.WriteHeader(entry.statusCode())
+	}
+
+	_, span := t.startSpan(SpanClientCopy)
+	copyStart := time.Now()
+	n, err := c.copyToClient(w, fileReader)
+	t.copy = time.Since(copyStart)
+	span.end(err, slog.Int64("picocache.bytes", n))
+	if err != nil {
+		if !errors.Is(err, errClientError) {
+			c.failed(entry, err)
+		}
+		log.Error("Failed to stream file", slog.String("err", err.Error()))
+		return
+	}
+	c.served(entry)
+	if digest != nil {
+		digest.send(w)
+	}
+
+	if c.frozen.Load() {
+		return
+	}
+	// Update last used time
+	now := time.Now()
+	os.Chtimes(entry.filename, now, now)
+	entry.lastUsed.Store(c.steadyNow().UnixNano())
+	if entry.negative() {
+		c.aux.touch(entry)
+	}
+	if entry.legacy.Load() {
+		c.queueUpgrade(entry, s.key)
+	}
+}
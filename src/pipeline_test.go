@@ -0,0 +1,285 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// roundTripFunc answers the requests to the source in process.
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newStageCache opens a cache whose source answers the path requested, or a
+// 404 for /missing, counting the requests it gets.
+func newStageCache(t *testing.T, opts ...Option) (*PicoCache, string, *atomic.Int64) {
+	var fetches atomic.Int64
+	source := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		fetches.Add(1)
+		status, body := http.StatusOK, r.URL.Path
+		if r.URL.Path == "/missing" {
+			status, body = http.StatusNotFound, "nope"
+		}
+		return &http.Response{
+			StatusCode:    status,
+			Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}, nil
+	})}
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), "http://source.test", dir, 1<<20, append([]Option{WithBlockSize(1), WithOriginClient(source)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache, dir, &fetches
+}
+
+// stage returns the state resolveKey picks for r, failing unless it does.
+func stage(t *testing.T, cache *PicoCache, w http.ResponseWriter, r *http.Request) *requestState {
+	t.Helper()
+	s, ok := cache.resolveKey(w, r, &timings{})
+	if !ok {
+		t.Fatalf("%s: answered by resolveKey", r.URL.Path)
+	}
+	return s
+}
+
+func TestResolveKey(t *testing.T) {
+	rules, err := ParseRules(".txt ttl=1h, /docs/ lang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, dir, fetches := newStageCache(t, WithRules(rules...), WithLanguages("en", "fr"), WithAdminToken("s3cret"))
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		wantStatus int    // when answered
+		wantKey    string // when not
+		wantRule   string
+	}{
+		{name: "method", method: http.MethodPost, path: "/a.txt", wantStatus: http.StatusMethodNotAllowed},
+		{name: "climbing", path: "/a/../../etc/passwd", wantStatus: http.StatusBadRequest},
+		{name: "root", path: "/", wantStatus: http.StatusNotFound},
+		{name: "favicon", path: "/favicon.ico", wantStatus: http.StatusNotFound},
+		{name: "plain", path: "/a.txt", wantKey: KeyForPath("/a.txt"), wantRule: ".txt"},
+		{name: "language", path: "/docs/intro", header: http.Header{"Accept-Language": {"fr"}}, wantKey: filepath.Base(cache.getCacheFilename(languageKey("/docs/intro", "fr"))), wantRule: "/docs/"},
+		{name: "untrusted key", path: "/b", header: http.Header{"X-Picocache-Key": {"0123456789abcdefghjkmnpqrs"}}, wantKey: KeyForPath("/b")},
+		{name: "trusted key", path: "/b", header: http.Header{"X-Picocache-Key": {"0123456789abcdefghjkmnpqrs"}, "Authorization": {"Bearer s3cret"}}, wantKey: "0123456789abcdefghjkmnpqrs"},
+		{name: "invalid key", path: "/b", header: http.Header{"X-Picocache-Key": {"not a key"}, "Authorization": {"Bearer s3cret"}}, wantStatus: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tc.path, nil)
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			tm := &timings{}
+			s, ok := cache.resolveKey(w, r, tm)
+			if tc.wantStatus != 0 {
+				if ok || w.Code != tc.wantStatus {
+					t.Fatalf("expected a %d, got %d, answered %v", tc.wantStatus, w.Code, !ok)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("answered with a %d", w.Code)
+			}
+			if s.cacheFile != filepath.Join(dir, tc.wantKey) || s.etag != tc.wantKey || tm.cacheFile != s.cacheFile {
+				t.Fatalf("expected key %s, got %s, ETag %s", tc.wantKey, s.cacheFile, s.etag)
+			}
+			if got := w.Header().Get("X-Cache-Key"); got != tc.wantKey || w.Header().Get("ETag") != tc.wantKey {
+				t.Fatalf("expected the key %s sent, got %s", tc.wantKey, got)
+			}
+			matched := ""
+			if s.rule != nil {
+				matched = s.rule.matcher()
+			}
+			if matched != tc.wantRule {
+				t.Fatalf("expected rule %q, got %q", tc.wantRule, matched)
+			}
+			if tm.outcome != OutcomeMiss {
+				t.Fatalf("expected a miss until fetched, got %s", tm.outcome)
+			}
+		})
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Fatalf("expected the source left alone, got %d requests", n)
+	}
+}
+
+func TestFetchAndFill(t *testing.T) {
+	cache, dir, fetches := newStageCache(t, WithUncachedPreconditions(PreconditionsForward))
+	fetch := func(path string, header http.Header) (*requestState, *httptest.ResponseRecorder, bool, error) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s := stage(t, cache, w, r)
+		answered, err := cache.fetchAndFill(s)
+		if s.file != nil && !answered {
+			t.Cleanup(func() { s.file.Close() })
+		}
+		return s, w, answered, err
+	}
+
+	for i, want := range []Outcome{OutcomeMiss, OutcomeHit} {
+		s, w, answered, err := fetch("/hi", nil)
+		if answered || err != nil {
+			t.Fatalf("fetch %d: answered %v, %v", i, answered, err)
+		}
+		if s.outcome != want || s.entry == nil || s.entry.size != 3 || s.file == nil {
+			t.Fatalf("fetch %d: expected a %s of 3 bytes, got %s %+v", i, want, s.outcome, s.entry)
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("fetch %d: expected nothing sent yet, got %q", i, w.Body.String())
+		}
+	}
+
+	if _, w, answered, err := fetch("/missing", nil); answered || err == nil || w.Body.Len() != 0 {
+		t.Fatalf("expected the source error left to serveError, got %v %v %q", answered, err, w.Body.String())
+	}
+
+	// Preconditions on an object not held go to the source
+	s, w, answered, err := fetch("/cold", http.Header{"If-Match": {"*"}})
+	if !answered || err != nil || s.t.outcome != OutcomeBypassPrecondition || w.Body.String() != "/cold" {
+		t.Fatalf("expected the preconditions forwarded, got %v %v %s %q", answered, err, s.t.outcome, w.Body.String())
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("expected 3 requests to the source, got %d", n)
+	}
+	verifyConsistency(t, cache, dir)
+}
+
+func TestServeError(t *testing.T) {
+	cache, _, fetches := newStageCache(t)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tc := range []struct {
+		name        string
+		err         error
+		ctx         context.Context
+		wantStatus  int
+		wantOutcome Outcome
+		wantBody    string
+	}{
+		{name: "frozen", err: errFrozen, wantStatus: http.StatusServiceUnavailable, wantOutcome: OutcomeFrozen},
+		{name: "too large", err: errTooLarge, wantStatus: http.StatusOK, wantOutcome: OutcomeBypassSize, wantBody: "/x"},
+		{name: "rejected", err: errRejected, wantStatus: http.StatusOK, wantOutcome: OutcomeBypassRejected, wantBody: "/x"},
+		{name: "draining", err: errDraining, wantStatus: http.StatusOK, wantOutcome: OutcomeBypassDraining, wantBody: "/x"},
+		{name: "offline", err: errOffline, wantStatus: http.StatusNotFound, wantOutcome: OutcomeMiss, wantBody: "picocache is offline, without a source to fetch /x from\n"},
+		{name: "violation", err: errOriginViolation, wantStatus: http.StatusBadGateway, wantOutcome: OutcomeMiss},
+		{name: "first byte", err: errFirstByteTimeout, wantStatus: http.StatusGatewayTimeout, wantOutcome: OutcomeMiss},
+		{name: "other", err: errors.New("disk on fire"), wantStatus: http.StatusInternalServerError, wantOutcome: OutcomeMiss},
+		{name: "client gone", err: errors.New("disk on fire"), ctx: canceled, wantStatus: http.StatusOK, wantOutcome: OutcomeMiss},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/x", nil)
+			if tc.ctx != nil {
+				r = r.WithContext(tc.ctx)
+			}
+			w := httptest.NewRecorder()
+			s := stage(t, cache, w, r)
+			cache.serveError(s, tc.err)
+			if w.Code != tc.wantStatus || s.t.outcome != tc.wantOutcome || w.Body.String() != tc.wantBody {
+				t.Fatalf("expected %d %s %q, got %d %s %q", tc.wantStatus, tc.wantOutcome, tc.wantBody, w.Code, s.t.outcome, w.Body.String())
+			}
+		})
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("expected the 3 bypasses sent to the source, got %d requests", n)
+	}
+}
+
+func TestCheckConditional(t *testing.T) {
+	modified := "Sat, 01 Jun 2024 10:00:00 GMT"
+	entry := &cacheEntry{lastModified: modified}
+
+	for _, tc := range []struct {
+		name       string
+		outcome    Outcome
+		header     http.Header
+		wantStatus int // 0 when left to serveHit
+	}{
+		{name: "none", outcome: OutcomeHit},
+		{name: "not modified", outcome: OutcomeHit, header: http.Header{"If-None-Match": {`"ABC"`}}, wantStatus: http.StatusNotModified},
+		{name: "modified", outcome: OutcomeHit, header: http.Header{"If-None-Match": {"other"}}},
+		{name: "match failed", outcome: OutcomeHit, header: http.Header{"If-Match": {"other"}}, wantStatus: http.StatusPreconditionFailed},
+		{name: "unmodified since", outcome: OutcomeHit, header: http.Header{"If-Unmodified-Since": {"Sat, 01 Jun 2024 09:00:00 GMT"}}, wantStatus: http.StatusPreconditionFailed},
+		{name: "offline", outcome: OutcomeHitOffline, header: http.Header{"If-None-Match": {"abc"}}, wantStatus: http.StatusNotModified},
+		{name: "just filled", outcome: OutcomeMiss, header: http.Header{"If-None-Match": {"ABC"}}},
+		{name: "revalidated", outcome: OutcomeRevalidated, header: http.Header{"If-Match": {"other"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/x", nil)
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			s := &requestState{w: w, r: r, t: &timings{}, entry: entry, etag: "ABC", outcome: tc.outcome}
+			answered := (&PicoCache{}).checkConditional(s)
+			if answered != (tc.wantStatus != 0) || answered && w.Code != tc.wantStatus {
+				t.Fatalf("expected %d, got answered %v with %d", tc.wantStatus, answered, w.Code)
+			}
+		})
+	}
+}
+
+func TestServeHit(t *testing.T) {
+	cache, dir, _ := newStageCache(t)
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s := stage(t, cache, w, r)
+		if answered, err := cache.fetchAndFill(s); answered || err != nil {
+			t.Fatalf("answered %v, %v", answered, err)
+		}
+		defer s.file.Close()
+		cache.describeEntry(s)
+		cache.serveHit(s)
+		return w
+	}
+
+	if w := serve(nil); w.Code != http.StatusOK || w.Body.String() != "/hello" || w.Header().Get("Content-Length") != "6" {
+		t.Fatalf("expected the whole entry, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	w := serve(http.Header{"Range": {"bytes=1-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "hel" || w.Header().Get("Content-Range") != "bytes 1-3/6" {
+		t.Fatalf("expected the range, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := serve(http.Header{"Range": {"bytes=9-"}}); w.Code != http.StatusRequestedRangeNotSatisfiable || w.Body.Len() != 0 {
+		t.Fatalf("expected an unsatisfiable range, got %d %q", w.Code, w.Body.String())
+	}
+
+	entry, _ := cache.entries.Load(filepath.Join(dir, KeyForPath("/hello")))
+	if entry.(*cacheEntry).lastUsed.Load() == 0 {
+		t.Fatal("expected the use of the entry recorded")
+	}
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,147 @@
+package picocache
+
+import (
+	"cmp"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// EvictionPolicy decides which entries go first when the cache is full.
+type EvictionPolicy int
+
+const (
+	EvictSLRU EvictionPolicy = iota // LRU with a protected segment, see WithProtectedShare
+	EvictLRU                        // least recently used first
+	EvictLFU                        // least hit first, then least recently used
+)
+
+var evictionPolicies = [...]string{"slru", "lru", "lfu"}
+
+// ParseEvictionPolicy parses slru, lru or lfu.
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	if i := slices.Index(evictionPolicies[:], s); i >= 0 {
+		return EvictionPolicy(i), nil
+	}
+	return EvictSLRU, fmt.Errorf("invalid eviction policy %q, expected slru, lru or lfu", s)
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicies[p]
+}
+
+// WithEvictionPolicy sets the eviction policy, SLRU by default.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(c *PicoCache) {
+		c.policy.kind = p
+	}
+}
+
+// evictionPolicy is an EvictionPolicy along with its settings. Both the
+// cache and Simulate go through it.
+type evictionPolicy struct {
+	kind           EvictionPolicy
+	protectedShare float64 // of the max size, for SLRU
+}
+
+// hit records entry being served from the cache.
+func (p evictionPolicy) hit(entry *cacheEntry) {
+	entry.hits.Add(1)
+	if p.kind == EvictSLRU && p.protectedShare > 0 {
+		entry.protected.Store(true)
+	}
+}
+
+// evictBatch is how many entries an eviction pass picks at a time, so that
+// it needs memory for that many whatever the size of the index.
+const evictBatch = 1024
+
+// segment returns where entry stands with SLRU: 0 for probationary entries,
+// 1 for those demoted during eviction pass pass and 2 for protected ones.
+func segment(entry *cacheEntry, pass uint64) int {
+	switch {
+	case entry.protected.Load():
+		return 2
+	case entry.demoted == pass:
+		return 1
+	}
+	return 0
+}
+
+// evictsBefore reports whether a gets evicted before b during eviction pass
+// pass.
+func (p evictionPolicy) evictsBefore(a, b *cacheEntry, pass uint64) bool {
+	return p.compare(a, b, pass) < 0
+}
+
+// compare orders a and b as they get evicted during eviction pass pass, by
+// what the policy goes by, then as compareAge does. Distinct entries never
+// compare equal, so the order is the same whatever the index yields first.
+func (p evictionPolicy) compare(a, b *cacheEntry, pass uint64) int {
+	switch p.kind {
+	case EvictLFU:
+		if c := cmp.Compare(a.hits.Load(), b.hits.Load()); c != 0 {
+			return c
+		}
+	case EvictSLRU:
+		if c := cmp.Compare(segment(a, pass), segment(b, pass)); c != 0 {
+			return c
+		}
+	}
+	return compareAge(a, b)
+}
+
+// compareAge orders least recently used entries first. Entries last used at
+// the same time, as those rebuilt from the mtimes of a filesystem counting
+// seconds, go largest first, then by key.
+func compareAge(a, b *cacheEntry) int {
+	if c := cmp.Compare(a.lastUsed.Load(), b.lastUsed.Load()); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(b.size, a.size); c != 0 {
+		return c
+	}
+	return strings.Compare(a.filename, b.filename)
+}
+
+// victims returns the n of entries going first during eviction pass pass,
+// in the order they get evicted.
+func (p evictionPolicy) victims(entries iter.Seq[*cacheEntry], n int, pass uint64) []*cacheEntry {
+	return topOf(entries, n, func(a, b *cacheEntry) bool { return p.evictsBefore(b, a, pass) })
+}
+
+// demote starts eviction pass pass for a cache of maxSize. With SLRU, the
+// least recently used protected entries overflowing their segment get
+// demoted, n at a time, becoming the most recently used probationary ones
+// for the rest of the pass.
+func (p evictionPolicy) demote(entries iter.Seq[*cacheEntry], n int, maxSize int64, pass uint64) {
+	if p.kind != EvictSLRU {
+		return
+	}
+	protectedMax := int64(float64(maxSize) * p.protectedShare)
+	protected := func(yield func(*cacheEntry) bool) {
+		for entry := range entries {
+			if entry.protected.Load() && !yield(entry) {
+				return
+			}
+		}
+	}
+	for {
+		protectedSize := int64(0)
+		for entry := range protected {
+			protectedSize += entry.diskSize
+		}
+		if protectedSize <= protectedMax {
+			return
+		}
+		for _, entry := range topOf(protected, n, byAge) {
+			if protectedSize <= protectedMax {
+				return
+			}
+			entry.protected.Store(false)
+			entry.demoted = pass
+			protectedSize -= entry.diskSize
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictionBatches(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1000, WithBlockSize(1), WithEvictionPolicy(EvictLRU))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.evictBatch = 3
+
+	for i := range 10 {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+strconv.Itoa(i), nil))
+	}
+	for i := range 10 {
+		value, _ := cache.entries.Load(cache.getCacheFilename("/" + strconv.Itoa(i)))
+		value.(*cacheEntry).lastUsed.Store(int64(i))
+	}
+
+	cache.maxCacheSize.Store(35)
+	if n := cache.evict(); n != 7 {
+		t.Fatalf("expected 7 entries evicted, got %d", n)
+	}
+	if s := cache.Stats(); s.EvictionBatches != 3 {
+		t.Fatalf("expected batches of 3, 3 and 1 victims, got %d batches", s.EvictionBatches)
+	}
+	for i := range 10 {
+		_, ok := cache.entries.Load(cache.getCacheFilename("/" + strconv.Itoa(i)))
+		if ok != (i >= 7) {
+			t.Fatalf("/%d: expected the least recently used entries evicted", i)
+		}
+	}
+	verifyConsistency(t, cache, dir)
+}
+
+func TestVictimsAcrossBatches(t *testing.T) {
+	entries := make([]*cacheEntry, 6)
+	for i := range entries {
+		entries[i] = &cacheEntry{filename: strconv.Itoa(i), diskSize: 10}
+		entries[i].lastUsed.Store(int64(i))
+		entries[i].protected.Store(i < 4)
+	}
+	names := func(entries []*cacheEntry) string {
+		s := []string{}
+		for _, entry := range entries {
+			s = append(s, entry.filename)
+		}
+		return fmt.Sprint(s)
+	}
+
+	// The 3 least recently used protected entries overflow their 10 bytes
+	p := evictionPolicy{kind: EvictSLRU, protectedShare: 0.25}
+	p.demote(slices.Values(entries), 2, 40, 1)
+	if got := names(p.victims(slices.Values(entries), 2, 1)); got != "[4 5]" {
+		t.Fatalf("expected the probationary entries first, got %s", got)
+	}
+	if got := names(p.victims(slices.Values(entries), 10, 1)); got != "[4 5 0 1 2 3]" {
+		t.Fatalf("expected the demoted entries after the probationary ones, got %s", got)
+	}
+	// Demoted entries are like any other probationary one in later passes
+	if got := names(p.victims(slices.Values(entries), 10, 2)); got != "[0 1 2 4 5 3]" {
+		t.Fatalf("unexpected order in the next pass %s", got)
+	}
+}
+
+func TestEvictionOrderDeterministic(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for round := range 50 {
+		// Few distinct times, sizes and hit counts, so that many entries tie
+		entries := make([]*cacheEntry, 40)
+		names := r.Perm(100)
+		for i := range entries {
+			size := int64(1 + r.IntN(3))
+			entries[i] = &cacheEntry{filename: fmt.Sprintf("%02d", names[i]), size: size, diskSize: size}
+			entries[i].lastUsed.Store(int64(r.IntN(3)) * int64(time.Second))
+			entries[i].hits.Store(int64(r.IntN(2)))
+			entries[i].protected.Store(r.IntN(2) == 0)
+		}
+		for _, kind := range []EvictionPolicy{EvictSLRU, EvictLRU, EvictLFU} {
+			p := evictionPolicy{kind: kind}
+			want := slices.SortedFunc(slices.Values(entries), func(a, b *cacheEntry) int { return p.compare(a, b, 1) })
+			for i := 1; i < len(want); i++ {
+				if p.compare(want[i-1], want[i], 1) >= 0 || p.compare(want[i], want[i-1], 1) <= 0 {
+					t.Fatalf("round %d, %s: %s and %s don't compare as distinct entries", round, kind, want[i-1].filename, want[i].filename)
+				}
+			}
+			for range 5 {
+				shuffled := slices.Clone(entries)
+				r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+				for _, n := range []int{1, 7, len(entries)} {
+					got := p.victims(slices.Values(shuffled), n, 1)
+					if !slices.Equal(got, want[:n]) {
+						t.Fatalf("round %d, %s: expected the first %d victims whatever the index order", round, kind, n)
+					}
+				}
+			}
+		}
+	}
+
+	// Ties go largest first, then by key
+	a, b, c := &cacheEntry{filename: "b", size: 1}, &cacheEntry{filename: "a", size: 1}, &cacheEntry{filename: "c", size: 5}
+	got := evictionPolicy{kind: EvictLRU}.victims(slices.Values([]*cacheEntry{a, b, c}), 3, 1)
+	if got[0] != c || got[1] != b || got[2] != a {
+		t.Fatalf("expected c, a then b, got %s %s %s", got[0].filename, got[1].filename, got[2].filename)
+	}
+}
+
+func TestEvictionSkipsFilling(t *testing.T) {
+	release := make(chan struct{})
+	var fills atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refilled" && fills.Add(1) > 1 {
+			<-release
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1000, WithBlockSize(1), WithEvictionPolicy(EvictLRU),
+		WithRules(Rule{Prefix: "/refilled", TTL: time.Minute}), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for i, path := range []string{"/refilled", "/a", "/b"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		value, _ := cache.entries.Load(cache.getCacheFilename(path))
+		value.(*cacheEntry).lastUsed.Store(int64(i))
+	}
+
+	// The least recently used entry, expired and being filled again
+	now = now.Add(2 * time.Minute)
+	refilled := cache.getCacheFilename("/refilled")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/refilled", nil))
+	}()
+	for {
+		if _, filling := cache.downloading.Load(refilled); filling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cache.maxCacheSize.Store(15)
+	cache.evict()
+	if _, ok := cache.entries.Load(refilled); !ok {
+		t.Fatal("expected the entry being filled left alone")
+	}
+	if _, ok := cache.entries.Load(cache.getCacheFilename("/a")); ok {
+		t.Fatal("expected the next least recently used entry evicted instead")
+	}
+	close(release)
+	<-done
+}
+
+// BenchmarkEvictionChurn churns 500k entries through an index of 100k, 50k
+// at a time, reporting how much the heap grew once the cache was full and
+// what an eviction pass allocates at most.
+func BenchmarkEvictionChurn(b *testing.B) {
+	const cycles, perCycle = 10, 50_000
+	cache, err := NewCache(slog.New(slog.DiscardHandler), "http://127.0.0.1:1", b.TempDir(), perCycle*2, WithBlockSize(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	heapInUse := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	var first, last, passAllocs uint64
+	n := 0
+	for b.Loop() {
+		for cycle := range cycles {
+			for range perCycle {
+				n++
+				entry := &cacheEntry{filename: fmt.Sprintf("%s/churn-%d", cache.cacheDir, n), size: 1, diskSize: 1}
+				entry.lastUsed.Store(int64(n))
+				cache.entries.Store(entry.filename, entry)
+				cache.account(entry)
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			cache.evict()
+			runtime.ReadMemStats(&after)
+			passAllocs = max(passAllocs, after.TotalAlloc-before.TotalAlloc)
+
+			// Full from the second cycle on
+			switch cycle {
+			case 1:
+				first = heapInUse()
+			case cycles - 1:
+				last = heapInUse()
+			}
+		}
+	}
+	b.ReportMetric(float64(last)/(1<<20), "heap-MB")
+	b.ReportMetric(float64(int64(last)-int64(first))/(1<<20), "heap-growth-MB")
+	b.ReportMetric(float64(passAllocs)/(1<<20), "pass-alloc-MB")
+}
@@ -0,0 +1,159 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithPrefixPurge indexes entries by the request key they were filled for,
+// so PurgePrefix can find them. The key gets stored in the metadata of
+// every entry for rebuilds, entries filled without it can't be purged by
+// prefix.
+func WithPrefixPurge() Option {
+	return func(c *PicoCache) {
+		c.paths = &pathIndex{entries: map[string]map[string]*cacheEntry{}}
+	}
+}
+
+var errNoPathIndex = errors.New("prefix purges need WithPrefixPurge")
+
+// pathIndex maps request keys to the entries filled for them, several ones
+// when the client set the cache key.
+type pathIndex struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*cacheEntry // by key then cache file
+}
+
+func (p *pathIndex) add(entry *cacheEntry) {
+	if entry.path == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	files, ok := p.entries[entry.path]
+	if !ok {
+		files = map[string]*cacheEntry{}
+		p.entries[entry.path] = files
+	}
+	files[entry.filename] = entry
+}
+
+// remove drops entry, leaving any entry which replaced it.
+func (p *pathIndex) remove(entry *cacheEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	files := p.entries[entry.path]
+	if files[entry.filename] != entry {
+		return
+	}
+	delete(files, entry.filename)
+	if len(files) == 0 {
+		delete(p.entries, entry.path)
+	}
+}
+
+// matching returns the entries whose key starts with prefix.
+func (p *pathIndex) matching(prefix string) []*cacheEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matches []*cacheEntry
+	for path, files := range p.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		for _, entry := range files {
+			matches = append(matches, entry)
+		}
+	}
+	return matches
+}
+
+// PurgePrefix removes the entries of every request path, query string
+// included, starting with prefix, escaped like request paths, returning how
+// many there were. Fills completing meanwhile are kept.
+func (c *PicoCache) PurgePrefix(prefix string) (int, error) {
+	normalized, entries, err := c.prefixEntries(prefix)
+	if err != nil {
+		return 0, err
+	}
+	if c.frozen.Load() {
+		return 0, errFrozen
+	}
+
+	if c.heads != nil {
+		c.heads.forgetPrefix(normalized)
+	}
+	purged := 0
+	for _, entry := range entries {
+		if c.purge(entry.filename, entry) {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// prefixEntries returns prefix normalized like request keys, and the
+// entries under it.
+func (c *PicoCache) prefixEntries(prefix string) (string, []*cacheEntry, error) {
+	if c.paths == nil {
+		return "", nil, errNoPathIndex
+	}
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return "", nil, err
+	}
+	normalized := keyPath(u, c.normalizePaths, c.lowercasePaths)
+	if strings.HasSuffix(prefix, "/") && !strings.HasSuffix(normalized, "/") {
+		// Don't let /galleries/123/ purge /galleries/1234
+		normalized += "/"
+	}
+	return normalized, c.paths.matching(normalized), nil
+}
+
+type prefixPurgeResult struct {
+	Prefix string       `json:"prefix"`
+	Purged int          `json:"purged"`
+	Peers  []PeerResult `json:"peers,omitempty"` // see WithPeers
+}
+
+// servePurgeMethod handles PURGE requests for trusted clients, removing the
+// entry of the request path, or every entry under it with prefix=1, and
+// forwards them to the peers.
+func (c *PicoCache) servePurgeMethod(w http.ResponseWriter, r *http.Request) {
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if c.frozen.Load() {
+		http.Error(w, errFrozen.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("prefix") != "1" {
+		key, purged := c.purgeRequest(r.URL)
+		json.NewEncoder(w).Encode(newPurgeResult(key, purged, c.propagate(r)))
+		return
+	}
+
+	purged, err := c.PurgePrefix(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	json.NewEncoder(w).Encode(prefixPurgeResult{Prefix: r.URL.Path, Purged: purged, Peers: c.propagate(r)})
+}
+
+// keyed reports whether cacheFile was set by the client rather than derived
+// from key.
+func keyed(cacheFile, key string) bool {
+	return filepath.Base(cacheFile) != KeyForPath(key)
+}
@@ -0,0 +1,128 @@
+package picocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPurgePrefix(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithPrefixPurge(), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != path {
+			t.Errorf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+		}
+		return w.Header().Get("X-Cache")
+	}
+
+	purged := []string{}
+	for i := range 50 {
+		purged = append(purged, fmt.Sprintf("/galleries/123/%d.jpg", i))
+	}
+	siblings := []string{"/galleries/1234/0.jpg", "/galleries/12/0.jpg", "/galleries/0.jpg"}
+	for _, path := range append(purged, siblings...) {
+		get(path)
+	}
+
+	// Siblings keep being hit while purging
+	stop := atomic.Bool{}
+	wg := sync.WaitGroup{}
+	for _, path := range siblings {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if cache := get(path); cache != "HIT" {
+					t.Errorf("%s: expected a hit, got %s", path, cache)
+					return
+				}
+			}
+		}()
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PURGE", "/galleries/123/?prefix=1", nil)
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted purge to be forbidden, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer s3cret")
+	cache.ServeHTTP(w, r)
+	result := prefixPurgeResult{}
+	json.NewDecoder(w.Body).Decode(&result)
+	stop.Store(true)
+	wg.Wait()
+	if w.Code != http.StatusOK || result.Purged != len(purged) {
+		t.Fatalf("unexpected purge %d %+v", w.Code, result)
+	}
+
+	for _, path := range purged[:3] {
+		if cache := get(path); cache != "MISS" {
+			t.Fatalf("%s: expected a miss once purged, got %s", path, cache)
+		}
+	}
+	if s := cache.Stats(); s.Entries != int64(len(siblings)+3) {
+		t.Fatalf("unexpected entries left %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestPurgePrefixAfterRebuild(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	unindexed, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unindexed.PurgePrefix("/"); err == nil {
+		t.Fatal("expected an error without WithPrefixPurge")
+	}
+	unindexed.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gallery/old.jpg", nil))
+	unindexed.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithPrefixPurge(), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/gallery/a.jpg?w=100", "/gallery/b.jpg"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	r := httptest.NewRequest(http.MethodGet, "/gallery/keyed.jpg", nil)
+	r.Header.Set("X-Picocache-Key", "keyed")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	cache.ServeHTTP(httptest.NewRecorder(), r)
+	cache.Close()
+
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithPrefixPurge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries filled before indexing are left out
+	if n, err := restarted.PurgePrefix("/gallery/"); err != nil || n != 3 {
+		t.Fatalf("expected 3 entries purged, got %d (%v)", n, err)
+	}
+	if s := restarted.Stats(); s.Entries != 1 {
+		t.Fatalf("expected the unindexed entry left, got %+v", s)
+	}
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
@@ -0,0 +1,139 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// originDownAfter is how many probes in a row must fail before the source
+// is considered down.
+const originDownAfter = 3
+
+// WithOriginProbe probes the source every interval with a request for path,
+// HEAD by default, outside of the cache. Once the source is down, misses fail
+// fast with 503 until a probe succeeds again. An interval that isn't
+// positive disables probing.
+func WithOriginProbe(interval time.Duration, method string, path string) Option {
+	return func(c *PicoCache) {
+		if interval <= 0 {
+			c.probe = nil
+			return
+		}
+		if method == "" {
+			method = http.MethodHead
+		}
+		c.probe = &originProbe{interval: interval, method: method, path: path}
+	}
+}
+
+type originProbe struct {
+	interval time.Duration
+	method   string
+	path     string
+
+	down atomic.Bool
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	lastError           string
+	latency             time.Duration
+}
+
+// OriginHealth is the outcome of the latest source probes.
+type OriginHealth struct {
+	Up                  bool          `json:"up"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	LastError           string        `json:"last_error,omitempty"`
+	Latency             time.Duration `json:"latency_ns"`
+}
+
+func (p *originProbe) health() *OriginHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return &OriginHealth{
+		Up:                  !p.down.Load(),
+		ConsecutiveFailures: p.consecutiveFailures,
+		LastError:           p.lastError,
+		Latency:             p.latency,
+	}
+}
+
+func (c *PicoCache) probeOrigin() {
+	ticker := time.NewTicker(c.probe.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.probeOnce()
+		}
+	}
+}
+
+func (c *PicoCache) probeOnce() {
+	p := c.probe
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	start := time.Now()
+	err := c.sendProbe(ctx)
+	latency := time.Since(start)
+	if errors.Is(err, errRateLimited) {
+		// Not the source failing, it's for the next probe to tell
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latency = latency
+	if err == nil {
+		p.consecutiveFailures = 0
+		p.lastError = ""
+		if p.down.Swap(false) {
+			c.log.Info("Source is back up", slog.Duration("latency", latency))
+		}
+		return
+	}
+
+	p.consecutiveFailures++
+	p.lastError = err.Error()
+	if p.consecutiveFailures >= originDownAfter && !p.down.Swap(true) {
+		c.log.Error("Source is down", slog.Int("failures", p.consecutiveFailures), slog.String("err", err.Error()))
+	}
+}
+
+func (c *PicoCache) sendProbe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, c.probe.method, c.originURL(c.probe.path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.originDo(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Anything but a server error means the source is answering
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("source returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// originDown reports whether probes found the source down.
+func (c *PicoCache) originDown() bool {
+	return c.probe != nil && c.probe.down.Load()
+}
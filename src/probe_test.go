@@ -0,0 +1,91 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOriginProbe(t *testing.T) {
+	var failing atomic.Bool
+	var probes atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			probes.Add(1)
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithOriginProbe(10*time.Millisecond, "", "/healthz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	waitFor := func(up bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for cache.Stats().Origin.Up != up {
+			if time.Now().After(deadline) {
+				t.Fatalf("source never became up=%v", up)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	failing.Store(true)
+	waitFor(false)
+	if h := cache.Stats().Origin; h.ConsecutiveFailures < originDownAfter || h.LastError == "" {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+	if code := get("/file"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a fast 503 while the source is down, got %d", code)
+	}
+
+	failing.Store(false)
+	waitFor(true)
+	if code := get("/file"); code != http.StatusOK {
+		t.Fatalf("expected 200 once the source is back, got %d", code)
+	}
+
+	// Probes never end up in the cache
+	if files := entryFiles(t, dir); len(files) != 1 || cache.Stats().Entries != 1 {
+		t.Fatalf("expected only the requested file to be cached, got %d files", len(files))
+	}
+
+	cache.Close()
+	time.Sleep(20 * time.Millisecond)
+	n := probes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if probes.Load() != n {
+		t.Fatal("probes continued after Close")
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestOriginProbeDisabled(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		cache, err := NewCache(slog.Default(), "http://127.0.0.1:1", t.TempDir(), 1<<20, WithOriginProbe(interval, "", "/healthz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := cache.Stats(); s.Origin != nil {
+			t.Errorf("%s: expected no probing, got %+v", interval, s.Origin)
+		}
+		cache.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// progressWindow is about how long the throughput of a fill is measured
+// over.
+const progressWindow = time.Second
+
+// FillProgress is a fill in progress, see Fills, or how it went once over,
+// see RequestEvent.
+type FillProgress struct {
+	Key            string    `json:"key"`
+	Path           string    `json:"path"`
+	Received       int64     `json:"received"` // body bytes, resumed ones included
+	Expected       int64     `json:"expected"` // -1 until known, or when the source doesn't tell
+	Started        time.Time `json:"started"`
+	BytesPerSecond int64     `json:"bytes_per_second"` // over the last second or so
+	Waiters        int64     `json:"waiters"`          // clients waiting on it
+}
+
+// fillWriter counts the body bytes of f as they get written, coming last
+// so that they already are, letting the clients tailing its growing file,
+// if any, know.
+type fillWriter struct {
+	f *fill
+	g *growingFile
+}
+
+func (w fillWriter) Write(p []byte) (int, error) {
+	if w.g != nil {
+		w.g.grow(int64(len(p)))
+	} else {
+		w.f.written.Add(int64(len(p)))
+	}
+	w.f.sample(time.Now())
+	return len(p), nil
+}
+
+// newFill returns the fill of the entry of key, for the request path.
+func newFill(key, path string, cancel func()) *fill {
+	f := &fill{key: key, path: path, started: time.Now(), cancel: cancel, holders: 1}
+	f.length.Store(-1)
+	f.sampledAt.Store(f.started.UnixNano())
+	return f
+}
+
+// attempt starts measuring the progress of f over, for an attempt at the
+// body of length bytes, starting from offset when resumed.
+func (f *fill) attempt(length, offset int64) {
+	f.length.Store(length)
+	f.written.Store(offset)
+	f.sampledBytes.Store(offset)
+	f.sampledAt.Store(time.Now().UnixNano())
+}
+
+// sample measures the throughput of f once per progressWindow. Only its
+// filler calls it.
+func (f *fill) sample(now time.Time) {
+	at := f.sampledAt.Load()
+	if elapsed := now.UnixNano() - at; elapsed >= int64(progressWindow) {
+		written := f.written.Load()
+		f.rate.Store((written - f.sampledBytes.Load()) * int64(time.Second) / elapsed)
+		f.sampledBytes.Store(written)
+		f.sampledAt.Store(now.UnixNano())
+	}
+}
+
+// progress returns where f is.
+func (f *fill) progress() FillProgress {
+	p := FillProgress{
+		Key:      f.key,
+		Path:     f.path,
+		Received: f.written.Load(),
+		Expected: f.length.Load(),
+		Started:  f.started,
+		Waiters:  f.waiters.Load(),
+	}
+	// A stalled source writes nothing that would sample it
+	p.BytesPerSecond = f.rate.Load()
+	if elapsed := time.Now().UnixNano() - f.sampledAt.Load(); elapsed >= 2*int64(progressWindow) {
+		p.BytesPerSecond = (p.Received - f.sampledBytes.Load()) * int64(time.Second) / elapsed
+	}
+	return p
+}
+
+// Fills returns the fills in progress, oldest first.
+func (c *PicoCache) Fills() []FillProgress {
+	fills := []FillProgress{}
+	c.downloading.Range(func(key, value any) bool {
+		fills = append(fills, value.(*fill).progress())
+		return true
+	})
+	slices.SortFunc(fills, func(a, b FillProgress) int { return a.Started.Compare(b.Started) })
+	return fills
+}
+
+// serveFills lists the fills in progress, for inspect?fills=1.
+func (c *PicoCache) serveFills(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Fills())
+}
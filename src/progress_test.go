@@ -0,0 +1,96 @@
+package picocache_test
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	picocache "picocache/src"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFillProgress(t *testing.T) {
+	const chunk, chunks = 1000, 10
+	step := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Chunked, the length isn't known
+		for range chunks {
+			<-step
+			w.Write([]byte(strings.Repeat("x", chunk)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	var events []picocache.RequestEvent
+	cache, err := picocache.NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, picocache.WithEvents(func(ev picocache.RequestEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}), picocache.WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	fills := func() []picocache.FillProgress {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/__picocache/inspect?fills=1", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		cache.ServeHTTP(w, r)
+		var fills []picocache.FillProgress
+		if err := json.NewDecoder(w.Body).Decode(&fills); err != nil {
+			t.Fatal(err)
+		}
+		return fills
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/big", nil))
+		if w.Code != http.StatusOK || w.Body.Len() != chunk*chunks {
+			t.Errorf("unexpected response %d of %d bytes", w.Code, w.Body.Len())
+		}
+	}()
+	Eventually(t, func() bool { return len(fills()) == 1 })
+
+	received := int64(0)
+	for i := range chunks - 1 {
+		step <- struct{}{}
+		Eventually(t, func() bool {
+			f := fills()
+			if len(f) != 1 {
+				t.Fatalf("expected a single fill, got %+v", f)
+			}
+			if f[0].Received < received {
+				t.Fatalf("progress went back from %d to %d bytes", received, f[0].Received)
+			}
+			received = f[0].Received
+			if f[0].Key != picocache.KeyForPath("/big") || f[0].Path != "/big" || f[0].Expected != -1 || f[0].Waiters != 1 {
+				t.Fatalf("unexpected progress %+v", f[0])
+			}
+			return received == int64((i+1)*chunk)
+		})
+	}
+	// The last one completes it
+	step <- struct{}{}
+	<-done
+
+	if f := fills(); len(f) != 0 {
+		t.Fatalf("expected the fill gone once complete, got %+v", f)
+	}
+	if s := cache.Stats(); len(s.Fills) != 0 {
+		t.Fatalf("expected no fill in stats, got %+v", s.Fills)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0].Fill == nil || events[0].Fill.Received != chunk*chunks || events[0].Fill.Key != picocache.KeyForPath("/big") {
+		t.Fatalf("expected the final figures in the event, got %+v", events)
+	}
+}
@@ -0,0 +1,45 @@
+package picocache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// WithStrictOrigin treats the entries filled from another source than the
+// one given to NewCache, as their metadata tell, as expired: they're
+// revalidated against it, or fetched from it again, before being served.
+// Entries filled before sources got recorded are served as they are.
+func WithStrictOrigin() Option {
+	return func(c *PicoCache) {
+		c.strictOrigin = true
+	}
+}
+
+// originIdentity returns source as entries record it: its scheme and host
+// lowercased, without their default port, nor credentials, query or
+// trailing slash. Placeholders of templates are kept as they are.
+func originIdentity(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if port := u.Port(); u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.User, u.RawQuery, u.ForceQuery, u.Fragment = nil, "", false, ""
+	u.Path, u.RawPath = strings.TrimRight(u.Path, "/"), strings.TrimRight(u.RawPath, "/")
+	return u.String()
+}
+
+// refusedForeign tells whether entry, of another source, isn't served as it
+// is, see WithStrictOrigin.
+func (c *PicoCache) refusedForeign(entry *cacheEntry) bool {
+	return c.strictOrigin && !c.shadow.observing[PolicyStrictOrigin] && c.foreign(entry)
+}
+
+// foreign tells whether entry was filled from another source than the one
+// in use. Entries not recorded theirs aren't.
+func (c *PicoCache) foreign(entry *cacheEntry) bool {
+	return entry.origin != "" && c.originID != "" && entry.origin != c.originID
+}
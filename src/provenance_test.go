@@ -0,0 +1,96 @@
+package picocache_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	picocache "picocache/src"
+	"strings"
+	"testing"
+)
+
+func TestStrictOrigin(t *testing.T) {
+	first := NewFakeOrigin(t)
+	first.Handle("/a", OriginResponse{Body: "first a"})
+	first.Handle("/b", OriginResponse{Body: "first b", Header: http.Header{"Etag": {`"b"`}}})
+	first.Handle("/c", OriginResponse{Body: "first c"})
+	cache := NewTestCache(t, first, 1<<20)
+	cache.Expect("/a", "MISS", "first a")
+	cache.Expect("/b", "MISS", "first b")
+	cache.Expect("/c", "MISS", "first c")
+	filled := map[string]string{}
+	cache.Range(func(d picocache.EntryDetails) bool {
+		filled[d.Path] = d.Origin
+		return true
+	})
+	for path, origin := range filled {
+		if origin != first.URL {
+			t.Fatalf("%s: expected filled from %s, got %q", path, first.URL, origin)
+		}
+	}
+	cache.Close()
+
+	// Entries from before sources got recorded have no metadata
+	metas, err := filepath.Glob(filepath.Join(cache.Dir, "*.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandfathered := ""
+	for _, meta := range metas {
+		data, err := os.ReadFile(strings.TrimSuffix(meta, ".meta"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) == "first c" {
+			grandfathered = meta
+		}
+	}
+	if grandfathered == "" {
+		t.Fatal("no metadata recorded for /c")
+	}
+	if err := os.Remove(grandfathered); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewFakeOrigin(t)
+	second.Handle("/a", OriginResponse{Body: "second a"})
+	second.Handle("/b", OriginResponse{Status: http.StatusNotModified})
+	second.Handle("/c", OriginResponse{Body: "second c"})
+
+	// Without strict origins, entries get served whatever their source
+	cache.Origin = second
+	cache.Reopen()
+	cache.Expect("/a", "HIT", "first a")
+	cache.Expect("/b", "HIT", "first b")
+	if s := cache.Stats(); s.Source != second.URL || s.ForeignEntries != 2 || s.ForeignRefills != 0 {
+		t.Fatalf("expected 2 entries of another source than %s, got %+v", second.URL, s)
+	}
+
+	// With them, they're revalidated or fetched again
+	cache.opts = append(cache.opts, picocache.WithStrictOrigin())
+	cache.Reopen()
+	cache.Expect("/a", "MISS", "second a")
+	cache.Expect("/a", "HIT", "second a")
+	cache.Expect("/b", "REVALIDATED", "first b")
+	cache.Expect("/b", "HIT", "first b")
+	cache.Expect("/c", "HIT", "first c")
+	if n := second.Requests("/a"); n != 1 {
+		t.Fatalf("expected /a fetched again once, got %d requests", n)
+	}
+	if n := second.Requests("/c"); n != 0 {
+		t.Fatalf("expected /c served as it is, got %d requests", n)
+	}
+	if s := cache.Stats(); s.ForeignEntries != 0 || s.ForeignRefills != 2 {
+		t.Fatalf("expected 2 entries bound again to the source, got %+v", s)
+	}
+	bound := 0
+	cache.Range(func(d picocache.EntryDetails) bool {
+		if d.Origin == second.URL {
+			bound++
+		}
+		return true
+	})
+	if bound != 2 {
+		t.Fatalf("expected 2 entries recording %s, got %d", second.URL, bound)
+	}
+}
@@ -0,0 +1,146 @@
+package picocache
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WithProxyPaths proxies requests for paths under prefixes to the source
+// instead of caching them: any method is allowed, request bodies are
+// streamed to the source and its responses streamed back whatever their
+// status, as X-Cache: BYPASS-PROXY. Hop-by-hop headers are dropped both
+// ways, and X-Forwarded-For, -Host and -Proto tell the source about the
+// client. Nothing of them ever gets cached. Other paths keep being served
+// from the cache, to GET and HEAD requests only.
+func WithProxyPaths(prefixes ...string) Option {
+	return func(c *PicoCache) {
+		c.proxyPaths = nil
+		for _, prefix := range prefixes {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				c.proxyPaths = append(c.proxyPaths, prefix)
+			}
+		}
+	}
+}
+
+// proxied reports whether requests for path get proxied to the source, see
+// WithProxyPaths.
+func (c *PicoCache) proxied(path string) bool {
+	for _, prefix := range c.proxyPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxy forwards r to the source and its response back to w, through the
+// transport of the origin client, redirects being the client's to follow.
+func (c *PicoCache) proxy(w http.ResponseWriter, r *http.Request, t *timings) {
+	t.outcome = OutcomeBypassProxy
+	if climbs(r.URL.Path) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if c.offline {
+		t.trace("offline")
+		c.refuseOffline(w, r.URL.Path)
+		return
+	}
+	if c.overBudget(-1) {
+		t.trace("over the origin byte budget")
+		c.refuseOverBudget(w, t)
+		return
+	}
+	path := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	target, err := url.Parse(c.originURL(path))
+	if err != nil {
+		c.log.Error("Failed to build source request", slog.String("path", r.URL.Path), slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	client := *c.origin
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	fetch := c.startOriginFetch(target.String(), "proxy", false)
+	var body *countingReadCloser
+	var fetchErr error
+	status := 0
+	defer func() {
+		// Also when the body fails midway, aborting the response
+		var n int64
+		if body != nil {
+			n = body.n
+		}
+		fetch.done(status, n, fetchErr)
+	}()
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = target
+			pr.Out.Host = ""
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+			fetch.startSpan(t, pr.Out)
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.RequestURI = ""
+			return c.originSend(&client, req)
+		}),
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			t.originFirstByte = time.Since(fetch.start)
+			status = resp.StatusCode
+			if c.throttled(resp) {
+				return errRateLimited
+			}
+			body = &countingReadCloser{ReadCloser: resp.Body}
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{c.budgeted(body), body}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			fetchErr = err
+			if errors.Is(err, errRateLimited) {
+				t.trace("over the origin request rate limit")
+				c.refuseRateLimited(w, t)
+				return
+			}
+			c.log.Error("Failed to proxy request", slog.String("path", r.URL.Path), slog.String("err", err.Error()))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog: slog.NewLogLogger(c.log.Handler(), slog.LevelWarn),
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// roundTripperFunc is a function sending requests as an http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// countingReadCloser counts the bytes read through it.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
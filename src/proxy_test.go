@@ -0,0 +1,118 @@
+package picocache
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyPaths(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Hop", r.Header.Get("X-Hop"))
+			w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(r.URL.RawQuery + ":" + string(body)))
+		case "/search/stream":
+			for _, chunk := range []string{"one,", "two,", "three"} {
+				w.Write([]byte(chunk))
+				w.(http.Flusher).Flush()
+			}
+		case "/search/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such thing"))
+		default:
+			w.Write([]byte("cached"))
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithProxyPaths("/search"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	server := httptest.NewServer(cache)
+	defer server.Close()
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A POST with its body, waiting for 100 Continue to send it
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/search?q=cats", strings.NewReader("page=2"))
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "q=cats:page=2" || resp.Header.Get("X-Method") != http.MethodPost {
+		t.Fatalf("expected the POST proxied with its body, got %d %q, %s", resp.StatusCode, body, resp.Header.Get("X-Method"))
+	}
+	if resp.Header.Get("X-Hop") != "" || resp.Header.Get("X-Forwarded-For") != "127.0.0.1" || resp.Header.Get("X-Cache") != "BYPASS-PROXY" {
+		t.Fatalf("expected hop-by-hop headers dropped and the client forwarded, got %v", resp.Header)
+	}
+
+	// A chunked response, streamed as it comes
+	resp, err = http.Get(server.URL + "/search/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 {
+		t.Fatalf("expected a chunked response, got %d %v", resp.ContentLength, resp.TransferEncoding)
+	}
+	chunk, err := bufio.NewReader(resp.Body).ReadString(',')
+	if err != nil || chunk != "one," {
+		t.Fatalf("expected the first chunk, got %q %v", chunk, err)
+	}
+	resp.Body.Close()
+
+	// Error statuses as they are, GETs repeated uncached
+	for range 2 {
+		resp, err = http.Get(server.URL + "/search/missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || string(body) != "no such thing" || resp.Header.Get("X-Cache") != "BYPASS-PROXY" {
+			t.Fatalf("expected the 404 proxied, got %d %q %s", resp.StatusCode, body, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	// Other paths keep to GET and HEAD
+	resp, err = http.Post(server.URL+"/file", "text/plain", strings.NewReader("nope"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected a 405 out of the proxied paths, got %d", resp.StatusCode)
+	}
+
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) || cache.Stats().Entries != 0 {
+		t.Fatalf("expected nothing proxied cached, got %d files, %d before", len(after), len(before))
+	}
+	if s := cache.Stats(); s.Outcomes["bypass-proxy"] != 4 {
+		t.Fatalf("expected 4 proxied requests, got %v", s.Outcomes)
+	}
+}
@@ -0,0 +1,158 @@
+package picocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// PurgeResult is what Purge did.
+type PurgeResult uint8
+
+const (
+	NotPurged     PurgeResult = iota // no entry nor fill in progress, or frozen
+	Purged                           // the entry got removed
+	PurgedFilling                    // a fill in progress got condemned, along with any entry
+)
+
+func (r PurgeResult) String() string {
+	switch r {
+	case Purged:
+		return "purged"
+	case PurgedFilling:
+		return "purged (was filling)"
+	}
+	return "not purged"
+}
+
+// Purge removes the entry with the given cache key, see KeyForPath. A fill
+// in progress isn't waited for but condemned: the clients already waiting
+// on it still get its body, which is then dropped rather than cached.
+// Copies of the entry in other directories go too, see WithCacheDirs.
+func (c *PicoCache) Purge(key string) PurgeResult {
+	if c.frozen.Load() {
+		return NotPurged
+	}
+	filling, purged := false, false
+	for _, cacheFile := range c.keyFiles(key) {
+		if f, ok := c.downloading.Load(cacheFile); ok {
+			// Checked by the fill as it publishes, under the file lock purge
+			// takes after it
+			f.(*fill).condemned.Store(true)
+			filling = true
+		}
+		if c.purge(cacheFile, nil) {
+			purged = true
+		}
+	}
+	switch {
+	case filling:
+		return PurgedFilling
+	case purged:
+		return Purged
+	}
+	return NotPurged
+}
+
+// purge removes the entry of cacheFile, or only entry when set, reporting
+// whether it did. Nothing is while frozen.
+func (c *PicoCache) purge(cacheFile string, entry *cacheEntry) bool {
+	if c.frozen.Load() {
+		return false
+	}
+	if c.heads != nil && entry == nil {
+		c.heads.forget(cacheFile)
+	}
+	unlock := c.lockFile(cacheFile)
+	if entry == nil {
+		e, ok := c.entries.LoadAndDelete(cacheFile)
+		if !ok {
+			unlock()
+			return false
+		}
+		entry = e.(*cacheEntry)
+	} else if !c.entries.CompareAndDelete(cacheFile, entry) {
+		unlock()
+		return false
+	}
+
+	entry.sealed.Store(false)
+	removeFiles(entry)
+	unlock()
+	c.unaccount(entry)
+	return true
+}
+
+// PurgePath removes the entry of a request path, escaped and possibly with
+// a query string, like Purge, and its language variants.
+func (c *PicoCache) PurgePath(path string) PurgeResult {
+	u, err := url.Parse(path)
+	if err != nil {
+		return NotPurged
+	}
+	_, purged := c.purgeRequest(u)
+	return purged
+}
+
+// purgeRequest purges the entry of u, and its language variants, returning
+// its cache key and the most Purge did for any.
+func (c *PicoCache) purgeRequest(u *url.URL) (string, PurgeResult) {
+	path, key := c.requestKey(u)
+	purged := c.Purge(KeyForPath(key))
+	for _, variant := range c.languageKeys(path, key) {
+		purged = max(purged, c.Purge(variant))
+	}
+	return KeyForPath(key), purged
+}
+
+type purgeResult struct {
+	Key     string       `json:"key"`
+	Purged  bool         `json:"purged"`
+	Filling bool         `json:"filling,omitempty"` // see PurgedFilling
+	Peers   []PeerResult `json:"peers,omitempty"`   // see WithPeers
+}
+
+func newPurgeResult(key string, purged PurgeResult, peers []PeerResult) purgeResult {
+	return purgeResult{Key: key, Purged: purged != NotPurged, Filling: purged == PurgedFilling, Peers: peers}
+}
+
+// servePurge purges the entry of the path or key query parameter, for
+// trusted requests only, and forwards the purge to the peers.
+func (c *PicoCache) servePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if c.frozen.Load() {
+		http.Error(w, errFrozen.Error(), http.StatusConflict)
+		return
+	}
+
+	query := r.URL.Query()
+	key := query.Get("key")
+	var purged PurgeResult
+	switch {
+	case key != "" && !validKey(key):
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	case key != "":
+		purged = c.Purge(key)
+	case query.Get("path") != "":
+		u, err := url.Parse(query.Get("path"))
+		if err != nil {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		key, purged = c.purgeRequest(u)
+	default:
+		http.Error(w, "path or key is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPurgeResult(key, purged, c.propagate(r)))
+}
@@ -0,0 +1,94 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPurgeFilling(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(strings.Repeat("x", 50)))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			w.Write([]byte(strings.Repeat("x", 50)))
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cacheFile := cache.getCacheFilename("/slow")
+	key := filepath.Base(cacheFile)
+	if got := cache.Purge(key); got != NotPurged {
+		t.Fatalf("expected nothing purged, got %s", got)
+	}
+
+	const clients = 3
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = httptest.NewRecorder()
+			cache.ServeHTTP(responses[i], httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+	}
+	waitFor(t, func() bool {
+		f, ok := cache.downloading.Load(cacheFile)
+		return ok && f.(*fill).written.Load() == 50 && f.(*fill).waiters.Load() == clients
+	})
+
+	// Purging doesn't wait for the fill
+	if got := cache.Purge(key); got != PurgedFilling {
+		t.Fatalf("expected the fill condemned, got %s", got)
+	}
+	close(release)
+	wg.Wait()
+
+	// Clients which asked before still get the body
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != strings.Repeat("x", 100) || w.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("%d: unexpected response %d %s %d bytes", i, w.Code, w.Header().Get("X-Cache"), w.Body.Len())
+		}
+	}
+	if _, ok := cache.entries.Load(cacheFile); ok {
+		t.Fatal("expected the condemned fill not cached")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), key) {
+			t.Errorf("expected nothing left of the condemned fill, got %s", f.Name())
+		}
+	}
+	verifyConsistency(t, cache, dir)
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		if got := w.Header().Get("X-Cache"); got != expected || w.Body.Len() != 100 {
+			t.Fatalf("expected %s, got %s with %d bytes", expected, got, w.Body.Len())
+		}
+	}
+	if got := cache.Purge(key); got != Purged {
+		t.Fatalf("expected the entry purged, got %s", got)
+	}
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,129 @@
+package picocache
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultPurgeDropQuiescence = 2 * time.Second
+
+// WithPurgeDrop watches dir, created if missing, for files listing what to
+// purge: a request path per line, escaped and possibly with a query string
+// as for PurgePath, or prefix: followed by one as for PurgePrefix. Empty
+// lines and those starting with # are skipped. Each file is processed, the
+// results logged, then deleted.
+//
+// Files are read as soon as they are closed after writing or renamed into
+// dir where the platform tells, otherwise once left unmodified for
+// quiescence, 2s if zero. Dotfiles and names ending with .tmp are ignored,
+// so files can be written under such a name then renamed. Purges made this
+// way aren't forwarded to peers.
+func WithPurgeDrop(dir string, quiescence time.Duration) Option {
+	return func(c *PicoCache) {
+		c.purgeDropDir = dir
+		c.purgeDropQuiescence = quiescence
+		if quiescence <= 0 {
+			c.purgeDropQuiescence = defaultPurgeDropQuiescence
+		}
+	}
+}
+
+// watchPurgeDrop processes the files of the purge drop directory until the
+// cache is closed. Directory scans pick up those dropped while not running,
+// left while frozen, or written where it can't be watched.
+func (c *PicoCache) watchPurgeDrop() {
+	dropped, stop, err := watchDir(c.purgeDropDir)
+	if err != nil {
+		c.log.Warn("Failed to watch the purge drop directory, polling it", slog.String("dir", c.purgeDropDir),
+			slog.String("err", err.Error()))
+	}
+	defer stop()
+	ticker := time.NewTicker(c.purgeDropQuiescence)
+	defer ticker.Stop()
+
+	c.scanPurgeDrop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case name, ok := <-dropped:
+			if !ok {
+				dropped = nil
+				continue
+			}
+			c.processPurgeDrop(name)
+		case <-ticker.C:
+			c.scanPurgeDrop()
+		}
+	}
+}
+
+// scanPurgeDrop processes the files of the purge drop directory left
+// unmodified for the quiescence interval, the others maybe still being
+// written.
+func (c *PicoCache) scanPurgeDrop() {
+	files, err := os.ReadDir(c.purgeDropDir)
+	if err != nil {
+		c.log.Warn("Failed to list the purge drop directory", slog.String("dir", c.purgeDropDir), slog.String("err", err.Error()))
+		return
+	}
+	for _, f := range files {
+		if !f.Type().IsRegular() || ignoredDrop(f.Name()) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil || c.now().Sub(info.ModTime()) < c.purgeDropQuiescence {
+			continue
+		}
+		c.processPurgeDrop(f.Name())
+	}
+}
+
+// ignoredDrop reports whether a file of the purge drop directory named name
+// is being written, to be renamed once complete.
+func ignoredDrop(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, tempSuffix)
+}
+
+// processPurgeDrop purges what the file name of the purge drop directory
+// lists, then deletes it. It is left for later while frozen.
+func (c *PicoCache) processPurgeDrop(name string) {
+	if ignoredDrop(name) || c.frozen.Load() {
+		return
+	}
+	path := filepath.Join(c.purgeDropDir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			c.log.Warn("Failed to read purge drop file", slog.String("file", path), slog.String("err", err.Error()))
+		}
+		return
+	}
+
+	log := c.log.With(slog.String("file", path))
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if prefix, ok := strings.CutPrefix(line, "prefix:"); ok {
+			prefix = strings.TrimSpace(prefix)
+			purged, err := c.PurgePrefix(prefix)
+			if err != nil {
+				log.Warn("Failed to purge prefix from drop file", slog.String("prefix", prefix), slog.String("err", err.Error()))
+				continue
+			}
+			log.Info("Purged prefix from drop file", slog.String("prefix", prefix), slog.Int("purged", purged))
+			continue
+		}
+		log.Info("Purged path from drop file", slog.String("path", line), slog.String("result", c.PurgePath(line).String()))
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("Failed to delete purge drop file", slog.String("err", err.Error()))
+	}
+}
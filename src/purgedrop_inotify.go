@@ -0,0 +1,57 @@
+//go:build linux
+
+package picocache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+// watchDir sends the names of the files closed after writing in dir, or
+// renamed into it, until stopped.
+func watchDir(dir string) (<-chan string, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, func() {}, err
+	}
+	// Non-blocking, so reads go through the runtime poller and Close
+	// interrupts them
+	events := os.NewFile(uintptr(fd), "inotify")
+
+	names := make(chan string)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(names)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := events.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				mask := binary.NativeEndian.Uint32(buf[off+4:])
+				length := int(binary.NativeEndian.Uint32(buf[off+12:]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+length]
+				off += syscall.SizeofInotifyEvent + length
+				if mask&syscall.IN_ISDIR != 0 {
+					continue
+				}
+				select {
+				case names <- string(bytes.TrimRight(name, "\x00")):
+				case <-stopped:
+					return
+				}
+			}
+		}
+	}()
+	return names, func() {
+		close(stopped)
+		events.Close()
+	}, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package picocache
+
+// watchDir sends nothing, dir being only scanned on this platform.
+func watchDir(dir string) (<-chan string, func(), error) {
+	return nil, func() {}, nil
+}
@@ -0,0 +1,79 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeDrop(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	drop := filepath.Join(t.TempDir(), "purge")
+	// Dropped while not running
+	if err := os.MkdirAll(drop, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(drop, "early"), []byte("/early\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithPrefixPurge(),
+		WithPurgeDrop(drop, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cached := func(path string) bool {
+		_, ok := cache.entries.Load(cache.getCacheFilename(path))
+		return ok
+	}
+	for _, path := range []string{"/a", "/b", "/c", "/dir/x", "/dir/y", "/other/z"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if !cached(path) {
+			t.Fatalf("%s: expected cached", path)
+		}
+	}
+	waitFor(t, func() bool {
+		_, err := os.Stat(filepath.Join(drop, "early"))
+		return os.IsNotExist(err)
+	})
+
+	// Written in place
+	if err := os.WriteFile(filepath.Join(drop, "first"), []byte("# from the pipeline\n/a\n\n  /b  \nprefix:/dir/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !cached("/a") && !cached("/b") && !cached("/dir/x") && !cached("/dir/y") })
+
+	// Written under a temporary name, then renamed
+	partial := filepath.Join(drop, ".second")
+	if err := os.WriteFile(partial, []byte("/c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(partial, old, old)
+	time.Sleep(200 * time.Millisecond)
+	if !cached("/c") {
+		t.Fatal("expected files being written left alone")
+	}
+	if err := os.Rename(partial, filepath.Join(drop, "second")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !cached("/c") })
+
+	waitFor(t, func() bool {
+		files, err := os.ReadDir(drop)
+		return err == nil && len(files) == 0
+	})
+	if !cached("/other/z") {
+		t.Error("expected unlisted entries kept")
+	}
+	verifyConsistency(t, cache, dir)
+}
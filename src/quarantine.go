@@ -0,0 +1,128 @@
+package picocache
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WithQuarantine quarantines entries failing to be served failures times
+// in a row, e.g. sitting on a bad disk sector: they're dropped from the
+// index, their file moved under the quarantine directory of the cache
+// directory, and misses for them are streamed from the source without
+// caching for avoidFor. By default, 3 failures in a row quarantine an entry
+// for 10 minutes. Zero failures never quarantine any.
+func WithQuarantine(failures int, avoidFor time.Duration) Option {
+	return func(c *PicoCache) {
+		c.quarantineFailures = failures
+		c.quarantineFor = avoidFor
+	}
+}
+
+const (
+	quarantineDir             = "quarantine"
+	defaultQuarantineFailures = 3
+	defaultQuarantineFor      = 10 * time.Minute
+)
+
+var errQuarantined = errors.New("entry quarantined, not cached again yet")
+
+// entryFailures are the errors an entry failed to be served with since it
+// last was.
+type entryFailures struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+// quarantine is the cache files whose entry got quarantined, until when
+// they aren't filled again.
+type quarantine struct {
+	mu    sync.Mutex
+	until map[string]time.Time // by cache file
+}
+
+// avoided tells whether cacheFile got quarantined recently enough not to be
+// filled again, sweeping the ones which weren't.
+func (q *quarantine) avoided(cacheFile string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	until, ok := q.until[cacheFile]
+	if ok && !now.Before(until) {
+		delete(q.until, cacheFile)
+		return false
+	}
+	return ok
+}
+
+// add avoids cacheFile for d from now, sweeping the files avoided long
+// enough, quarantines being rare.
+func (q *quarantine) add(cacheFile string, now time.Time, d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for file, until := range q.until {
+		if !now.Before(until) {
+			delete(q.until, file)
+		}
+	}
+	q.until[cacheFile] = now.Add(d)
+}
+
+// served resets the failures of entry, served once again.
+func (c *PicoCache) served(entry *cacheEntry) {
+	if _, ok := c.failing.Load(entry); ok {
+		c.failing.Delete(entry)
+	}
+}
+
+// failed records entry failing to be served with err, other than by the
+// client, and quarantines it once it did too many times in a row.
+func (c *PicoCache) failed(entry *cacheEntry, err error) {
+	if c.quarantineFailures <= 0 {
+		return
+	}
+	f, _ := c.failing.LoadOrStore(entry, &entryFailures{})
+	failures := f.(*entryFailures)
+	failures.mu.Lock()
+	failures.errs = append(failures.errs, err)
+	errs := failures.errs
+	failures.mu.Unlock()
+	if len(errs) < c.quarantineFailures || !c.failing.CompareAndDelete(entry, f) {
+		return
+	}
+	c.quarantineEntry(entry, errors.Join(errs...))
+}
+
+// quarantineEntry drops entry from the index and moves its file aside,
+// keeping it from being filled again for a while.
+func (c *PicoCache) quarantineEntry(entry *cacheEntry, err error) {
+	cacheFile := entry.filename
+	c.avoid.add(cacheFile, c.steadyNow(), c.quarantineFor)
+	if c.frozen.Load() {
+		return
+	}
+
+	unlock := c.lockFile(cacheFile)
+	if !c.entries.CompareAndDelete(cacheFile, entry) {
+		unlock()
+		return
+	}
+	entry.sealed.Store(false)
+	moved := filepath.Join(c.fileDir(cacheFile), quarantineDir, filepath.Base(cacheFile)+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if os.MkdirAll(filepath.Dir(moved), 0755) != nil || os.Rename(cacheFile, moved) != nil {
+		moved = ""
+		os.Remove(cacheFile)
+	}
+	os.Remove(cacheFile + metaSuffix)
+	unlock()
+	c.unaccount(entry)
+
+	c.stats.quarantined.Add(1)
+	c.log.Warn("Quarantined entry failing to be served", slog.String("file", cacheFile),
+		slog.String("moved_to", moved), slog.Duration("avoided_for", c.quarantineFor), slog.String("err", err.Error()))
+}
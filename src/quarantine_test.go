@@ -0,0 +1,98 @@
+package picocache
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	fetches := atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithQuarantine(3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	bad := cache.getCacheFilename("/bad")
+	failing := false
+	cache.open = func(name string) (*os.File, error) {
+		if name == bad && failing {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EIO}
+		}
+		return os.Open(name)
+	}
+	get := func(path string, code int, cacheStatus string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || w.Header().Get("X-Cache") != cacheStatus {
+			t.Fatalf("%s: expected %d %s, got %d %s", path, code, cacheStatus, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+
+	get("/bad", http.StatusOK, "MISS")
+	get("/good", http.StatusOK, "MISS")
+
+	// Failures in a row only
+	failing = true
+	get("/bad", http.StatusInternalServerError, "MISS")
+	get("/bad", http.StatusInternalServerError, "MISS")
+	failing = false
+	get("/bad", http.StatusOK, "HIT")
+	failing = true
+	get("/bad", http.StatusInternalServerError, "MISS")
+	get("/bad", http.StatusInternalServerError, "MISS")
+	if s := cache.Stats(); s.Quarantined != 0 || s.Entries != 2 {
+		t.Fatalf("expected nothing quarantined yet, got %+v", s)
+	}
+	get("/bad", http.StatusInternalServerError, "MISS")
+	if s := cache.Stats(); s.Quarantined != 1 || s.Entries != 1 {
+		t.Fatalf("expected the entry quarantined, got %+v", s)
+	}
+	moved, err := filepath.Glob(filepath.Join(dir, quarantineDir, filepath.Base(bad)+".*"))
+	if err != nil || len(moved) != 1 {
+		t.Fatalf("expected the file moved to quarantine, got %v %v", moved, err)
+	}
+
+	// Not filled again for a while
+	fetches.Store(0)
+	get("/bad", http.StatusOK, "BYPASS-QUARANTINE")
+	get("/good", http.StatusOK, "HIT")
+	if n := fetches.Load(); n != 1 || cache.Stats().Entries != 1 {
+		t.Fatalf("expected the quarantined entry streamed from the source, got %d fetches", n)
+	}
+	verifyConsistency(t, cache, dir)
+
+	failing = false
+	now = now.Add(time.Minute)
+	get("/bad", http.StatusOK, "MISS")
+	get("/bad", http.StatusOK, "HIT")
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// Quarantined files aren't entries
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if s := restarted.Stats(); s.Entries != 2 || s.TotalSize != 6 {
+		t.Fatalf("unexpected entries after a restart %+v", s)
+	}
+	verifyConsistency(t, restarted, dir)
+}
@@ -0,0 +1,63 @@
+package picocache
+
+import (
+	"net/url"
+)
+
+// queryFilter selects the query parameters making it into cache keys and
+// source URLs, see WithStrippedQueryParams and WithKeptQueryParams.
+type queryFilter struct {
+	names map[string]bool
+	keep  bool // keep only names, rather than strip them
+}
+
+func newQueryFilter(names []string, keep bool) *queryFilter {
+	f := &queryFilter{names: map[string]bool{}, keep: keep}
+	for _, name := range names {
+		f.names[name] = true
+	}
+	return f
+}
+
+// WithStrippedQueryParams makes query strings part of cache keys and source
+// URLs, minus the given parameters. Meant for cache-busting tokens, so
+// /app.js?v=1 and /app.js?v=2 share an entry when v is stripped.
+//
+// Without it nor WithKeptQueryParams, query strings are ignored altogether.
+func WithStrippedQueryParams(names ...string) Option {
+	return func(c *PicoCache) {
+		c.query = newQueryFilter(names, false)
+	}
+}
+
+// WithKeptQueryParams makes the given query parameters, and only them, part
+// of cache keys and source URLs.
+func WithKeptQueryParams(names ...string) Option {
+	return func(c *PicoCache) {
+		c.query = newQueryFilter(names, true)
+	}
+}
+
+// queryString returns the filtered query of u, prefixed with a question
+// mark, or an empty string when nothing is left. Parameters are matched on
+// their decoded name and sorted, so their order doesn't matter.
+func (c *PicoCache) queryString(u *url.URL) string {
+	return c.query.queryString(u)
+}
+
+func (f *queryFilter) queryString(u *url.URL) string {
+	if f == nil || u.RawQuery == "" {
+		return ""
+	}
+
+	values, _ := url.ParseQuery(u.RawQuery)
+	for name := range values {
+		if f.names[name] != f.keep {
+			delete(values, name)
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return "?" + values.Encode()
+}
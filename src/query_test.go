@@ -0,0 +1,73 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestQueryString(t *testing.T) {
+	strip := &PicoCache{query: newQueryFilter([]string{"v", "ts"}, false)}
+	keep := &PicoCache{query: newQueryFilter([]string{"size", "format"}, true)}
+
+	for _, tc := range []struct {
+		cache           *PicoCache
+		query, expected string
+	}{
+		{&PicoCache{}, "size=200", ""},
+		{strip, "", ""},
+		{strip, "v=abc123", ""},
+		{strip, "size=200&v=1", "?size=200"},
+		{strip, "v=1&size=200&ts=9", "?size=200"},
+		{strip, "format=webp&size=200", "?format=webp&size=200"},
+		{strip, "size=200&format=webp", "?format=webp&size=200"},
+		{strip, "%76=1&size=200", "?size=200"},
+		{strip, "vv=1", "?vv=1"},
+		{keep, "v=1&size=200", "?size=200"},
+		{keep, "utm_source=x", ""},
+		{keep, "si%7Ae=200", "?size=200"},
+	} {
+		u := &url.URL{Path: "/img", RawQuery: tc.query}
+		if got := tc.cache.queryString(u); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.query, tc.expected, got)
+		}
+	}
+}
+
+func TestStrippedQueryParams(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.RequestURI())
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithStrippedQueryParams("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ path, expected, body string }{
+		{"/app.js?v=1", "MISS", "/app.js"},
+		{"/app.js?v=2", "HIT", "/app.js"},
+		{"/img?size=200", "MISS", "/img?size=200"},
+		{"/img?size=400", "MISS", "/img?size=400"},
+		{"/img?v=3&size=200", "HIT", "/img?size=200"},
+	} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := w.Header().Get("X-Cache"); got != tc.expected {
+			t.Fatalf("%s: expected %s, got %s", tc.path, tc.expected, got)
+		}
+		if w.Body.String() != tc.body {
+			t.Fatalf("%s: expected body %q, got %q", tc.path, tc.body, w.Body.String())
+		}
+	}
+
+	if len(fetched) != 3 {
+		t.Fatalf("expected 3 source requests, got %v", fetched)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,287 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultOriginRateWait = time.Second
+
+// defaultThrottlePause is how long a 429 without a Retry-After the cache
+// understands pauses the origin request rate limit.
+const defaultThrottlePause = time.Second
+
+// RequestRate is how many requests may be sent to the source per period,
+// see WithOriginRateLimit.
+type RequestRate struct {
+	Requests int64
+	Per      time.Duration
+}
+
+// ParseRequestRate parses a count per period such as 100/s, the period
+// being a second, minute, hour, day or a Go duration.
+func ParseRequestRate(s string) (RequestRate, error) {
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return RequestRate{}, fmt.Errorf("invalid rate %q, expected a count per period such as 100/s", s)
+	}
+	requests, err := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+	if err != nil || requests <= 0 {
+		return RequestRate{}, fmt.Errorf("invalid rate count %q", count)
+	}
+	per, err := parsePeriod(period)
+	if err != nil {
+		return RequestRate{}, fmt.Errorf("invalid rate period %q", period)
+	}
+	return RequestRate{Requests: requests, Per: per}, nil
+}
+
+// WithOriginRateLimit paces every request sent to the source, fills,
+// pass-throughs, revalidations, HEAD requests and probes alike, as a bucket
+// of rate.Requests refilling over rate.Per. Requests over it wait their
+// turn, in the order they came, for up to wait, 1s when 0: misses which
+// would wait longer are answered 503 with a Retry-After, and expired
+// entries served stale rather than fetched again. A 429 from the source
+// pauses the bucket for its Retry-After.
+func WithOriginRateLimit(rate RequestRate, wait time.Duration) Option {
+	return func(c *PicoCache) {
+		if wait <= 0 {
+			wait = defaultOriginRateWait
+		}
+		c.originRate = &rateLimiter{RequestRate: rate, maxWait: wait, tokens: float64(rate.Requests), last: time.Now()}
+	}
+}
+
+var errRateLimited = errors.New("origin request rate limit reached")
+
+// rateLimiter is a token bucket in requests. Tokens are taken ahead of
+// time, a request finding none waiting for the one it took: waits grow
+// with each request in line, which keeps them in order.
+type rateLimiter struct {
+	RequestRate
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	tokens  float64   // negative once taken ahead of time
+	last    time.Time // tokens are earned from, ahead of now while paused
+	limited int64
+
+	waiters atomic.Int64
+}
+
+// refill adds the tokens earned since the last call, holding mu.
+func (l *rateLimiter) refill(now time.Time) {
+	if now.After(l.last) {
+		earned := now.Sub(l.last).Seconds() * float64(l.Requests) / l.Per.Seconds()
+		l.tokens = min(l.tokens+earned, float64(l.Requests))
+		l.last = now
+	}
+}
+
+// delay returns how long until a token is there, holding mu.
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	d := max(l.last.Sub(now), 0)
+	if l.tokens < 1 {
+		d += time.Duration((1 - l.tokens) / float64(l.Requests) * float64(l.Per))
+	}
+	return d
+}
+
+// allows tells whether a request sent now wouldn't wait over maxWait,
+// counting a refusal otherwise.
+func (l *rateLimiter) allows(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	if l.delay(now) <= l.maxWait {
+		return true
+	}
+	l.limited++
+	return false
+}
+
+// reserve takes a token, returning how long until it's there, or reports
+// false when that's over maxWait, counting a refusal.
+func (l *rateLimiter) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	d := l.delay(now)
+	if d > l.maxWait {
+		l.limited++
+		return 0, false
+	}
+	l.tokens--
+	return d, true
+}
+
+// until returns how long until a token is there.
+func (l *rateLimiter) until(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	return l.delay(now)
+}
+
+// refuse counts a request refused.
+func (l *rateLimiter) refuse() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limited++
+}
+
+// cancel gives back a token taken but not used.
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.tokens+1, float64(l.Requests))
+}
+
+// pause stops earning tokens until until, those left being lost.
+func (l *rateLimiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if until.After(l.last) {
+		l.last = until
+		l.tokens = min(l.tokens, 0)
+	}
+}
+
+// paused returns how long the bucket is still paused for.
+func (l *rateLimiter) paused(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return max(l.last.Sub(now), 0)
+}
+
+// wait waits for a token, up to maxWait. Requests already waiting when a
+// 429 paused the bucket wait for the pause to be over too, within the
+// same bound.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	start := time.Now()
+	d, ok := l.reserve(start)
+	if !ok {
+		return errRateLimited
+	}
+	if d <= 0 {
+		return nil
+	}
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
+	for d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			l.cancel()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now := time.Now()
+		if d = l.paused(now); d > 0 && now.Sub(start)+d > l.maxWait {
+			l.cancel()
+			l.refuse()
+			return errRateLimited
+		}
+	}
+	return nil
+}
+
+// OriginRateStats is the state of the origin request rate limit.
+type OriginRateStats struct {
+	Requests  int64         `json:"requests"` // per period
+	Per       time.Duration `json:"per"`
+	Available int64         `json:"available"` // negative when requests wait for theirs
+	Waiters   int64         `json:"waiters"`
+	PausedFor time.Duration `json:"paused_for"` // by a 429 of the source
+	Limited   int64         `json:"limited"`    // requests refused or served stale
+}
+
+func (l *rateLimiter) stats(now time.Time) *OriginRateStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	return &OriginRateStats{
+		Requests:  l.Requests,
+		Per:       l.Per,
+		Available: int64(l.tokens),
+		Waiters:   l.waiters.Load(),
+		PausedFor: max(l.last.Sub(now), 0),
+		Limited:   l.limited,
+	}
+}
+
+// retryAfter returns the pause the Retry-After of a 429 asks for, in
+// seconds or as a date.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return defaultThrottlePause
+}
+
+// originDo sends req to the source, once the origin request rate limit if
+// any allows. The 429s of the source are counted, and pause it.
+func (c *PicoCache) originDo(req *http.Request) (*http.Response, error) {
+	return c.originSend(c.origin, req)
+}
+
+// originSend is originDo through client.
+func (c *PicoCache) originSend(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.originRate != nil {
+		if err := c.originRate.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		c.stats.originThrottled.Add(1)
+		if c.originRate != nil {
+			pause := retryAfter(resp.Header, time.Now())
+			c.log.Warn("Source is rate limiting, pausing requests to it", slog.String("url", req.URL.String()), slog.Duration("pause", pause))
+			c.originRate.pause(time.Now().Add(pause))
+		}
+	}
+	return resp, err
+}
+
+// throttled tells whether resp is a 429 of the source pausing the origin
+// request rate limit.
+func (c *PicoCache) throttled(resp *http.Response) bool {
+	return c.originRate != nil && resp.StatusCode == http.StatusTooManyRequests
+}
+
+// overRate tells whether a request to the source would now wait over the
+// bound of the origin request rate limit.
+func (c *PicoCache) overRate() bool {
+	return c.originRate != nil && !c.originRate.allows(time.Now())
+}
+
+// refuseRateLimited answers a miss with a 503 until the source may be asked
+// again.
+func (c *PicoCache) refuseRateLimited(w http.ResponseWriter, t *timings) {
+	t.outcome = OutcomeRateLimited
+	w.Header().Set("Retry-After", strconv.Itoa(int(c.originRate.until(time.Now()).Seconds())+1))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
@@ -0,0 +1,117 @@
+package picocache_test
+
+import (
+	"fmt"
+	"net/http"
+	picocache "picocache/src"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRequestRate(t *testing.T) {
+	for s, want := range map[string]picocache.RequestRate{
+		"100/s":       {Requests: 100, Per: time.Second},
+		"6000/minute": {Requests: 6000, Per: time.Minute},
+		"5 / 10s":     {Requests: 5, Per: 10 * time.Second},
+	} {
+		if got, err := picocache.ParseRequestRate(s); err != nil || got != want {
+			t.Errorf("%s: expected %+v, got %+v, %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"100", "0/s", "-1/s", "many/s", "100/fortnight", "100/-1s"} {
+		if _, err := picocache.ParseRequestRate(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestOriginRateLimit(t *testing.T) {
+	t.Run("ceiling under a burst", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 1<<20, picocache.WithOriginRateLimit(picocache.RequestRate{Requests: 10, Per: time.Second}, 5*time.Second))
+
+		var wg sync.WaitGroup
+		for i := range 25 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path := fmt.Sprintf("/cold/%d", i)
+				if w := cache.Get(path, nil); w.Code != http.StatusOK || w.Body.String() != path {
+					t.Errorf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+
+		// A bucket of 10 refilling at 10/s: never more than 10 requests,
+		// and 10 more per second since the first
+		arrivals := origin.Arrivals()
+		if len(arrivals) != 25 {
+			t.Fatalf("expected 25 requests to the source, got %d", len(arrivals))
+		}
+		for i, at := range arrivals {
+			if allowed := 10 + 10*at.Sub(arrivals[0]).Seconds(); float64(i+1) > allowed+1 {
+				t.Fatalf("request %d sent %s after the first, over the ceiling", i+1, at.Sub(arrivals[0]))
+			}
+		}
+		if elapsed := arrivals[24].Sub(arrivals[0]); elapsed < 1300*time.Millisecond {
+			t.Fatalf("expected the burst spread over 1.5s, took %s", elapsed)
+		}
+		if s := cache.Stats().OriginRate; s == nil || s.Requests != 10 || s.Waiters != 0 || s.Limited != 0 {
+			t.Fatalf("unexpected rate stats %+v", s)
+		}
+	})
+
+	t.Run("over the wait bound", func(t *testing.T) {
+		rules, err := picocache.ParseRules(".txt ttl=1h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 1<<20, picocache.WithRules(rules...),
+			picocache.WithOriginRateLimit(picocache.RequestRate{Requests: 1, Per: time.Minute}, 10*time.Millisecond))
+
+		cache.Expect("/a.txt", "MISS", "/a.txt")
+		w := cache.Get("/b", nil)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Cache") != "RATE-LIMITED" || w.Header().Get("Retry-After") != "60" {
+			t.Fatalf("expected a 503 until the next request may be sent, got %d %s %s", w.Code, w.Header().Get("X-Cache"), w.Header().Get("Retry-After"))
+		}
+
+		// Expired, it's served stale rather than fetched again
+		cache.Clock.Advance(2 * time.Hour)
+		cache.Expect("/a.txt", "STALE", "/a.txt")
+		if n := origin.Requests("/a.txt") + origin.Requests("/b"); n != 1 {
+			t.Fatalf("expected a single request to the source, got %d", n)
+		}
+		if s := cache.Stats(); s.OriginRate.Limited != 2 || s.Outcomes["rate-limited"] != 1 {
+			t.Fatalf("unexpected rate stats %+v, outcomes %v", s.OriginRate, s.Outcomes)
+		}
+	})
+
+	t.Run("429s", func(t *testing.T) {
+		origin := NewFakeOrigin(t)
+		cache := NewTestCache(t, origin, 1<<20, picocache.WithOriginRateLimit(picocache.RequestRate{Requests: 100, Per: time.Second}, 3*time.Second))
+		origin.Handle("/busy", OriginResponse{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}, Body: "slow down"})
+
+		w := cache.Get("/busy", nil)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Cache") != "RATE-LIMITED" || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("expected a 503 for the 429, got %d %s %s", w.Code, w.Header().Get("X-Cache"), w.Header().Get("Retry-After"))
+		}
+		if s := cache.Stats(); s.OriginThrottled != 1 || s.OriginRate.PausedFor <= 0 {
+			t.Fatalf("expected the bucket paused by the 429, got %d, %+v", s.OriginThrottled, s.OriginRate)
+		}
+
+		// Requests wait for the pause to be over, and the 429 wasn't cached
+		origin.Handle("/busy", OriginResponse{Body: "ok"})
+		start := time.Now()
+		cache.Expect("/busy", "MISS", "ok")
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Fatalf("expected the request held for the Retry-After, sent after %s", elapsed)
+		}
+		cache.Expect("/busy", "HIT", "ok")
+		if n := origin.Requests("/busy"); n != 2 {
+			t.Fatalf("expected the source asked twice, got %d requests", n)
+		}
+	})
+}
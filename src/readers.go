@@ -0,0 +1,60 @@
+package picocache
+
+import (
+	"context"
+	"time"
+)
+
+// WithMaxReadersPerEntry bounds how many clients read an entry at once, so
+// a hot one doesn't starve the disk. Readers over the limit wait up to
+// queue for their turn, and get a 503 if it doesn't come.
+func WithMaxReadersPerEntry(n int, queue time.Duration) Option {
+	return func(c *PicoCache) {
+		c.maxReaders = int64(n)
+		c.readerQueue = queue
+	}
+}
+
+const readerPollInterval = 10 * time.Millisecond
+
+// acquireReader registers a client reading entry, once it is allowed to.
+// The count of readers also tells eviction which entries are in use.
+func (c *PicoCache) acquireReader(ctx context.Context, entry *cacheEntry, t *timings) (release func(), ok bool) {
+	release = func() { entry.readers.Add(-1) }
+	if c.maxReaders <= 0 {
+		entry.readers.Add(1)
+		return release, true
+	}
+
+	deadline := time.Now().Add(c.readerQueue)
+	var end func() time.Duration
+	defer func() {
+		if end != nil {
+			end()
+		}
+	}()
+	for {
+		n := entry.readers.Load()
+		if n < c.maxReaders {
+			if entry.readers.CompareAndSwap(n, n+1) {
+				return release, true
+			}
+			continue
+		}
+		if end == nil {
+			end = c.waits.begin(entry.filename, waitReaders, t)
+		}
+		if !time.Now().Before(deadline) {
+			c.stats.readerRejections.Add(1)
+			return nil, false
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(readerPollInterval):
+		}
+	}
+}
+
+// byReaders orders entries read by the most clients right now first.
+func byReaders(a, b *cacheEntry) bool { return a.readers.Load() < b.readers.Load() }
@@ -0,0 +1,95 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledWriter blocks writing the body until released.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestMaxReadersPerEntry(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	for _, tc := range []struct {
+		name     string
+		queue    time.Duration
+		expected int
+	}{
+		{"reject", 0, http.StatusServiceUnavailable},
+		{"queue", 5 * time.Second, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithMaxReadersPerEntry(2, tc.queue), WithAdminToken("s3cret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hot", nil))
+			entry, _ := cache.entries.Load(cache.getCacheFilename("/hot"))
+
+			release := make(chan struct{})
+			wg := sync.WaitGroup{}
+			for range 2 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := &stalledWriter{httptest.NewRecorder(), release}
+					cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hot", nil))
+				}()
+			}
+			for entry.(*cacheEntry).readers.Load() != 2 {
+				time.Sleep(time.Millisecond)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/__picocache/top?by=readers&n=1", nil)
+			r.Header.Set("Authorization", "Bearer s3cret")
+			cache.ServeHTTP(w, r)
+			top := []TopEntry{}
+			if err := json.NewDecoder(w.Body).Decode(&top); err != nil || len(top) != 1 || top[0].Readers != 2 {
+				t.Fatalf("unexpected top entries %+v (%v)", top, err)
+			}
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+			}()
+			w = httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hot", nil))
+			if w.Code != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, w.Code)
+			}
+			wg.Wait()
+
+			rejections := int64(0)
+			if tc.expected != http.StatusOK {
+				rejections = 1
+				if w.Header().Get("Retry-After") == "" {
+					t.Fatal("missing Retry-After")
+				}
+			}
+			if s := cache.Stats(); s.ReaderRejections != rejections {
+				t.Fatalf("expected %d rejections, got %d", rejections, s.ReaderRejections)
+			}
+			if n := entry.(*cacheEntry).readers.Load(); n != 0 {
+				t.Fatalf("expected no readers left, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package picocache
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const defaultWritableProbeInterval = 30 * time.Second
+
+var errReadOnly = errors.New("cache directory is read-only")
+
+// isReadOnlyErr reports whether err means the cache directory can't be
+// written to anymore.
+func isReadOnlyErr(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
+
+// degrade switches the cache to read-only mode, where hits keep being served
+// but misses get streamed from the source uncached, until a probe write
+// succeeds again.
+func (c *PicoCache) degrade(err error) {
+	if !c.readOnly.CompareAndSwap(false, true) {
+		return
+	}
+	c.log.Error("Cache directory isn't writable, switching to read-only mode", slog.String("err", err.Error()))
+	go c.probeWritable()
+}
+
+func (c *PicoCache) probeWritable() {
+	ticker := time.NewTicker(c.writableProbeInterval)
+	defer ticker.Stop()
+
+	probe := filepath.Join(c.cacheDir, "probe"+tempSuffix)
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		file, err := c.create(probe)
+		if err != nil {
+			continue
+		}
+		file.Close()
+		os.Remove(probe)
+
+		c.readOnly.Store(false)
+		c.log.Info("Cache directory is writable again, leaving read-only mode")
+		return
+	}
+}
@@ -0,0 +1,78 @@
+package picocache
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyDegradation(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failing atomic.Bool
+	cache.writableProbeInterval = 10 * time.Millisecond
+	cache.create = func(name string) (*os.File, error) {
+		if failing.Load() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+		}
+		return os.Create(name)
+	}
+
+	get := func(path, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+			t.Fatalf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+	healthy := func() bool {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/__picocache/health", nil))
+		var h health
+		if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		return !h.ReadOnly
+	}
+
+	get("/cached", "MISS")
+
+	failing.Store(true)
+	get("/new", "BYPASS-READONLY")
+	if healthy() {
+		t.Fatal("health doesn't report the degradation")
+	}
+	get("/cached", "HIT")
+	get("/new", "BYPASS-READONLY")
+
+	failing.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("never recovered from read-only mode")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	get("/new", "MISS")
+	get("/new", "HIT")
+	verifyConsistency(t, cache, cache.cacheDir)
+}
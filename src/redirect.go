@@ -0,0 +1,144 @@
+package picocache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WithLargeObjectRedirect redirects clients to the source for objects over
+// the size cap rather than streaming them through, see Rule.MaxSize and
+// WithMaxContentLength. Sizes are learned with HEAD requests to the source,
+// remembered for sizeTTL. The redirect goes to location when set, a source
+// like template, e.g. a public hostname for the source. Credentials are
+// always stripped off the redirect URL.
+func WithLargeObjectRedirect(location string, sizeTTL time.Duration) Option {
+	return func(c *PicoCache) {
+		c.redirect = &largeObjectRedirect{
+			location: location,
+			sizeTTL:  sizeTTL,
+			sizes:    map[string]knownSize{},
+		}
+	}
+}
+
+type largeObjectRedirect struct {
+	location         string
+	locationTemplate bool
+	sizeTTL          time.Duration
+
+	mu    sync.Mutex
+	sizes map[string]knownSize // by cache file
+}
+
+// knownSize is what a size probe learned of an object.
+type knownSize struct {
+	large   bool
+	expires time.Time
+}
+
+// maxKnownSizes is how many sizes get remembered before expired ones are
+// swept.
+const maxKnownSizes = 4096
+
+func (l *largeObjectRedirect) learn(cacheFile string, large bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.sizes) >= maxKnownSizes {
+		for file, size := range l.sizes {
+			if !now.Before(size.expires) {
+				delete(l.sizes, file)
+			}
+		}
+	}
+	l.sizes[cacheFile] = knownSize{large: large, expires: now.Add(l.sizeTTL)}
+}
+
+func (l *largeObjectRedirect) known(cacheFile string, now time.Time) (large bool, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size, ok := l.sizes[cacheFile]
+	if !ok || !now.Before(size.expires) {
+		return false, false
+	}
+	return size.large, true
+}
+
+// sizeCap returns the size over which objects aren't cached under rule.
+func (c *PicoCache) sizeCap(rule *Rule) int64 {
+	if rule != nil && rule.MaxSize > 0 {
+		return min(rule.MaxSize, c.maxContentLength)
+	}
+	return c.maxContentLength
+}
+
+// oversized tells whether the object of key is known to be over the size
+// cap, asking the source with a HEAD request if it isn't known yet. Objects
+// of unknown size aren't.
+func (c *PicoCache) oversized(ctx context.Context, key, cacheFile string, rule *Rule, t *timings) bool {
+	now := c.now()
+	if large, ok := c.redirect.known(cacheFile, now); ok {
+		return large
+	}
+	if size, ok := c.knownSize(cacheFile); ok {
+		return size > c.sizeCap(rule)
+	}
+
+	source := c.originURL(key)
+	req, err := c.newOriginRequest(ctx, source)
+	if err != nil {
+		return false
+	}
+	req.Method = http.MethodHead
+	t.askLanguage(req)
+	fetch := c.startOriginFetch(source, "size", false)
+	fetch.startSpan(t, req)
+	resp, err := c.originDo(req)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return false
+	}
+	resp.Body.Close()
+	fetch.done(resp.StatusCode, 0, nil)
+
+	large := resp.StatusCode == http.StatusOK && resp.ContentLength > c.sizeCap(rule)
+	t.trace("source reports %d bytes", resp.ContentLength)
+	c.redirect.learn(cacheFile, large, now)
+	return large
+}
+
+// redirectLarge sends the client to the source for the object of key, over
+// the size cap.
+func (c *PicoCache) redirectLarge(w http.ResponseWriter, key string, log *slog.Logger, t *timings) {
+	location, err := c.redirectLocation(key)
+	if err != nil {
+		log.Error("Failed to build redirect", slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t.outcome = OutcomeBypassRedirect
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+}
+
+// redirectLocation returns where clients get sent for the object of key,
+// without credentials.
+func (c *PicoCache) redirectLocation(key string) (string, error) {
+	location := c.originURL(key)
+	if c.redirect.location != "" {
+		location = expand(c.redirect.location, c.redirect.locationTemplate, key)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	u.User = nil
+	return u.String(), nil
+}
@@ -0,0 +1,99 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLargeObjectRedirect(t *testing.T) {
+	mu := sync.Mutex{}
+	requests := map[string]int{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		size := 5
+		if strings.HasPrefix(r.URL.Path, "/big") {
+			size = 100
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Write(bytes.Repeat([]byte("A"), size))
+	}))
+	defer origin.Close()
+	count := func(request string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[request]
+	}
+
+	source := strings.Replace(origin.URL, "http://", "http://user:s3cret@", 1)
+	rules := WithRules(Rule{Prefix: "/", MaxSize: 10})
+	get := func(cache *PicoCache, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	now := time.Now()
+	cache, err := NewCache(slog.Default(), source, t.TempDir(), 1<<20, rules, WithLargeObjectRedirect("", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.now = func() time.Time { return now }
+
+	for range 2 {
+		w := get(cache, "/big.bin")
+		if w.Code != http.StatusFound || w.Header().Get("Location") != origin.URL+"/big.bin" || w.Body.Len() != 0 {
+			t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+		}
+	}
+	if count("HEAD /big.bin") != 1 || count("GET /big.bin") != 0 {
+		t.Fatalf("expected a single size probe, got %v", requests)
+	}
+
+	for _, cacheStatus := range []string{"MISS", "HIT"} {
+		if w := get(cache, "/small.bin"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != cacheStatus {
+			t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+		}
+	}
+	if count("HEAD /small.bin") != 1 || count("GET /small.bin") != 1 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+
+	// Sizes are probed again once forgotten
+	now = now.Add(time.Minute)
+	get(cache, "/big.bin")
+	if count("HEAD /big.bin") != 2 {
+		t.Fatalf("expected the size to be probed again, got %v", requests)
+	}
+
+	// Redirecting elsewhere
+	cache, err = NewCache(slog.Default(), source, t.TempDir(), 1<<20, rules,
+		WithLargeObjectRedirect("https://admin:pw@cdn.example.com/files{path}", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := get(cache, "/big.bin?v=2"); w.Header().Get("Location") != "https://cdn.example.com/files/big.bin" {
+		t.Fatalf("unexpected location %q", w.Header().Get("Location"))
+	}
+
+	// Proxying by default, without probing sizes
+	cache, err = NewCache(slog.Default(), source, t.TempDir(), 1<<20, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := get(cache, "/big2.bin"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS-SIZE" || w.Body.Len() != 100 {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	if count("HEAD /big2.bin") != 0 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
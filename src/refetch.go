@@ -0,0 +1,142 @@
+package picocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// refetch is a Refresh in progress, shared by those of an entry.
+type refetch struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+// Refresh fetches the object at path, which may carry a query string, from
+// the source again and puts it in place of its entry, of the default
+// language for those varying by it. The entry held keeps being served
+// meanwhile, and is left as it is if the fill fails, whose error is
+// returned. Refreshes of the same entry at the same time share one fill,
+// which isn't abandoned when ctx is done.
+func (c *PicoCache) Refresh(ctx context.Context, path string) (EntryInfo, error) {
+	entry, cacheFile, path, err := c.refresh(ctx, path)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return *c.entryInfo(entry, cacheFile, path, OutcomeMiss), nil
+}
+
+func (c *PicoCache) refresh(ctx context.Context, path string) (entry *cacheEntry, cacheFile, rulePath string, err error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if climbs(u.Path) {
+		return nil, "", "", fmt.Errorf("path %q goes above the root", u.Path)
+	}
+	path, key := c.requestKey(u)
+	if _, ok := c.released(key); !ok {
+		return nil, "", "", errNotReleased
+	}
+	if c.frozen.Load() {
+		return nil, "", "", errFrozen
+	}
+	if c.offline {
+		return nil, "", "", errOffline
+	}
+	rule := c.matchRule(path)
+	t := &timings{start: c.now()}
+	cacheFile = c.getCacheFilename(key)
+	if t.language = c.language("", rule); t.language != "" {
+		cacheFile = c.getCacheFilename(languageKey(key, t.language))
+	}
+
+	r := &refetch{done: make(chan struct{})}
+	if running, ok := c.refetches.LoadOrStore(cacheFile, r); ok {
+		r = running.(*refetch)
+	} else {
+		go func() {
+			defer close(r.done)
+			defer c.refetches.Delete(cacheFile)
+			r.entry, r.err = c.refill(key, cacheFile, rule, t)
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		return nil, "", "", ctx.Err()
+	case <-r.done:
+		return r.entry, cacheFile, path, r.err
+	}
+}
+
+// refill fills cacheFile anew, in place of the entry held if any.
+func (c *PicoCache) refill(key, cacheFile string, rule *Rule, t *timings) (*cacheEntry, error) {
+	// A fill already running may have started before the source changed,
+	// and would hand its result, or the entry held, over to this one
+	for {
+		if _, filling := c.downloading.Load(cacheFile); !filling {
+			break
+		}
+		select {
+		case <-c.closed:
+			return nil, errAbandoned
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	entry, err := c.downloadFile(context.Background(), c.originURL(key), cacheFile, key, rule, t)
+	if err != nil {
+		c.log.Warn("Failed to refresh entry", slog.String("url", key), slog.String("err", err.Error()))
+		return nil, err
+	}
+	if entry.condemned != nil {
+		entry.condemned.release()
+	}
+	c.stats.refreshed.Add(1)
+	return entry, nil
+}
+
+// serveRefresh handles POST requests of trusted clients to fetch the path
+// query parameter from the source again, describing the entry filled.
+func (c *PicoCache) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(path); err != nil || climbs(u.Path) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	entry, _, _, err := c.refresh(r.Context(), path)
+	switch {
+	case errors.Is(err, errNotReleased):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errFrozen), errors.Is(err, errReadOnly), errors.Is(err, errOffline):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil && r.Context().Err() != nil:
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.details(entry))
+}
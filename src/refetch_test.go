@@ -0,0 +1,122 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefresh(t *testing.T) {
+	var mu sync.Mutex
+	body, status := "v1", http.StatusOK
+	var gate chan struct{}
+	var fetches atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		mu.Lock()
+		g, b, s := gate, body, status
+		mu.Unlock()
+		if g != nil {
+			<-g
+		}
+		w.WriteHeader(s)
+		w.Write([]byte(b))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	get := func(cacheStatus, want string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != cacheStatus || w.Body.String() != want {
+			t.Fatalf("expected %s %q, got %d %s %q", cacheStatus, want, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	get("MISS", "v1")
+
+	// A slow refresh, asked for twice
+	mu.Lock()
+	body, gate = "v2!", make(chan struct{})
+	release := gate
+	mu.Unlock()
+	before := fetches.Load()
+	results := make(chan EntryInfo, 2)
+	for range 2 {
+		go func() {
+			info, err := cache.Refresh(t.Context(), "/a")
+			if err != nil {
+				t.Error(err)
+			}
+			results <- info
+		}()
+	}
+	waitFor(t, func() bool { return fetches.Load() == before+1 })
+	time.Sleep(50 * time.Millisecond)
+	get("HIT", "v1")
+	get("HIT", "v1")
+
+	mu.Lock()
+	gate = nil
+	mu.Unlock()
+	close(release)
+	for range 2 {
+		if info := <-results; info.Size != 3 || info.Cache != OutcomeMiss {
+			t.Fatalf("unexpected entry %+v", info)
+		}
+	}
+	if n := fetches.Load() - before; n != 1 {
+		t.Fatalf("expected concurrent refreshes to share a fill, the source got %d requests", n)
+	}
+	get("HIT", "v2!")
+
+	// The source fails, the entry stays
+	mu.Lock()
+	body, status = "oops", http.StatusInternalServerError
+	mu.Unlock()
+	if _, err := cache.Refresh(t.Context(), "/a"); err == nil {
+		t.Fatal("expected the failed refresh reported")
+	}
+	get("HIT", "v2!")
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/__picocache/refresh?path=/a", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+	if w := refresh(""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted refreshes refused, got %d", w.Code)
+	}
+	if w := refresh("s3cret"); w.Code != http.StatusBadGateway {
+		t.Fatalf("expected the source failure reported, got %d %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	body, status = "v3", http.StatusOK
+	mu.Unlock()
+	w := refresh("s3cret")
+	var details EntryDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); w.Code != http.StatusOK || err != nil || details.Size != 2 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	get("HIT", "v3")
+	if s := cache.Stats(); s.Refreshed != 2 {
+		t.Fatalf("expected 2 refreshes counted, got %d", s.Refreshed)
+	}
+
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,183 @@
+package picocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const defaultMetadataRefreshRate = 10
+
+var errRefreshing = errors.New("a metadata refresh is already running")
+
+// WithSourceContentType serves entries with the Content-Type of their source
+// response, stored with them, rather than the one the extension of their
+// path tells. Those filled without one, or before, still get the latter.
+func WithSourceContentType() Option {
+	return func(c *PicoCache) {
+		c.sourceContentType = true
+	}
+}
+
+// WithMetadataRefreshRate caps the HEAD requests RefreshMetadata sends to
+// the source to perSecond, 10 by default.
+func WithMetadataRefreshRate(perSecond float64) Option {
+	return func(c *PicoCache) {
+		if perSecond > 0 {
+			c.metadataRefreshRate = perSecond
+		}
+	}
+}
+
+// entryContentType returns the Content-Type entry, filled for path, is
+// served with.
+func (c *PicoCache) entryContentType(entry *cacheEntry, path string) string {
+	if c.sourceContentType && entry.contentType != "" {
+		return entry.contentType
+	}
+	return c.contentType(path)
+}
+
+// RefreshMetadata asks the source for the headers of every entry under
+// prefix, escaped like request paths, with a HEAD request, updating their
+// Content-Type, Content-Language and validators without fetching their body
+// again. Entries whose validators or status changed get purged instead, to
+// be filled anew. It returns how many entries there are, refreshed in the
+// background at the rate of WithMetadataRefreshRate, one sweep at a time.
+func (c *PicoCache) RefreshMetadata(prefix string) (int, error) {
+	_, entries, err := c.prefixEntries(prefix)
+	if err != nil {
+		return 0, err
+	}
+	if c.frozen.Load() {
+		return 0, errFrozen
+	}
+	if c.offline {
+		return 0, errOffline
+	}
+	if !c.refreshing.CompareAndSwap(false, true) {
+		return 0, errRefreshing
+	}
+	go c.refreshEntries(prefix, entries)
+	return len(entries), nil
+}
+
+func (c *PicoCache) refreshEntries(prefix string, entries []*cacheEntry) {
+	defer c.refreshing.Store(false)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.metadataRefreshRate))
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	refreshed, purged, failed := 0, 0, 0
+	for i, entry := range entries {
+		if i > 0 {
+			select {
+			case <-c.closed:
+				return
+			case <-ticker.C:
+			}
+		}
+		changed, err := c.refreshEntry(ctx, entry)
+		switch {
+		case err != nil:
+			failed++
+			c.log.Warn("Failed to refresh entry metadata", slog.String("url", entry.path), slog.String("err", err.Error()))
+		case changed:
+			purged++
+		default:
+			refreshed++
+		}
+	}
+	c.log.Info("Refreshed entry metadata", slog.String("prefix", prefix), slog.Int("refreshed", refreshed),
+		slog.Int("purged", purged), slog.Int("failed", failed))
+}
+
+// refreshEntry updates the metadata of entry from a HEAD request to the
+// source, reporting whether it changed there and got purged instead.
+func (c *PicoCache) refreshEntry(ctx context.Context, entry *cacheEntry) (changed bool, err error) {
+	source := c.originURL(entry.path)
+	req, err := c.newOriginRequest(ctx, source)
+	if err != nil {
+		return false, err
+	}
+	req.Method = http.MethodHead
+	for _, l := range c.languages {
+		if filepath.Base(entry.filename) == KeyForPath(languageKey(entry.path, l)) {
+			req.Header.Set("Accept-Language", l)
+		}
+	}
+	fetch := c.startOriginFetch(source, "metadata refresh", false)
+	resp, err := c.originDo(req)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return false, err
+	}
+	resp.Body.Close()
+	fetch.done(resp.StatusCode, 0, nil)
+
+	differs := func(stored, got string) bool { return stored != "" && got != "" && stored != got }
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return false, fmt.Errorf("source returned %d", resp.StatusCode)
+	case resp.StatusCode != entry.statusCode(), differs(entry.etag, resp.Header.Get("ETag")),
+		differs(entry.lastModified, resp.Header.Get("Last-Modified")):
+		c.purge(entry.filename, entry)
+		return true, nil
+	}
+	if c.amend(entry, entry.expires, entry.adaptive, resp.Header) != nil {
+		c.stats.metadataRefreshed.Add(1)
+	}
+	return false, nil
+}
+
+type refreshResult struct {
+	Prefix  string `json:"prefix"`
+	Entries int    `json:"entries"` // being refreshed in the background
+}
+
+// serveRefreshMetadata handles POST requests of trusted clients to refresh
+// the metadata of the entries under the prefix query parameter.
+func (c *PicoCache) serveRefreshMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "missing prefix", http.StatusBadRequest)
+		return
+	}
+
+	n, err := c.RefreshMetadata(prefix)
+	switch {
+	case errors.Is(err, errNoPathIndex):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, errFrozen), errors.Is(err, errRefreshing), errors.Is(err, errOffline):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(refreshResult{Prefix: prefix, Entries: n})
+}
@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRefreshMetadata(t *testing.T) {
+	var mu sync.Mutex
+	contentType, version := "image/jpeg", "1"
+	fetched := map[string]int{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet {
+			fetched[r.URL.Path]++
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Last-Modified", "Mon, 05 Oct 2026 10:00:00 GMT")
+		switch r.URL.Path {
+		case "/images/b.jpg":
+			w.Header().Set("ETag", `"b`+version+`"`)
+			w.Write([]byte("b" + version))
+		default:
+			w.Header().Set("ETag", `"a"`)
+			w.Write([]byte("a"))
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	open := func() *PicoCache {
+		cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithPrefixPurge(), WithAdminToken("s3cret"),
+			WithSourceContentType(), WithMetadataRefreshRate(1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	get := func(cache *PicoCache, path, cacheStatus, contentType, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Header().Get("X-Cache") != cacheStatus || w.Header().Get("Content-Type") != contentType || w.Body.String() != body {
+			t.Fatalf("%s: expected %s %s %q, got %s %s %q", path, cacheStatus, contentType, body,
+				w.Header().Get("X-Cache"), w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+	refresh := func(cache *PicoCache, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/__picocache/refresh-metadata?prefix=/images/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	cache := open()
+	get(cache, "/images/a.jpg", "MISS", "image/jpeg", "a")
+	get(cache, "/images/b.jpg", "MISS", "image/jpeg", "b1")
+	get(cache, "/other/c.jpg", "MISS", "image/jpeg", "a")
+
+	// The origin migrated its images in place
+	mu.Lock()
+	contentType, version = "image/webp", "2"
+	mu.Unlock()
+	get(cache, "/images/a.jpg", "HIT", "image/jpeg", "a")
+
+	if w := refresh(cache, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted refreshes refused, got %d", w.Code)
+	}
+	w := refresh(cache, "s3cret")
+	var result refreshResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusAccepted || err != nil || result.Entries != 2 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	waitFor(t, func() bool { return !cache.refreshing.Load() })
+
+	// Unchanged bodies are kept, changed ones fetched again
+	get(cache, "/images/a.jpg", "HIT", "image/webp", "a")
+	get(cache, "/images/b.jpg", "MISS", "image/webp", "b2")
+	get(cache, "/other/c.jpg", "HIT", "image/jpeg", "a")
+	mu.Lock()
+	for path, n := range map[string]int{"/images/a.jpg": 1, "/images/b.jpg": 2, "/other/c.jpg": 1} {
+		if fetched[path] != n {
+			t.Errorf("%s: expected %d fetches, got %d", path, n, fetched[path])
+		}
+	}
+	mu.Unlock()
+	if s := cache.Stats(); s.MetadataRefreshed != 1 {
+		t.Errorf("expected an entry refreshed, got %d", s.MetadataRefreshed)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// Refreshed metadata survives restarts
+	cache = open()
+	defer cache.Close()
+	get(cache, "/images/a.jpg", "HIT", "image/webp", "a")
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,168 @@
+package picocache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNotReleased       = errors.New("path not listed in the release manifest")
+	errReleaseMismatch   = errors.New("source body differs from the release manifest")
+	errNoReleaseManifest = errors.New("no release manifest")
+)
+
+// WithReleaseManifest only serves the request paths listed in the file at
+// path, answering 404 to the others without asking the source, to expose a
+// part of it only. Each line holds one, escaped as in requests and without
+// query string, optionally followed by the expected size of its body in
+// bytes and its SHA-256 checksum as sha256:<hex>. Fills of paths with either
+// listed are checked against them before being cached. Empty lines and
+// those starting with # are skipped. The file is read anew by
+// ReloadReleaseManifest.
+func WithReleaseManifest(path string) Option {
+	return func(c *PicoCache) {
+		c.releaseManifest = path
+	}
+}
+
+// releaseEntry is what the release manifest lists about a path.
+type releaseEntry struct {
+	size   int64  // -1 unless listed
+	sha256 []byte // nil unless listed
+}
+
+// parseReleaseManifest returns the entries listed in data, by the request
+// key path of the paths listed.
+func (c *PicoCache) parseReleaseManifest(data string) (map[string]releaseEntry, error) {
+	entries := make(map[string]releaseEntry)
+	for i, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil || !strings.HasPrefix(u.Path, "/") || u.RawQuery != "" || climbs(u.Path) {
+			return nil, fmt.Errorf("line %d: invalid path %q", i+1, fields[0])
+		}
+		entry := releaseEntry{size: -1}
+		for _, field := range fields[1:] {
+			if sum, ok := strings.CutPrefix(field, "sha256:"); ok {
+				entry.sha256, err = hex.DecodeString(sum)
+				if err != nil || len(entry.sha256) != sha256.Size {
+					return nil, fmt.Errorf("line %d: invalid checksum %q", i+1, field)
+				}
+				continue
+			}
+			entry.size, err = strconv.ParseInt(field, 10, 64)
+			if err != nil || entry.size < 0 {
+				return nil, fmt.Errorf("line %d: expected a size or sha256:<hex>, got %q", i+1, field)
+			}
+		}
+		entries[keyPath(u, c.normalizePaths, c.lowercasePaths)] = entry
+	}
+	return entries, nil
+}
+
+// ReloadReleaseManifest reads the release manifest again, returning how
+// many paths it lists. The one in use is kept if it can't be read. Fills in
+// progress are checked against the one they started with.
+func (c *PicoCache) ReloadReleaseManifest() (int, error) {
+	if c.releaseManifest == "" {
+		return 0, errNoReleaseManifest
+	}
+	data, err := os.ReadFile(c.releaseManifest)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := c.parseReleaseManifest(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", c.releaseManifest, err)
+	}
+	c.release.Store(&entries)
+	return len(entries), nil
+}
+
+// released returns what the release manifest lists about the request key,
+// reporting whether it lists it, as it does every key without one.
+func (c *PicoCache) released(key string) (releaseEntry, bool) {
+	entries := c.release.Load()
+	if entries == nil {
+		return releaseEntry{size: -1}, true
+	}
+	path, _, _ := strings.Cut(key, "?")
+	entry, ok := (*entries)[path]
+	return entry, ok
+}
+
+// checkRelease reports whether the body filled in file, gzipped or not,
+// matches the size and checksum listed in entry.
+func checkRelease(entry releaseEntry, file string, gzipped bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var body io.Reader = f
+	if gzipped {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		body = zr
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, body)
+	switch {
+	case err != nil:
+		return err
+	case entry.size >= 0 && n != entry.size:
+		return fmt.Errorf("%w: %d bytes, expected %d", errReleaseMismatch, n, entry.size)
+	case entry.sha256 != nil && !bytes.Equal(hash.Sum(nil), entry.sha256):
+		return fmt.Errorf("%w: checksum sha256:%x, expected sha256:%x", errReleaseMismatch, hash.Sum(nil), entry.sha256)
+	}
+	return nil
+}
+
+type releaseResult struct {
+	Paths int `json:"paths"`
+}
+
+// serveReloadManifest handles POST requests of trusted clients to read the
+// release manifest again.
+func (c *PicoCache) serveReloadManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	n, err := c.ReloadReleaseManifest()
+	switch {
+	case errors.Is(err, errNoReleaseManifest):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		c.log.Warn("Failed to reload the release manifest", slog.String("err", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	c.log.Info("Reloaded the release manifest", slog.Int("paths", n))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(releaseResult{Paths: n})
+}
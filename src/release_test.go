@@ -0,0 +1,105 @@
+package picocache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReleaseManifest(t *testing.T) {
+	var requests atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	sum := func(s string) string { return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s))) }
+	write := func(content string) {
+		if err := os.WriteFile(manifest, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# release 1\n/app.tar.gz " + sum("body of /app.tar.gz") + "\n" +
+		"/notes.txt 18\n" +
+		"/corrupt.bin 19 " + sum("something else") + "\n")
+
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithAdminToken("s3cret"),
+		WithReleaseManifest(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	get := func(path string, code int, cacheStatus string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || cacheStatus != "" && w.Header().Get("X-Cache") != cacheStatus {
+			t.Fatalf("%s: expected %d %q, got %d %q", path, code, cacheStatus, w.Code, w.Header().Get("X-Cache"))
+		}
+		if source, _, _ := strings.Cut(path, "?"); code == http.StatusOK && w.Body.String() != "body of "+source {
+			t.Fatalf("%s: unexpected body %q", path, w.Body.String())
+		}
+	}
+	reload := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/__picocache/reload-manifest", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	get("/app.tar.gz", http.StatusOK, "MISS")
+	get("/app.tar.gz", http.StatusOK, "HIT")
+	get("/notes.txt", http.StatusOK, "MISS")
+	get("/app.tar.gz?v=2", http.StatusOK, "HIT")
+
+	before := requests.Load()
+	get("/secret.txt", http.StatusNotFound, "")
+	if requests.Load() != before {
+		t.Fatal("expected paths not listed to be denied without asking the source")
+	}
+	if _, _, err := cache.Get(t.Context(), "/secret.txt"); err != errNotReleased {
+		t.Fatalf("expected Get to deny paths not listed, got %v", err)
+	}
+
+	get("/corrupt.bin", http.StatusBadGateway, "")
+	if e, ok := cache.entries.Load(cache.getCacheFilename("/corrupt.bin")); ok {
+		t.Fatalf("expected a body differing from the manifest not cached, got %+v", e)
+	}
+	if s := cache.Stats(); s.ReleaseDenied != 2 || s.ReleaseMismatches != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// A new release is published
+	write("/app.tar.gz\n/notes.txt\n/corrupt.bin\n/secret.txt\n")
+	if w := reload(""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted reloads refused, got %d", w.Code)
+	}
+	if w := reload("s3cret"); w.Code != http.StatusOK || w.Body.String() != "{\"paths\":4}\n" {
+		t.Fatalf("unexpected reload response %d %s", w.Code, w.Body.String())
+	}
+	get("/secret.txt", http.StatusOK, "MISS")
+	get("/corrupt.bin", http.StatusOK, "MISS")
+
+	// A broken one keeps the previous list
+	write("/app.tar.gz size\n")
+	if w := reload("s3cret"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected an invalid manifest refused, got %d %s", w.Code, w.Body.String())
+	}
+	get("/secret.txt", http.StatusOK, "HIT")
+
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,121 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// defaultShrinkRate is how fast a shrunk cache gets evicted, see Resize.
+const defaultShrinkRate = 1 << 30 // bytes per second
+
+// WithShrinkRate sets how many bytes per second get evicted at most after
+// the cache got shrunk below its usage.
+func WithShrinkRate(bytesPerSecond int64) Option {
+	return func(c *PicoCache) {
+		c.shrinkRate = bytesPerSecond
+	}
+}
+
+// shrink is a cache being shrunk below its usage, from used bytes at start.
+type shrink struct {
+	used  int64
+	start time.Time
+}
+
+// evictionLimit returns the size eviction brings the cache down to. While
+// shrinking, it goes down from the usage at the time to the new maximum
+// size at the shrink rate.
+func (c *PicoCache) evictionLimit() int64 {
+	maxSize := c.maxCacheSize.Load()
+	s := c.shrinking.Load()
+	if s == nil {
+		return maxSize
+	}
+
+	limit := s.used - int64(c.now().Sub(s.start).Seconds()*float64(c.shrinkRate))
+	if limit <= maxSize {
+		c.shrinking.CompareAndSwap(s, nil)
+		return maxSize
+	}
+	return limit
+}
+
+// Resize changes the maximum size of the cache. Growing is immediate, while
+// shrinking below the space used evicts entries over time, see
+// WithShrinkRate.
+func (c *PicoCache) Resize(maxSize int64) error {
+	if maxSize <= 0 {
+		return errors.New("cache size must be positive")
+	}
+	if pinned := c.pinnedSize(); maxSize < pinned {
+		return fmt.Errorf("cache size %d smaller than the %d bytes pinned", maxSize, pinned)
+	}
+
+	previous := c.maxCacheSize.Swap(maxSize)
+	if used := c.totalSize.Load(); maxSize < used {
+		c.shrinking.Store(&shrink{used: used, start: c.now()})
+		if c.shrinkRunning.CompareAndSwap(false, true) {
+			go c.shrinkPeriodically()
+		}
+	} else {
+		c.shrinking.Store(nil)
+	}
+
+	c.log.Info("Cache resized", slog.Int64("from", previous), slog.Int64("to", maxSize))
+	return nil
+}
+
+func (c *PicoCache) pinnedSize() int64 {
+	size := int64(0)
+	c.pinned.Range(func(key, value any) bool {
+		if e, ok := c.entries.Load(key); ok {
+			size += e.(*cacheEntry).diskSize
+		}
+		return true
+	})
+	return size
+}
+
+// shrinkPeriodically evicts every second until done shrinking.
+func (c *PicoCache) shrinkPeriodically() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer c.shrinkRunning.Store(false)
+
+	for c.shrinking.Load() != nil {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.cleanupOldEntries()
+		}
+	}
+}
+
+// serveResize resizes the cache to the size query parameter, for trusted
+// requests only.
+func (c *PicoCache) serveResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	size, err := units.FromHumanSize(r.URL.Query().Get("size"))
+	if err == nil {
+		err = c.Resize(size)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResize(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 2000,
+		WithBlockSize(1), WithShrinkRate(200), WithAdminToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for i := range 10 {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil))
+	}
+
+	pinned := cache.getCacheFilename("/0")
+	cache.pinned.Store(pinned, true)
+	for _, size := range []int64{0, -1, 50} {
+		if err := cache.Resize(size); err == nil {
+			t.Errorf("%d: expected an error", size)
+		}
+	}
+
+	start := time.Now()
+	now := start
+	cache.now = func() time.Time { return now }
+	if err := cache.Resize(400); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries get evicted at the shrink rate rather than all at once
+	for _, step := range []struct {
+		elapsed     time.Duration
+		size, limit int64
+	}{
+		{time.Second, 800, 800},
+		{2 * time.Second, 600, 600},
+		{3 * time.Second, 400, 0},
+	} {
+		now = start.Add(step.elapsed)
+		cache.cleanupOldEntries()
+		if s := cache.Stats(); s.TotalSize != step.size || s.ShrinkLimit != step.limit || s.MaxSize != 400 {
+			t.Fatalf("after %s: expected %d bytes down to %d, got %+v", step.elapsed, step.size, step.limit, s)
+		}
+	}
+	if _, ok := cache.entries.Load(pinned); !ok {
+		t.Fatal("pinned entry got evicted")
+	}
+
+	// Growing is immediate, through the admin endpoint too
+	r := httptest.NewRequest(http.MethodPost, "/__picocache/resize?size=3kB", nil)
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("untrusted resize: expected 403, got %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	cache.ServeHTTP(w, r)
+	if s := cache.Stats(); w.Code != http.StatusNoContent || s.MaxSize != 3000 || s.ShrinkLimit != 0 {
+		t.Fatalf("unexpected resize %d %+v", w.Code, s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,177 @@
+package picocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	resumeDir        = "resume"
+	defaultResumeTTL = time.Hour
+)
+
+// WithResumableFills keeps what arrived of the body of fills failing
+// partway for ttl, 1 hour if zero, under the resume directory of the cache
+// directory. The next fill of the entry only asks the source for the rest,
+// with a range request carrying If-Range, and starts over when the source
+// changed or sends it all anyway. Only bodies of a known length, from
+// sources telling Accept-Ranges: bytes and sending a strong ETag or a
+// Last-Modified header, can be resumed, and none when deduplicating.
+func WithResumableFills(ttl time.Duration) Option {
+	return func(c *PicoCache) {
+		c.resumeTTL = ttl
+		if ttl <= 0 {
+			c.resumeTTL = defaultResumeTTL
+		}
+	}
+}
+
+// resumeRecord describes a partial body kept to be resumed, stored next
+// to it.
+type resumeRecord struct {
+	URL          string `json:"url"`
+	Written      int64  `json:"written"` // bytes of the body kept
+	Length       int64  `json:"length"`  // of the whole body
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Saved        int64  `json:"saved"` // unix time
+}
+
+// validator returns what the source response of r can be told apart from
+// another with, for If-Range.
+func (r *resumeRecord) validator() string {
+	if r.ETag != "" && !strings.HasPrefix(r.ETag, "W/") {
+		return r.ETag
+	}
+	return r.LastModified
+}
+
+// ask makes req ask for the rest of the body of r, unless it changed.
+func (r *resumeRecord) ask(req *http.Request) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.Written))
+	req.Header.Set("If-Range", r.validator())
+}
+
+// continuedBy reports whether resp sends exactly the rest of the body of r.
+func (r *resumeRecord) continuedBy(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return false
+	}
+	return start == r.Written && end == r.Length-1 && total == r.Length &&
+		(resp.ContentLength < 0 || resp.ContentLength == r.Length-r.Written)
+}
+
+// partialFile returns where the partial body of cacheFile is kept.
+func (c *PicoCache) partialFile(cacheFile string) string {
+	return filepath.Join(c.fileDir(cacheFile), resumeDir, filepath.Base(cacheFile))
+}
+
+// loadResume returns the record of the partial body of cacheFile filled
+// from url, if there is one to resume, dropping it if it can't be.
+func (c *PicoCache) loadResume(cacheFile, url string) *resumeRecord {
+	if c.resumeTTL <= 0 {
+		return nil
+	}
+	partial := c.partialFile(cacheFile)
+	b, err := os.ReadFile(partial + metaSuffix)
+	if err != nil {
+		return nil
+	}
+
+	var r resumeRecord
+	info, statErr := os.Stat(partial)
+	if err := json.Unmarshal(b, &r); err != nil || statErr != nil || r.URL != url || c.dedup ||
+		c.now().Sub(time.Unix(r.Saved, 0)) > c.resumeTTL || r.Written <= 0 || r.Written >= r.Length || info.Size() < r.Written {
+		c.dropPartial(cacheFile)
+		return nil
+	}
+	if info.Size() > r.Written {
+		// Written past the record before the process died
+		if err := os.Truncate(partial, r.Written); err != nil {
+			c.dropPartial(cacheFile)
+			return nil
+		}
+	}
+	return &r
+}
+
+// keepPartial keeps file, holding the first bytes of the body of resp for
+// url, length bytes long once whole, to be resumed. When resuming, file is
+// the partial body already and only its record gets updated. It reports
+// whether it did, file being left as it is otherwise.
+func (c *PicoCache) keepPartial(cacheFile, file, url string, resp *http.Response, resume *resumeRecord, length int64) bool {
+	if c.resumeTTL <= 0 || c.dedup {
+		return false
+	}
+	r := resume
+	if r == nil {
+		r = &resumeRecord{URL: url, Length: length, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+		if length <= 0 || resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || r.validator() == "" {
+			return false
+		}
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Size() == 0 || info.Size() >= length {
+		return false
+	}
+
+	partial := c.partialFile(cacheFile)
+	if file != partial {
+		if os.MkdirAll(filepath.Dir(partial), 0755) != nil || os.Rename(file, partial) != nil {
+			return false
+		}
+	}
+	r.Written, r.Saved = info.Size(), c.now().Unix()
+	b, err := json.Marshal(r)
+	if err == nil {
+		err = os.WriteFile(partial+metaSuffix, b, 0644)
+	}
+	if err != nil {
+		c.dropPartial(cacheFile)
+		return false
+	}
+	return true
+}
+
+// dropPartial removes the partial body of cacheFile and its record.
+func (c *PicoCache) dropPartial(cacheFile string) {
+	partial := c.partialFile(cacheFile)
+	os.Remove(partial)
+	os.Remove(partial + metaSuffix)
+}
+
+// collectPartials removes the partial bodies kept for longer than the
+// resume TTL, until the cache is closed.
+func (c *PicoCache) collectPartials() {
+	ticker := time.NewTicker(c.resumeTTL / 2)
+	defer ticker.Stop()
+	for {
+		for _, d := range c.dirs {
+			files, _ := os.ReadDir(filepath.Join(d.Path, resumeDir))
+			for _, f := range files {
+				cacheFile := filepath.Join(d.Path, strings.TrimSuffix(f.Name(), metaSuffix))
+				if _, filling := c.downloading.Load(cacheFile); filling {
+					continue
+				}
+				if info, err := f.Info(); err == nil && c.now().Sub(info.ModTime()) > c.resumeTTL {
+					c.dropPartial(cacheFile)
+				}
+			}
+		}
+
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
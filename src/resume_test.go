@@ -0,0 +1,144 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResumableFills(t *testing.T) {
+	type object struct {
+		body []byte
+		etag string
+		cuts []int // bytes sent by the next responses before dropping the connection
+	}
+	var mu sync.Mutex
+	objects := map[string]*object{}
+	asked := map[string][]string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		o := objects[r.URL.Path]
+		asked[r.URL.Path] = append(asked[r.URL.Path], r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		cut := -1
+		if len(o.cuts) > 0 {
+			cut, o.cuts = o.cuts[0], o.cuts[1:]
+		}
+		body, etag := o.body, o.etag
+		mu.Unlock()
+
+		w.Header().Set("ETag", etag)
+		if cut < 0 {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		start := 0
+		if rang := r.Header.Get("Range"); rang != "" && r.Header.Get("If-Range") == etag {
+			fmt.Sscanf(rang, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.Write(body[start : start+cut])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer origin.Close()
+	serve := func(path, etag string, cuts ...int) []byte {
+		body := bytes.Repeat([]byte(path+etag), 1000)[:1000]
+		mu.Lock()
+		objects[path] = &object{body: body, etag: etag, cuts: cuts}
+		mu.Unlock()
+		return body
+	}
+	expectAsked := func(path string, requests ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Equal(asked[path], requests) {
+			t.Errorf("%s: expected the source asked %q, got %q", path, requests, asked[path])
+		}
+		asked[path] = nil
+	}
+
+	dir := t.TempDir()
+	open := func(ttl time.Duration) *PicoCache {
+		cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), WithResumableFills(ttl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	get := func(cache *PicoCache, path string, code int, body []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || body != nil && !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("%s: expected %d with %d bytes, got %d with %d bytes", path, code, len(body), w.Code, w.Body.Len())
+		}
+	}
+	kept := func(path string) int64 {
+		info, err := os.Stat(filepath.Join(dir, resumeDir, KeyForPath(path)))
+		if err != nil {
+			return -1
+		}
+		return info.Size()
+	}
+
+	cache := open(0)
+
+	// Attempts resume where the previous one got cut
+	body := serve("/flaky", `"v1"`, 600, 200)
+	get(cache, "/flaky", http.StatusOK, body)
+	expectAsked("/flaky", " ", `bytes=600- "v1"`, `bytes=800- "v1"`)
+	get(cache, "/flaky", http.StatusOK, body)
+	expectAsked("/flaky")
+	if s := cache.Stats(); s.ResumedFills != 1 || kept("/flaky") != -1 {
+		t.Errorf("expected a resumed fill leaving nothing behind, got %d", s.ResumedFills)
+	}
+
+	// Failed fills are resumed by the next request, unless the source changed
+	serve("/changed", `"v1"`, 100, 100, 100)
+	get(cache, "/changed", http.StatusInternalServerError, nil)
+	expectAsked("/changed", " ", `bytes=100- "v1"`, `bytes=200- "v1"`)
+	if n := kept("/changed"); n != 300 {
+		t.Fatalf("expected 300 bytes kept, got %d", n)
+	}
+	body = serve("/changed", `"v2"`)
+	get(cache, "/changed", http.StatusOK, body)
+	expectAsked("/changed", `bytes=300- "v1"`)
+
+	// Partial bodies are never served nor indexed, and survive restarts
+	body = serve("/restart", `"v1"`, 400, 100, 100)
+	get(cache, "/restart", http.StatusInternalServerError, nil)
+	expectAsked("/restart", " ", `bytes=400- "v1"`, `bytes=500- "v1"`)
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+	cache = open(0)
+	if s := cache.Stats(); s.Entries != 2 {
+		t.Fatalf("expected the partial body not indexed, got %d entries", s.Entries)
+	}
+	get(cache, "/restart", http.StatusOK, body)
+	expectAsked("/restart", `bytes=600- "v1"`)
+	verifyConsistency(t, cache, dir)
+
+	// And get collected once stale
+	serve("/stale", `"v1"`, 100, 100, 100)
+	get(cache, "/stale", http.StatusInternalServerError, nil)
+	cache.Close()
+	cache = open(50 * time.Millisecond)
+	defer cache.Close()
+	waitFor(t, func() bool { return kept("/stale") == -1 })
+	verifyConsistency(t, cache, dir)
+}
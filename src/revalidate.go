@@ -0,0 +1,173 @@
+package picocache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// WithStartupRevalidation revalidates the entries found on disk on startup
+// the first time they're hit, with a conditional request to the source,
+// rather than serving them as they are. Only entries whose source response
+// had a Last-Modified or ETag header can be, the others are served as
+// they are. Changed ones are fetched again.
+func WithStartupRevalidation() Option {
+	return func(c *PicoCache) {
+		c.startupRevalidation = true
+	}
+}
+
+// revalidate asks the source whether entry changed with a conditional HEAD
+// request, renewing it along with the metadata headers of the response when
+// it didn't. It reports whether the source told it did, neither being the
+// case when entry has no validators or the source didn't answer.
+func (c *PicoCache) revalidate(ctx context.Context, key string, entry *cacheEntry, rule *Rule, t *timings) (renewed *cacheEntry, changed bool) {
+	if entry.etag == "" && entry.lastModified == "" || c.originDown() {
+		return nil, false
+	}
+
+	source := c.originURL(key)
+	req, err := c.newOriginRequest(ctx, source)
+	if err != nil {
+		return nil, false
+	}
+	req.Method = http.MethodHead
+	t.askLanguage(req)
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+	fetch := c.startOriginFetch(source, "revalidation", false)
+	fetch.startSpan(t, req)
+	resp, err := c.originDo(req)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return nil, false
+	}
+	resp.Body.Close()
+	fetch.done(resp.StatusCode, 0, nil)
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		t.trace("not modified at the source")
+		renewed := c.renew(entry, rule, resp.Header)
+		if renewed != nil {
+			c.stats.revalidated.Add(1)
+		}
+		return renewed, false
+	case c.cacheable(resp.StatusCode):
+		t.trace("modified at the source")
+		return nil, true
+	default:
+		t.trace("source returned %d to the revalidation", resp.StatusCode)
+		return nil, false
+	}
+}
+
+// renew replaces entry, found unchanged at the source, by a copy expiring
+// anew under rule, with the metadata header of the source response has,
+// returning it, or nil if entry got replaced meanwhile.
+func (c *PicoCache) renew(old *cacheEntry, rule *Rule, header http.Header) *cacheEntry {
+	var expires time.Time
+	adaptive := old.adaptive
+	if rule != nil && rule.TTL > 0 {
+		ttl := c.ttl(rule)
+		if c.adaptiveTTL != nil {
+			adaptive = c.adaptiveTTL.unchanged(rule, old.adaptive)
+			ttl = adaptive.ttl
+		}
+		expires = c.steadyNow().Add(ttl)
+	}
+	return c.amend(old, expires, adaptive, header)
+}
+
+// amend replaces entry by a copy expiring at expires, bound to the source in
+// use, with the adaptive TTL state adaptive and the validators,
+// Content-Language, stale-if-error, application headers and, with
+// WithSourceContentType, Content-Type header has, returning it, or nil if
+// entry got replaced meanwhile. The body stays the same.
+func (c *PicoCache) amend(old *cacheEntry, expires time.Time, adaptive adaptiveState, header http.Header) *cacheEntry {
+	cacheFile := old.filename
+	defer c.lockFile(cacheFile)()
+
+	entry := &cacheEntry{
+		filename:      cacheFile,
+		size:          old.size,
+		diskSize:      old.diskSize,
+		encoding:      old.encoding,
+		decodedSize:   old.decodedSize,
+		sourceEncoded: old.sourceEncoded,
+		expires:       expires,
+		hash:          old.hash,
+		filled:        old.filled,
+		path:          old.path,
+		status:        old.status,
+		location:      old.location,
+		language:      old.language,
+		contentType:   old.contentType,
+		etag:          old.etag,
+		lastModified:  old.lastModified,
+		adaptive:      adaptive,
+		origin:        c.originID,
+		staleIfError:  old.staleIfError,
+		headers:       c.storeAppHeaders(old.headers, header),
+	}
+	entry.lastUsed.Store(old.lastUsed.Load())
+	entry.hits.Store(old.hits.Load())
+	entry.protected.Store(old.protected.Load())
+	if v := header.Get("ETag"); v != "" {
+		entry.etag = v
+	}
+	if v := header.Get("Last-Modified"); v != "" {
+		entry.lastModified = v
+	}
+	if v := header.Get("Content-Type"); v != "" && c.sourceContentType {
+		entry.contentType = v
+	}
+	if v := header.Get("Content-Language"); v != "" {
+		entry.language = v
+	}
+	if v := header.Get("Cache-Control"); v != "" {
+		entry.staleIfError = parseStaleIfError(v)
+	}
+
+	meta, err := readMeta(cacheFile)
+	if err == nil && meta == nil {
+		meta = &entryMeta{}
+	}
+	if err == nil && !c.frozen.Load() {
+		meta.Expires = 0
+		if !entry.expires.IsZero() {
+			meta.Expires = c.toWall(entry.expires).Unix()
+		}
+		meta.SourceETag, meta.LastModified = entry.etag, entry.lastModified
+		meta.ContentType, meta.ContentLanguage = entry.contentType, entry.language
+		meta.Origin, meta.StaleIfError = entry.origin, int64(entry.staleIfError/time.Second)
+		meta.Headers = entry.headers
+		if c.adaptiveTTL != nil {
+			entry.adaptive.store(meta)
+		}
+		err = c.writeMeta(cacheFile, meta)
+	}
+	if err != nil {
+		c.log.Warn("Failed to update entry metadata", slog.String("file", cacheFile), slog.String("err", err.Error()))
+	}
+
+	entry.sealed.Store(true)
+	if !c.entries.CompareAndSwap(cacheFile, old, entry) {
+		return nil
+	}
+	// The file stays the same, readers of old keep reading it
+	c.account(entry)
+	c.unaccount(old)
+	return entry
+}
+
+// startupEntry tells whether entry, found on disk on startup, should be
+// revalidated before being served, once.
+func (c *PicoCache) startupEntry(entry *cacheEntry) bool {
+	return c.startupRevalidation && entry.unverified.CompareAndSwap(true, false)
+}
@@ -0,0 +1,53 @@
+package picocache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const rollingBucketWidth = 10 * time.Second
+const rollingBuckets = int(time.Hour / rollingBucketWidth)
+
+// rollingCounter sums values over the last hour in a ring of fixed width
+// buckets. Each bucket remembers which period it holds, so stale buckets get
+// reset by the first add landing in them without any lock or ticker.
+type rollingCounter struct {
+	now     func() time.Time
+	buckets [rollingBuckets]struct {
+		period atomic.Int64
+		value  atomic.Int64
+	}
+}
+
+func newRollingCounter(now func() time.Time) *rollingCounter {
+	return &rollingCounter{now: now}
+}
+
+func (r *rollingCounter) period() int64 {
+	return r.now().UnixNano() / int64(rollingBucketWidth)
+}
+
+func (r *rollingCounter) add(n int64) {
+	p := r.period()
+	b := &r.buckets[p%int64(rollingBuckets)]
+	if old := b.period.Load(); old != p && b.period.CompareAndSwap(old, p) {
+		b.value.Store(0)
+	}
+	b.value.Add(n)
+}
+
+// sum returns the total added during the last window, rounded to the bucket
+// width.
+func (r *rollingCounter) sum(window time.Duration) int64 {
+	p := r.period()
+	n := min(int64(window/rollingBucketWidth), int64(rollingBuckets))
+
+	total := int64(0)
+	for i := p - n + 1; i <= p; i++ {
+		b := &r.buckets[i%int64(rollingBuckets)]
+		if b.period.Load() == i {
+			total += b.value.Load()
+		}
+	}
+	return total
+}
@@ -0,0 +1,41 @@
+package picocache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingCounter(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	r := newRollingCounter(func() time.Time { return now })
+
+	r.add(10)
+	now = now.Add(30 * time.Second)
+	r.add(20)
+
+	if got := r.sum(time.Minute); got != 30 {
+		t.Fatalf("1m: expected 30, got %d", got)
+	}
+
+	now = now.Add(time.Minute)
+	r.add(5)
+	if got := r.sum(time.Minute); got != 5 {
+		t.Fatalf("1m: expected 5, got %d", got)
+	}
+	if got := r.sum(5 * time.Minute); got != 35 {
+		t.Fatalf("5m: expected 35, got %d", got)
+	}
+
+	// A full lap later old buckets got reused rather than summed
+	now = now.Add(time.Hour)
+	r.add(1)
+	if got := r.sum(time.Hour); got != 1 {
+		t.Fatalf("1h: expected 1, got %d", got)
+	}
+
+	// Skipped buckets are ignored, not reset
+	now = now.Add(2 * time.Hour)
+	if got := r.sum(time.Hour); got != 0 {
+		t.Fatalf("1h: expected 0, got %d", got)
+	}
+}
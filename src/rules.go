@@ -0,0 +1,166 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Rule overrides the caching policy of the requests it matches, see
+// ParseRules.
+type Rule struct {
+	Prefix    string // path prefix, if any
+	Extension string // path extension with its dot, if any
+
+	TTL            time.Duration // entries expire after it, never when zero
+	MaxSize        int64         // larger responses aren't cached, if set
+	NoCacheControl bool          // don't send a Cache-Control header
+	Language       bool          // entries vary by Accept-Language, see WithLanguages
+}
+
+// ParseRules parses a comma-separated list of rules such as
+//
+//	.m3u8 ttl=5s nocache-control, .ts ttl=10m, /img/*.jpg ttl=7d maxsize=20MB
+//
+// Each rule starts with what it matches: an extension, a path prefix, or a
+// path prefix followed by `*` and an extension. Then come its settings: a
+// ttl (a Go duration, or a number of days such as 7d), a maxsize (such as
+// 20MB), nocache-control and lang, see WithLanguages.
+func ParseRules(s string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		rule, err := parseRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", raw, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(raw string) (Rule, error) {
+	fields := strings.Fields(raw)
+	rule := Rule{}
+
+	matcher := fields[0]
+	switch {
+	case strings.HasPrefix(matcher, "."):
+		rule.Extension = matcher
+	case strings.HasPrefix(matcher, "/"):
+		prefix, ext, found := strings.Cut(matcher, "*")
+		if found && !strings.HasPrefix(ext, ".") {
+			return rule, errors.New("expected an extension after *")
+		}
+		rule.Prefix, rule.Extension = prefix, ext
+	default:
+		return rule, fmt.Errorf("%q is neither an extension nor a path prefix", matcher)
+	}
+	if strings.ContainsAny(rule.Extension, "/*") || rule.Extension == "." {
+		return rule, fmt.Errorf("invalid extension %q", rule.Extension)
+	}
+
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		var err error
+		switch name {
+		case "ttl":
+			rule.TTL, err = parseTTL(value)
+		case "maxsize":
+			rule.MaxSize, err = units.FromHumanSize(value)
+			if err == nil && rule.MaxSize <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "nocache-control":
+			if value != "" {
+				err = errors.New("takes no value")
+			}
+			rule.NoCacheControl = true
+		case "lang":
+			if value != "" {
+				err = errors.New("takes no value")
+			}
+			rule.Language = true
+		default:
+			return rule, fmt.Errorf("unknown setting %q", name)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return rule, nil
+}
+
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		ttl = time.Duration(n) * 24 * time.Hour
+	} else {
+		ttl, err = time.ParseDuration(s)
+	}
+	if err == nil && ttl <= 0 {
+		err = errors.New("must be positive")
+	}
+	return ttl, err
+}
+
+var errTooLarge = errors.New("response larger than the rule max size")
+
+// defaultCacheControl is sent for entries no rule gives a TTL to.
+const defaultCacheControl = "public, max-age=604800, immutable"
+
+// WithRules sets per-path caching policies. The first rule matching a
+// request applies.
+func WithRules(rules ...Rule) Option {
+	return func(c *PicoCache) {
+		c.rules = rules
+	}
+}
+
+// matches reports whether the rule applies to path.
+func (r *Rule) matches(path string) bool {
+	return strings.HasPrefix(path, r.Prefix) &&
+		(r.Extension == "" || strings.EqualFold(filepath.Ext(path), r.Extension))
+}
+
+// matchRule returns the first rule matching path, nil if none does.
+func (c *PicoCache) matchRule(path string) *Rule {
+	for i := range c.rules {
+		if c.rules[i].matches(path) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
+// cacheControl returns the Cache-Control header to send for entries of the
+// rule, an empty string for none.
+func (r *Rule) cacheControl() string {
+	switch {
+	case r == nil:
+		return defaultCacheControl
+	case r.NoCacheControl:
+		return ""
+	case r.TTL > 0:
+		return "public, max-age=" + strconv.Itoa(int(r.TTL.Seconds()))
+	default:
+		return defaultCacheControl
+	}
+}
+
+// expired reports whether the TTL of entry elapsed.
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
@@ -0,0 +1,170 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(".m3u8 ttl=5s nocache-control, .ts ttl=10m, /img/*.jpg ttl=7d maxsize=20MB, /private maxsize=1KB,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Rule{
+		{Extension: ".m3u8", TTL: 5 * time.Second, NoCacheControl: true},
+		{Extension: ".ts", TTL: 10 * time.Minute},
+		{Prefix: "/img/", Extension: ".jpg", TTL: 7 * 24 * time.Hour, MaxSize: 20_000_000},
+		{Prefix: "/private", MaxSize: 1000},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, rules)
+	}
+
+	if rules, err := ParseRules(" , "); err != nil || len(rules) != 0 {
+		t.Fatalf("expected no rules, got %+v, %v", rules, err)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, rule := range []string{
+		"m3u8 ttl=5s",
+		".m3u8 ttl=5",
+		".m3u8 ttl=-5s",
+		".m3u8 ttl=0s",
+		".m3u8 ttl=xd",
+		".jpg maxsize=big",
+		".jpg maxsize=0",
+		".jpg nocache-control=yes",
+		".jpg color=blue",
+		"/img/*jpg",
+		"/img/*.j/pg",
+		".",
+	} {
+		_, err := ParseRules(".ts ttl=10m, " + rule)
+		if err == nil {
+			t.Errorf("%s: expected an error", rule)
+			continue
+		}
+		if !strings.Contains(err.Error(), `"`+rule+`"`) {
+			t.Errorf("%s: error doesn't quote the rule: %v", rule, err)
+		}
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules, err := ParseRules("/live/*.m3u8 ttl=1s, .m3u8 ttl=5s, /live ttl=1m, .JPG ttl=7d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PicoCache{rules: rules}
+
+	for _, tc := range []struct {
+		path string
+		rule int // -1 for none
+	}{
+		{"/live/index.m3u8", 0},
+		{"/vod/index.m3u8", 1},
+		{"/live/segment.ts", 2},
+		{"/lively.m3u8", 1},
+		{"/img/logo.jpg", 3},
+		{"/img/logo.JPG", 3},
+		{"/img/logo.png", -1},
+		{"/m3u8", -1},
+	} {
+		rule := c.matchRule(tc.path)
+		switch {
+		case tc.rule < 0 && rule != nil:
+			t.Errorf("%s: expected no rule, got %+v", tc.path, rule)
+		case tc.rule >= 0 && rule != &c.rules[tc.rule]:
+			t.Errorf("%s: expected rule %d, got %+v", tc.path, tc.rule, rule)
+		}
+	}
+
+	if (&PicoCache{}).matchRule("/img/logo.png") != nil {
+		t.Fatal("expected no rule without rules")
+	}
+}
+
+func TestRuleCacheControl(t *testing.T) {
+	for _, tc := range []struct {
+		rule     *Rule
+		expected string
+	}{
+		{nil, defaultCacheControl},
+		{&Rule{}, defaultCacheControl},
+		{&Rule{TTL: 10 * time.Minute}, "public, max-age=600"},
+		{&Rule{TTL: 10 * time.Minute, NoCacheControl: true}, ""},
+	} {
+		if got := tc.rule.cacheControl(); got != tc.expected {
+			t.Errorf("%+v: expected %q, got %q", tc.rule, tc.expected, got)
+		}
+	}
+}
+
+func TestRulesApply(t *testing.T) {
+	fetches := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(strings.Repeat("x", 10)))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	rules := WithRules(
+		Rule{Extension: ".m3u8", TTL: 50 * time.Millisecond, NoCacheControl: true},
+		Rule{Extension: ".mp4", MaxSize: 5},
+	)
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, expected string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("%s: expected %s, got %s", path, expected, got)
+		}
+		return w
+	}
+
+	if w := get("/index.m3u8", "MISS"); w.Header().Get("Cache-Control") != "" {
+		t.Fatalf("unexpected Cache-Control %s", w.Header().Get("Cache-Control"))
+	}
+	get("/index.m3u8", "HIT")
+	time.Sleep(60 * time.Millisecond)
+	get("/index.m3u8", "MISS")
+	if fetches != 2 {
+		t.Fatalf("expected the expired entry to be fetched again, got %d fetches", fetches)
+	}
+	if s := cache.Stats(); s.Expirations != 1 || s.Entries != 1 || s.TotalSize != 10 {
+		t.Fatalf("unexpected stats after expiration %+v", s)
+	}
+
+	get("/video.mp4", "BYPASS-SIZE")
+	get("/video.mp4", "BYPASS-SIZE")
+	if w := get("/logo.png", "MISS"); w.Header().Get("Cache-Control") != defaultCacheControl {
+		t.Fatalf("unexpected Cache-Control %s", w.Header().Get("Cache-Control"))
+	}
+
+	// Expiry survives a restart
+	cache.Close()
+	restarted, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := restarted.entries.Load(restarted.getCacheFilename("/index.m3u8"))
+	if !ok || e.(*cacheEntry).expires.IsZero() {
+		t.Fatal("expected the rebuilt entry to keep its expiry")
+	}
+	verifyConsistency(t, restarted, restarted.cacheDir)
+}
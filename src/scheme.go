@@ -0,0 +1,328 @@
+package picocache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// KeyMigration is what happens when the cache directory was filled with
+// another key scheme than the configured one, e.g. with path normalization
+// or query parameters newly enabled.
+type KeyMigration int
+
+const (
+	MigrateRefuse   KeyMigration = iota // fail to start
+	MigrateDualRead                     // look entries up under their previous key too, moving them on hits
+	MigrateBulk                         // move entries whose request path is known at startup, drop the others
+)
+
+// ParseKeyMigration parses refuse, dual-read or bulk.
+func ParseKeyMigration(s string) (KeyMigration, error) {
+	switch s {
+	case "refuse":
+		return MigrateRefuse, nil
+	case "dual-read":
+		return MigrateDualRead, nil
+	case "bulk":
+		return MigrateBulk, nil
+	}
+	return MigrateRefuse, fmt.Errorf("invalid key migration %q, expected refuse, dual-read or bulk", s)
+}
+
+// WithKeyMigration sets what happens when the key scheme changed.
+func WithKeyMigration(m KeyMigration) Option {
+	return func(c *PicoCache) {
+		c.keyMigration = m
+	}
+}
+
+const manifestFile = "picocache.manifest"
+
+// keyVersion is the version of KeyForPath and of how request paths make
+// keys: 2 keys on canonical escaped paths, 1 on decoded ones.
+const keyVersion = 2
+
+// keyScheme is how request URLs map to cache files.
+type keyScheme struct {
+	Version   int      `json:"version"`
+	Normalize bool     `json:"normalize,omitempty"`
+	Lowercase bool     `json:"lowercase,omitempty"`
+	Query     string   `json:"query,omitempty"` // keep or strip Params, query strings are ignored otherwise
+	Params    []string `json:"params,omitempty"`
+}
+
+// manifest describes how the cache directory was filled.
+type manifest struct {
+	Scheme   keyScheme  `json:"scheme"`
+	Previous *keyScheme `json:"previous,omitempty"` // being migrated from, with MigrateDualRead
+}
+
+// keyScheme returns the configured key scheme.
+func (c *PicoCache) keyScheme() keyScheme {
+	s := keyScheme{Version: keyVersion, Normalize: c.normalizePaths, Lowercase: c.lowercasePaths}
+	if c.query != nil {
+		s.Query = "strip"
+		if c.query.keep {
+			s.Query = "keep"
+		}
+		for name := range c.query.names {
+			s.Params = append(s.Params, name)
+		}
+		slices.Sort(s.Params)
+	}
+	return s
+}
+
+func (s keyScheme) equal(o keyScheme) bool {
+	return s.Version == o.Version && s.Normalize == o.Normalize && s.Lowercase == o.Lowercase &&
+		s.Query == o.Query && slices.Equal(s.Params, o.Params)
+}
+
+// upgradesTo reports whether o only differs from s by a later version.
+func (s keyScheme) upgradesTo(o keyScheme) bool {
+	upgraded := s
+	upgraded.Version = o.Version
+	return s.Version < o.Version && upgraded.equal(o)
+}
+
+func (s keyScheme) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// key returns the request key of u under the scheme.
+func (s keyScheme) key(u *url.URL) string {
+	path := keyPath(u, s.Normalize, s.Lowercase)
+	if s.Version < 2 {
+		path = u.Path
+		if s.Normalize {
+			path = normalized(path, s.Lowercase)
+		}
+	}
+	if s.Query == "" {
+		return path
+	}
+	return path + newQueryFilter(s.Params, s.Query == "keep").queryString(u)
+}
+
+// fileKey returns the cache key of u under the scheme, naming its file.
+func (s keyScheme) fileKey(u *url.URL) string {
+	// Only one version of KeyForPath so far, older ones would be kept here
+	return KeyForPath(s.key(u))
+}
+
+func readManifest(path string) (*manifest, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func writeManifest(path string, m *manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+tempSuffix, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+tempSuffix, path)
+}
+
+// checkKeyScheme compares the configured key scheme with the one in the
+// manifest of the cache directory, migrating entries as configured. A
+// directory without one is assumed to match.
+func (c *PicoCache) checkKeyScheme() error {
+	path := filepath.Join(c.cacheDir, manifestFile)
+	m, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+
+	current := c.keyScheme()
+	write := func(m *manifest) error {
+		if c.frozen.Load() {
+			// Written once thawed and restarted
+			return nil
+		}
+		return writeManifest(path, m)
+	}
+	switch {
+	case m == nil:
+		return write(&manifest{Scheme: current})
+	case m.Scheme.equal(current):
+		if m.Previous != nil && (c.keyMigration == MigrateDualRead || m.Previous.upgradesTo(current)) {
+			c.previousScheme = m.Previous
+		}
+		return nil
+	}
+
+	migration := c.keyMigration
+	if migration == MigrateRefuse && m.Scheme.upgradesTo(current) {
+		// Keys of most paths stay across versions, no need to ask
+		migration = MigrateDualRead
+	}
+
+	switch migration {
+	case MigrateDualRead:
+		c.log.Warn("Key scheme changed, looking entries up under their previous key too",
+			slog.String("previous", m.Scheme.String()), slog.String("current", current.String()))
+		c.previousScheme = &m.Scheme
+		return write(&manifest{Scheme: current, Previous: &m.Scheme})
+	case MigrateBulk:
+		if c.frozen.Load() {
+			return fmt.Errorf("cache directory filled with key scheme %s, not %s: can't move entries while frozen", m.Scheme, current)
+		}
+		if err := c.rekey(current); err != nil {
+			return err
+		}
+		return writeManifest(path, &manifest{Scheme: current})
+	}
+	return fmt.Errorf("cache directory filled with key scheme %s, not %s: set a key migration", m.Scheme, current)
+}
+
+// previousFile returns the cache file of u under the previous key scheme,
+// if it is being migrated from and differs from cacheFile.
+func (c *PicoCache) previousFile(u *url.URL, cacheFile string) string {
+	if c.previousScheme == nil {
+		return ""
+	}
+	if previous := c.keyFile(c.previousScheme.fileKey(u)); previous != cacheFile {
+		return previous
+	}
+	return ""
+}
+
+// rehome moves the entry of previous, if any, to cacheFile, reporting
+// whether it did.
+func (c *PicoCache) rehome(previous, cacheFile, key string) bool {
+	unlock := c.lockFile(previous)
+	e, ok := c.entries.Load(previous)
+	if !ok || !e.(*cacheEntry).sealed.Load() || !c.entries.CompareAndDelete(previous, e) {
+		unlock()
+		return false
+	}
+	old := e.(*cacheEntry)
+	old.sealed.Store(false)
+	moved := cacheFile + ".rehome" + tempSuffix
+	err := os.Rename(previous, moved)
+	meta, _ := readMeta(previous)
+	if err != nil {
+		os.Remove(previous)
+	}
+	os.Remove(previous + metaSuffix)
+	unlock()
+	c.unaccount(old)
+	if err != nil {
+		c.log.Warn("Failed to move entry to its new key", slog.String("file", previous), slog.String("err", err.Error()))
+		return false
+	}
+
+	entry := &cacheEntry{
+		filename:      cacheFile,
+		size:          old.size,
+		diskSize:      old.diskSize,
+		encoding:      old.encoding,
+		decodedSize:   old.decodedSize,
+		sourceEncoded: old.sourceEncoded,
+		expires:       old.expires,
+		hash:          old.hash,
+		filled:        old.filled,
+		path:          key,
+		status:        old.status,
+		location:      old.location,
+		language:      old.language,
+		contentType:   old.contentType,
+		etag:          old.etag,
+		lastModified:  old.lastModified,
+		origin:        old.origin,
+		staleIfError:  old.staleIfError,
+		headers:       old.headers,
+		adaptive:      old.adaptive,
+	}
+	entry.lastUsed.Store(c.steadyNow().UnixNano())
+	if meta == nil {
+		meta = &entryMeta{}
+	}
+	meta.Key, meta.Path = "", ""
+	if c.paths != nil {
+		meta.Path = key
+	}
+	if err := c.publish(entry, moved, meta, nil, nil); err != nil {
+		return false
+	}
+	c.stats.rehomed.Add(1)
+	return true
+}
+
+// rekey moves entries to their key under scheme, before the index is
+// rebuilt. Only entries whose request path got recorded can be, see
+// WithPrefixPurge, the others are dropped. Those whose key was set by the
+// client stay. Entries stay in their directory, those with a key belonging
+// to another one left to eviction, see WithCacheDirs.
+func (c *PicoCache) rekey(scheme keyScheme) error {
+	moved, dropped := 0, 0
+	for _, d := range c.dirs {
+		if d.offline.Load() {
+			continue
+		}
+		files, err := os.ReadDir(d.Path)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			path := filepath.Join(d.Path, f.Name())
+			if f.IsDir() || isAuxFile(path) || isControlFile(f.Name()) {
+				continue
+			}
+
+			meta, err := readMeta(path)
+			if err == nil && meta != nil && meta.Key != "" {
+				continue
+			}
+			var u *url.URL
+			if err == nil && meta != nil && meta.Path != "" {
+				u, err = url.Parse(meta.Path)
+			}
+			if err != nil || u == nil {
+				os.Remove(path)
+				os.Remove(path + metaSuffix)
+				dropped++
+				continue
+			}
+
+			key := scheme.key(u)
+			cacheFile := filepath.Join(d.Path, KeyForPath(key))
+			if cacheFile == path {
+				continue
+			}
+			meta.Path = key
+			if err := c.writeMeta(cacheFile, meta); err != nil {
+				return err
+			}
+			if err := os.Rename(path, cacheFile); err != nil {
+				return err
+			}
+			os.Remove(path + metaSuffix)
+			moved++
+		}
+	}
+	c.log.Info("Moved entries to the new key scheme", slog.Int("moved", moved), slog.Int("dropped", dropped))
+	return nil
+}
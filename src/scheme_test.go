@@ -0,0 +1,130 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// entryFiles lists the files in dir other than the manifest, lock and
+// entry metadata.
+func entryFiles(t *testing.T, dir string) []string {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		if !isControlFile(f.Name()) && !strings.HasSuffix(f.Name(), metaSuffix) {
+			names = append(names, filepath.Join(dir, f.Name()))
+		}
+	}
+	return names
+}
+
+func TestKeySchemeChange(t *testing.T) {
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	get := func(cache *PicoCache, path string) string {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+			t.Fatalf("%s: unexpected response %d %q", path, w.Code, w.Body.String())
+		}
+		return w.Header().Get("X-Cache")
+	}
+
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(cache, "/A")
+	get(cache, "/Img//B")
+	cache.Close()
+
+	if _, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithPathNormalization(true)); err == nil {
+		t.Fatal("expected a changed key scheme to be refused")
+	}
+
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20,
+		WithPathNormalization(true), WithKeyMigration(MigrateDualRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cacheStatus := get(cache, "/A"); cacheStatus != "HIT" {
+		t.Errorf("expected a HIT once moved over, got %s", cacheStatus)
+	}
+	if cacheStatus := get(cache, "/a"); cacheStatus != "HIT" {
+		t.Errorf("expected a HIT under the new key, got %s", cacheStatus)
+	}
+	// Keyed /Img//B before, only its exact path would have moved it over
+	if cacheStatus := get(cache, "/img/b"); cacheStatus != "MISS" {
+		t.Errorf("expected a MISS, got %s", cacheStatus)
+	}
+	if fetched != 3 {
+		t.Errorf("expected 3 fetches, got %d", fetched)
+	}
+	if n := cache.Stats().Rehomed; n != 1 {
+		t.Errorf("expected 1 entry moved over, got %d", n)
+	}
+	cache.Close()
+
+	// Still migrating once restarted
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20,
+		WithPathNormalization(true), WithKeyMigration(MigrateDualRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.previousScheme == nil {
+		t.Error("expected the previous key scheme to be remembered")
+	}
+	if _, err := os.Stat(filepath.Join(dir, KeyForPath("/a"))); err != nil {
+		t.Errorf("expected /A under its new key: %v", err)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestKeySchemeBulkMigration(t *testing.T) {
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithPrefixPurge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/Img//B", nil))
+	cache.Close()
+
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20,
+		WithPrefixPurge(), WithPathNormalization(true), WithKeyMigration(MigrateBulk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img/b", nil))
+	if cacheStatus := w.Header().Get("X-Cache"); cacheStatus != "HIT" {
+		t.Errorf("expected a HIT, got %s", cacheStatus)
+	}
+	if fetched != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetched)
+	}
+	if _, err := os.Stat(filepath.Join(dir, KeyForPath("/Img//B"))); !os.IsNotExist(err) {
+		t.Errorf("expected the previous file gone, got %v", err)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
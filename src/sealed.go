@@ -0,0 +1,50 @@
+package picocache
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+// lookup returns the cached entry for cacheFile along with its opened file,
+// or a nil entry on a miss. Entries are sealed once filled, so hits never
+// wait on anything. Eviction clears the seal before removing the files: an
+// entry found unsealed after opening its path may be reading a file that
+// got deleted, or replaced by a newer fill, and is treated as a miss.
+func (c *PicoCache) lookup(cacheFile string) (*cacheEntry, *os.File, error) {
+	e, ok := c.entries.Load(cacheFile)
+	if !ok {
+		return nil, nil, nil
+	}
+	entry := e.(*cacheEntry)
+	if !entry.sealed.Load() {
+		return nil, nil, nil
+	}
+
+	file, err := c.open(entry.filename)
+	if !entry.sealed.Load() {
+		if err == nil {
+			file.Close()
+		}
+		return nil, nil, nil
+	}
+	if err != nil && c.dirFailed(entry.filename, err) {
+		// Offline, its entries are misses until it's back
+		return nil, nil, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) && c.frozen.Load() {
+		return nil, nil, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed behind our back, don't keep failing on it
+		c.log.Warn("Dropping entry whose file is gone", slog.String("file", entry.filename))
+		c.purge(cacheFile, entry)
+		return nil, nil, nil
+	}
+	if err != nil {
+		c.failed(entry, err)
+		return nil, nil, err
+	}
+	return entry, file, nil
+}
@@ -0,0 +1,110 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func BenchmarkConcurrentHits(b *testing.B) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4096")
+		w.Write(bytes.Repeat([]byte("x"), 4096))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, b.TempDir(), 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hot", nil))
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hot", nil))
+			if w.Header().Get("X-Cache") != "HIT" {
+				b.Fatalf("expected a hit, got %s", w.Header().Get("X-Cache"))
+			}
+		}
+	})
+}
+
+// TestSealedEntriesUnderEviction hammers a few paths while they keep being
+// filled and evicted, every fill serving a body of a different length. A
+// hit opening a replaced or deleted file would serve a body not matching its
+// Content-Length, or mixing two fills.
+func TestSealedEntriesUnderEviction(t *testing.T) {
+	fills := atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := fills.Add(1)
+		body := bytes.Repeat([]byte(fmt.Sprintf("%s#%d;", r.URL.Path, n)), 1+int(n%5))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 64, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	evicted := make(chan struct{})
+	go func() {
+		defer close(evicted)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.cleanupOldEntries()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				path := fmt.Sprintf("/entry/%d", (g+i)%4)
+				w := httptest.NewRecorder()
+				cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != http.StatusOK {
+					continue
+				}
+
+				body := w.Body.Bytes()
+				if w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+					t.Errorf("%s: Content-Length %s for a %d bytes body", path, w.Header().Get("Content-Length"), len(body))
+					return
+				}
+				segment, _, _ := bytes.Cut(body, []byte(";"))
+				segment = append(segment, ';')
+				if !bytes.HasPrefix(segment, []byte(path+"#")) || len(body)%len(segment) != 0 ||
+					!bytes.Equal(body, bytes.Repeat(segment, len(body)/len(segment))) {
+
+					t.Errorf("%s: body mixes fills: %q", path, body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-evicted
+
+	if fills.Load() <= 4 {
+		t.Fatalf("expected entries to be evicted and filled again, got %d fills", fills.Load())
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,98 @@
+package picocache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// WithSelfTest sets the path of a known object checked by SelfTest through
+// the admin endpoint. Its entry is pinned: never evicted, it doubles as an
+// always warm target for health probes.
+func WithSelfTest(path string) Option {
+	return func(c *PicoCache) {
+		c.selfTestPath = path
+	}
+}
+
+// discardWriter is a ResponseWriter for in-process requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(status int)      {}
+
+// selfTestGet serves path to an in-process request.
+func (c *PicoCache) selfTestGet(ctx context.Context, path string) (*recorder, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec := &recorder{ResponseWriter: &discardWriter{header: http.Header{}}, now: c.now}
+	start := time.Now()
+	c.ServeHTTP(rec, req)
+	return rec, time.Since(start), nil
+}
+
+// SelfTest checks path can be fetched from the source into the cache, then
+// served back from it. The entry gets pinned, see WithSelfTest.
+func (c *PicoCache) SelfTest(ctx context.Context, path string) error {
+	fill, fillTime, err := c.selfTestGet(ctx, path)
+	if err != nil {
+		return err
+	}
+	if fill.status != http.StatusOK || fill.bytes == 0 {
+		return fmt.Errorf("self-test of %s: got status %d with %d bytes", path, fill.status, fill.bytes)
+	}
+	c.pinned.Store(c.keyFile(fill.Header().Get("X-Cache-Key")), true)
+
+	hit, hitTime, err := c.selfTestGet(ctx, path)
+	if err != nil {
+		return err
+	}
+	if cache := hit.Header().Get("X-Cache"); hit.status != http.StatusOK || cache != OutcomeHit.String() || hit.bytes != fill.bytes {
+		return fmt.Errorf("self-test of %s: served back with status %d, %s and %d bytes instead of %d", path, hit.status, cache, hit.bytes, fill.bytes)
+	}
+
+	c.log.Info("Self-test passed",
+		slog.String("path", path),
+		slog.Int64("bytes", fill.bytes),
+		slog.String("fill", fill.Header().Get("X-Cache")),
+		slog.Duration("fill_duration", fillTime),
+		slog.Duration("hit_duration", hitTime))
+	return nil
+}
+
+type selfTestResult struct {
+	Path  string `json:"path"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// serveSelfTest runs the self-test again, for trusted clients.
+func (c *PicoCache) serveSelfTest(w http.ResponseWriter, r *http.Request) {
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if c.selfTestPath == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	result := selfTestResult{Path: c.selfTestPath, OK: true}
+	if err := c.SelfTest(r.Context(), c.selfTestPath); err != nil {
+		result.OK, result.Error = false, err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
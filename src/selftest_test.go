@@ -0,0 +1,100 @@
+package picocache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/empty":
+		default:
+			w.Write([]byte(strings.Repeat("x", 100)))
+		}
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1000, WithBlockSize(1), WithProtectedShare(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.SelfTest(context.Background(), "/known"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/missing", "/empty"} {
+		if err := cache.SelfTest(context.Background(), path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+
+	// The self-test entry is the least recently used, but pinned
+	for i := range 20 {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/flood/%d", i), nil))
+		cache.cleanupOldEntries()
+	}
+	if _, ok := cache.entries.Load(cache.getCacheFilename("/known")); !ok {
+		t.Fatal("self-test entry got evicted")
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestSelfTestEndpoint(t *testing.T) {
+	up := true
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	token := "s3cret"
+	get := func(cache *PicoCache) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/__picocache/selftest", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		cache.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	unset, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(unset); code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a self-test path, got %d", code)
+	}
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithSelfTest("/known"), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = "nope"
+	if code := get(cache); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for untrusted clients, got %d", code)
+	}
+	if n := cache.Stats().Entries; n != 0 {
+		t.Fatalf("expected nothing filled for untrusted clients, got %d entries", n)
+	}
+	token = "s3cret"
+	up = false
+	if code := get(cache); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with the source failing, got %d", code)
+	}
+	up = true
+	if code := get(cache); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
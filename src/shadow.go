@@ -0,0 +1,108 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Policy is one of the policies refusing to cache or serve requests they
+// catch as they are, which can be tried out on live traffic first, see
+// WithPolicyMode.
+type Policy int
+
+const (
+	PolicyAdmission     Policy = iota // see WithAdmitAfter
+	PolicyKeyFlood                    // see WithKeyFloodGuard
+	PolicyContentType                 // see WithContentTypeValidation
+	PolicyBodyBlocklist               // see WithBodyBlocklist
+	PolicyStrictOrigin                // see WithStrictOrigin
+
+	policyCount
+)
+
+var policyNames = [policyCount]string{
+	PolicyAdmission:     "admission",
+	PolicyKeyFlood:      "key_flood",
+	PolicyContentType:   "content_type",
+	PolicyBodyBlocklist: "body_blocklist",
+	PolicyStrictOrigin:  "strict_origin",
+}
+
+// String returns the policy as stats report it, e.g. key_flood.
+func (p Policy) String() string {
+	if p < 0 || p >= policyCount {
+		return "Policy(" + strconv.Itoa(int(p)) + ")"
+	}
+	return policyNames[p]
+}
+
+// PolicyMode is whether a policy acts on what it decides.
+type PolicyMode int
+
+const (
+	PolicyEnforce PolicyMode = iota // the default
+	PolicyObserve                   // requests go on as without the policy, what it would have done being counted
+)
+
+// ParsePolicyMode parses enforce or observe.
+func ParsePolicyMode(s string) (PolicyMode, error) {
+	switch s {
+	case "enforce":
+		return PolicyEnforce, nil
+	case "observe":
+		return PolicyObserve, nil
+	}
+	return PolicyEnforce, fmt.Errorf("invalid policy mode %q, expected enforce or observe", s)
+}
+
+// WithPolicyMode sets the mode of p. In observe mode, the policy still
+// decides everything it would, but requests go on as if it wasn't there:
+// what it would have done gets counted in the shadow stats instead, along
+// with a sampled log line, while the counters of what it does stay put.
+func WithPolicyMode(p Policy, mode PolicyMode) Option {
+	return func(c *PicoCache) {
+		if p >= 0 && p < policyCount {
+			c.shadow.observing[p] = mode == PolicyObserve
+		}
+	}
+}
+
+// shadowLogEvery spaces the lines logged for the decisions of a policy in
+// observe mode.
+const shadowLogEvery = 10 * time.Second
+
+// shadowPolicies tracks the policies in observe mode.
+type shadowPolicies struct {
+	observing [policyCount]bool
+	would     [policyCount]atomic.Int64 // decisions not acted on
+	logged    [policyCount]atomic.Int64 // unix nanoseconds of the last line
+}
+
+// enforced tells whether p acts on its decision about the request of t,
+// refusing it for reason. In observe mode it only counts the decision,
+// logging it now and then along with attrs.
+func (c *PicoCache) enforced(p Policy, t *timings, reason string, attrs ...any) bool {
+	if !c.shadow.observing[p] {
+		return true
+	}
+	c.shadow.would[p].Add(1)
+	t.trace("%s, observed only", reason)
+	now, last := time.Now().UnixNano(), c.shadow.logged[p].Load()
+	if now-last >= int64(shadowLogEvery) && c.shadow.logged[p].CompareAndSwap(last, now) {
+		c.log.Info("Policy in observe mode would have acted",
+			append([]any{slog.String("policy", p.String()), slog.String("reason", reason)}, attrs...)...)
+	}
+	return false
+}
+
+// shadowStats returns the decisions of each policy not acted on, by name.
+func (c *PicoCache) shadowStats() map[string]int64 {
+	s := make(map[string]int64, policyCount)
+	for p := range policyCount {
+		s[p.String()] = c.shadow.would[p].Load()
+	}
+	return s
+}
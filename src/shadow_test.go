@@ -0,0 +1,96 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyModes(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>not found</html>"))
+		case "/error.txt":
+			w.Write([]byte("<!DOCTYPE html><p>oops"))
+		default:
+			w.Write([]byte("body of " + r.URL.Path))
+		}
+	}))
+	defer origin.Close()
+	// The same source, recorded as another one
+	elsewhere := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)
+	traffic := []string{"/a.txt", "/b.txt", "/img.png", "/error.txt", "/c.txt", "/d.txt", "/e.txt"}
+
+	for _, tc := range []struct {
+		policy   Policy
+		opts     []Option
+		enforced func(Stats) int64
+	}{
+		{PolicyAdmission, []Option{WithAdmitAfter(2, 0)}, func(s Stats) int64 { return s.AdmissionRejections }},
+		{PolicyKeyFlood, []Option{WithKeyFloodGuard(2, 0, time.Minute)}, func(s Stats) int64 { return s.KeyFlood.ByClient }},
+		{PolicyContentType, []Option{WithContentTypeValidation()}, func(s Stats) int64 { return s.RejectedContentType }},
+		{PolicyBodyBlocklist, []Option{WithBodyBlocklist("<!DOCTYPE html>")}, func(s Stats) int64 { return s.RejectedBody }},
+		{PolicyStrictOrigin, []Option{WithStrictOrigin()}, func(s Stats) int64 { return s.ForeignRefills }},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			run := func(opts ...Option) (Stats, []string) {
+				dir := t.TempDir()
+				seed, err := NewCache(slog.Default(), elsewhere, dir, 1<<20)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range traffic[:2] {
+					seed.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+				}
+				seed.Close()
+
+				cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer cache.Close()
+				var responses []string
+				for _, path := range traffic {
+					w := httptest.NewRecorder()
+					cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+					responses = append(responses, fmt.Sprintf("%s %d %s %q", path, w.Code, w.Header().Get("X-Cache"), w.Body.String()))
+				}
+				return cache.Stats(), responses
+			}
+
+			_, baseline := run()
+			enforcing, enforced := run(tc.opts...)
+			observing, observed := run(append(tc.opts, WithPolicyMode(tc.policy, PolicyObserve))...)
+
+			if n := tc.enforced(enforcing); n == 0 || enforcing.Shadow[tc.policy.String()] != 0 {
+				t.Fatalf("expected the policy enforced, got %d, shadow %v", n, enforcing.Shadow)
+			}
+			if n := tc.enforced(observing); n != 0 || observing.Shadow[tc.policy.String()] != tc.enforced(enforcing) {
+				t.Fatalf("expected %d decisions observed, got %v, %d enforced", tc.enforced(enforcing), observing.Shadow, n)
+			}
+			if strings.Join(enforced, "\n") == strings.Join(baseline, "\n") {
+				t.Fatalf("expected enforcing to change responses, got %v", enforced)
+			}
+			for i := range baseline {
+				if observed[i] != baseline[i] {
+					t.Fatalf("expected responses unchanged while observing, got %s, not %s", observed[i], baseline[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePolicyMode(t *testing.T) {
+	if m, err := ParsePolicyMode("observe"); err != nil || m != PolicyObserve {
+		t.Fatalf("expected observe, got %v %v", m, err)
+	}
+	if _, err := ParsePolicyMode("shadow"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,80 @@
+package picocache
+
+import "io"
+
+// SimulationResult is how a cache would have fared replaying a trace file,
+// see Simulate.
+type SimulationResult struct {
+	Requests  int64   `json:"requests"`
+	Hits      int64   `json:"hits"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"`
+}
+
+// Simulate replays trace files written with WithTraceFile, read in order
+// from r, through a cache of maxSize bytes evicting entries with policy, the
+// same way the cache does. Only requests which went through the cache get
+// replayed, not those bypassing it or failing.
+func Simulate(r io.Reader, maxSize int64, policy EvictionPolicy, protectedShare float64) (SimulationResult, error) {
+	p := evictionPolicy{kind: policy, protectedShare: protectedShare}
+	entries := map[uint64]*cacheEntry{}
+	keys := map[*cacheEntry]uint64{}
+	candidates := func(yield func(*cacheEntry) bool) {
+		for _, entry := range entries {
+			if !yield(entry) {
+				return
+			}
+		}
+	}
+	passes := uint64(0)
+	totalSize := int64(0)
+	result := SimulationResult{}
+
+	err := readTraces(r, func(record traceRecord) {
+		if !record.cached() {
+			return
+		}
+		result.Requests++
+
+		if entry, ok := entries[record.Key]; ok {
+			result.Hits++
+			p.hit(entry)
+			entry.lastUsed.Store(record.Time)
+			return
+		}
+
+		entry := &cacheEntry{size: record.Size, diskSize: record.Size}
+		entry.lastUsed.Store(record.Time)
+		entries[record.Key] = entry
+		keys[entry] = record.Key
+		totalSize += entry.diskSize
+
+		toFree := totalSize - maxSize
+		if toFree < 0 {
+			return
+		}
+		passes++
+		p.demote(candidates, evictBatch, maxSize, passes)
+		freed := int64(0)
+	evicting:
+		for {
+			batch := p.victims(candidates, evictBatch, passes)
+			if len(batch) == 0 {
+				break
+			}
+			for _, entry := range batch {
+				delete(entries, keys[entry])
+				delete(keys, entry)
+				totalSize -= entry.diskSize
+				result.Evictions++
+				if freed += entry.diskSize; freed >= toFree {
+					break evicting
+				}
+			}
+		}
+	})
+	if result.Requests > 0 {
+		result.HitRate = float64(result.Hits) / float64(result.Requests)
+	}
+	return result, err
+}
@@ -0,0 +1,44 @@
+package picocache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	trace := &bytes.Buffer{}
+	for i, key := range "ABACABCA" {
+		record := traceRecord{Time: int64(i), Key: uint64(key), Size: 1, Outcome: 1}
+		binary.Write(trace, binary.LittleEndian, &record)
+	}
+	// Neither bypassing nor failed requests get replayed
+	for _, outcome := range []uint8{0, 4} {
+		record := traceRecord{Time: 100, Key: 'Z', Size: 1, Outcome: outcome}
+		binary.Write(trace, binary.LittleEndian, &record)
+	}
+	// A record cut short by a crash
+	trace.Write([]byte{1, 2, 3})
+
+	// Filling a third entry makes the cache reach its size and evict one,
+	// worked out by hand from there
+	for _, test := range []struct {
+		policy    EvictionPolicy
+		share     float64
+		hits      int64
+		evictions int64
+	}{
+		{EvictLRU, 0, 2, 4},
+		{EvictSLRU, 0, 2, 4},
+		{EvictSLRU, 0.5, 3, 3},
+		{EvictLFU, 0, 3, 3},
+	} {
+		result, err := Simulate(bytes.NewReader(trace.Bytes()), 3, test.policy, test.share)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Requests != 8 || result.Hits != test.hits || result.Evictions != test.evictions || result.HitRate != float64(test.hits)/8 {
+			t.Errorf("%s %g: unexpected result %+v", test.policy, test.share, result)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package picocache
+
+import (
+	"container/heap"
+	"encoding/json"
+	"iter"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// sizeBounds are the exclusive upper bounds of the entry size histogram
+// buckets, entries larger than the last one going to an extra bucket.
+var sizeBounds = []int64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20}
+
+// sizeBucket returns the histogram bucket of an entry of the given size.
+func sizeBucket(size int64) int {
+	for i, bound := range sizeBounds {
+		if size < bound {
+			return i
+		}
+	}
+	return len(sizeBounds)
+}
+
+// SizeBucket counts the cached entries smaller than Below bytes, and not
+// counted by the previous bucket. Below is zero for the last bucket.
+type SizeBucket struct {
+	Below   int64 `json:"below,omitempty"`
+	Entries int64 `json:"entries"`
+}
+
+func (c *PicoCache) sizeHistogram() []SizeBucket {
+	buckets := make([]SizeBucket, len(c.stats.sizes))
+	for i := range buckets {
+		if i < len(sizeBounds) {
+			buckets[i].Below = sizeBounds[i]
+		}
+		buckets[i].Entries = c.stats.sizes[i].Load()
+	}
+	return buckets
+}
+
+const defaultTopEntries = 50
+const maxTopEntries = 1000
+
+// TopEntry describes a cached entry in a /__picocache/top report.
+type TopEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	DiskSize int64     `json:"disk_size"`
+	LastUsed time.Time `json:"last_used"`
+	Encoding string    `json:"encoding,omitempty"`
+	Readers  int64     `json:"readers"` // right now
+}
+
+// entryHeap is a min-heap of entries according to less, see topEntries.
+type entryHeap struct {
+	entries []*cacheEntry
+	less    func(a, b *cacheEntry) bool
+}
+
+func (h *entryHeap) Len() int           { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool { return h.less(h.entries[i], h.entries[j]) }
+func (h *entryHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *entryHeap) Push(x any)         { h.entries = append(h.entries, x.(*cacheEntry)) }
+func (h *entryHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// topEntries returns the n greatest entries according to less, greatest
+// first, see topOf.
+func (c *PicoCache) topEntries(n int, less func(a, b *cacheEntry) bool) []*cacheEntry {
+	return topOf(c.allEntries, n, less)
+}
+
+// allEntries yields every entry of the index.
+func (c *PicoCache) allEntries(yield func(*cacheEntry) bool) {
+	c.entries.Range(func(key, value any) bool {
+		return yield(value.(*cacheEntry))
+	})
+}
+
+// topOf returns the n greatest of entries according to less, greatest
+// first. It keeps a heap of the n best entries seen so far rather than
+// sorting them all, needing memory for n entries only.
+func topOf(entries iter.Seq[*cacheEntry], n int, less func(a, b *cacheEntry) bool) []*cacheEntry {
+	h := &entryHeap{less: less}
+	for entry := range entries {
+		if h.Len() < n {
+			heap.Push(h, entry)
+		} else if n > 0 && less(h.entries[0], entry) {
+			h.entries[0] = entry
+			heap.Fix(h, 0)
+		}
+	}
+
+	slices.SortFunc(h.entries, func(a, b *cacheEntry) int {
+		if less(b, a) {
+			return -1
+		}
+		if less(a, b) {
+			return +1
+		}
+		return 0
+	})
+	return h.entries
+}
+
+func bySize(a, b *cacheEntry) bool { return a.size < b.size }
+
+// byAge orders least recently used entries last, so they get reported first.
+func byAge(a, b *cacheEntry) bool { return compareAge(a, b) > 0 }
+
+// serveTop lists the largest, oldest or busiest entries, for trusted
+// clients.
+func (c *PicoCache) serveTop(w http.ResponseWriter, r *http.Request) {
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	var less func(a, b *cacheEntry) bool
+	switch query.Get("by") {
+	case "", "size":
+		less = bySize
+	case "age":
+		less = byAge
+	case "readers":
+		less = byReaders
+	default:
+		http.Error(w, "by must be size, age or readers", http.StatusBadRequest)
+		return
+	}
+
+	n := defaultTopEntries
+	if s := query.Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTopEntries {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxTopEntries), http.StatusBadRequest)
+			return
+		}
+	}
+
+	top := []TopEntry{}
+	for _, entry := range c.topEntries(n, less) {
+		top = append(top, TopEntry{
+			Key:      filepath.Base(entry.filename),
+			Size:     entry.size,
+			DiskSize: entry.diskSize,
+			LastUsed: c.toWall(time.Unix(0, entry.lastUsed.Load())).UTC(),
+			Encoding: entry.encoding,
+			Readers:  entry.readers.Load(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(top)
+}
@@ -0,0 +1,149 @@
+package picocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeBucket(t *testing.T) {
+	for _, tc := range []struct {
+		size   int64
+		bucket int
+	}{
+		{0, 0},
+		{4<<10 - 1, 0},
+		{4 << 10, 1},
+		{64<<10 - 1, 1},
+		{64 << 10, 2},
+		{1<<20 - 1, 2},
+		{1 << 20, 3},
+		{16<<20 - 1, 3},
+		{16 << 20, 4},
+		{256<<20 - 1, 4},
+		{256 << 20, 5},
+		{1 << 40, 5},
+	} {
+		if got := sizeBucket(tc.size); got != tc.bucket {
+			t.Errorf("%d: expected bucket %d, got %d", tc.size, tc.bucket, got)
+		}
+	}
+}
+
+func TestSizeHistogramAccounting(t *testing.T) {
+	c := &PicoCache{originBytes: newRollingCounter(time.Now)}
+	small := &cacheEntry{size: 100}
+	large := &cacheEntry{size: 20 << 20}
+	c.account(small)
+	c.account(large)
+	c.account(&cacheEntry{size: 200})
+	c.unaccount(small)
+
+	expected := []int64{1, 0, 0, 0, 1, 0}
+	for i, b := range c.sizeHistogram() {
+		if b.Entries != expected[i] {
+			t.Errorf("bucket %d: expected %d entries, got %d", i, expected[i], b.Entries)
+		}
+	}
+
+	w := &strings.Builder{}
+	c.WritePrometheus(w)
+	for _, line := range []string{
+		`picocache_entry_size_bytes_bucket{le="4095"} 1`,
+		`picocache_entry_size_bytes_bucket{le="268435455"} 2`,
+		`picocache_entry_size_bytes_bucket{le="+Inf"} 2`,
+		`picocache_entry_size_bytes_count 2`,
+	} {
+		if !strings.Contains(w.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, w.String())
+		}
+	}
+}
+
+func TestTopEntries(t *testing.T) {
+	c := &PicoCache{}
+	all := []*cacheEntry{}
+	for i := range 500 {
+		entry := &cacheEntry{filename: fmt.Sprint(i), size: rand.Int64N(100)}
+		entry.lastUsed.Store(rand.Int64N(100))
+		c.entries.Store(entry.filename, entry)
+		all = append(all, entry)
+	}
+
+	for _, tc := range []struct {
+		name string
+		less func(a, b *cacheEntry) bool
+		key  func(e *cacheEntry) int64
+	}{
+		{"size", bySize, func(e *cacheEntry) int64 { return -e.size }},
+		{"age", byAge, func(e *cacheEntry) int64 { return e.lastUsed.Load() }},
+	} {
+		sorted := slices.Clone(all)
+		slices.SortStableFunc(sorted, func(a, b *cacheEntry) int { return int(tc.key(a) - tc.key(b)) })
+
+		for _, n := range []int{1, 10, 50, 500, 1000} {
+			top := c.topEntries(n, tc.less)
+			if len(top) != min(n, len(all)) {
+				t.Fatalf("%s top %d: got %d entries", tc.name, n, len(top))
+			}
+			for i := range top {
+				if tc.key(top[i]) != tc.key(sorted[i]) {
+					t.Fatalf("%s top %d: entry %d differs from the full sort", tc.name, n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestServeTop(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/bbbb", "/cc"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	top := func(query string, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/__picocache/top?"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, token := range []string{"", "nope"} {
+		if w := top("by=size", token); w.Code != http.StatusForbidden {
+			t.Fatalf("expected untrusted clients refused, got %d", w.Code)
+		}
+	}
+
+	w := top("by=size&n=2", "s3cret")
+	entries := []TopEntry{}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Size != 5 || entries[1].Size != 3 {
+		t.Fatalf("unexpected top entries %+v", entries)
+	}
+
+	for _, query := range []string{"by=name", "n=0", "n=abc"} {
+		if w := top(query, "s3cret"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a bad request, got %d", query, w.Code)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,13 @@
+package picocache
+
+const defaultProtectedShare = 0.8
+
+// WithProtectedShare sets the share of the cache reserved to entries hit at
+// least once since they were filled. Eviction drains entries which were
+// never hit first, so a burst of new content can't flush the hot set. Zero
+// falls back to a plain LRU.
+func WithProtectedShare(share float64) Option {
+	return func(c *PicoCache) {
+		c.policy.protectedShare = min(max(share, 0), 1)
+	}
+}
@@ -0,0 +1,187 @@
+package picocache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hotSetSurvival fills a hot set, floods the cache with one-off requests
+// and returns how many hot entries are still cached.
+func hotSetSurvival(t *testing.T, opts ...Option) int {
+	body := bytes.Repeat([]byte("x"), 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	opts = append([]Option{WithBlockSize(1)}, opts...)
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1000, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settle := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for cache.totalSize.Load() > cache.maxCacheSize.Load() {
+			if time.Now().After(deadline) {
+				t.Fatal("cache never shrunk back to its size limit")
+			}
+			cache.cleanupOldEntries()
+			time.Sleep(time.Millisecond)
+		}
+	}
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		settle()
+		return w.Header().Get("X-Cache")
+	}
+
+	for i := range 5 {
+		get(fmt.Sprintf("/hot/%d", i))
+		get(fmt.Sprintf("/hot/%d", i))
+	}
+	for i := range 30 {
+		get(fmt.Sprintf("/flood/%d", i))
+	}
+
+	survivors := 0
+	for i := range 5 {
+		if get(fmt.Sprintf("/hot/%d", i)) == "HIT" {
+			survivors++
+		}
+	}
+	return survivors
+}
+
+func TestSegmentedLRUProtectsHotSet(t *testing.T) {
+	if n := hotSetSurvival(t); n != 5 {
+		t.Fatalf("expected the whole hot set to survive the flood, %d did", n)
+	}
+	if n := hotSetSurvival(t, WithProtectedShare(0)); n != 0 {
+		t.Fatalf("expected plain LRU to lose the hot set, %d survived", n)
+	}
+}
+
+func TestSegmentedLRUDemotesOverflow(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1000, WithBlockSize(1), WithProtectedShare(0.2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hit everything, more than the protected segment can hold
+	for i := range 10 {
+		for range 2 {
+			w := httptest.NewRecorder()
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil))
+		}
+	}
+	cache.cleanupOldEntries()
+
+	protected := 0
+	cache.entries.Range(func(key, value any) bool {
+		if value.(*cacheEntry).protected.Load() {
+			protected++
+		}
+		return true
+	})
+	if protected > 2 {
+		t.Fatalf("protected segment holds %d entries, more than its 20%% share", protected)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+// TestEvictionAccounting fills, purges and evicts concurrently, checking
+// sizes are never subtracted twice and match the surviving entries.
+func TestEvictionAccounting(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Path[1:])
+		w.Write(bytes.Repeat([]byte("x"), 10+n))
+	}))
+	defer origin.Close()
+
+	const maxSize = 500
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), maxSize, WithBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	background := sync.WaitGroup{}
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.cleanupOldEntries()
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if size := cache.totalSize.Load(); size < 0 {
+					t.Errorf("negative total size %d", size)
+					return
+				}
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 40 {
+				path := fmt.Sprintf("/%d", (g*7+i)%32)
+				if i%10 == 0 {
+					cache.PurgePath(path)
+					continue
+				}
+				cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+	cache.cleanupOldEntries()
+
+	sum := int64(0)
+	cache.entries.Range(func(key, value any) bool {
+		entry := value.(*cacheEntry)
+		sum += entry.diskSize
+		if info, err := os.Stat(entry.filename); err != nil || info.Size() != entry.size {
+			t.Errorf("%s: file doesn't match its entry: %v", entry.filename, err)
+		}
+		return true
+	})
+	if size := cache.totalSize.Load(); size != sum || size > maxSize {
+		t.Fatalf("total size %d, entries sum to %d, max %d", size, sum, maxSize)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
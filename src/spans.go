@@ -0,0 +1,107 @@
+package picocache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+)
+
+// Names of the spans requests get, see WithTracer.
+const (
+	SpanRequest     = "picocache.request"      // the whole request, parent of the others
+	SpanResolveKey  = "picocache.resolve_key"  // picking the entry
+	SpanLookup      = "picocache.lookup"       // of the entry in the index
+	SpanLockWait    = "picocache.lock_wait"    // on a fill, file lock, reader or request slot
+	SpanOriginFetch = "picocache.origin_fetch" // a request to the source
+	SpanDiskWrite   = "picocache.disk_write"   // of a fill to its cache file
+	SpanClientCopy  = "picocache.client_copy"  // of the body to the client
+)
+
+// Tracer starts the spans of the requests served, see WithTracer. It lets
+// them join the traces of a tracing system, such as OpenTelemetry with the
+// otelspans module, without the cache depending on one.
+type Tracer interface {
+	// Extract returns ctx carrying the span context header propagates, as
+	// in traceparent and tracestate headers, if any.
+	Extract(ctx context.Context, header http.Header) context.Context
+	// StartSpan starts a span named name, child of the one ctx carries,
+	// returning a context carrying it.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+	// Inject sets the headers propagating the span ctx carries on header.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is a span a Tracer started.
+type Span interface {
+	// End ends the span with attrs, failed with err if not nil.
+	End(err error, attrs ...slog.Attr)
+}
+
+// WithTracer has tracer trace requests, as a SpanRequest span child of the
+// one their headers propagate, itself parent of the spans of the phases of
+// serving them. Requests to the source propagate their SpanOriginFetch
+// span, so that its spans link up.
+func WithTracer(tracer Tracer) Option {
+	return func(c *PicoCache) {
+		c.tracer = tracer
+	}
+}
+
+// span is a Span, doing nothing when the request isn't traced.
+type span struct {
+	Span
+}
+
+func (s span) end(err error, attrs ...slog.Attr) {
+	if s.Span != nil {
+		s.Span.End(err, attrs...)
+	}
+}
+
+// startRequestSpan starts the span of the request r of t with tracer.
+func (t *timings) startRequestSpan(tracer Tracer, r *http.Request) {
+	t.tracer = tracer
+	t.spanCtx, t.span = tracer.StartSpan(tracer.Extract(r.Context(), r.Header), SpanRequest)
+}
+
+// endRequestSpan ends the span of the request of t, served as ev.
+func (t *timings) endRequestSpan(ev RequestEvent) {
+	if t.span == nil {
+		return
+	}
+	var err error
+	if ev.Status >= http.StatusInternalServerError {
+		err = fmt.Errorf("status %d", ev.Status)
+	}
+	attrs := []slog.Attr{
+		slog.String("http.request.method", ev.Method),
+		slog.String("url.path", ev.Path),
+		slog.Int("http.response.status_code", ev.Status),
+		slog.String("picocache.outcome", ev.Cache.String()),
+		slog.Int64("picocache.bytes", ev.Bytes),
+	}
+	if t.cacheFile != "" {
+		attrs = append(attrs, slog.String("picocache.key", filepath.Base(t.cacheFile)))
+	}
+	t.span.End(err, attrs...)
+}
+
+// startSpan starts a span named name, child of the one of the request of t,
+// returning a context carrying it for inject. t may be nil.
+func (t *timings) startSpan(name string) (context.Context, span) {
+	if t == nil || t.tracer == nil {
+		return nil, span{}
+	}
+	ctx, s := t.tracer.StartSpan(t.spanCtx, name)
+	return ctx, span{s}
+}
+
+// inject sets the headers propagating the span ctx carries, as startSpan
+// returned it, on header.
+func (t *timings) inject(ctx context.Context, header http.Header) {
+	if ctx != nil {
+		t.tracer.Inject(ctx, header)
+	}
+}
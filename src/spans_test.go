@@ -0,0 +1,161 @@
+package picocache_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	picocache "picocache/src"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span recordingTracer saw end.
+type recordedSpan struct {
+	name   string
+	id     int
+	parent int // 0 for the root, -1 for a remote one
+	attrs  map[string]slog.Value
+	err    error
+}
+
+// recordingTracer records spans, propagating their ids as the span id of
+// traceparent headers.
+type recordingTracer struct {
+	mu     sync.Mutex
+	nextID int
+	ended  []recordedSpan
+}
+
+type spanKey struct{}
+
+func (tr *recordingTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if parts := strings.Split(header.Get("Traceparent"), "-"); len(parts) == 4 {
+		return context.WithValue(ctx, spanKey{}, -1)
+	}
+	return ctx
+}
+
+func (tr *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, picocache.Span) {
+	tr.mu.Lock()
+	tr.nextID++
+	s := &recordingSpan{tr: tr, span: recordedSpan{name: name, id: tr.nextID}}
+	tr.mu.Unlock()
+	s.span.parent, _ = ctx.Value(spanKey{}).(int)
+	return context.WithValue(ctx, spanKey{}, s.span.id), s
+}
+
+func (tr *recordingTracer) Inject(ctx context.Context, header http.Header) {
+	header.Set("Traceparent", fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%016x-01", ctx.Value(spanKey{}).(int)))
+}
+
+// spans returns the spans ended so far and forgets them.
+func (tr *recordingTracer) spans() []recordedSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	spans := tr.ended
+	tr.ended = nil
+	return spans
+}
+
+type recordingSpan struct {
+	tr   *recordingTracer
+	span recordedSpan
+}
+
+func (s *recordingSpan) End(err error, attrs ...slog.Attr) {
+	s.span.err = err
+	s.span.attrs = map[string]slog.Value{}
+	for _, a := range attrs {
+		s.span.attrs[a.Key] = a.Value
+	}
+	s.tr.mu.Lock()
+	s.tr.ended = append(s.tr.ended, s.span)
+	s.tr.mu.Unlock()
+}
+
+// headerRecorder records the headers of the requests it sends.
+type headerRecorder struct {
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func (h *headerRecorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	h.headers = append(h.headers, r.Header.Clone())
+	h.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestTracer(t *testing.T) {
+	origin := NewFakeOrigin(t)
+	origin.Handle("/a", OriginResponse{Body: "hello"})
+	tracer := &recordingTracer{}
+	sent := &headerRecorder{}
+	cache := NewTestCache(t, origin, 1<<20, picocache.WithTracer(tracer), picocache.WithOriginClient(&http.Client{Transport: sent}))
+	traceparent := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+
+	// checkSpans checks the request span, child of the remote one, and that
+	// its children are those named, returning them by name
+	checkSpans := func(outcome string, names ...string) map[string]recordedSpan {
+		t.Helper()
+		spans := tracer.spans()
+		if len(spans) == 0 || spans[len(spans)-1].name != picocache.SpanRequest {
+			t.Fatalf("expected the request span to end last, got %v", spans)
+		}
+		request := spans[len(spans)-1]
+		if request.parent != -1 || request.attrs["picocache.outcome"].String() != outcome ||
+			request.attrs["http.response.status_code"].Int64() != http.StatusOK || request.attrs["picocache.bytes"].Int64() != 5 {
+			t.Fatalf("unexpected request span %+v", request)
+		}
+		byName := map[string]recordedSpan{}
+		var got []string
+		for _, s := range spans[:len(spans)-1] {
+			if s.parent != request.id || s.err != nil {
+				t.Fatalf("expected %s to be a successful child of the request span, got %+v", s.name, s)
+			}
+			byName[s.name] = s
+			got = append(got, s.name)
+		}
+		if !slices.Equal(got, names) {
+			t.Fatalf("expected spans %v, got %v", names, got)
+		}
+		return byName
+	}
+
+	w := cache.Get("/a", traceparent)
+	if w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected a miss, got %s", w.Header().Get("X-Cache"))
+	}
+	spans := checkSpans("MISS", picocache.SpanResolveKey, picocache.SpanLookup, picocache.SpanOriginFetch,
+		picocache.SpanDiskWrite, picocache.SpanClientCopy)
+	fetch := spans[picocache.SpanOriginFetch]
+	if fetch.attrs["picocache.fetch"].String() != "fill" || fetch.attrs["http.response.status_code"].Int64() != http.StatusOK ||
+		fetch.attrs["picocache.bytes"].Int64() != 5 {
+		t.Fatalf("unexpected origin fetch span %+v", fetch)
+	}
+	if n := spans[picocache.SpanDiskWrite].attrs["picocache.bytes"].Int64(); n != 5 {
+		t.Fatalf("expected 5 bytes written, got %d", n)
+	}
+	if n := spans[picocache.SpanClientCopy].attrs["picocache.bytes"].Int64(); n != 5 {
+		t.Fatalf("expected 5 bytes copied, got %d", n)
+	}
+	if held := spans[picocache.SpanLookup].attrs["picocache.held"].Bool(); held {
+		t.Fatal("expected the lookup of a miss not to find the entry")
+	}
+	// The source gets the span of the fetch
+	if got, want := sent.headers[len(sent.headers)-1].Get("Traceparent"), fmt.Sprintf("-%016x-", fetch.id); !strings.Contains(got, want) {
+		t.Fatalf("expected the source to get traceparent with span %d, got %q", fetch.id, got)
+	}
+
+	cache.Get("/a", traceparent)
+	spans = checkSpans("HIT", picocache.SpanResolveKey, picocache.SpanLookup, picocache.SpanClientCopy)
+	if held := spans[picocache.SpanLookup].attrs["picocache.held"].Bool(); !held {
+		t.Fatal("expected the lookup of a hit to find the entry")
+	}
+	if key := spans[picocache.SpanResolveKey].attrs["picocache.key"].String(); key != w.Header().Get("X-Cache-Key") {
+		t.Fatalf("expected key %s, got %s", w.Header().Get("X-Cache-Key"), key)
+	}
+}
@@ -0,0 +1,71 @@
+package picocache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleWarning is sent along with entries served stale as the source
+// failed.
+const staleWarning = `111 - "Revalidation failed"`
+
+// WithStaleIfError serves expired entries for up to window past their
+// expiry when the source fails to fill them again, not answering or
+// answering with a server error, rather than failing the request. They're
+// sent as STALE, along with a 111 Warning. An entry whose source response
+// had a stale-if-error Cache-Control directive, or a request sending one,
+// get the longest of the windows, whether this is set or not.
+func WithStaleIfError(window time.Duration) Option {
+	return func(c *PicoCache) {
+		c.staleIfError = window
+	}
+}
+
+// errSourceFailed is the error of fills the source failed, see
+// WithStaleIfError.
+var errSourceFailed = errors.New("source failed the fill")
+
+// sourceFailed tells whether err is the source failing, rather than the
+// cache turning the fill down.
+func sourceFailed(err error) bool {
+	return errors.Is(err, errSourceFailed) || errors.Is(err, errOriginDown) || errors.Is(err, errFirstByteTimeout)
+}
+
+// parseStaleIfError returns the stale-if-error window of a Cache-Control
+// header, 0 if it has none.
+func parseStaleIfError(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(name, "stale-if-error") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+		if err != nil || seconds <= 0 {
+			return 0
+		}
+		// Over a century, to keep it from overflowing
+		return time.Duration(min(seconds, 1<<32)) * time.Second
+	}
+	return 0
+}
+
+// failOver tells whether the expired entry stale may be served in place of
+// the fill the source failed with err, recording it for t if so.
+func (c *PicoCache) failOver(stale *cacheEntry, err error, t *timings) bool {
+	if !sourceFailed(err) {
+		return false
+	}
+	window := max(c.staleIfError, stale.staleIfError, t.staleIfError)
+	over := c.steadyNow().Sub(stale.expires)
+	if window == 0 || over > window {
+		return false
+	}
+	t.trace("source failed, served stale %s into its %s stale-if-error window", over.Round(time.Millisecond), window)
+	t.failedOver = true
+	c.stats.stale.Add(1)
+	c.stats.staleIfError.Add(1)
+	c.policy.hit(stale)
+	return true
+}
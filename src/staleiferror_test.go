@@ -0,0 +1,71 @@
+package picocache_test
+
+import (
+	"net/http"
+	picocache "picocache/src"
+	"testing"
+	"time"
+)
+
+func TestStaleIfError(t *testing.T) {
+	rules, err := picocache.ParseRules(".txt ttl=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := NewFakeOrigin(t)
+	origin.Handle("/a.txt", OriginResponse{Body: "a", Header: http.Header{"Cache-Control": {"max-age=60, stale-if-error=600"}}})
+	cache := NewTestCache(t, origin, 1<<20, picocache.WithRules(rules...))
+	cache.Expect("/a.txt", "MISS", "a")
+	cache.Expect("/b.txt", "MISS", "/b.txt")
+	expectStale := func(path, body string, header http.Header) {
+		t.Helper()
+		w := cache.Get(path, header)
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" || w.Body.String() != body || w.Header().Get("Warning") != `111 - "Revalidation failed"` {
+			t.Fatalf("%s: expected served stale, got %d %s %q, Warning %q", path, w.Code, w.Header().Get("X-Cache"), w.Body.String(), w.Header().Get("Warning"))
+		}
+	}
+	expectFailed := func(path string, header http.Header) {
+		t.Helper()
+		if w := cache.Get(path, header); w.Code == http.StatusOK {
+			t.Fatalf("%s: expected the failure passed on, got %d %s %q", path, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+
+	// The source tells how long its entries may outlive it
+	cache.Clock.Advance(2 * time.Minute)
+	origin.SetDown(true)
+	expectStale("/a.txt", "a", nil)
+	expectFailed("/b.txt", nil)
+
+	// Clients may allow it too
+	expectStale("/b.txt", "/b.txt", http.Header{"Cache-Control": {"max-age=0, stale-if-error=300"}})
+
+	// The window of the source survives restarts, server errors count too
+	cache.Reopen()
+	origin.SetDown(false)
+	origin.Handle("/a.txt", OriginResponse{Status: http.StatusServiceUnavailable})
+	expectStale("/a.txt", "a", nil)
+	origin.Handle("/b.txt", OriginResponse{Status: http.StatusNotFound})
+	expectFailed("/b.txt", http.Header{"Cache-Control": {"stale-if-error=300"}})
+	if s := cache.Stats(); s.StaleIfError != 1 {
+		t.Fatalf("expected an entry served stale since the restart, got %d", s.StaleIfError)
+	}
+
+	// Past the window, failures get through
+	cache.Clock.Advance(10 * time.Minute)
+	expectFailed("/a.txt", nil)
+	expectFailed("/a.txt", http.Header{"Cache-Control": {"stale-if-error=300"}})
+	expectStale("/a.txt", "a", http.Header{"Cache-Control": {"stale-if-error=3600"}})
+
+	// A window may be set for every entry
+	cache.opts = append(cache.opts, picocache.WithStaleIfError(time.Hour))
+	cache.Reopen()
+	origin.Handle("/b.txt", OriginResponse{Status: http.StatusBadGateway})
+	expectStale("/a.txt", "a", nil)
+	expectStale("/b.txt", "/b.txt", nil)
+
+	// Once the source is back, entries are filled again
+	origin.Handle("/a.txt", OriginResponse{Body: "a2"})
+	cache.Expect("/a.txt", "MISS", "a2")
+	cache.Expect("/a.txt", "HIT", "a2")
+}
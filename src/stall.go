@@ -0,0 +1,15 @@
+package picocache
+
+import "time"
+
+const defaultWriteStallTimeout = time.Minute
+
+// WithWriteStallTimeout drops clients which don't take any of the response
+// for d while it's being sent, so they don't hold an entry and a request
+// slot forever. Clients slowly downloading a large object are kept as long
+// as they make progress. Zero disables it.
+func WithWriteStallTimeout(d time.Duration) Option {
+	return func(c *PicoCache) {
+		c.writeStallTimeout = d
+	}
+}
@@ -0,0 +1,82 @@
+package picocache
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteStallTimeout(t *testing.T) {
+	body := bytes.Repeat([]byte("Yay"), 8<<20)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<30, WithWriteStallTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	// Fill it first, the stall is on a hit
+	resp, err := http.Get(server.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := io.Copy(io.Discard, resp.Body); n != int64(len(body)) {
+		t.Fatalf("expected %d bytes, got %d", len(body), n)
+	}
+	resp.Body.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	conn.Write([]byte("GET /big HTTP/1.1\r\nHost: x\r\n\r\n"))
+	conn.Read(make([]byte, 4096))
+
+	start := time.Now()
+	for deadline := time.Now().Add(5 * time.Second); cache.Stats().ClientStalls == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled client never dropped")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled client dropped after %s", elapsed)
+	}
+	e, _ := cache.entries.Load(cache.getCacheFilename("/big"))
+	for deadline := time.Now().Add(time.Second); e.(*cacheEntry).readers.Load() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stalled client to stop reading the entry")
+		}
+	}
+
+	// Slow but steady clients get it all
+	resp, err = http.Get(server.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	n := int64(0)
+	for {
+		m, err := io.CopyN(io.Discard, resp.Body, 4<<20)
+		n += m
+		if err != nil {
+			break
+		}
+		time.Sleep(60 * time.Millisecond)
+	}
+	if n != int64(len(body)) {
+		t.Fatalf("expected %d bytes read slowly, got %d", len(body), n)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,588 @@
+package picocache
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type stats struct {
+	hits                atomic.Int64
+	misses              atomic.Int64
+	stale               atomic.Int64
+	admissionRejections atomic.Int64
+	normalizedRequests  atomic.Int64
+	keyMismatches       atomic.Int64
+	rehomed             atomic.Int64
+	originViolations    atomic.Int64
+	partialResponses    atomic.Int64
+	originThrottled     atomic.Int64
+	rejectedContentType atomic.Int64
+	rejectedBody        atomic.Int64
+	releaseDenied       atomic.Int64
+	refusedRequests     atomic.Int64
+	offlineMisses       atomic.Int64
+	releaseMismatches   atomic.Int64
+	foreignRefills      atomic.Int64
+	fillsOverBudget     atomic.Int64
+	staleIfError        atomic.Int64
+	expirations         atomic.Int64
+	clockSteps          atomic.Int64
+	quarantined         atomic.Int64
+	revalidated         atomic.Int64
+	metadataRefreshed   atomic.Int64
+	refreshed           atomic.Int64
+	abandonedCompleted  atomic.Int64
+	abandonedAborted    atomic.Int64
+	readerRejections    atomic.Int64
+	clientStalls        atomic.Int64
+	streamedFills       atomic.Int64
+	resumedFills        atomic.Int64
+	evictionBatches     atomic.Int64
+	originConnsReused   atomic.Int64
+	originDials         atomic.Int64
+	originTLSHandshakes atomic.Int64
+	originBytes         atomic.Int64
+	sizes               [6]atomic.Int64 // entries per sizeBucket
+}
+
+// Stats is a point-in-time snapshot of the cache counters.
+type Stats struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+
+	Entries     int64  `json:"entries"`
+	TotalSize   int64  `json:"total_size"`   // disk usage, rounded to the block size
+	LogicalSize int64  `json:"logical_size"` // sum of the entries content length
+	DedupSaved  int64  `json:"dedup_saved"`  // disk space saved by shared bodies
+	MaxSize     int64  `json:"max_size"`
+	ShrinkLimit int64  `json:"shrink_limit,omitempty"` // what's left to evict down to, until it reaches MaxSize
+	ReadOnly    bool   `json:"read_only"`
+	Frozen      bool   `json:"frozen"`    // see Freeze
+	Offline     bool   `json:"offline"`   // see WithOffline
+	Drain       string `json:"drain"`     // serving, draining or stopped, see Drain
+	InFlight    int64  `json:"in_flight"` // requests being served, outside of the admin API
+
+	SizeHistogram []SizeBucket `json:"size_histogram"`
+
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Stale  int64 `json:"stale"` // expired entries served, see WithMaxRevalidations
+
+	AdmissionRejections int64 `json:"admission_rejections"`
+	NormalizedRequests  int64 `json:"normalized_requests"`
+	KeyMismatches       int64 `json:"key_mismatches"`
+	Rehomed             int64 `json:"rehomed"` // entries moved from their previous key, see WithKeyMigration
+	Expirations         int64 `json:"expirations"`
+	ClockSteps          int64 `json:"clock_steps"`        // backwards steps of the wall clock taken out of expiry and recency
+	Quarantined         int64 `json:"quarantined"`        // entries failing to be served, see WithQuarantine
+	Revalidated         int64 `json:"revalidated"`        // entries found unchanged at the source rather than fetched again
+	MetadataRefreshed   int64 `json:"metadata_refreshed"` // entries updated from the source headers, see RefreshMetadata
+	Refreshed           int64 `json:"refreshed"`          // entries fetched again, see Refresh
+	ReaderRejections    int64 `json:"reader_rejections"`
+	ClientStalls        int64 `json:"client_stalls"`    // clients dropped for not reading, see WithWriteStallTimeout
+	StreamedFills       int64 `json:"streamed_fills"`   // misses served while filling, see WithStreamingFills
+	ResumedFills        int64 `json:"resumed_fills"`    // completed from the bytes a failed one kept, see WithResumableFills
+	EvictionBatches     int64 `json:"eviction_batches"` // batches of victims eviction passes went through
+
+	AbandonedFillsCompleted int64 `json:"abandoned_fills_completed"`
+	AbandonedFillsAborted   int64 `json:"abandoned_fills_aborted"`
+
+	OriginConnsReused   int64 `json:"origin_conns_reused"`
+	OriginDials         int64 `json:"origin_dials"`
+	OriginTLSHandshakes int64 `json:"origin_tls_handshakes"`
+	OriginViolations    int64 `json:"origin_violations"`
+	PartialResponses    int64 `json:"partial_responses"`     // unexpected 206s from the source, streamed uncached
+	OriginThrottled     int64 `json:"origin_throttled"`      // 429s from the source
+	RejectedContentType int64 `json:"rejected_content_type"` // see WithContentTypeValidation
+	RejectedBody        int64 `json:"rejected_body"`         // see WithBodyBlocklist
+	ReleaseDenied       int64 `json:"release_denied"`        // requests for paths not in the release manifest
+	RefusedRequests     int64 `json:"refused_requests"`      // for a method, target or host not served
+	OfflineMisses       int64 `json:"offline_misses"`        // requests for objects not held, while offline
+	ReleaseMismatches   int64 `json:"release_mismatches"`    // fills differing from the release manifest
+	FillsOverBudget     int64 `json:"fills_over_budget"`     // of unknown length, abandoned midway over the fill byte budget
+	StaleIfError        int64 `json:"stale_if_error"`        // expired entries served stale as the source failed, see WithStaleIfError
+
+	Source         string `json:"source,omitempty"` // as entries record it, empty while offline
+	ForeignEntries int64  `json:"foreign_entries"`  // held, filled from another source
+	ForeignRefills int64  `json:"foreign_refills"`  // entries of another source revalidated or fetched again, see WithStrictOrigin
+
+	OriginBytes   int64 `json:"origin_bytes"`
+	OriginBytes1m int64 `json:"origin_bytes_1m"`
+	OriginBytes5m int64 `json:"origin_bytes_5m"`
+	OriginBytes1h int64 `json:"origin_bytes_1h"`
+
+	OriginBudget *OriginBudgetStats `json:"origin_budget,omitempty"` // see WithOriginByteBudget
+	OriginRate   *OriginRateStats   `json:"origin_rate,omitempty"`   // see WithOriginRateLimit
+	FillBudget   *OriginBudgetStats `json:"fill_budget,omitempty"`   // see WithFillByteBudget
+	KeyFlood     *KeyFloodStats     `json:"key_flood,omitempty"`     // see WithKeyFloodGuard
+
+	Aux    AuxStats    `json:"aux"`    // records held apart from body entries, see WithMaxAuxEntries
+	Legacy LegacyStats `json:"legacy"` // entries without metadata, see WithLegacyUpgrades
+
+	Shadow map[string]int64 `json:"shadow"` // decisions of the policies in observe mode not acted on, by policy, see WithPolicyMode
+
+	Warm *WarmStats `json:"warm,omitempty"` // see WithWarmFrom
+
+	Dirs []DirStats `json:"dirs,omitempty"` // with several directories, see WithCacheDirs
+
+	TTFB     map[string]LatencySummary `json:"ttfb"`      // by cache outcome
+	LockWait map[string]LatencySummary `json:"lock_wait"` // blocked on fills, entry locks or queues, by cache outcome
+	Outcomes map[string]int64          `json:"outcomes"`  // requests served, by outcome in lower case
+
+	Blocked      int64         `json:"blocked"`       // requests blocked right now
+	LongestWaits []BlockedWait `json:"longest_waits"` // of those, up to 10
+
+	Fills []FillProgress `json:"fills"` // in progress, oldest first
+
+	WouldHaveHits map[string]WouldHaveHits `json:"would_have_hits,omitempty"` // by loss reason, see WithGhosts
+
+	TracesDropped int64 `json:"traces_dropped,omitempty"` // requests left out of the trace file, see WithTraceFile
+	LogSuppressed int64 `json:"log_suppressed,omitempty"` // repeated log lines dropped, see WithLogSuppression
+
+	Admitted map[string]int64 `json:"admitted,omitempty"` // by request class, see WithMaxRequests
+	Shed     map[string]int64 `json:"shed,omitempty"`
+
+	Origin *OriginHealth `json:"origin,omitempty"` // only when probing
+
+	MaintenanceOpen bool               `json:"maintenance_open"` // within a maintenance window, see WithMaintenanceWindows
+	Maintenance     []MaintenanceStats `json:"maintenance"`
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *PicoCache) Stats() Stats {
+	entries, foreign, legacy := int64(0), int64(0), int64(0)
+	c.entries.Range(func(key, value any) bool {
+		if value.(*cacheEntry).negative() {
+			return true
+		}
+		entries++
+		if c.foreign(value.(*cacheEntry)) {
+			foreign++
+		}
+		if value.(*cacheEntry).legacy.Load() {
+			legacy++
+		}
+		return true
+	})
+
+	s := Stats{
+		Version: Version,
+		Commit:  Commit,
+
+		Entries:     entries,
+		TotalSize:   c.totalSize.Load(),
+		LogicalSize: c.logicalSize.Load(),
+		DedupSaved:  c.dedupSavedBytes(),
+		MaxSize:     c.maxCacheSize.Load(),
+		ReadOnly:    c.readOnly.Load(),
+		Frozen:      c.frozen.Load(),
+		Offline:     c.offline,
+		Drain:       c.DrainState(),
+		InFlight:    c.inFlight.Load(),
+
+		SizeHistogram: c.sizeHistogram(),
+
+		Hits:   c.stats.hits.Load(),
+		Misses: c.stats.misses.Load(),
+		Stale:  c.stats.stale.Load(),
+
+		AdmissionRejections: c.stats.admissionRejections.Load(),
+		NormalizedRequests:  c.stats.normalizedRequests.Load(),
+		KeyMismatches:       c.stats.keyMismatches.Load(),
+		Rehomed:             c.stats.rehomed.Load(),
+		Expirations:         c.stats.expirations.Load(),
+		ClockSteps:          c.stats.clockSteps.Load(),
+		Quarantined:         c.stats.quarantined.Load(),
+		Revalidated:         c.stats.revalidated.Load(),
+		MetadataRefreshed:   c.stats.metadataRefreshed.Load(),
+		Refreshed:           c.stats.refreshed.Load(),
+		ReaderRejections:    c.stats.readerRejections.Load(),
+		ClientStalls:        c.stats.clientStalls.Load(),
+		StreamedFills:       c.stats.streamedFills.Load(),
+		ResumedFills:        c.stats.resumedFills.Load(),
+		EvictionBatches:     c.stats.evictionBatches.Load(),
+
+		AbandonedFillsCompleted: c.stats.abandonedCompleted.Load(),
+		AbandonedFillsAborted:   c.stats.abandonedAborted.Load(),
+
+		OriginConnsReused:   c.stats.originConnsReused.Load(),
+		OriginDials:         c.stats.originDials.Load(),
+		OriginTLSHandshakes: c.stats.originTLSHandshakes.Load(),
+		OriginViolations:    c.stats.originViolations.Load(),
+		PartialResponses:    c.stats.partialResponses.Load(),
+		OriginThrottled:     c.stats.originThrottled.Load(),
+		RejectedContentType: c.stats.rejectedContentType.Load(),
+		RejectedBody:        c.stats.rejectedBody.Load(),
+		ReleaseDenied:       c.stats.releaseDenied.Load(),
+		RefusedRequests:     c.stats.refusedRequests.Load(),
+		OfflineMisses:       c.stats.offlineMisses.Load(),
+		ReleaseMismatches:   c.stats.releaseMismatches.Load(),
+		FillsOverBudget:     c.stats.fillsOverBudget.Load(),
+		StaleIfError:        c.stats.staleIfError.Load(),
+
+		Source:         c.originID,
+		ForeignEntries: foreign,
+		ForeignRefills: c.stats.foreignRefills.Load(),
+
+		OriginBytes:   c.stats.originBytes.Load(),
+		OriginBytes1m: c.originBytes.sum(time.Minute),
+		OriginBytes5m: c.originBytes.sum(5 * time.Minute),
+		OriginBytes1h: c.originBytes.sum(time.Hour),
+	}
+	s.TTFB, s.LockWait = map[string]LatencySummary{}, map[string]LatencySummary{}
+	for i, outcome := range ttfbOutcomes {
+		s.TTFB[outcome] = c.ttfb[i].summary()
+		s.LockWait[outcome] = c.lockWait[i].summary()
+	}
+	s.Blocked, s.LongestWaits = c.waits.blocked.Load(), c.waits.longest(maxLongestWaits)
+	s.Fills = c.Fills()
+	s.Outcomes = map[string]int64{}
+	for o := OutcomeHit; o < outcomeCount; o++ {
+		s.Outcomes[strings.ToLower(o.String())] = c.outcomes[o].Load()
+	}
+	if c.shrinking.Load() != nil {
+		s.ShrinkLimit = c.evictionLimit()
+	}
+	if c.ghosts != nil {
+		s.WouldHaveHits = c.ghosts.summary()
+	}
+	if c.traceFile != nil {
+		s.TracesDropped = c.traceFile.dropped.Load()
+	}
+	if c.logSuppressor != nil {
+		s.LogSuppressed = c.logSuppressor.suppressed.Load()
+	}
+	if c.limit != nil {
+		s.Admitted, s.Shed = c.limit.summary()
+	}
+	if c.probe != nil {
+		s.Origin = c.probe.health()
+	}
+	if c.budget != nil {
+		s.OriginBudget = c.budget.stats(c.steadyNow())
+	}
+	if c.originRate != nil {
+		s.OriginRate = c.originRate.stats(time.Now())
+	}
+	if c.fillBudget != nil {
+		s.FillBudget = c.fillBudget.stats(c.steadyNow())
+	}
+	if c.keyFlood != nil {
+		s.KeyFlood = c.keyFlood.stats(c.steadyNow())
+	}
+	s.Aux = c.auxStats()
+	s.Legacy = c.legacyStats(legacy)
+	s.Shadow = c.shadowStats()
+	s.Warm = c.warmStats()
+	s.Dirs = c.dirStats()
+	s.MaintenanceOpen = c.inWindow()
+	s.Maintenance = c.maintenance.summary()
+	return s
+}
+
+type metric struct {
+	name, typ, help string
+	value           float64
+}
+
+// histogram is a cumulative Prometheus histogram, see sizeHistogram.
+type histogram struct {
+	name, help string
+	labels     string    // e.g. outcome="hit", if any
+	bounds     []float64 // upper bounds of all buckets but the +Inf one
+	counts     []int64   // per bucket, not cumulative
+	sum        float64
+}
+
+func (s Stats) metrics() []metric {
+	metrics := []metric{
+		{"picocache_entries", "gauge", "Number of cached entries.", float64(s.Entries)},
+		{"picocache_size_bytes", "gauge", "Disk space used by cached entries.", float64(s.TotalSize)},
+		{"picocache_logical_size_bytes", "gauge", "Content length of cached entries.", float64(s.LogicalSize)},
+		{"picocache_dedup_saved_bytes", "gauge", "Disk space saved by sharing identical bodies.", float64(s.DedupSaved)},
+		{"picocache_max_size_bytes", "gauge", "Configured maximum cache size.", float64(s.MaxSize)},
+		{"picocache_read_only", "gauge", "Whether the cache directory became read-only.", boolValue(s.ReadOnly)},
+		{"picocache_frozen", "gauge", "Whether the cache got frozen by the operator.", boolValue(s.Frozen)},
+		{"picocache_offline", "gauge", "Whether the cache serves without a source.", boolValue(s.Offline)},
+		{"picocache_draining", "gauge", "Whether the cache is draining or drained, on its way out of its pool.", boolValue(s.Drain != "serving")},
+		{"picocache_in_flight_requests", "gauge", "Requests being served right now.", float64(s.InFlight)},
+		{"picocache_hits_total", "counter", "Requests served from the cache.", float64(s.Hits)},
+		{"picocache_misses_total", "counter", "Requests fetched from the source.", float64(s.Misses)},
+		{"picocache_stale_total", "counter", "Expired entries served while over the revalidation budget.", float64(s.Stale)},
+		{"picocache_admission_rejections_total", "counter", "Requests streamed uncached as not yet admitted.", float64(s.AdmissionRejections)},
+		{"picocache_normalized_requests_total", "counter", "Requests whose path got normalized.", float64(s.NormalizedRequests)},
+		{"picocache_expirations_total", "counter", "Hits on entries whose TTL elapsed, fetched again.", float64(s.Expirations)},
+		{"picocache_clock_steps_total", "counter", "Backwards steps of the wall clock detected.", float64(s.ClockSteps)},
+		{"picocache_quarantined_total", "counter", "Entries quarantined after failing to be served too many times in a row.", float64(s.Quarantined)},
+		{"picocache_revalidated_total", "counter", "Entries found unchanged at the source by a conditional request.", float64(s.Revalidated)},
+		{"picocache_metadata_refreshed_total", "counter", "Entries whose metadata got updated from the source headers.", float64(s.MetadataRefreshed)},
+		{"picocache_refreshed_total", "counter", "Entries fetched again from the source on request.", float64(s.Refreshed)},
+		{"picocache_reader_rejections_total", "counter", "Requests rejected as too many clients were reading their entry.", float64(s.ReaderRejections)},
+		{"picocache_client_stalls_total", "counter", "Responses cut short as the client stopped reading them.", float64(s.ClientStalls)},
+		{"picocache_streamed_fills_total", "counter", "Misses served from the file while it was being filled.", float64(s.StreamedFills)},
+		{"picocache_resumed_fills_total", "counter", "Fills completed from what arrived of a failed one.", float64(s.ResumedFills)},
+		{"picocache_eviction_batches_total", "counter", "Batches of victims picked by eviction passes.", float64(s.EvictionBatches)},
+		{"picocache_abandoned_fills_completed_total", "counter", "Fills completed after all their clients gave up.", float64(s.AbandonedFillsCompleted)},
+		{"picocache_abandoned_fills_aborted_total", "counter", "Fills aborted after all their clients gave up.", float64(s.AbandonedFillsAborted)},
+		{"picocache_key_mismatches_total", "counter", "Requests whose X-Picocache-Expect-Key didn't match their cache key.", float64(s.KeyMismatches)},
+		{"picocache_rehomed_total", "counter", "Entries moved from their key under the previous key scheme.", float64(s.Rehomed)},
+		{"picocache_origin_conns_reused_total", "counter", "Source requests sent over a reused connection.", float64(s.OriginConnsReused)},
+		{"picocache_origin_dials_total", "counter", "New connections dialed to the source.", float64(s.OriginDials)},
+		{"picocache_origin_tls_handshakes_total", "counter", "TLS handshakes with the source.", float64(s.OriginTLSHandshakes)},
+		{"picocache_origin_violations_total", "counter", "Malformed or implausible source responses.", float64(s.OriginViolations)},
+		{"picocache_origin_partial_responses_total", "counter", "Partial content sent by the source to unranged fills.", float64(s.PartialResponses)},
+		{"picocache_origin_throttled_total", "counter", "Requests the source answered 429.", float64(s.OriginThrottled)},
+		{`picocache_origin_rejected_responses_total{reason="content_type"}`, "counter", "Source responses not cached as error pages.", float64(s.RejectedContentType)},
+		{`picocache_origin_rejected_responses_total{reason="body"}`, "counter", "Source responses not cached as error pages.", float64(s.RejectedBody)},
+		{"picocache_release_denied_total", "counter", "Requests for paths not in the release manifest.", float64(s.ReleaseDenied)},
+		{"picocache_refused_requests_total", "counter", "Requests refused for their method, target form or host.", float64(s.RefusedRequests)},
+		{"picocache_offline_misses_total", "counter", "Requests for objects not held, refused while offline.", float64(s.OfflineMisses)},
+		{"picocache_release_mismatches_total", "counter", "Fills not cached as their body differed from the release manifest.", float64(s.ReleaseMismatches)},
+		{"picocache_fills_over_budget_total", "counter", "Fills of unknown length abandoned midway over the fill byte budget.", float64(s.FillsOverBudget)},
+		{"picocache_stale_if_error_total", "counter", "Expired entries served stale as the source failed to fill them again.", float64(s.StaleIfError)},
+		{"picocache_foreign_entries", "gauge", "Entries held that were filled from another source.", float64(s.ForeignEntries)},
+		{"picocache_foreign_refills_total", "counter", "Entries of another source revalidated or fetched again before being served.", float64(s.ForeignRefills)},
+		{"picocache_origin_bytes_total", "counter", "Body bytes fetched from the source.", float64(s.OriginBytes)},
+		{"picocache_origin_bytes_1m", "gauge", "Body bytes fetched from the source during the last minute.", float64(s.OriginBytes1m)},
+		{"picocache_origin_bytes_5m", "gauge", "Body bytes fetched from the source during the last 5 minutes.", float64(s.OriginBytes5m)},
+		{"picocache_origin_bytes_1h", "gauge", "Body bytes fetched from the source during the last hour.", float64(s.OriginBytes1h)},
+		{"picocache_blocked_requests", "gauge", "Requests blocked on concurrent fills, entry locks or queues right now.", float64(s.Blocked)},
+		{"picocache_log_suppressed_total", "counter", "Repeated log lines dropped.", float64(s.LogSuppressed)},
+	}
+	for _, q := range []struct {
+		name, help string
+		value      func(LatencySummary) float64
+	}{
+		{"p50", "Median time to first byte, estimated from its histogram.", func(l LatencySummary) float64 { return l.P50 }},
+		{"p90", "90th percentile of the time to first byte.", func(l LatencySummary) float64 { return l.P90 }},
+		{"p99", "99th percentile of the time to first byte.", func(l LatencySummary) float64 { return l.P99 }},
+	} {
+		for _, outcome := range ttfbOutcomes {
+			name := "picocache_ttfb_" + q.name + `_seconds{outcome="` + outcome + `"}`
+			metrics = append(metrics, metric{name, "gauge", q.help, q.value(s.TTFB[outcome])})
+		}
+	}
+	for o := OutcomeHit; o < outcomeCount; o++ {
+		outcome := strings.ToLower(o.String())
+		name := `picocache_requests_total{outcome="` + outcome + `"}`
+		metrics = append(metrics, metric{name, "counter", "Requests served, by cache outcome.", float64(s.Outcomes[outcome])})
+	}
+	for p := range policyCount {
+		name := `picocache_shadow_decisions_total{policy="` + p.String() + `"}`
+		metrics = append(metrics, metric{name, "counter", "Decisions of policies in observe mode not acted on, by policy.", float64(s.Shadow[p.String()])})
+	}
+	if s.WouldHaveHits != nil {
+		for _, reason := range ghostReasons {
+			name := `picocache_would_have_hits_total{reason="` + reason + `"}`
+			metrics = append(metrics, metric{name, "counter", "Misses on entries lost to eviction or restarts.", float64(s.WouldHaveHits[reason].Hits)})
+		}
+		for _, reason := range ghostReasons {
+			name := `picocache_would_have_hit_bytes_total{reason="` + reason + `"}`
+			metrics = append(metrics, metric{name, "counter", "Bytes fetched again for entries lost to eviction or restarts.", float64(s.WouldHaveHits[reason].Bytes)})
+		}
+	}
+	if s.Admitted != nil {
+		for _, class := range requestClasses {
+			name := `picocache_requests_admitted_total{class="` + class + `"}`
+			metrics = append(metrics, metric{name, "counter", "Requests admitted under the request limit, by probable outcome.", float64(s.Admitted[class])})
+		}
+		for _, class := range requestClasses {
+			name := `picocache_requests_shed_total{class="` + class + `"}`
+			metrics = append(metrics, metric{name, "counter", "Requests rejected over the request limit, by probable outcome.", float64(s.Shed[class])})
+		}
+	}
+	metrics = append(metrics, metric{"picocache_maintenance_open", "gauge", "Whether background maintenance is within its window.", boolValue(s.MaintenanceOpen)})
+	for _, task := range s.Maintenance {
+		name := `picocache_maintenance_runs_total{task="` + task.Task + `"}`
+		metrics = append(metrics, metric{name, "counter", "Runs of a maintenance task.", float64(task.Runs)})
+	}
+	for _, task := range s.Maintenance {
+		name := `picocache_maintenance_progress{task="` + task.Task + `"}`
+		metrics = append(metrics, metric{name, "gauge", "Entries handled by the current or last run of a maintenance task.", float64(task.Progress)})
+	}
+	for _, task := range s.Maintenance {
+		last := 0.0
+		if !task.LastRun.IsZero() {
+			last = float64(task.LastRun.UnixNano()) / 1e9
+		}
+		name := `picocache_maintenance_last_run_timestamp_seconds{task="` + task.Task + `"}`
+		metrics = append(metrics, metric{name, "gauge", "When the last run of a maintenance task started.", last})
+	}
+	if s.OriginBudget != nil {
+		metrics = append(metrics,
+			metric{"picocache_origin_budget_available_bytes", "gauge", "Body bytes left in the origin byte budget.", float64(s.OriginBudget.Available)},
+			metric{"picocache_origin_budget_refill_seconds", "gauge", "Time until the origin byte budget is full again.", s.OriginBudget.RefillIn.Seconds()},
+			metric{"picocache_origin_budget_refused_total", "counter", "Misses turned away or served stale over the origin byte budget.", float64(s.OriginBudget.Refused)},
+		)
+	}
+	if s.FillBudget != nil {
+		metrics = append(metrics,
+			metric{"picocache_fill_budget_available_bytes", "gauge", "Bytes left in the fill byte budget.", float64(s.FillBudget.Available)},
+			metric{"picocache_fill_budget_refill_seconds", "gauge", "Time until the fill byte budget is full again.", s.FillBudget.RefillIn.Seconds()},
+			metric{"picocache_fill_budget_refused_total", "counter", "Misses streamed from the source uncached over the fill byte budget.", float64(s.FillBudget.Refused)},
+		)
+	}
+	if s.KeyFlood != nil {
+		metrics = append(metrics,
+			metric{"picocache_key_flood_new_keys", "gauge", "New keys requested over the last key flood guard window, estimated.", float64(s.KeyFlood.NewKeys)},
+			metric{"picocache_key_flood_clients", "gauge", "Clients tracked by the key flood guard.", float64(s.KeyFlood.Clients)},
+			metric{`picocache_key_flood_refused_total{threshold="client"}`, "counter", "Requests for new keys refused by the key flood guard, by threshold.", float64(s.KeyFlood.ByClient)},
+			metric{`picocache_key_flood_refused_total{threshold="global"}`, "counter", "Requests for new keys refused by the key flood guard, by threshold.", float64(s.KeyFlood.ByGlobal)},
+		)
+	}
+	metrics = append(metrics,
+		metric{`picocache_aux_records{kind="negative"}`, "gauge", "Auxiliary records held apart from body entries, by kind.", float64(s.Aux.Negative)},
+		metric{`picocache_aux_records{kind="head"}`, "gauge", "Auxiliary records held apart from body entries, by kind.", float64(s.Aux.Head)},
+		metric{`picocache_aux_evicted_total{kind="negative"}`, "counter", "Auxiliary records evicted over their cap, by kind.", float64(s.Aux.NegativeEvicted)},
+		metric{`picocache_aux_evicted_total{kind="head"}`, "counter", "Auxiliary records evicted over their cap, by kind.", float64(s.Aux.HeadEvicted)},
+		metric{`picocache_aux_expired_total{kind="negative"}`, "counter", "Auxiliary records swept once expired, by kind.", float64(s.Aux.NegativeExpired)},
+		metric{`picocache_aux_expired_total{kind="head"}`, "counter", "Auxiliary records swept once expired, by kind.", float64(s.Aux.HeadExpired)},
+		metric{"picocache_legacy_entries", "gauge", "Entries found on startup without metadata, not upgraded yet.", float64(s.Legacy.Remaining)},
+		metric{"picocache_legacy_upgraded_total", "counter", "Legacy entries upgraded to entries with metadata.", float64(s.Legacy.Upgraded)},
+		metric{"picocache_legacy_validated_total", "counter", "Upgraded legacy entries bound to the validators of the source.", float64(s.Legacy.Validated)},
+		metric{"picocache_legacy_failed_total", "counter", "Legacy entry upgrades that failed.", float64(s.Legacy.Failed)},
+	)
+	if s.Warm != nil {
+		metrics = append(metrics,
+			metric{"picocache_warm_runs_total", "counter", "Times the cache got warmed from its listing.", float64(s.Warm.Runs)},
+			metric{`picocache_warm_entries_total{result="warmed"}`, "counter", "Listing entries warming went through, by result.", float64(s.Warm.Warmed)},
+			metric{`picocache_warm_entries_total{result="held"}`, "counter", "Listing entries warming went through, by result.", float64(s.Warm.Held)},
+			metric{`picocache_warm_entries_total{result="failed"}`, "counter", "Listing entries warming went through, by result.", float64(s.Warm.Failed)},
+			metric{`picocache_warm_entries_total{result="skipped"}`, "counter", "Listing entries warming went through, by result.", float64(s.Warm.Skipped)},
+		)
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		value           func(DirStats) float64
+	}{
+		{"picocache_dir_size_bytes", "gauge", "Physical size of the entries of each cache directory.", func(d DirStats) float64 { return float64(d.Size) }},
+		{"picocache_dir_max_size_bytes", "gauge", "Share of the max size of each cache directory.", func(d DirStats) float64 { return float64(d.MaxSize) }},
+		{"picocache_dir_offline", "gauge", "Whether each cache directory is offline.", func(d DirStats) float64 { return boolValue(d.Offline) }},
+		{"picocache_dir_failures_total", "counter", "Times each cache directory got taken offline.", func(d DirStats) float64 { return float64(d.Failures) }},
+	} {
+		for _, d := range s.Dirs {
+			metrics = append(metrics, metric{m.name + `{dir="` + labelValue(d.Path) + `"}`, m.typ, m.help, m.value(d)})
+		}
+	}
+	if s.OriginRate != nil {
+		metrics = append(metrics,
+			metric{"picocache_origin_rate_available_requests", "gauge", "Requests left in the origin request rate limit, negative when some wait.", float64(s.OriginRate.Available)},
+			metric{"picocache_origin_rate_waiters", "gauge", "Requests waiting for the origin request rate limit.", float64(s.OriginRate.Waiters)},
+			metric{"picocache_origin_rate_paused_seconds", "gauge", "Time until the origin request rate limit resumes after a 429.", s.OriginRate.PausedFor.Seconds()},
+			metric{"picocache_origin_rate_limited_total", "counter", "Requests turned away or served stale over the origin request rate limit.", float64(s.OriginRate.Limited)},
+		)
+	}
+	if s.Origin != nil {
+		metrics = append(metrics,
+			metric{"picocache_origin_up", "gauge", "Whether the source answers probes.", boolValue(s.Origin.Up)},
+			metric{"picocache_origin_probe_failures", "gauge", "Source probes failed in a row.", float64(s.Origin.ConsecutiveFailures)},
+			metric{"picocache_origin_probe_latency_seconds", "gauge", "Latency of the latest source probe.", s.Origin.Latency.Seconds()},
+		)
+	}
+	return metrics
+}
+
+func (s Stats) histograms() []histogram {
+	sizes := histogram{name: "picocache_entry_size_bytes", help: "Size of cached entries.", sum: float64(s.LogicalSize)}
+	for _, b := range s.SizeHistogram {
+		if b.Below != 0 {
+			// Prometheus bounds are inclusive
+			sizes.bounds = append(sizes.bounds, float64(b.Below-1))
+		}
+		sizes.counts = append(sizes.counts, b.Entries)
+	}
+	histograms := []histogram{sizes}
+
+	for _, outcome := range ttfbOutcomes {
+		ttfb := s.TTFB[outcome]
+		histograms = append(histograms, histogram{
+			name:   "picocache_ttfb_seconds",
+			help:   "Time to first byte sent to the client, by cache outcome.",
+			labels: `outcome="` + outcome + `"`,
+			bounds: LatencyBounds(),
+			counts: ttfb.Buckets,
+			sum:    ttfb.Sum,
+		})
+	}
+	for _, outcome := range ttfbOutcomes {
+		wait := s.LockWait[outcome]
+		histograms = append(histograms, histogram{
+			name:   "picocache_lock_wait_seconds",
+			help:   "Time requests were blocked on concurrent fills, entry locks or queues, by cache outcome.",
+			labels: `outcome="` + outcome + `"`,
+			bounds: LatencyBounds(),
+			counts: wait.Buckets,
+			sum:    wait.Sum,
+		})
+	}
+	return histograms
+}
+
+// family returns the name of the metric family of a series, stripping any
+// labels.
+func family(series string) string {
+	name, _, _ := strings.Cut(series, "{")
+	return name
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WritePrometheus writes the cache counters in the Prometheus text format.
+// Series of a family are written together, its HELP and TYPE only once.
+func (c *PicoCache) WritePrometheus(w io.Writer) error {
+	stats := c.Stats()
+	last := ""
+	header := func(name, help, typ string) error {
+		if name == last {
+			return nil
+		}
+		last = name
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		return err
+	}
+
+	for _, m := range stats.metrics() {
+		if err := header(family(m.name), m.help, m.typ); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", m.name, strconv.FormatFloat(m.value, 'f', -1, 64)); err != nil {
+			return err
+		}
+	}
+	for _, h := range stats.histograms() {
+		if err := header(h.name, h.help, "histogram"); err != nil {
+			return err
+		}
+		labels := ""
+		if h.labels != "" {
+			labels = h.labels + ","
+		}
+		cumulative := int64(0)
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, le, cumulative); err != nil {
+				return err
+			}
+		}
+		if h.labels != "" {
+			labels = "{" + h.labels + "}"
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, strconv.FormatFloat(h.sum, 'f', -1, 64), h.name, labels, cumulative); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package picocache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithCacheableStatus caches source responses with one of codes on top of
+// 200s, e.g. 301s for short links or 410s for tombstones. Hits replay
+// the status along with the Location header. Redirects of a cacheable status
+// aren't followed anymore when fetching from the source.
+func WithCacheableStatus(codes []int) Option {
+	return func(c *PicoCache) {
+		c.cacheableStatus = map[int]bool{}
+		for _, code := range codes {
+			c.cacheableStatus[code] = true
+		}
+	}
+}
+
+// ParseStatusCodes parses a comma-separated list of HTTP status codes.
+func ParseStatusCodes(s string) ([]int, error) {
+	codes := []int{}
+	for _, field := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", field)
+		}
+		if code == http.StatusPartialContent {
+			return nil, errors.New("partial content can't be cached")
+		}
+		if code == http.StatusTooManyRequests {
+			return nil, errors.New("429s can't be cached")
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// cacheable reports whether source responses with code get cached, never
+// for 429s, which only tell the source is rate limiting.
+func (c *PicoCache) cacheable(code int) bool {
+	return code == http.StatusOK || c.cacheableStatus[code] && code != http.StatusTooManyRequests
+}
+
+// keepRedirects stops the source client from following redirects which get
+// cached, working on a copy of it as it may be shared.
+func (c *PicoCache) keepRedirects() {
+	follow := c.origin.CheckRedirect
+	client := *c.origin
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if c.cacheable(req.Response.StatusCode) {
+			return http.ErrUseLastResponse
+		}
+		if follow != nil {
+			return follow(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	c.origin = &client
+}
+
+// statusCode returns the status the entry gets served with.
+func (e *cacheEntry) statusCode() int {
+	if e.status == 0 {
+		return http.StatusOK
+	}
+	return e.status
+}
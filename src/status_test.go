@@ -0,0 +1,105 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseStatusCodes(t *testing.T) {
+	codes, err := ParseStatusCodes("200, 301,410")
+	if err != nil || len(codes) != 3 || codes[0] != 200 || codes[1] != 301 || codes[2] != 410 {
+		t.Fatalf("unexpected %v, %v", codes, err)
+	}
+	for _, s := range []string{"", "abc", "99", "206"} {
+		if _, err := ParseStatusCodes(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestCacheableStatus(t *testing.T) {
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		switch r.URL.Path {
+		case "/short":
+			http.Redirect(w, r, "/long", http.StatusMovedPermanently)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("Yay"))
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	opts := []Option{WithCacheableStatus([]int{http.StatusMovedPermanently, http.StatusGone})}
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cache *PicoCache, path string, code int, cacheStatus string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || w.Header().Get("X-Cache") != cacheStatus {
+			t.Fatalf("%s: expected %d %s, got %d %s", path, code, cacheStatus, w.Code, w.Header().Get("X-Cache"))
+		}
+		return w
+	}
+	get(cache, "/short", http.StatusMovedPermanently, "MISS")
+	get(cache, "/gone", http.StatusGone, "MISS")
+	get(cache, "/gone", http.StatusGone, "HIT")
+	get(cache, "/missing", http.StatusInternalServerError, "MISS")
+	get(cache, "/long", http.StatusOK, "MISS")
+	if fetched != 4 {
+		t.Fatalf("expected 4 fetches, got %d", fetched)
+	}
+
+	// Survives a restart
+	cache.Close()
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := get(cache, "/short", http.StatusMovedPermanently, "HIT")
+	if location := w.Header().Get("Location"); location != "/long" {
+		t.Errorf("expected the Location header replayed, got %q", location)
+	}
+	w = get(cache, "/long", http.StatusOK, "HIT")
+	if w.Header().Get("Location") != "" || w.Body.String() != "Yay" {
+		t.Errorf("unexpected %v %q", w.Header(), w.Body.String())
+	}
+	if fetched != 4 {
+		t.Errorf("expected no more fetches, got %d", fetched)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestCacheableStatusDefault(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/short" {
+			http.Redirect(w, r, "/long", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Followed and cached as the 200 it leads to
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/short", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Yay" || w.Header().Get("Location") != "" {
+		t.Fatalf("unexpected %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,169 @@
+package picocache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithStreamingFills serves misses from the file being filled as it grows,
+// instead of once complete. The fill goes at the pace of the source and
+// the disk, each client reading at its own. Compressed fills, ranges and
+// HEAD requests still wait for the entry, so do integrity trailers.
+func WithStreamingFills() Option {
+	return func(c *PicoCache) {
+		c.streamFills = true
+	}
+}
+
+var (
+	errFillDone   = errors.New("fill already done")
+	errFillFailed = errors.New("fill failed")
+)
+
+// growingFile is the temporary file of a fill, readable while written.
+// Readers wait on grew, closed and replaced whenever something changes.
+type growingFile struct {
+	name   string
+	length int64 // expected, -1 when unknown
+
+	written *atomic.Int64 // of the fill, see fillWriter
+
+	mu   sync.Mutex
+	done bool
+	err  error // why the fill failed, nil once complete
+	grew chan struct{}
+}
+
+func newGrowingFile(name string, length int64, written *atomic.Int64) *growingFile {
+	return &growingFile{name: name, length: length, written: written, grew: make(chan struct{})}
+}
+
+// grow is called with the n bytes written to the file, once they are.
+func (g *growingFile) grow(n int64) {
+	g.mu.Lock()
+	g.written.Add(n)
+	g.notify()
+	g.mu.Unlock()
+}
+
+// finish reports the fill complete, or failed with err. Only the first
+// call counts.
+func (g *growingFile) finish(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	g.done, g.err = true, err
+	g.notify()
+}
+
+func (g *growingFile) notify() {
+	close(g.grew)
+	g.grew = make(chan struct{})
+}
+
+// open opens the file for reading, failing once the fill is done since it
+// may have been moved already.
+func (g *growingFile) open() (*os.File, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return nil, errFillDone
+	}
+	return os.Open(g.name)
+}
+
+// tailReader reads a growing file, waiting for it to grow when caught up.
+// It fails along with the fill.
+type tailReader struct {
+	ctx  context.Context
+	g    *growingFile
+	file *os.File
+	read int64
+}
+
+func (r *tailReader) Read(p []byte) (int, error) {
+	for {
+		r.g.mu.Lock()
+		written, done, err, grew := r.g.written.Load(), r.g.done, r.g.err, r.g.grew
+		r.g.mu.Unlock()
+
+		switch {
+		case r.read < written:
+			p = p[:min(int64(len(p)), written-r.read)]
+			n, err := r.file.Read(p)
+			r.read += int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		case done && err != nil:
+			return 0, err
+		case done:
+			return 0, io.EOF
+		}
+
+		select {
+		case <-grew:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// streamedMiss is a response being streamed from a growing file, see
+// streamFill.
+type streamedMiss struct {
+	done  chan struct{}
+	err   error
+	bytes int64
+	copy  time.Duration
+}
+
+// wait waits for the client to be done with the response.
+func (s *streamedMiss) wait() error {
+	<-s.done
+	return s.err
+}
+
+// streamable reports whether the miss of r can be streamed as it fills.
+func (c *PicoCache) streamable(r *http.Request) bool {
+	return c.streamFills && r.Method == http.MethodGet && r.Header.Get("Range") == "" &&
+		!(c.integrityTrailer && acceptsTrailers(r))
+}
+
+// streamFill sends the headers of a miss and starts streaming g to w,
+// returning nil if the fill completed before the file could be opened.
+// Nothing else may write to w until the stream is done.
+func (c *PicoCache) streamFill(ctx context.Context, w http.ResponseWriter, g *growingFile) *streamedMiss {
+	file, err := g.open()
+	if err != nil {
+		return nil
+	}
+
+	header := w.Header()
+	if g.length >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(g.length, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	c.stats.streamedFills.Add(1)
+
+	s := &streamedMiss{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer file.Close()
+		start := time.Now()
+		tail := &tailReader{ctx: ctx, g: g, file: file}
+		_, s.err = c.copyToClient(w, tail)
+		s.bytes, s.copy = tail.read, time.Since(start)
+	}()
+	return s
+}
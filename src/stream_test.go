@@ -0,0 +1,148 @@
+package picocache
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowWriter is a client reading a chunk every delay.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestStreamingFillReleasesOrigin(t *testing.T) {
+	body := bytes.Repeat([]byte("A"), 4<<20)
+	var mu sync.Mutex
+	var released time.Time
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.Write(body[:1<<20])
+			w.(http.Flusher).Flush()
+			w.Write(body[1<<20:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateIdle {
+			mu.Lock()
+			released = time.Now()
+			mu.Unlock()
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<30, WithStreamingFills())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/sized", "/chunked"} {
+		w := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: 10 * time.Millisecond}
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		finished := time.Now()
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("%s: unexpected response %d %s of %d bytes", path, w.Code, w.Header().Get("X-Cache"), w.Body.Len())
+		}
+		mu.Lock()
+		if released.IsZero() || finished.Sub(released) < 500*time.Millisecond {
+			t.Errorf("%s: source connection released at %v, only %v before the client finished", path, released, finished.Sub(released))
+		}
+		released = time.Time{}
+		mu.Unlock()
+	}
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sized", nil))
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.Len() != len(body) {
+		t.Fatalf("expected a whole HIT, got %s of %d bytes", w.Header().Get("X-Cache"), w.Body.Len())
+	}
+	if n := cache.Stats().StreamedFills; n != 2 {
+		t.Errorf("expected 2 streamed fills, got %d", n)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestStreamingFillReaders(t *testing.T) {
+	body := bytes.Repeat([]byte("A"), 1<<20)
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		// Slow enough for every client to join
+		for i := 0; i < len(body); i += 64 << 10 {
+			w.Write(body[i : i+64<<10])
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<30, WithStreamingFills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: time.Duration(i) * time.Millisecond}
+			cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/shared", nil))
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+				t.Errorf("client %d: unexpected response %d of %d bytes", i, w.Code, w.Body.Len())
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+	if fetched != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetched)
+	}
+	if n := cache.Stats().StreamedFills; n != 4 {
+		t.Errorf("expected every client streamed, got %d", n)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestStreamingFillFailure(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(1<<20))
+		w.Write(bytes.Repeat([]byte("A"), 256<<10))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<30, WithStreamingFills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("expected the truncated body to fail the response")
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
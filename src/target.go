@@ -0,0 +1,81 @@
+package picocache
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// WithHosts only serves requests for hosts, compared without their port
+// and case. Requests naming another one, in their Host header or an
+// absolute-form target, get a 421.
+func WithHosts(hosts ...string) Option {
+	return func(c *PicoCache) {
+		c.hosts = nil
+		for _, host := range hosts {
+			if host = canonicalHost(host); host != "" {
+				c.hosts = append(c.hosts, host)
+			}
+		}
+	}
+}
+
+// canonicalHost returns host in lower case, without its port nor trailing
+// dot.
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// allowedMethods returns the methods requests outside of the admin API may
+// use, as sent in Allow. PURGE is only there with an admin token or trusted
+// proxies to allow it.
+func (c *PicoCache) allowedMethods() string {
+	if c.purgeAllowed() {
+		return "GET, HEAD, PURGE"
+	}
+	return "GET, HEAD"
+}
+
+// purgeAllowed reports whether PURGE is among allowedMethods.
+func (c *PicoCache) purgeAllowed() bool {
+	return c.adminToken != "" || len(c.trustedProxies) > 0
+}
+
+// refuseMethod answers a request whose method isn't allowed.
+func (c *PicoCache) refuseMethod(w http.ResponseWriter) {
+	c.stats.refusedRequests.Add(1)
+	w.Header().Set("Allow", c.allowedMethods())
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// admitTarget answers requests whose target picocache doesn't serve,
+// returning the request to go on with otherwise. Absolute-form targets, as
+// in GET http://host/path, are served like their path: the request gets
+// rewritten to origin-form so that the scheme and host never end up in a
+// key. So does the authority-form of CONNECT, refused for its method.
+// Asterisk-form targets get a 400.
+func (c *PicoCache) admitTarget(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if r.RequestURI == "*" || r.URL.Path == "*" {
+		c.stats.refusedRequests.Add(1)
+		http.Error(w, "asterisk-form targets aren't served", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if r.URL.Scheme != "" || r.URL.Host != "" {
+		u := *r.URL
+		u.Scheme, u.Host, u.User = "", "", nil
+		r = r.WithContext(r.Context())
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+	}
+	if len(c.hosts) > 0 && !slices.Contains(c.hosts, canonicalHost(r.Host)) {
+		c.stats.refusedRequests.Add(1)
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return nil, false
+	}
+	return r, true
+}
@@ -0,0 +1,97 @@
+package picocache
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTargets(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer origin.Close()
+
+	do := func(cache *PicoCache, raw string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw + "\r\n\r\n")))
+		if err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for _, tc := range []struct {
+		raw    string
+		status int
+		cache  string
+		allow  string
+	}{
+		{"GET /a HTTP/1.1\r\nHost: example.com", http.StatusOK, "MISS", ""},
+		{"GET http://example.com/a HTTP/1.1", http.StatusOK, "HIT", ""},
+		{"HEAD https://user@other.org:8443/a HTTP/1.1", http.StatusOK, "HIT", ""},
+		{"OPTIONS * HTTP/1.1", http.StatusBadRequest, "", ""},
+		{"PRI * HTTP/2.0", http.StatusBadRequest, "", ""},
+		{"CONNECT example.com:443 HTTP/1.1", http.StatusMethodNotAllowed, "", "GET, HEAD"},
+		{"OPTIONS /a HTTP/1.1", http.StatusMethodNotAllowed, "", "GET, HEAD"},
+		{"DELETE http://example.com/b HTTP/1.1", http.StatusMethodNotAllowed, "", "GET, HEAD"},
+		{"PURGE /a HTTP/1.1", http.StatusMethodNotAllowed, "", "GET, HEAD"},
+	} {
+		w := do(cache, tc.raw)
+		if w.Code != tc.status || w.Header().Get("X-Cache") != tc.cache || w.Header().Get("Allow") != tc.allow {
+			t.Fatalf("%q: unexpected response %d %q, Allow %q", tc.raw, w.Code, w.Header().Get("X-Cache"), w.Header().Get("Allow"))
+		}
+		if w.Code == http.StatusOK && tc.raw[0] == 'G' && w.Body.String() != "/a" {
+			t.Fatalf("%q: expected the source asked for /a, got %q", tc.raw, w.Body.String())
+		}
+	}
+	if n := cache.Len(); n != 1 {
+		t.Fatalf("expected a single entry, got %d", n)
+	}
+	if s := cache.Stats(); s.RefusedRequests != 6 {
+		t.Fatalf("expected 6 refused requests, got %d", s.RefusedRequests)
+	}
+	verifyConsistency(t, cache, dir)
+	cache.Close()
+
+	// PURGE is allowed along with an admin token, and hosts may be checked
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20, WithAdminToken("s3cret"), WithHosts("Example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for _, tc := range []struct {
+		raw    string
+		status int
+		allow  string
+	}{
+		{"GET /a HTTP/1.1\r\nHost: example.com:8080", http.StatusOK, ""},
+		{"GET http://EXAMPLE.com/a HTTP/1.1\r\nHost: other.org", http.StatusOK, ""},
+		{"GET /a HTTP/1.1\r\nHost: other.org", http.StatusMisdirectedRequest, ""},
+		{"GET http://other.org/c HTTP/1.1\r\nHost: example.com", http.StatusMisdirectedRequest, ""},
+		{"DELETE /a HTTP/1.1\r\nHost: example.com", http.StatusMethodNotAllowed, "GET, HEAD, PURGE"},
+		{"PURGE /a HTTP/1.1\r\nHost: example.com", http.StatusForbidden, ""},
+		{"PURGE http://example.com/a HTTP/1.1\r\nAuthorization: Bearer s3cret", http.StatusOK, ""},
+	} {
+		w := do(cache, tc.raw)
+		if w.Code != tc.status || w.Header().Get("Allow") != tc.allow {
+			t.Fatalf("%q: unexpected response %d, Allow %q", tc.raw, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("expected the entry purged, got %d entries", n)
+	}
+	verifyConsistency(t, cache, dir)
+}
@@ -0,0 +1,106 @@
+package picocache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Placeholders which, when present in the source, make it a template
+// expanded per request instead of a prefix the path is appended to.
+const (
+	placeholderPath        = "{path}"
+	placeholderPathEscaped = "{path_escaped}"
+)
+
+// parseSourceTemplate reports whether source is a template, failing on
+// placeholders it doesn't know about.
+func parseSourceTemplate(source string) (bool, error) {
+	isTemplate := false
+	for rest := source; ; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return isTemplate, nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return false, fmt.Errorf("unterminated placeholder in source %q", source)
+		}
+
+		placeholder := rest[start : start+end+1]
+		if placeholder != placeholderPath && placeholder != placeholderPathEscaped {
+			return false, fmt.Errorf("unknown placeholder %s in source %q", placeholder, source)
+		}
+		isTemplate = true
+		rest = rest[start+end+1:]
+	}
+}
+
+// originURL returns the source URL to fetch path from.
+func (c *PicoCache) originURL(path string) string {
+	return expand(c.source, c.sourceTemplate, path)
+}
+
+// expand returns the URL of path under source, a template or a base URL
+// the path is joined to. Paths are escaped and may carry a query string,
+// added to the one of the base URL.
+func expand(source string, isTemplate bool, path string) string {
+	if isTemplate {
+		decoded, err := url.PathUnescape(path)
+		if err != nil {
+			decoded = path
+		}
+		return strings.NewReplacer(
+			placeholderPath, path,
+			placeholderPathEscaped, url.QueryEscape(decoded),
+		).Replace(source)
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		// Checked by normalizeSource
+		return source + path
+	}
+	path, query, _ := strings.Cut(path, "?")
+	u = u.JoinPath(path)
+	if u.RawQuery != "" && query != "" {
+		u.RawQuery += "&" + query
+	} else if query != "" {
+		u.RawQuery = query
+	}
+	return u.String()
+}
+
+// normalizeSource checks that source, when not a template, is an absolute
+// URL, and strips its trailing slashes so paths joined to it don't start
+// with an empty segment.
+func normalizeSource(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid source: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("source %q isn't an absolute URL", source)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String(), nil
+}
+
+// climbs reports whether path goes above the root with .. segments, which
+// would escape the base path of the source once joined to it.
+func climbs(path string) bool {
+	depth := 0
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
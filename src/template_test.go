@@ -0,0 +1,147 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginURL(t *testing.T) {
+	for _, tc := range []struct {
+		source, path, expected string
+	}{
+		{"https://o.example.com/assets", "/img/logo.png", "https://o.example.com/assets/img/logo.png"},
+		{"https://o.example.com/v2/objects?key={path_escaped}", "/img/logo.png", "https://o.example.com/v2/objects?key=%2Fimg%2Flogo.png"},
+		{"https://o.example.com/v2/objects?key={path_escaped}", "/a b&c=d?e#f", "https://o.example.com/v2/objects?key=%2Fa+b%26c%3Dd%3Fe%23f"},
+		{"https://o.example.com/v2/objects?key={path_escaped}", "/caf%C3%A9%20b.png", "https://o.example.com/v2/objects?key=%2Fcaf%C3%A9+b.png"},
+		{"https://o.example.com/v2{path}?raw=1", "/a%20b", "https://o.example.com/v2/a%20b?raw=1"},
+		{"https://o.example.com/v2{path}?raw=1", "/img/logo.png", "https://o.example.com/v2/img/logo.png?raw=1"},
+		{"https://o.example.com{path}?key={path_escaped}", "/x/{path}", "https://o.example.com/x/{path}?key=%2Fx%2F%7Bpath%7D"},
+		{"https://o.example.com", "/foo.jpg", "https://o.example.com/foo.jpg"},
+		{"https://o.example.com/", "/foo.jpg", "https://o.example.com/foo.jpg"},
+		{"https://o.example.com//", "/foo.jpg", "https://o.example.com/foo.jpg"},
+		{"https://o.example.com/base/", "/foo.jpg", "https://o.example.com/base/foo.jpg"},
+		{"https://o.example.com/base", "/dir/", "https://o.example.com/base/dir/"},
+		{"https://o.example.com/base", "/a%20b%23c.jpg", "https://o.example.com/base/a%20b%23c.jpg"},
+		{"https://o.example.com/base", "/a%2Fb+c", "https://o.example.com/base/a%2Fb+c"},
+		{"https://o.example.com/base", "/img?w=100", "https://o.example.com/base/img?w=100"},
+		{"https://o.example.com/base?token=x", "/img?w=100", "https://o.example.com/base/img?token=x&w=100"},
+		{"https://o.example.com/base?token=x", "/img", "https://o.example.com/base/img?token=x"},
+		{"https://o.example.com/base", "/a/../b", "https://o.example.com/base/b"},
+		{"https://user:pw@o.example.com:8443/", "/x", "https://user:pw@o.example.com:8443/x"},
+	} {
+		isTemplate, err := parseSourceTemplate(tc.source)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.source, err)
+		}
+		source := tc.source
+		if !isTemplate {
+			if source, err = normalizeSource(source); err != nil {
+				t.Fatalf("%s: %v", tc.source, err)
+			}
+		}
+		c := &PicoCache{source: source, sourceTemplate: isTemplate}
+		if got := c.originURL(tc.path); got != tc.expected {
+			t.Errorf("%s with %s: expected %s, got %s", tc.source, tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestClimbs(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/a/b":       false,
+		"/a/../b":    false,
+		"/a/./../b":  false,
+		"/..":        true,
+		"/../b":      true,
+		"/a/../../b": true,
+		"/a/..%2f":   false,
+	} {
+		if got := climbs(path); got != expected {
+			t.Errorf("%s: expected %v, got %v", path, expected, got)
+		}
+	}
+}
+
+func TestSourceBasePath(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.RequestURI)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL+"/base/", t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/foo.jpg", http.StatusOK},
+		{"/a%20b.jpg", http.StatusOK},
+		{"/../secret", http.StatusBadRequest},
+		{"/a/../../secret", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.code, w.Code)
+		}
+	}
+	if len(fetched) != 2 || fetched[0] != "/base/foo.jpg" || fetched[1] != "/base/a%20b.jpg" {
+		t.Errorf("unexpected source requests %v", fetched)
+	}
+
+	if _, err := NewCache(slog.Default(), "o.example.com/base", t.TempDir(), 1<<20); err == nil {
+		t.Error("expected a source without a scheme to be refused")
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestSourceTemplateRejectsUnknownPlaceholders(t *testing.T) {
+	for _, source := range []string{
+		"https://o.example.com/objects?key={key}",
+		"https://o.example.com/{path}/{PATH}",
+		"https://o.example.com/objects?key={path",
+	} {
+		if _, err := NewCache(slog.Default(), source, t.TempDir(), 1<<20); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestSourceTemplateFetch(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path+"?"+r.URL.Query().Get("key"))
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL+"/v2/objects?key={path_escaped}", t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img/logo.png", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "Yay" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+
+	if len(fetched) != 1 || fetched[0] != "/v2/objects?/img/logo.png" {
+		t.Fatalf("unexpected source requests %v", fetched)
+	}
+	if _, ok := cache.entries.Load(cache.getCacheFilename("/img/logo.png")); !ok {
+		t.Fatal("entry isn't keyed on the client path")
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
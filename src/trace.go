@@ -0,0 +1,44 @@
+package picocache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const traceHeader = "X-Picocache-Trace"
+
+// maxTraceLength bounds the trace header, some proxies choking on larger
+// ones.
+const maxTraceLength = 1024
+
+// tracing reports whether the request asks for a trace of the decisions
+// made serving it, which only trusted clients get.
+func (c *PicoCache) tracing(r *http.Request) bool {
+	return r.Header.Get("X-Picocache-Debug") == "1" && c.trusted(r)
+}
+
+// trace records a decision made serving the request, when traced. It is
+// called from the decision points themselves, so the trace can't lie.
+func (t *timings) trace(format string, args ...any) {
+	if t.traced {
+		t.steps = append(t.steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// traceString returns the trace, truncated for a header.
+func (t *timings) traceString() string {
+	s := strings.Join(t.steps, "; ")
+	if len(s) > maxTraceLength {
+		s = s[:maxTraceLength-3] + "..."
+	}
+	return s
+}
+
+// matcher returns what the rule matches, as in ParseRules.
+func (r *Rule) matcher() string {
+	if r.Prefix != "" && r.Extension != "" {
+		return r.Prefix + "*" + r.Extension
+	}
+	return r.Prefix + r.Extension
+}
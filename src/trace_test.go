@@ -0,0 +1,64 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecisionTrace(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	rules, _ := ParseRules(".txt ttl=1m, /big/ maxsize=2B")
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithRules(rules...), WithAdminToken("secret"), WithAdmitAfter(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := KeyForPath("/a.txt")
+
+	get := func(path string, trusted bool) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Picocache-Debug", "1")
+		if trusted {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w.Header().Get(traceHeader)
+	}
+
+	for _, tc := range []struct {
+		name, path string
+		before     func()
+		expected   string
+	}{
+		{"not admitted", "/a.txt", nil, "key " + key + "; rule .txt; no entry, not admitted yet"},
+		{"miss", "/a.txt", nil, "key " + key + "; rule .txt; no entry, filling; filled 3 bytes"},
+		{"hit", "/a.txt", nil, "key " + key + "; rule .txt; entry held, expiring in "},
+		{"expired", "/a.txt", func() {
+			later := time.Now().Add(2 * time.Minute)
+			cache.now = func() time.Time { return later }
+		}, "key " + key + "; rule .txt; expired "},
+		{"too large", "/big/file", func() { get("/big/file", false) }, "rule /big/; no entry, filling; 3 bytes, over the rule max size"},
+	} {
+		if tc.before != nil {
+			tc.before()
+		}
+		if trace := get(tc.path, true); !strings.Contains(trace, tc.expected) {
+			t.Errorf("%s: expected %q in trace %q", tc.name, tc.expected, trace)
+		}
+	}
+
+	if trace := get("/a.txt", false); trace != "" {
+		t.Fatalf("untrusted client got a trace %q", trace)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
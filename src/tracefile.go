@@ -0,0 +1,166 @@
+package picocache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// WithTraceFile records every request to path, for Simulate to replay. Once
+// over maxSize bytes, the file is moved to path.1, replacing the previous
+// one, and a new one started.
+func WithTraceFile(path string, maxSize int64) Option {
+	return func(c *PicoCache) {
+		c.traceFile = &traceFile{
+			path:    path,
+			maxSize: maxSize,
+			records: make(chan traceRecord, 4096),
+			done:    make(chan struct{}),
+		}
+	}
+}
+
+// traceRecord is a request as written to trace files, little endian.
+type traceRecord struct {
+	Time    int64  // unix nanoseconds
+	Key     uint64 // hash of the cache key
+	Size    int64  // of the entry, if any
+	Outcome uint8  // 1 + index in ttfbOutcomes, 0 for failed requests
+}
+
+// cached reports whether the request went through the cache rather than
+// bypassing it or failing.
+func (r traceRecord) cached() bool {
+	return r.Outcome > 0 && int(r.Outcome) <= len(ttfbOutcomes) && ttfbOutcomes[r.Outcome-1] != "bypass"
+}
+
+var traceRecordSize = int64(binary.Size(traceRecord{}))
+
+type traceFile struct {
+	path    string
+	maxSize int64
+	records chan traceRecord
+	dropped atomic.Int64 // records the writer couldn't keep up with
+	done    chan struct{}
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func (f *traceFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.w, f.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+func (f *traceFile) close() error {
+	err := f.w.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f *traceFile) rotate() error {
+	if err := f.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *traceFile) write(r traceRecord) error {
+	if f.size >= f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(f.w, binary.LittleEndian, &r); err != nil {
+		return err
+	}
+	f.size += traceRecordSize
+	return nil
+}
+
+// traceRequest queues the record of a request for writeTraces, dropping it
+// if the writer fell behind.
+func (c *PicoCache) traceRequest(t *timings, cache Outcome) {
+	h := fnv.New64a()
+	h.Write([]byte(filepath.Base(t.cacheFile)))
+	r := traceRecord{
+		Time:    t.start.UnixNano(),
+		Key:     h.Sum64(),
+		Size:    t.size,
+		Outcome: uint8(cache.ttfb() + 1),
+	}
+	select {
+	case c.traceFile.records <- r:
+	default:
+		c.traceFile.dropped.Add(1)
+	}
+}
+
+// writeTraces writes queued records until the cache is closed, flushing
+// them every second.
+func (c *PicoCache) writeTraces() {
+	f := c.traceFile
+	defer close(f.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	failed := false
+	for {
+		select {
+		case r := <-f.records:
+			if err := f.write(r); err != nil && !failed {
+				failed = true
+				c.log.Error("Failed to write trace file", slog.String("file", f.path), slog.String("err", err.Error()))
+			}
+		case <-ticker.C:
+			f.w.Flush()
+		case <-c.closed:
+			for len(f.records) > 0 {
+				f.write(<-f.records)
+			}
+			if err := f.close(); err != nil {
+				c.log.Error("Failed to write trace file", slog.String("file", f.path), slog.String("err", err.Error()))
+			}
+			return
+		}
+	}
+}
+
+// readTraces calls fn with each record read from r, stopping at a record
+// cut short by a crash.
+func readTraces(r io.Reader, fn func(traceRecord)) error {
+	br := bufio.NewReader(r)
+	for {
+		var record traceRecord
+		err := binary.Read(br, binary.LittleEndian, &record)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(record)
+	}
+}
@@ -0,0 +1,70 @@
+package picocache
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceFile(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("A"), len(r.URL.Path)))
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "trace")
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithTraceFile(path, 3*traceRecordSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/a", "/bb", "/a", "/bb"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/a", nil))
+	cache.Close()
+
+	// The first three got rotated
+	records := []traceRecord{}
+	for _, file := range []string{path + ".1", path} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readTraces(bytes.NewReader(b), func(r traceRecord) { records = append(records, r) })
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+
+	a, bb := records[0].Key, records[2].Key
+	for i, expected := range []struct {
+		key     uint64
+		size    int64
+		outcome Outcome
+	}{
+		{a, 2, OutcomeMiss}, {a, 2, OutcomeHit}, {bb, 3, OutcomeMiss}, {a, 2, OutcomeHit}, {bb, 3, OutcomeHit},
+	} {
+		r := records[i]
+		if r.Key != expected.key || r.Size != expected.size || r.Outcome != uint8(expected.outcome.ttfb()+1) {
+			t.Errorf("%d: unexpected record %+v", i, r)
+		}
+		if i > 0 && r.Time < records[i-1].Time {
+			t.Errorf("%d: records out of order", i)
+		}
+	}
+	if r := records[5]; r.cached() {
+		t.Errorf("rejected requests aren't cached, got %+v", r)
+	}
+
+	trace, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	result, err := Simulate(bytes.NewReader(append(trace, current...)), 1<<20, EvictSLRU, defaultProtectedShare)
+	if err != nil || result.Requests != 5 || result.Hits != 3 {
+		t.Fatalf("unexpected replay %+v (%v)", result, err)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,97 @@
+package picocache
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithAdminToken sets a token, sent as "Authorization: Bearer <token>",
+// making requests trusted: they may purge entries and set their cache key.
+func WithAdminToken(token string) Option {
+	return func(c *PicoCache) {
+		c.adminToken = token
+	}
+}
+
+// WithTrustedProxies trusts requests coming from the given networks, as
+// WithAdminToken does.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(c *PicoCache) {
+		c.trustedProxies = prefixes
+	}
+}
+
+// ParsePrefixes parses a comma-separated list of CIDRs for
+// WithTrustedProxies, bare addresses standing for themselves.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trusted reports whether r carries the admin token or comes from a trusted
+// proxy.
+func (c *PicoCache) trusted(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && c.adminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) == 1 {
+
+		return true
+	}
+
+	if len(c.trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+const maxKeyLength = 128
+
+// validKey reports whether key can be used as a cache key set by a client,
+// see X-Picocache-Key. Keys name files in the cache directory, so dots,
+// which metadata and temporary files use, aren't allowed.
+func validKey(key string) bool {
+	if key == "" || len(key) > maxKeyLength {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes("10.0.0.0/8, 192.168.1.7 ,::1,fd00::1/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.7/32", "::1/128", "fd00::/8"}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, prefixes)
+	}
+	for i, p := range prefixes {
+		if p.String() != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], p)
+		}
+	}
+
+	if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	c := &PicoCache{adminToken: "s3cret", trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+
+	for _, tc := range []struct {
+		remoteAddr, authorization string
+		trusted                   bool
+	}{
+		{"192.0.2.1:1234", "", false},
+		{"192.0.2.1:1234", "Bearer s3cret", true},
+		{"192.0.2.1:1234", "Bearer wrong", false},
+		{"192.0.2.1:1234", "s3cret", false},
+		{"10.1.2.3:1234", "", true},
+		{"[::ffff:10.1.2.3]:1234", "", true},
+		{"@", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		if got := c.trusted(r); got != tc.trusted {
+			t.Errorf("%s with %q: expected trusted=%v", tc.remoteAddr, tc.authorization, tc.trusted)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if (&PicoCache{}).trusted(r) {
+		t.Fatal("an empty token must not be trusted")
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"sha256-3f2a9c":          true,
+		KeyForPath("/img.png"):   true,
+		"a_B-9":                  true,
+		"":                       false,
+		"x.meta":                 false,
+		"../etc":                 false,
+		"a/b":                    false,
+		"é":                      false,
+		strings.Repeat("a", 128): true,
+		strings.Repeat("a", 129): false,
+	} {
+		if got := validKey(key); got != valid {
+			t.Errorf("%q: expected valid=%v", key, valid)
+		}
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	fetched := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, key string, trusted bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Picocache-Key", key)
+		if trusted {
+			r.Header.Set("Authorization", "Bearer s3cret")
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/en/logo.png", "logo-v1", true); w.Header().Get("X-Cache") != "MISS" || w.Header().Get("X-Cache-Key") != "logo-v1" {
+		t.Fatalf("unexpected response %s %s", w.Header().Get("X-Cache"), w.Header().Get("X-Cache-Key"))
+	}
+	if w := get("/fr/logo.png", "logo-v1", true); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "Yay" {
+		t.Fatalf("expected a hit of the same entry, got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if len(fetched) != 1 || fetched[0] != "/en/logo.png" {
+		t.Fatalf("unexpected source requests %v", fetched)
+	}
+
+	meta, err := readMeta(filepath.Join(cache.cacheDir, "logo-v1"))
+	if err != nil || meta == nil || meta.Key != "logo-v1" || meta.Path != "/en/logo.png" {
+		t.Fatalf("unexpected metadata %+v, %v", meta, err)
+	}
+
+	// Untrusted clients don't get to choose
+	if w := get("/de/logo.png", "logo-v1", false); w.Header().Get("X-Cache") != "MISS" || w.Header().Get("X-Cache-Key") != KeyForPath("/de/logo.png") {
+		t.Fatalf("untrusted key honored: %s %s", w.Header().Get("X-Cache"), w.Header().Get("X-Cache-Key"))
+	}
+	if w := get("/de/logo.png", "../logo", true); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid key to be rejected, got %d", w.Code)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
+
+func TestPurge(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	purge := func(query string, trusted bool) (int, purgeResult) {
+		r := httptest.NewRequest(http.MethodPost, "/__picocache/purge?"+query, nil)
+		if trusted {
+			r.Header.Set("Authorization", "Bearer s3cret")
+		}
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, r)
+		result := purgeResult{}
+		json.NewDecoder(w.Body).Decode(&result)
+		return w.Code, result
+	}
+
+	if code, _ := purge("path=/a", false); code != http.StatusForbidden {
+		t.Fatalf("expected untrusted purge to be forbidden, got %d", code)
+	}
+	if code, result := purge("path=/a", true); code != http.StatusOK || !result.Purged {
+		t.Fatalf("expected /a to be purged, got %d %+v", code, result)
+	}
+	if code, result := purge("key="+KeyForPath("/b"), true); code != http.StatusOK || !result.Purged {
+		t.Fatalf("expected /b to be purged by key, got %d %+v", code, result)
+	}
+	if _, result := purge("path=/a", true); result.Purged {
+		t.Fatal("purged /a twice")
+	}
+	for _, query := range []string{"", "key=a.meta"} {
+		if code, _ := purge(query, true); code != http.StatusBadRequest {
+			t.Errorf("%q: expected a bad request, got %d", query, code)
+		}
+	}
+
+	if s := cache.Stats(); s.Entries != 0 || s.TotalSize != 0 {
+		t.Fatalf("unexpected stats after purging %+v", s)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
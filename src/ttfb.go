@@ -0,0 +1,93 @@
+package picocache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the inclusive upper bounds of latency histogram
+// buckets, an extra one counting anything slower.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// latencyHistogram is a fixed-bucket histogram safe for concurrent use,
+// recording without allocating.
+type latencyHistogram struct {
+	counts [len(latencyBounds) + 1]atomic.Int64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// LatencySummary is a snapshot of a latency histogram, in seconds.
+type LatencySummary struct {
+	Count   int64   `json:"count"`
+	Sum     float64 `json:"sum"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Buckets []int64 `json:"buckets"` // per bucket of LatencyBounds, then slower
+}
+
+// LatencyBounds returns the upper bounds of the LatencySummary buckets, in
+// seconds.
+func LatencyBounds() []float64 {
+	bounds := make([]float64, len(latencyBounds))
+	for i, b := range latencyBounds {
+		bounds[i] = b.Seconds()
+	}
+	return bounds
+}
+
+func (h *latencyHistogram) summary() LatencySummary {
+	s := LatencySummary{Buckets: make([]int64, len(h.counts))}
+	for i := range h.counts {
+		s.Buckets[i] = h.counts[i].Load()
+		s.Count += s.Buckets[i]
+	}
+	s.Sum = time.Duration(h.sum.Load()).Seconds()
+	s.P50, s.P90, s.P99 = s.quantile(0.5), s.quantile(0.9), s.quantile(0.99)
+	return s
+}
+
+// quantile estimates the q quantile, interpolating linearly within its
+// bucket. The slowest bucket has no upper bound, so its lower one is used.
+func (s LatencySummary) quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Count)
+	cumulative := int64(0)
+	for i, count := range s.Buckets {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1].Seconds()
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBounds[i-1].Seconds()
+		}
+		upper := latencyBounds[i].Seconds()
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(count)
+	}
+	return latencyBounds[len(latencyBounds)-1].Seconds()
+}
+
+// ttfbOutcomes are the cache outcomes time to first byte is tracked for.
+var ttfbOutcomes = [...]string{"hit", "miss", "stale", "bypass"}
@@ -0,0 +1,128 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	h := &latencyHistogram{}
+	for _, d := range []time.Duration{0, time.Millisecond, time.Millisecond + 1, 10 * time.Second, time.Minute} {
+		h.observe(d)
+	}
+
+	s := h.summary()
+	expected := map[int]int64{0: 2, 1: 1, len(latencyBounds) - 1: 1, len(latencyBounds): 1}
+	for i, count := range s.Buckets {
+		if count != expected[i] {
+			t.Errorf("bucket %d: expected %d, got %d", i, expected[i], count)
+		}
+	}
+	if s.Count != 5 {
+		t.Fatalf("expected 5 observations, got %d", s.Count)
+	}
+}
+
+func TestLatencyQuantiles(t *testing.T) {
+	h := &latencyHistogram{}
+	if s := h.summary(); s.P50 != 0 || s.P99 != 0 {
+		t.Fatalf("expected empty quantiles, got %+v", s)
+	}
+
+	// 100 observations spread evenly within the 10ms to 25ms bucket
+	for range 100 {
+		h.observe(20 * time.Millisecond)
+	}
+	s := h.summary()
+	for _, tc := range []struct{ got, expected float64 }{
+		{s.P50, 0.0175},
+		{s.P90, 0.0235},
+		{s.P99, 0.02485},
+	} {
+		if diff := tc.got - tc.expected; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("expected %v, got %v", tc.expected, tc.got)
+		}
+	}
+
+	// Beyond the last bound, quantiles report it
+	h.observe(time.Hour)
+	if s := h.summary(); s.quantile(1) != 10 {
+		t.Fatalf("expected the last bound, got %v", s.quantile(1))
+	}
+}
+
+func TestLatencyHistogramConcurrent(t *testing.T) {
+	h := &latencyHistogram{}
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				h.observe(time.Duration(g*i) * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s := h.summary(); s.Count != 8000 {
+		t.Fatalf("expected 8000 observations, got %d", s.Count)
+	}
+}
+
+func TestTTFBByOutcome(t *testing.T) {
+	clock := atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock.Add(int64(300 * time.Millisecond))
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.now = func() time.Time { return time.Unix(0, clock.Load()) }
+
+	for range 2 {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hi", nil))
+	}
+
+	s := cache.Stats()
+	if b := s.TTFB["miss"].Buckets; s.TTFB["miss"].Count != 1 || b[8] != 1 {
+		t.Fatalf("expected a miss between 250ms and 500ms, got %v", b)
+	}
+	if b := s.TTFB["hit"].Buckets; s.TTFB["hit"].Count != 1 || b[0] != 1 {
+		t.Fatalf("expected an instant hit, got %v", b)
+	}
+	if s.TTFB["bypass"].Count != 0 || s.TTFB["stale"].Count != 0 {
+		t.Fatalf("unexpected outcomes %+v", s.TTFB)
+	}
+
+	w := &strings.Builder{}
+	if err := cache.WritePrometheus(w); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`picocache_ttfb_seconds_bucket{outcome="miss",le="0.25"} 0`,
+		`picocache_ttfb_seconds_bucket{outcome="miss",le="0.5"} 1`,
+		`picocache_ttfb_seconds_count{outcome="hit"} 1`,
+		`picocache_ttfb_p50_seconds{outcome="miss"} 0.375`,
+	} {
+		if !strings.Contains(w.String(), line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+	for _, name := range []string{"picocache_ttfb_seconds", "picocache_ttfb_p50_seconds"} {
+		if n := strings.Count(w.String(), "# TYPE "+name+" "); n != 1 {
+			t.Errorf("expected one TYPE line for %s, got %d", name, n)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
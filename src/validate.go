@@ -0,0 +1,109 @@
+package picocache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"mime"
+	"strings"
+)
+
+// WithContentTypeValidation refuses to cache successful responses whose
+// Content-Type fundamentally disagrees with the one the extension of their
+// path tells: HTML for anything but HTML, or another type than an image, an
+// audio or video file or a font for one. Paths without a known extension,
+// and responses without a Content-Type, aren't checked.
+func WithContentTypeValidation() Option {
+	return func(c *PicoCache) {
+		c.validateContentType = true
+	}
+}
+
+// WithBodyBlocklist refuses to cache successful responses whose body starts
+// with any of prefixes, such as <!DOCTYPE html> for error pages sent with a
+// 200. Prefixes are compared byte for byte.
+func WithBodyBlocklist(prefixes ...string) Option {
+	return func(c *PicoCache) {
+		c.bodyBlocklist = nil
+		for _, p := range prefixes {
+			if p != "" {
+				c.bodyBlocklist = append(c.bodyBlocklist, []byte(p))
+			}
+		}
+	}
+}
+
+// WithRejectedAsBadGateway answers 502 to requests whose fill got refused by
+// WithContentTypeValidation or WithBodyBlocklist, rather than streaming the
+// response from the source without caching it.
+func WithRejectedAsBadGateway() Option {
+	return func(c *PicoCache) {
+		c.rejectedAsBadGateway = true
+	}
+}
+
+var errRejected = errors.New("source response rejected as an error page")
+
+// mismatchedType reports whether got, the Content-Type of a response, can't
+// be a body of implied, the type its path tells.
+func mismatchedType(implied, got string) bool {
+	impliedType, _, err := mime.ParseMediaType(implied)
+	if err != nil {
+		return false
+	}
+	gotType, _, err := mime.ParseMediaType(got)
+	if err != nil {
+		return false
+	}
+
+	html := func(t string) bool { return t == "text/html" || t == "application/xhtml+xml" }
+	if html(gotType) {
+		return !html(impliedType)
+	}
+	top, _, _ := strings.Cut(impliedType, "/")
+	gotTop, _, _ := strings.Cut(gotType, "/")
+	switch top {
+	case "image", "audio", "video", "font":
+		// Sources not telling better send application/octet-stream
+		return gotTop != top && gotType != "application/octet-stream"
+	}
+	return false
+}
+
+// rejectedType reports whether a successful response for path with the
+// given Content-Type shouldn't be cached, logging and counting it.
+func (c *PicoCache) rejectedType(url, path, contentType string, t *timings) bool {
+	if !c.validateContentType || contentType == "" {
+		return false
+	}
+	implied := c.contentType(path)
+	if implied == "" || !mismatchedType(implied, contentType) ||
+		!c.enforced(PolicyContentType, t, "Content-Type not matching the path", slog.String("url", url),
+			slog.String("content_type", contentType), slog.String("expected", implied)) {
+		return false
+	}
+	c.stats.rejectedContentType.Add(1)
+	c.log.Warn("Source response rejected, its Content-Type doesn't match its path", slog.String("url", url),
+		slog.String("content_type", contentType), slog.String("expected", implied))
+	return true
+}
+
+// rejectedBody reports whether the body of a successful response starts
+// with a prefix of the blocklist, logging and counting it.
+func (c *PicoCache) rejectedBody(url string, body *bufio.Reader, t *timings) bool {
+	for _, prefix := range c.bodyBlocklist {
+		start, _ := body.Peek(len(prefix))
+		if bytes.Equal(start, prefix) {
+			if !c.enforced(PolicyBodyBlocklist, t, "body starting with a blocked prefix", slog.String("url", url),
+				slog.String("prefix", string(prefix))) {
+				return false
+			}
+			c.stats.rejectedBody.Add(1)
+			c.log.Warn("Source response rejected, its body starts with a blocked prefix", slog.String("url", url),
+				slog.String("prefix", string(prefix)))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMismatchedType(t *testing.T) {
+	for _, tc := range []struct {
+		implied, got string
+		mismatched   bool
+	}{
+		{"image/jpeg", "text/html; charset=utf-8", true},
+		{"image/jpeg", "text/plain", true},
+		{"image/jpeg", "image/png", false},
+		{"image/jpeg", "application/octet-stream", false},
+		{"video/mp4", "application/json", true},
+		{"text/css; charset=utf-8", "text/html", true},
+		{"text/html; charset=utf-8", "text/html", false},
+		{"text/javascript; charset=utf-8", "application/javascript", false},
+		{"application/json", "text/plain", false},
+		{"image/jpeg", "invalid;;", false},
+	} {
+		if got := mismatchedType(tc.implied, tc.got); got != tc.mismatched {
+			t.Errorf("%s for %s: expected %v, got %v", tc.got, tc.implied, tc.mismatched, got)
+		}
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.jpg", "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>Object not found</html>"))
+		case "/generic.png":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("PNG"))
+		case "/disguised.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("<!DOCTYPE html><p>Object not found"))
+		default:
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("JPEG"))
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithBlockSize(1),
+		WithContentTypeValidation(), WithBodyBlocklist("<!DOCTYPE html>", "<!doctype html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	get := func(cache *PicoCache, path string, code int, cacheStatus, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code || w.Header().Get("X-Cache") != cacheStatus || body != "" && w.Body.String() != body {
+			t.Fatalf("%s: expected %d %s %q, got %d %s %q", path, code, cacheStatus, body, w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+
+	// Rejected responses are streamed through, never cached
+	get(cache, "/missing.jpg", http.StatusOK, "BYPASS-REJECTED", "<html>Object not found</html>")
+	get(cache, "/missing.jpg", http.StatusOK, "BYPASS-REJECTED", "<html>Object not found</html>")
+	get(cache, "/disguised.jpg", http.StatusOK, "BYPASS-REJECTED", "<!DOCTYPE html><p>Object not found")
+
+	// Paths without an extension and generic types aren't rejected
+	for _, path := range []string{"/page", "/generic.png", "/photo.jpg"} {
+		get(cache, path, http.StatusOK, "MISS", "")
+		get(cache, path, http.StatusOK, "HIT", "")
+	}
+	if s := cache.Stats(); s.RejectedContentType != 2 || s.RejectedBody != 1 || s.Entries != 3 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	verifyConsistency(t, cache, dir)
+
+	strict, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithContentTypeValidation(), WithBodyBlocklist("<!DOCTYPE html>"), WithRejectedAsBadGateway())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Close()
+	get(strict, "/missing.jpg", http.StatusBadGateway, "MISS", "")
+	get(strict, "/disguised.jpg", http.StatusBadGateway, "MISS", "")
+	get(strict, "/photo.jpg", http.StatusOK, "MISS", "JPEG")
+}
@@ -0,0 +1,152 @@
+package picocache
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// maxVerifySample bounds how many entries a verify request reads back.
+const maxVerifySample = 100_000
+
+// VerifyReport is what Verify found.
+type VerifyReport struct {
+	Checked     int            `json:"checked"`
+	Checksummed int            `json:"checksummed"` // of those, entries whose hash is known, see WithDedup
+	Corrupt     []CorruptEntry `json:"corrupt"`
+}
+
+// CorruptEntry is an entry which failed verification.
+type CorruptEntry struct {
+	Key     string `json:"key"`
+	Path    string `json:"path,omitempty"` // when known, see WithPrefixPurge
+	Problem string `json:"problem"`
+	Purged  bool   `json:"purged"`
+}
+
+// Verify reads back a random sample of n entries, checking their size, the
+// hash of their body when known and that compressed ones decode to their
+// size. Corrupt entries are purged along the way when purge is set.
+func (c *PicoCache) Verify(n int, purge bool) *VerifyReport {
+	return c.verify(n, purge, func() bool { return false }, &atomic.Int64{})
+}
+
+// verify is Verify, counting the entries checked in progress and giving up
+// once stop returns true.
+func (c *PicoCache) verify(n int, purge bool, stop func() bool, progress *atomic.Int64) *VerifyReport {
+	// Reservoir sampling, sync.Map ranging in no particular order
+	sample := make([]*cacheEntry, 0, n)
+	seen := 0
+	c.entries.Range(func(key, value any) bool {
+		seen++
+		if len(sample) < n {
+			sample = append(sample, value.(*cacheEntry))
+		} else if i := rand.IntN(seen); i < n {
+			sample[i] = value.(*cacheEntry)
+		}
+		return true
+	})
+
+	report := &VerifyReport{Corrupt: []CorruptEntry{}}
+	for _, entry := range sample {
+		if stop() {
+			break
+		}
+		if !entry.sealed.Load() {
+			continue
+		}
+		report.Checked++
+		progress.Add(1)
+		if entry.hash != "" {
+			report.Checksummed++
+		}
+		err := verifyEntry(entry)
+		if err == nil || !entry.sealed.Load() {
+			// Evicted or replaced while being read
+			continue
+		}
+		corrupt := CorruptEntry{Key: filepath.Base(entry.filename), Path: entry.path, Problem: err.Error()}
+		if purge {
+			corrupt.Purged = c.purge(entry.filename, entry)
+		}
+		c.log.Warn("Corrupt cache entry", slog.String("key", corrupt.Key), slog.String("problem", corrupt.Problem))
+		report.Corrupt = append(report.Corrupt, corrupt)
+	}
+	return report
+}
+
+func verifyEntry(entry *cacheEntry) error {
+	file, err := os.Open(entry.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+	if n != entry.size {
+		return fmt.Errorf("%d bytes long, expected %d", n, entry.size)
+	}
+	if entry.hash != "" && hex.EncodeToString(h.Sum(nil)) != entry.hash {
+		return errors.New("body doesn't match its hash")
+	}
+
+	if entry.encoding == "gzip" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("can't decompress: %w", err)
+		}
+		decoded, err := io.Copy(io.Discard, gz)
+		if err != nil {
+			return fmt.Errorf("can't decompress: %w", err)
+		}
+		if decoded != entry.decodedSize {
+			return fmt.Errorf("decodes to %d bytes, expected %d", decoded, entry.decodedSize)
+		}
+	}
+	return nil
+}
+
+// serveVerify verifies sample entries, 1000 by default, purging corrupt
+// ones with purge=1, for trusted requests only.
+func (c *PicoCache) serveVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.trusted(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	n := 1000
+	if s := query.Get("sample"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxVerifySample {
+			http.Error(w, "sample must be between 1 and "+strconv.Itoa(maxVerifySample), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Verify(n, query.Get("purge") == "1"))
+}
@@ -0,0 +1,63 @@
+package picocache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("Yay", 100) + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+		WithDedup(), WithCompression(true), WithAdminToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if report := cache.Verify(10, false); report.Checked != 3 || report.Checksummed != 3 || len(report.Corrupt) != 0 {
+		t.Fatalf("expected all entries fine, got %+v", report)
+	}
+
+	// Same size, other bytes
+	b, err := os.ReadFile(cache.getCacheFilename("/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(cache.getCacheFilename("/b"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/__picocache/verify?sample=10&purge=1", nil)
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected untrusted verifies forbidden, got %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	cache.ServeHTTP(w, r)
+	var report VerifyReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || len(report.Corrupt) != 1 || report.Corrupt[0].Key != KeyForPath("/b") || !report.Corrupt[0].Purged {
+		t.Fatalf("expected /b found corrupt and purged, got %+v", report)
+	}
+	if report := cache.Verify(1, false); report.Checked != 1 {
+		t.Fatalf("expected a sample of 1, got %+v", report)
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
@@ -0,0 +1,45 @@
+package picocache
+
+import "runtime/debug"
+
+// Version and Commit identify the build, set with e.g.
+// -ldflags "-X picocache/src.Version=1.2.0 -X picocache/src.Commit=abc123".
+// Commit defaults to the VCS revision Go recorded, if any.
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+func init() {
+	if Commit != "" {
+		return
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				Commit = setting.Value
+			}
+		}
+	}
+}
+
+// Product returns picocache/<version>, as sent to the source by default.
+func Product() string {
+	return "picocache/" + Version
+}
+
+// WithOriginUserAgent sets the User-Agent of requests to the source, Product
+// by default.
+func WithOriginUserAgent(userAgent string) Option {
+	return func(c *PicoCache) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithServedBy sends an X-Served-By header, Product followed by hostname,
+// with every response.
+func WithServedBy(hostname string) Option {
+	return func(c *PicoCache) {
+		c.servedBy = Product() + " " + hostname
+	}
+}
@@ -0,0 +1,81 @@
+package picocache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOriginUserAgent(t *testing.T) {
+	mu := sync.Mutex{}
+	seen := map[string]string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path] = r.Header.Get("User-Agent")
+		mu.Unlock()
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	for _, test := range []struct {
+		opts      []Option
+		userAgent string
+	}{
+		{nil, "picocache/" + Version},
+		{[]Option{WithOriginUserAgent("gallery-cache")}, "gallery-cache"},
+	} {
+		cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20,
+			append(test.opts, WithOriginProbe(time.Hour, "", "/probe"))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/yay", nil))
+		cache.probeOnce()
+		cache.Close()
+
+		mu.Lock()
+		for _, path := range []string{"/yay", "/probe"} {
+			if seen[path] != test.userAgent {
+				t.Errorf("%s: expected %q, got %q", path, test.userAgent, seen[path])
+			}
+		}
+		clear(seen)
+		mu.Unlock()
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Yay"))
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/yay", nil))
+	if servedBy := w.Header().Get("X-Served-By"); servedBy != "" {
+		t.Fatalf("X-Served-By is opt-in, got %q", servedBy)
+	}
+	if s := cache.Stats(); s.Version != Version {
+		t.Fatalf("expected version %q in stats, got %q", Version, s.Version)
+	}
+
+	cache, err = NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithServedBy("node-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/yay", "/missing/", "/__picocache/health"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if servedBy := w.Header().Get("X-Served-By"); servedBy != "picocache/"+Version+" node-1" {
+			t.Errorf("%s: unexpected X-Served-By %q", path, servedBy)
+		}
+	}
+	verifyConsistency(t, cache, cache.cacheDir)
+}
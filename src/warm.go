@@ -0,0 +1,336 @@
+package picocache
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWarmConcurrency = 4
+	maxListingSize         = 50 << 20 // the most a sitemap may be, uncompressed
+	defaultSitemapPriority = 0.5
+)
+
+// WithWarmFrom warms the cache on startup from the listing at url, fetched
+// again every so often unless zero: the objects of the source it lists are
+// filled as Get would, up to concurrency at once, those of the highest
+// priority first. Listings are sitemaps, sitemap indexes pointing at
+// sitemaps, or when not sent as XML, a list of one URL or path per line in
+// priority order. URLs outside of the source, and paths the cache doesn't
+// fill such as proxied ones, are skipped. Warming stops once over the
+// origin byte budget.
+func WithWarmFrom(url string, every time.Duration, concurrency int) Option {
+	return func(c *PicoCache) {
+		if url == "" {
+			c.warm = nil
+			return
+		}
+		if concurrency <= 0 {
+			concurrency = defaultWarmConcurrency
+		}
+		c.warm = &warmer{url: url, every: every, concurrency: concurrency, done: make(chan struct{})}
+	}
+}
+
+// warmer warms the cache from a listing, see WithWarmFrom.
+type warmer struct {
+	url         string
+	every       time.Duration
+	concurrency int
+	done        chan struct{}
+
+	runs    atomic.Int64
+	listed  atomic.Int64
+	skipped atomic.Int64 // malformed, outside of the source or not filled by the cache
+	warmed  atomic.Int64
+	held    atomic.Int64 // already
+	failed  atomic.Int64
+	lastRun atomic.Int64 // unix nanoseconds
+}
+
+// warmTarget is a path listed for warming.
+type warmTarget struct {
+	path     string
+	priority float64
+}
+
+// warmLoop warms the cache now, then every so often until it closes.
+func (c *PicoCache) warmLoop() {
+	defer close(c.warm.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		c.warmOnce(ctx)
+		if c.warm.every <= 0 {
+			return
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(c.warm.every):
+		}
+	}
+}
+
+// warmOnce fetches the listing and fills what it lists.
+func (c *PicoCache) warmOnce(ctx context.Context) {
+	w := c.warm
+	w.runs.Add(1)
+	w.lastRun.Store(c.now().UnixNano())
+	targets, skipped, err := c.fetchListing(ctx, w.url, true)
+	w.skipped.Add(int64(skipped))
+	if err != nil {
+		if ctx.Err() == nil {
+			c.log.Warn("Failed to fetch the warm listing", slog.String("url", w.url), slog.String("err", err.Error()))
+		}
+		return
+	}
+	targets = slices.DeleteFunc(targets, func(target warmTarget) bool {
+		if c.warmable(target.path) {
+			return false
+		}
+		skipped++
+		w.skipped.Add(1)
+		return true
+	})
+	slices.SortStableFunc(targets, func(a, b warmTarget) int {
+		return cmp.Compare(b.priority, a.priority)
+	})
+	w.listed.Add(int64(len(targets)))
+	if skipped > 0 {
+		c.log.Warn("Skipped warm listing entries", slog.String("url", w.url), slog.Int("skipped", skipped))
+	}
+
+	var warmed, held, failed atomic.Int64
+	var next atomic.Int64
+	var overBudget atomic.Bool
+	var wg sync.WaitGroup
+	for range min(w.concurrency, len(targets)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(len(targets)) || ctx.Err() != nil || overBudget.Load() {
+					return
+				}
+				r, info, err := c.Get(ctx, targets[i].path)
+				switch {
+				case err == nil:
+					r.Close()
+					if info.Cache == OutcomeHit {
+						held.Add(1)
+					} else {
+						warmed.Add(1)
+					}
+				case errors.Is(err, errBudgetExhausted):
+					overBudget.Store(true)
+				case ctx.Err() == nil:
+					failed.Add(1)
+					c.log.Debug("Failed to warm entry", slog.String("path", targets[i].path), slog.String("err", err.Error()))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	w.warmed.Add(warmed.Load())
+	w.held.Add(held.Load())
+	w.failed.Add(failed.Load())
+	c.log.Info("Warmed cache from listing", slog.String("url", w.url), slog.Int("listed", len(targets)),
+		slog.Int64("warmed", warmed.Load()), slog.Int64("held", held.Load()), slog.Int64("failed", failed.Load()),
+		slog.Bool("over_budget", overBudget.Load()))
+}
+
+// warmable reports whether the cache fills path, as ServeHTTP would.
+func (c *PicoCache) warmable(path string) bool {
+	u, err := url.Parse(path)
+	if err != nil || climbs(u.Path) || u.Path == "/" || u.Path == "/favicon.ico" {
+		return false
+	}
+	return !strings.HasPrefix(u.Path, adminPrefix) && !c.proxied(u.Path)
+}
+
+// sitemap is a sitemap or a sitemap index, as encoding/xml decodes them.
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc      string `xml:"loc"`
+		Priority string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// fetchListing fetches the listing at listing, returning the paths of the
+// source it lists in its order along with how many entries were skipped.
+// Sitemap indexes get the sitemaps they point at fetched too, when index.
+func (c *PicoCache) fetchListing(ctx context.Context, listing string, index bool) ([]warmTarget, int, error) {
+	req, err := c.newOriginRequest(ctx, listing)
+	if err != nil {
+		return nil, 0, err
+	}
+	fetch := c.startOriginFetch(listing, "warm listing", false)
+	resp, err := c.originDo(req)
+	if err != nil {
+		fetch.done(0, 0, err)
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fetch.done(resp.StatusCode, 0, nil)
+		return nil, 0, fmt.Errorf("listing returned status %d", resp.StatusCode)
+	}
+	body := &countingReader{Reader: io.LimitReader(resp.Body, maxListingSize)}
+	defer func() { fetch.done(resp.StatusCode, body.n, nil) }()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasSuffix(mediaType, "/xml") && !strings.HasSuffix(mediaType, "+xml") {
+		return c.parseListing(body)
+	}
+
+	var doc sitemap
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("can't parse sitemap: %w", err)
+	}
+	var targets []warmTarget
+	skipped := 0
+	switch doc.XMLName.Local {
+	case "urlset":
+		for _, u := range doc.URLs {
+			path, ok := c.sourcePath(strings.TrimSpace(u.Loc))
+			priority, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64)
+			if u.Priority == "" {
+				priority, err = defaultSitemapPriority, nil
+			}
+			if !ok || err != nil {
+				skipped++
+				continue
+			}
+			targets = append(targets, warmTarget{path, priority})
+		}
+	case "sitemapindex":
+		if !index {
+			return nil, 0, errors.New("sitemap index pointed at by a sitemap index")
+		}
+		for _, s := range doc.Sitemaps {
+			sub, subSkipped, err := c.fetchListing(ctx, strings.TrimSpace(s.Loc), false)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, 0, err
+				}
+				c.log.Warn("Failed to fetch sitemap", slog.String("url", s.Loc), slog.String("err", err.Error()))
+				skipped++
+				continue
+			}
+			targets = append(targets, sub...)
+			skipped += subSkipped
+		}
+	default:
+		return nil, 0, fmt.Errorf("not a sitemap but a %s document", doc.XMLName.Local)
+	}
+	return targets, skipped, nil
+}
+
+// parseListing parses a list of URLs or paths, one per line, first ones
+// first. Empty lines and those starting with # are left out.
+func (c *PicoCache) parseListing(r io.Reader) ([]warmTarget, int, error) {
+	var targets []warmTarget
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, ok := line, strings.HasPrefix(line, "/")
+		if !ok {
+			path, ok = c.sourcePath(line)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		// Listed in priority order, which sorting keeps
+		targets = append(targets, warmTarget{path, defaultSitemapPriority})
+	}
+	return targets, skipped, scanner.Err()
+}
+
+// sourcePath returns the request path, along with its query, of the object
+// of the source at rawURL, reporting false if it isn't one of its objects.
+// Templated sources can't tell.
+func (c *PicoCache) sourcePath(rawURL string) (string, bool) {
+	if c.sourceTemplate {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	base, err := url.Parse(c.source)
+	if err != nil || !strings.EqualFold(u.Scheme, base.Scheme) || !strings.EqualFold(u.Host, base.Host) {
+		return "", false
+	}
+	path, ok := strings.CutPrefix(u.EscapedPath(), strings.TrimRight(base.EscapedPath(), "/"))
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path, true
+}
+
+// WarmStats is the progress of warming the cache, see WithWarmFrom.
+type WarmStats struct {
+	Runs    int64     `json:"runs"`
+	LastRun time.Time `json:"last_run"`
+	Listed  int64     `json:"listed"`  // objects of the source listed, over all runs
+	Skipped int64     `json:"skipped"` // listing entries malformed, outside of the source or not filled by the cache
+	Warmed  int64     `json:"warmed"`  // filled
+	Held    int64     `json:"held"`    // held already
+	Failed  int64     `json:"failed"`
+}
+
+func (c *PicoCache) warmStats() *WarmStats {
+	if c.warm == nil {
+		return nil
+	}
+	w := c.warm
+	s := &WarmStats{
+		Runs:    w.runs.Load(),
+		Listed:  w.listed.Load(),
+		Skipped: w.skipped.Load(),
+		Warmed:  w.warmed.Load(),
+		Held:    w.held.Load(),
+		Failed:  w.failed.Load(),
+	}
+	if last := w.lastRun.Load(); last != 0 {
+		s.LastRun = time.Unix(0, last)
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+package picocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWarmFromSitemap(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/sitemaps/pages.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/sitemaps/media.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/sitemaps/missing.xml</loc></sitemap>
+</sitemapindex>`, origin.URL)
+		case "/sitemaps/pages.xml":
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/index.html</loc><priority>0.8</priority></url>
+  <url><loc>%[1]s/about.html</loc></url>
+  <url><loc>https://elsewhere.example/page.html</loc><priority>1.0</priority></url>
+  <url><loc>%[1]s/odd.html</loc><priority>high</priority></url>
+  <url><loc>%[1]s/__picocache/stats</loc></url>
+</urlset>`, origin.URL)
+		case "/sitemaps/media.xml":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/hero.jpg</loc><priority>1.0</priority></url>
+  <url><loc>%[1]s/thumb.jpg</loc><priority>0.1</priority></url>
+</urlset>`, origin.URL)
+		case "/sitemaps/missing.xml":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			mu.Lock()
+			fetched = append(fetched, r.URL.RequestURI())
+			mu.Unlock()
+			w.Write([]byte("body of " + r.URL.Path))
+		}
+	}))
+	defer origin.Close()
+
+	cache, err := NewCache(slog.Default(), origin.URL, t.TempDir(), 1<<20, WithWarmFrom(origin.URL+"/sitemap.xml", 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	<-cache.warm.done
+
+	want := []string{"/hero.jpg", "/index.html", "/about.html", "/thumb.jpg"}
+	if strings.Join(fetched, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected %v filled in priority order, got %v", want, fetched)
+	}
+	for _, path := range want {
+		if _, ok := cache.entries.Load(cache.getCacheFilename(path)); !ok {
+			t.Fatalf("expected %s cached", path)
+		}
+	}
+	s := cache.Stats()
+	if s.Entries != int64(len(want)) || s.Warm.Runs != 1 || s.Warm.Listed != 4 || s.Warm.Warmed != 4 || s.Warm.Skipped != 4 {
+		t.Fatalf("expected exactly the listed objects warmed, 4 entries skipped, got %d entries, %+v", s.Entries, s.Warm)
+	}
+}
+
+func TestWarmFromList(t *testing.T) {
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hot.txt" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "# hot objects\n%s/a.txt\n/b.txt\n\nnot a url\n/c.txt\n", origin.URL)
+			return
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	cache, err := NewCache(slog.Default(), origin.URL, dir, 1<<20, WithWarmFrom(origin.URL+"/hot.txt", 0, 2),
+		WithProxyPaths("/c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-cache.warm.done
+	if s := cache.Stats(); s.Entries != 2 || s.Warm.Warmed != 2 || s.Warm.Skipped != 2 {
+		t.Fatalf("expected the 2 cacheable listed objects warmed, got %d entries, %+v", s.Entries, s.Warm)
+	}
+	cache.Close()
+
+	// Held already on the next start
+	cache, err = NewCache(slog.Default(), origin.URL, dir, 1<<20, WithWarmFrom(origin.URL+"/hot.txt", 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	<-cache.warm.done
+	if s := cache.Stats(); s.Warm.Held != 2 || s.Warm.Warmed != 1 {
+		t.Fatalf("expected the warmed objects held, got %+v", s.Warm)
+	}
+}